@@ -3,6 +3,7 @@ module github.com/devicemxl/dxm
 go 1.24.3
 
 require (
+	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
 	go.etcd.io/bbolt v1.4.0
 )
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Bar es la respuesta de una página del endpoint `/v2/stocks/{symbol}/bars`.
+type Bar struct {
+	NextPageToken string   `json:"next_page_token"` // Cryptographic value.
+	Bars          []oneBar `json:"bars"`            // Bars Body
+	Symbol        string   `json:"symbol"`          // ticker
+}
+
+func (p Bar) nextToken() string { return p.NextPageToken }
+
+func (p Bar) bySymbol(symbol string) map[string][]oneBar {
+	if p.Symbol != "" {
+		symbol = p.Symbol
+	}
+	return map[string][]oneBar{symbol: p.Bars}
+}
+
+// oneBar representa una barra OHLCV tal como la entrega el endpoint
+// `/v2/stocks/{symbol}/bars` de Alpaca.
+type oneBar struct {
+	O  float64 `json:"o"`  // Open (Precio de apertura).
+	H  float64 `json:"h"`  // High (Precio máximo).
+	L  float64 `json:"l"`  // Low (Precio mínimo).
+	C  float64 `json:"c"`  // Close (Precio de cierre).
+	V  int64   `json:"v"`  // Volume (Volumen negociado).
+	N  int64   `json:"n"`  // Trade Count (Número de operaciones).
+	VW float64 `json:"vw"` // VWAP (Precio medio ponderado por volumen).
+	T  string  `json:"t"`  // Timestamp de apertura de la barra.
+}
+
+// barRecords convierte barras de Alpaca al registro neutral que guarda bbolt.
+func barRecords(bars []oneBar) []BarRecord {
+	records := make([]BarRecord, len(bars))
+	for i, b := range bars {
+		records[i] = BarRecord(b)
+	}
+	return records
+}
+
+// barAdjustments son los modos de ajuste corporativo que acepta Alpaca.
+var barAdjustments = map[string]bool{"raw": true, "split": true, "dividend": true, "all": true}
+
+// validateBarOptions comprueba el timeframe y el ajuste de una descarga de barras.
+//
+// Alpaca acepta timeframes con la forma `<n><unidad>`: 1-59 Min (o T), 1-23 Hour (o H),
+// 1 Day (o D), 1 Week (o W) y 1, 2, 3, 4, 6 o 12 Month (o M). El ajuste puede ir vacío
+// (Alpaca usa "raw").
+func validateBarOptions(timeframe, adjustment string) error {
+	if adjustment != "" && !barAdjustments[adjustment] {
+		return fmt.Errorf("ajuste de barras inválido '%s': se esperaba raw, split, dividend o all", adjustment)
+	}
+
+	units := []struct {
+		names []string
+		valid func(n int) bool
+	}{
+		{[]string{"Min", "T"}, func(n int) bool { return n >= 1 && n <= 59 }},
+		{[]string{"Hour", "H"}, func(n int) bool { return n >= 1 && n <= 23 }},
+		{[]string{"Day", "D"}, func(n int) bool { return n == 1 }},
+		{[]string{"Week", "W"}, func(n int) bool { return n == 1 }},
+		{[]string{"Month", "M"}, func(n int) bool { return n == 1 || n == 2 || n == 3 || n == 4 || n == 6 || n == 12 }},
+	}
+	for _, unit := range units {
+		for _, name := range unit.names {
+			if !strings.HasSuffix(timeframe, name) {
+				continue
+			}
+			n, err := strconv.Atoi(strings.TrimSuffix(timeframe, name))
+			if err == nil && unit.valid(n) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("timeframe de barras inválido '%s' (ej. 1Min, 5Min, 1Hour, 1Day)", timeframe)
+}
+
+// downloadBarsPaginated descarga todas las páginas de barras OHLCV de un símbolo
+// siguiendo `next_page_token`, con el mismo esquema de reintentos que
+// `downloadQuotesPaginated`. 'opt.timeframe' es obligatorio y 'opt.adjustment' opcional.
+//
+// Devuelve el número total de barras entregadas a 'handler' o un error si las opciones
+// no son válidas, falla una descarga, la decodificación de una página o el propio 'handler'.
+func downloadBarsPaginated(ctx context.Context, opt alpacaPageOptions, pageToken string, handler BarPageHandler) (int, error) {
+	opt.dataset = datasetBars
+	if err := validateBarOptions(opt.timeframe, opt.adjustment); err != nil {
+		return 0, err
+	}
+	return downloadPaginated(ctx, opt, pageToken, datasetPageFunc[Bar, MultiBar](opt,
+		func(r oneBar) string { return r.T },
+		func(symbol string, bars []oneBar, pageToken string) error {
+			return handler(symbol, barRecords(bars), pageToken)
+		}))
+}
@@ -0,0 +1,66 @@
+package main
+
+import "context"
+
+// Quote es la respuesta de una página del endpoint `/v2/stocks/{symbol}/quotes`.
+type Quote struct {
+	NextPageToken string     `json:"next_page_token"` // Cryptographic value.
+	Quotes        []oneQuote `json:"quotes"`          // Quotes Body
+	Symbol        string     `json:"symbol"`          // ticker
+}
+
+func (p Quote) nextToken() string { return p.NextPageToken }
+
+func (p Quote) bySymbol(symbol string) map[string][]oneQuote {
+	if p.Symbol != "" {
+		symbol = p.Symbol
+	}
+	return map[string][]oneQuote{symbol: p.Quotes}
+}
+
+// oneQuote es una quote tal como la entrega Alpaca.
+type oneQuote struct {
+	AP float64  `json:"ap"` // Ask Price (Precio de Venta).
+	AS int      `json:"as"` // Ask Size (Tamaño de Venta).
+	AX string   `json:"ax"` // Ask Exchange (Bolsa de Venta).
+	BP float64  `json:"bp"` // Bid Price (Precio de Compra).
+	BS int      `json:"bs"` // Bid Size (Tamaño de Compra).
+	BX string   `json:"bx"` // Bid Exchange (Bolsa de Compra).
+	C  []string `json:"c"`  // Conditions (Condiciones de la quote), un código por condición (ej. ["R"]).
+	T  string   `json:"t"`  // Timestamp (Marca de Tiempo).
+	Z  string   `json:"z"`  // Tape (Cinta).
+}
+
+// quoteRecords convierte quotes de Alpaca al registro neutral que guarda bbolt.
+func quoteRecords(quotes []oneQuote) []QuoteRecord {
+	records := make([]QuoteRecord, len(quotes))
+	for i, q := range quotes {
+		records[i] = QuoteRecord(q)
+	}
+	return records
+}
+
+// downloadQuotesPaginated descarga todas las páginas de quotes de un símbolo siguiendo
+// `next_page_token` hasta que el token llegue vacío o se alcance la fecha final.
+//
+// Las páginas se entregan una a una a 'handler', ya convertidas a `QuoteRecord`
+// (normalmente un cierre que las entrega a un `IngestWriter`), de modo que nunca se
+// acumula el histórico completo en memoria.
+//
+// Parámetros:
+//   - ctx: contexto de cancelación (ver `downloadPaginated`).
+//   - opt: opciones de la descarga; 'opt.dataset' se fija a datasetQuotes.
+//   - pageToken: token desde el que continuar; vacío para empezar desde 'opt.start'.
+//   - handler: función que procesa cada página descargada.
+//
+// Devuelve:
+//   - El número total de quotes entregadas a 'handler'.
+//   - Un error si falla una descarga, la decodificación de una página o el propio 'handler'.
+func downloadQuotesPaginated(ctx context.Context, opt alpacaPageOptions, pageToken string, handler QuotePageHandler) (int, error) {
+	opt.dataset = datasetQuotes
+	return downloadPaginated(ctx, opt, pageToken, datasetPageFunc[Quote, MultiQuote](opt,
+		func(r oneQuote) string { return r.T },
+		func(symbol string, quotes []oneQuote, pageToken string) error {
+			return handler(symbol, quoteRecords(quotes), pageToken)
+		}))
+}
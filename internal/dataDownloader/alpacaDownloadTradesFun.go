@@ -0,0 +1,54 @@
+package main
+
+import "context"
+
+// Trade es la respuesta de una página del endpoint `/v2/stocks/{symbol}/trades`.
+type Trade struct {
+	NextPageToken string     `json:"next_page_token"` // Cryptographic value.
+	Trades        []oneTrade `json:"trades"`          // Trades Body
+	Symbol        string     `json:"symbol"`          // ticker
+}
+
+func (p Trade) nextToken() string { return p.NextPageToken }
+
+func (p Trade) bySymbol(symbol string) map[string][]oneTrade {
+	if p.Symbol != "" {
+		symbol = p.Symbol
+	}
+	return map[string][]oneTrade{symbol: p.Trades}
+}
+
+// oneTrade representa una operación ejecutada (print) tal como la entrega
+// el endpoint `/v2/stocks/{symbol}/trades` de Alpaca.
+type oneTrade struct {
+	P float64  `json:"p"` // Trade Price (Precio de la operación).
+	S int      `json:"s"` // Trade Size (Tamaño de la operación).
+	X string   `json:"x"` // Exchange (Bolsa donde se ejecutó).
+	I int64    `json:"i"` // Trade ID (Identificador de la operación).
+	C []string `json:"c"` // Conditions (Condiciones de la Operación).
+	T string   `json:"t"` // Timestamp (Marca de Tiempo).
+	Z string   `json:"z"` // Tape (Cinta).
+}
+
+// tradeRecords convierte trades de Alpaca al registro neutral que guarda bbolt.
+func tradeRecords(trades []oneTrade) []TradeRecord {
+	records := make([]TradeRecord, len(trades))
+	for i, t := range trades {
+		records[i] = TradeRecord(t)
+	}
+	return records
+}
+
+// downloadTradesPaginated descarga todas las páginas de trades de un símbolo siguiendo
+// `next_page_token`, con el mismo esquema de reintentos que `downloadQuotesPaginated`.
+//
+// Devuelve el número total de trades entregados a 'handler' o un error si falla una
+// descarga, la decodificación de una página o el propio 'handler'.
+func downloadTradesPaginated(ctx context.Context, opt alpacaPageOptions, pageToken string, handler TradePageHandler) (int, error) {
+	opt.dataset = datasetTrades
+	return downloadPaginated(ctx, opt, pageToken, datasetPageFunc[Trade, MultiTrade](opt,
+		func(r oneTrade) string { return r.T },
+		func(symbol string, trades []oneTrade, pageToken string) error {
+			return handler(symbol, tradeRecords(trades), pageToken)
+		}))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	db "go.etcd.io/bbolt"
+)
+
+// MultiQuote es la respuesta de una página de `/v2/stocks/quotes?symbols=...`:
+// las quotes llegan agrupadas por símbolo.
+type MultiQuote struct {
+	NextPageToken string                `json:"next_page_token"` // Cryptographic value.
+	Quotes        map[string][]oneQuote `json:"quotes"`          // Quotes por ticker
+}
+
+func (p MultiQuote) nextToken() string                     { return p.NextPageToken }
+func (p MultiQuote) bySymbol(string) map[string][]oneQuote { return p.Quotes }
+
+// MultiTrade es la respuesta de una página de `/v2/stocks/trades?symbols=...`.
+type MultiTrade struct {
+	NextPageToken string                `json:"next_page_token"` // Cryptographic value.
+	Trades        map[string][]oneTrade `json:"trades"`          // Trades por ticker
+}
+
+func (p MultiTrade) nextToken() string                     { return p.NextPageToken }
+func (p MultiTrade) bySymbol(string) map[string][]oneTrade { return p.Trades }
+
+// MultiBar es la respuesta de una página de `/v2/stocks/bars?symbols=...`.
+type MultiBar struct {
+	NextPageToken string              `json:"next_page_token"` // Cryptographic value.
+	Bars          map[string][]oneBar `json:"bars"`            // Barras por ticker
+}
+
+func (p MultiBar) nextToken() string                   { return p.NextPageToken }
+func (p MultiBar) bySymbol(string) map[string][]oneBar { return p.Bars }
+
+// UniverseOptions agrupa los parámetros de una descarga de muchos símbolos.
+type UniverseOptions struct {
+	// SYMBOLS es el universo completo de tickers a descargar.
+	SYMBOLS []string
+	// GROUP_SIZE es cuántos tickers se piden juntos en cada petición multi-símbolo
+	// (`symbols=...`). Limita el largo de la URL; Alpaca reparte 'limit' entre todos.
+	GROUP_SIZE int
+	// GROUP_WORKERS es cuántos grupos se descargan a la vez.
+	GROUP_WORKERS int
+	// INGEST es el escritor por el que se guardan las páginas de todos los grupos (ver
+	// `IngestWriter`).
+	INGEST *IngestWriter
+}
+
+// symbolGroups ordena y deduplica el universo y lo parte en grupos de 'size' tickers.
+// El orden es determinista para que los grupos (y por tanto sus checkpoints) sean los
+// mismos entre ejecuciones.
+func symbolGroups(symbols []string, size int) [][]string {
+	if size < 1 {
+		size = 1
+	}
+	universe := make([]string, 0, len(symbols))
+	for _, s := range symbols {
+		s = strings.ToUpper(strings.TrimSpace(s))
+		if s != "" {
+			universe = append(universe, s)
+		}
+	}
+	slices.Sort(universe)
+	universe = slices.Compact(universe)
+
+	var groups [][]string
+	for len(universe) > 0 {
+		n := min(size, len(universe))
+		groups = append(groups, universe[:n:n])
+		universe = universe[n:]
+	}
+	return groups
+}
+
+// downloadUniverse descarga de 'provider' el dataset 'dataset' para todo un universo de símbolos.
+//
+// El universo se parte en grupos de `GROUP_SIZE` tickers; cada grupo se pide al
+// proveedor en una sola petición (con Alpaca, una secuencia de peticiones multi-símbolo
+// `/v2/stocks/{dataset}?symbols=...`) y sus páginas se reparten por símbolo a los
+// buckets de cada ticker. Un pool de `GROUP_WORKERS` goroutines procesa los grupos en
+// paralelo, y cada grupo retoma su propio checkpoint (ver `downloadResumable`). Todos
+// entregan sus páginas al mismo escritor `INGEST`, que las junta en transacciones.
+// 'base' aporta el rango, feed y opciones de barras; sus símbolos se ignoran.
+//
+// El fallo de un grupo no detiene a los demás: se devuelven todos los errores juntos.
+// Si 'ctx' se cancela no se empiezan grupos nuevos y los que están en curso se
+// detienen tras confirmar su página en vuelo (ver `downloadResumable`).
+//
+// Devuelve el número total de registros guardados y un error si algún grupo falló.
+func downloadUniverse(ctx context.Context, dbInstance *db.DB, provider MarketDataProvider, dataset string, base FetchRequest, opt UniverseOptions) (int, error) {
+	if opt.INGEST == nil {
+		return 0, fmt.Errorf("escritor de ingesta nulo")
+	}
+	groups := symbolGroups(opt.SYMBOLS, opt.GROUP_SIZE)
+	if len(groups) == 0 {
+		return 0, fmt.Errorf("universo de símbolos vacío")
+	}
+	workers := max(1, min(opt.GROUP_WORKERS, len(groups)))
+
+	groupChan := make(chan []string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	total := 0
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for group := range groupChan {
+				groupReq := base
+				groupReq.Symbols = group
+
+				n, err := downloadResumable(ctx, dbInstance, opt.INGEST, provider, dataset, groupReq)
+
+				mu.Lock()
+				total += n
+				if err != nil {
+					errs = append(errs, fmt.Errorf("grupo %s: %w", symbolKey(group), err))
+				}
+				mu.Unlock()
+				log.Printf("Grupo %s (%s, %s): %d registros.", symbolKey(group), dataset, provider.Name(), n)
+			}
+		}()
+	}
+
+feed:
+	for _, group := range groups {
+		select {
+		case groupChan <- group:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(groupChan)
+	wg.Wait()
+
+	if ctx.Err() != nil && len(errs) == 0 {
+		return total, ctx.Err()
+	}
+	return total, errors.Join(errs...)
+}
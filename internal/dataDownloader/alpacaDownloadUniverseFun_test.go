@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// restHarness es una descarga contra `fakeAlpacaREST`, sin red ni claves reales, que
+// guarda en una base de datos temporal con su propio `IngestWriter`.
+type restHarness struct {
+	fake     *fakeAlpacaREST
+	db       *db.DB
+	ingest   *IngestWriter
+	callOpts alpacaCallItOptions
+	provider *alpacaProvider
+	req      FetchRequest // Rango [base, end), feed "sip" y barras de 1Min sin ajustar
+	dir      string
+}
+
+// Rango de los fixtures de los tests de descarga.
+var (
+	restBase = time.Date(2016, 1, 4, 9, 0, 0, 0, time.UTC)
+	restEnd  = restBase.Add(time.Hour)
+)
+
+// newRestHarness arranca el servidor falso, abre la base de datos y el escritor y
+// apunta el cliente HTTP al servidor con un timeout corto. Todo se cierra al terminar
+// el test.
+func newRestHarness(t *testing.T) *restHarness {
+	t.Helper()
+	h := &restHarness{fake: newFakeAlpacaREST("test-key", "test-secret"), dir: t.TempDir()}
+	t.Cleanup(h.fake.Close)
+
+	timeout := alpacaHTTPClient.Timeout
+	alpacaHTTPClient.Timeout = 200 * time.Millisecond
+	t.Cleanup(func() { alpacaHTTPClient.Timeout = timeout })
+
+	var err error
+	h.db, err = db.Open(filepath.Join(h.dir, "ticks.db"), 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.db.Close() })
+	h.ingest, err = NewIngestWriter(IngestOptions{DB_INSTANCE: h.db, ENCODERS: 2, RULES: ticks.ValidationRules})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.ingest.Close() })
+
+	h.callOpts = alpacaCallItOptions{
+		key:            "test-key",
+		secret:         "test-secret",
+		MaxRetries:     5,
+		initialBackoff: 10 * time.Millisecond,
+		maxBackoff:     50 * time.Millisecond,
+		logText:        t.Name(),
+	}
+	h.provider = newAlpacaProvider(h.fake.Protocol(), h.fake.Domain(), 10, h.callOpts)
+	h.req = FetchRequest{
+		Start:      restBase.Format(time.RFC3339),
+		End:        restEnd.Format(time.RFC3339),
+		Feed:       "sip",
+		Timeframe:  "1Min",
+		Adjustment: "raw",
+	}
+	return h
+}
+
+// download descarga 'dataset' de 'symbols' en grupos de 'groupSize' con un solo
+// worker.
+func (h *restHarness) download(ctx context.Context, dataset string, groupSize int, symbols ...string) (int, error) {
+	return downloadUniverse(ctx, h.db, h.provider, dataset, h.req,
+		UniverseOptions{SYMBOLS: symbols, GROUP_SIZE: groupSize, GROUP_WORKERS: 1, INGEST: h.ingest})
+}
+
+// count cuenta las claves del bucket anidado en 'path'.
+func (h *restHarness) count(t *testing.T, path ...string) int {
+	t.Helper()
+	var n int
+	if err := h.db.View(func(tx *db.Tx) error { n = countBucketKeys(tx, path...); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// addRecords añade registros al servidor falso o falla el test.
+func (h *restHarness) addRecords(t *testing.T, dataset, symbol string, records ...interface{}) {
+	t.Helper()
+	if err := h.fake.AddRecords(dataset, symbol, records...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restPerSymbol es el número de registros en rango de cada símbolo y dataset que
+// carga `addRestFixtures`.
+const restPerSymbol = 25
+
+// addRestFixtures carga en el servidor falso, para cada símbolo, 25 quotes y 25
+// trades (una por milisegundo) y 25 barras (una por minuto) dentro del rango, más una
+// de cada en 'restEnd', que queda fuera. Las quotes se cargan como una página de un
+// símbolo guardada en un archivo y los trades como una página multi-símbolo.
+func addRestFixtures(t *testing.T, h *restHarness, symbols ...string) {
+	t.Helper()
+	for _, sym := range symbols {
+		var quotes, trades, bars []map[string]interface{}
+		for i := 0; i <= restPerSymbol; i++ {
+			ts, barTs := restBase.Add(time.Duration(i)*time.Millisecond), restBase.Add(time.Duration(i)*time.Minute)
+			if i == restPerSymbol {
+				ts, barTs = restEnd, restEnd
+			}
+			quotes = append(quotes, map[string]interface{}{"ap": 110.87, "as": 6, "ax": "T",
+				"bp": 109.3, "bs": 30, "bx": "T", "c": []string{"R"}, "t": ts.Format(time.RFC3339Nano), "z": "C"})
+			trades = append(trades, map[string]interface{}{"p": 110.85, "s": 100, "x": "V",
+				"i": i + 1, "c": []string{"@"}, "t": ts.Format(time.RFC3339Nano), "z": "C"})
+			bars = append(bars, map[string]interface{}{"o": 110.0, "h": 111.0, "l": 109.5, "c": 110.5,
+				"v": 1200, "n": 12, "vw": 110.4, "t": barTs.Format(time.RFC3339)})
+		}
+		writeFixture(t, h.fake, filepath.Join(h.dir, sym+"_quotes.json"),
+			map[string]interface{}{"quotes": quotes, "symbol": sym, "next_page_token": nil})
+		writeFixture(t, h.fake, filepath.Join(h.dir, sym+"_trades.json"),
+			map[string]interface{}{"trades": map[string]interface{}{sym: trades}, "next_page_token": nil})
+		h.addRecords(t, datasetBars, sym, toInterfaces(bars)...)
+	}
+}
+
+// writeFixture guarda 'page' como archivo JSON en 'path' y lo carga en el servidor falso.
+func writeFixture(t *testing.T, fake *fakeAlpacaREST, path string, page interface{}) {
+	t.Helper()
+	raw, err := json.Marshal(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fake.LoadFixture(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// toInterfaces convierte registros a la forma variádica de `AddRecords`.
+func toInterfaces[R any](records []R) []interface{} {
+	out := make([]interface{}, len(records))
+	for i, r := range records {
+		out[i] = r
+	}
+	return out
+}
+
+// TestRestDownload ejercita la descarga histórica de punta a punta contra
+// `fakeAlpacaREST`. Cada subtest usa su propio servidor y su propia base de datos.
+func TestRestDownload(t *testing.T) {
+	datasets := []string{datasetQuotes, datasetTrades, datasetBars}
+	symbols := []string{"QQQ", "SPY"}
+
+	// Paginación multi-símbolo, corte por fecha final y reintentos ante un 429
+	// (respetando Retry-After), un 500 y un timeout.
+	t.Run("universe", func(t *testing.T) {
+		h := newRestHarness(t)
+		addRestFixtures(t, h, symbols...)
+		h.fake.Inject(
+			fakeFault{Status: 429, RetryAfter: "1"},
+			fakeFault{Status: 500},
+			fakeFault{Delay: time.Second},
+		)
+		for _, dataset := range datasets {
+			n, err := h.download(context.Background(), dataset, 2, symbols...)
+			if err != nil {
+				t.Fatalf("%s: %v", dataset, err)
+			}
+			if want := restPerSymbol * len(symbols); n != want {
+				t.Errorf("%s: se guardaron %d registros, se esperaban %d", dataset, n, want)
+			}
+		}
+		if times := h.fake.RequestTimes(); len(times) < 2 || times[1].Sub(times[0]) < 900*time.Millisecond {
+			t.Errorf("no se respetó el Retry-After del 429")
+		}
+		for _, sym := range symbols {
+			for _, path := range [][]string{
+				{sym, "AP"},
+				{sym, ticks.TradesBucket, "P"},
+				{sym, barsBucketName("1Min", "raw"), "C"},
+			} {
+				if got := h.count(t, path...); got != restPerSymbol {
+					t.Errorf("%v: %d claves, se esperaban %d", path, got, restPerSymbol)
+				}
+			}
+		}
+	})
+
+	// Las condiciones llegan como array ("c": ["R"]) y se guardan como lista.
+	t.Run("conditions", func(t *testing.T) {
+		h := newRestHarness(t)
+		addRestFixtures(t, h, "QQQ")
+		if _, err := h.download(context.Background(), datasetQuotes, 1, "QQQ"); err != nil {
+			t.Fatal(err)
+		}
+		quotes, err := ticks.ReadQuotes(h.db, ticks.QueryOptions{SYMBOL: "QQQ", FIELDS: []string{"C"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(quotes) != restPerSymbol {
+			t.Fatalf("%d quotes, se esperaban %d", len(quotes), restPerSymbol)
+		}
+		for _, q := range quotes {
+			if !slices.Equal(q.C, []string{"R"}) {
+				t.Fatalf("%s: condiciones %q, se esperaba [\"R\"]", q.T, q.C)
+			}
+		}
+	})
+
+	// Cada tipo de dato de cada símbolo queda en `ticks.SymbolsBucket` con sus
+	// registros, su rango y su origen.
+	t.Run("metadata", func(t *testing.T) {
+		h := newRestHarness(t)
+		addRestFixtures(t, h, symbols...)
+		for _, dataset := range datasets {
+			if _, err := h.download(context.Background(), dataset, 2, symbols...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		metas, err := ticks.ReadSymbolMeta(h.db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := map[ticks.Kind]time.Time{
+			ticks.KindQuotes: restBase.Add((restPerSymbol - 1) * time.Millisecond),
+			ticks.KindTrades: restBase.Add((restPerSymbol - 1) * time.Millisecond),
+			ticks.Kind(barsBucketName("1Min", "raw")): restBase.Add((restPerSymbol - 1) * time.Minute),
+		}
+		if len(metas) != len(symbols)*len(last) {
+			t.Fatalf("%d metadatos, se esperaban %d: %+v", len(metas), len(symbols)*len(last), metas)
+		}
+		for _, m := range metas {
+			if m.Count != restPerSymbol || !m.First.Equal(restBase) || !m.Last.Equal(last[m.Kind]) ||
+				m.Feed != "sip" || m.Source != h.provider.Name() || m.SchemaVersion != ticks.SchemaVersion {
+				t.Errorf("metadatos de %s %s inesperados: %+v", m.Symbol, m.Kind, m)
+			}
+		}
+	})
+
+	// Con los checkpoints completos no hay nada nuevo que guardar.
+	t.Run("resume", func(t *testing.T) {
+		h := newRestHarness(t)
+		addRestFixtures(t, h, symbols...)
+		for _, dataset := range datasets {
+			if _, err := h.download(context.Background(), dataset, 2, symbols...); err != nil {
+				t.Fatal(err)
+			}
+			n, err := h.download(context.Background(), dataset, 2, symbols...)
+			if err != nil {
+				t.Fatalf("%s (reanudación): %v", dataset, err)
+			}
+			if n != 0 {
+				t.Errorf("%s (reanudación): se volvieron a guardar %d registros", dataset, n)
+			}
+		}
+	})
+
+	// Una ejecución posterior pide una fecha inicial anterior a la de la primera: lo que
+	// falta al principio del rango también se descarga, con el checkpoint completo o
+	// interrumpido.
+	t.Run("resume-earlier-start", func(t *testing.T) {
+		h := newRestHarness(t)
+		addRestFixtures(t, h, symbols...)
+		for _, dataset := range datasets {
+			h.req.Start = restBase.Add(10 * time.Millisecond).Format(time.RFC3339Nano)
+			if _, err := h.download(context.Background(), dataset, 2, symbols...); err != nil {
+				t.Fatal(err)
+			}
+			h.req.Start = restBase.Format(time.RFC3339Nano)
+			n, err := h.download(context.Background(), dataset, 2, symbols...)
+			if err != nil {
+				t.Fatalf("%s (fecha inicial anterior): %v", dataset, err)
+			}
+			// Se vuelve a pedir todo el rango; lo repetido no se duplica (ver abajo).
+			if want := restPerSymbol * len(symbols); n != want {
+				t.Errorf("%s (fecha inicial anterior): se entregaron %d registros, se esperaban %d", dataset, n, want)
+			}
+		}
+		for _, sym := range symbols {
+			for _, path := range [][]string{
+				{sym, "AP"},
+				{sym, ticks.TradesBucket, "P"},
+				{sym, barsBucketName("1Min", "raw"), "C"},
+			} {
+				if got := h.count(t, path...); got != restPerSymbol {
+					t.Errorf("%v: %d claves, se esperaban %d", path, got, restPerSymbol)
+				}
+			}
+		}
+
+		// Interrumpida tras la primera página (quotes 5 a 14): la siguiente ejecución,
+		// desde el principio, pide todo y completa las quotes 0 a 4 y 15 a 24.
+		h = newRestHarness(t)
+		var quotes []interface{}
+		for i := 0; i < restPerSymbol; i++ {
+			quotes = append(quotes, map[string]interface{}{"ap": 110.87, "as": 6, "ax": "T", "bp": 109.3, "bs": 30,
+				"bx": "T", "t": restBase.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano), "z": "C"})
+		}
+		h.addRecords(t, datasetQuotes, "IWM", quotes...)
+		h.fake.Inject(fakeFault{}, fakeFault{Delay: 500 * time.Millisecond})
+		ctx, cancel := context.WithCancel(context.Background())
+		timer := time.AfterFunc(100*time.Millisecond, cancel)
+		h.req.Start = restBase.Add(5 * time.Millisecond).Format(time.RFC3339Nano)
+		_, err := h.download(ctx, datasetQuotes, 1, "IWM")
+		timer.Stop()
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("se esperaba context.Canceled, se obtuvo: %v", err)
+		}
+		h.req.Start = restBase.Format(time.RFC3339Nano)
+		if n, err := h.download(context.Background(), datasetQuotes, 1, "IWM"); err != nil || n != restPerSymbol {
+			t.Fatalf("reanudación: %d quotes guardadas, se esperaban %d: %v", n, restPerSymbol, err)
+		}
+		if got := h.count(t, "IWM", "AP"); got != restPerSymbol {
+			t.Errorf("%d quotes guardadas, se esperaban %d", got, restPerSymbol)
+		}
+		cp, err := LoadCheckpoint(h.db, "IWM", h.req.Feed, checkpointKind(datasetQuotes, h.req))
+		if err != nil || cp == nil || !cp.Complete || cp.Since != h.req.Start {
+			t.Fatalf("checkpoint %+v, %v", cp, err)
+		}
+	})
+
+	// Cada símbolo lleva su propio checkpoint: al añadir IWM al universo los grupos
+	// cambian ([IWM QQQ] y [SPY]), pero de QQQ y SPY no se vuelve a guardar nada.
+	t.Run("universe-change", func(t *testing.T) {
+		h := newRestHarness(t)
+		addRestFixtures(t, h, "IWM", "QQQ", "SPY")
+		for _, dataset := range datasets {
+			if _, err := h.download(context.Background(), dataset, 2, symbols...); err != nil {
+				t.Fatal(err)
+			}
+			n, err := h.download(context.Background(), dataset, 2, append([]string{"IWM"}, symbols...)...)
+			if err != nil {
+				t.Fatalf("%s (universo nuevo): %v", dataset, err)
+			}
+			if n != restPerSymbol {
+				t.Errorf("%s (universo nuevo): se guardaron %d registros, se esperaban solo los %d de IWM", dataset, n, restPerSymbol)
+			}
+			for _, symbol := range []string{"IWM", "QQQ", "SPY"} {
+				cp, err := LoadCheckpoint(h.db, symbol, h.req.Feed, checkpointKind(dataset, h.req))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cp == nil || !cp.Complete || cp.LastTimestamp.IsZero() {
+					t.Errorf("%s %s: checkpoint %+v", dataset, symbol, cp)
+				}
+			}
+		}
+		if got := h.count(t, "IWM", "AP"); got != restPerSymbol {
+			t.Errorf("%d quotes de IWM guardadas, se esperaban %d", got, restPerSymbol)
+		}
+	})
+
+	// Se cancela el contexto mientras se espera la segunda página: la primera queda
+	// guardada con su checkpoint incompleto y la siguiente ejecución termina el rango.
+	t.Run("cancel", func(t *testing.T) {
+		h := newRestHarness(t)
+		var quotes []interface{}
+		for i := 0; i < restPerSymbol; i++ {
+			quotes = append(quotes, map[string]interface{}{"ap": 110.87, "as": 6, "ax": "T", "bp": 109.3, "bs": 30,
+				"bx": "T", "t": restBase.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano), "z": "C"})
+		}
+		h.addRecords(t, datasetQuotes, "IWM", quotes...)
+		h.fake.Inject(fakeFault{}, fakeFault{Delay: 500 * time.Millisecond})
+		ctx, cancel := context.WithCancel(context.Background())
+		timer := time.AfterFunc(100*time.Millisecond, cancel)
+		n, err := h.download(ctx, datasetQuotes, 1, "IWM")
+		timer.Stop()
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("se esperaba context.Canceled, se obtuvo: %v", err)
+		}
+		cp, err := LoadCheckpoint(h.db, "IWM", h.req.Feed, checkpointKind(datasetQuotes, h.req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || cp.Complete || n != 10 {
+			t.Fatalf("se esperaba una página guardada y el checkpoint incompleto (guardadas %d, checkpoint %+v)", n, cp)
+		}
+		if _, err := h.download(context.Background(), datasetQuotes, 1, "IWM"); err != nil {
+			t.Fatalf("reanudación: %v", err)
+		}
+		if got := h.count(t, "IWM", "AP"); got != restPerSymbol {
+			t.Errorf("%d quotes guardadas, se esperaban %d", got, restPerSymbol)
+		}
+	})
+
+	// Con particiones, las quotes se confirman en ellas antes que el checkpoint en la
+	// base de datos principal. Se corta entre los dos commits (el escritor guarda el
+	// checkpoint en un archivo ya cerrado): la primera página queda en las particiones
+	// sin checkpoint, y la reanudación la repite sin duplicarla.
+	t.Run("partition-crash", func(t *testing.T) {
+		h := newRestHarness(t)
+		var quotes []interface{}
+		for i := 0; i < restPerSymbol; i++ {
+			quotes = append(quotes, map[string]interface{}{"ap": 110.87, "as": 6, "ax": "T", "bp": 109.3, "bs": 30,
+				"bx": "T", "t": restBase.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano), "z": "C"})
+		}
+		h.addRecords(t, datasetQuotes, "IWM", quotes...)
+		partitions, err := ticks.OpenPartitionedStore(ticks.PartitionOptions{
+			ROOT: filepath.Join(h.dir, "partitions"), PERIOD: ticks.PeriodDay, MAX_OPEN: 1, LAYOUT: ticks.LayoutColumns})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { partitions.Close() })
+		partitionQuotes := func() int {
+			t.Helper()
+			stats, err := partitions.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return stats.Quotes
+		}
+		withWriter := func(dbInstance *db.DB) *IngestWriter {
+			t.Helper()
+			ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: dbInstance, ENCODERS: 2, PARTITIONS: partitions})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { ingest.Close() })
+			return ingest
+		}
+
+		crashed, err := db.Open(filepath.Join(h.dir, "crashed.db"), 0600, &db.Options{Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crashed.Close(); err != nil {
+			t.Fatal(err)
+		}
+		h.ingest = withWriter(crashed)
+		if _, err := h.download(context.Background(), datasetQuotes, 1, "IWM"); !errors.Is(err, db.ErrDatabaseNotOpen) {
+			t.Fatalf("se esperaba un fallo en el commit del checkpoint, se obtuvo: %v", err)
+		}
+		cp, err := LoadCheckpoint(h.db, "IWM", h.req.Feed, checkpointKind(datasetQuotes, h.req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := partitionQuotes(); cp != nil || got != 10 {
+			t.Fatalf("se esperaba la primera página en las particiones sin checkpoint (%d quotes, checkpoint %+v)", got, cp)
+		}
+
+		h.ingest = withWriter(h.db)
+		if _, err := h.download(context.Background(), datasetQuotes, 1, "IWM"); err != nil {
+			t.Fatalf("reanudación: %v", err)
+		}
+		if cp, err = LoadCheckpoint(h.db, "IWM", h.req.Feed, checkpointKind(datasetQuotes, h.req)); err != nil || cp == nil || !cp.Complete {
+			t.Fatalf("checkpoint %+v, %v", cp, err)
+		}
+		stats := h.ingest.Stats()
+		if got := partitionQuotes(); got != restPerSymbol || stats.Existing != 10 || stats.Written != restPerSymbol-10 {
+			t.Errorf("%d quotes en las particiones (%d nuevas, %d repetidas), se esperaban %d sin duplicar la primera página",
+				got, stats.Written, stats.Existing, restPerSymbol)
+		}
+		if got := h.count(t, "IWM", "AP"); got != 0 {
+			t.Errorf("%d quotes en la base de datos principal, se esperaban 0", got)
+		}
+	})
+
+	// 13 quotes de DIA donde la 10ª y la 11ª comparten nanosegundo a ambos lados del
+	// corte de página y la 12ª y la 13ª son idénticas: se guardan todas, volver a
+	// guardarlas no duplica nada y la lectura por rango las separa por secuencia.
+	t.Run("same-timestamp", func(t *testing.T) {
+		h := newRestHarness(t)
+		dia := sameTimestampQuotes()
+		h.addRecords(t, datasetQuotes, "DIA", toInterfaces(dia)...)
+		if _, err := h.download(context.Background(), datasetQuotes, 1, "DIA"); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.ingest.SaveQuotes(context.Background(), "DIA", dia, nil); err != nil {
+			t.Fatalf("re-guardado: %v", err)
+		}
+		if got := h.count(t, "DIA", "AP"); got != len(dia) {
+			t.Errorf("%d quotes guardadas, se esperaban %d", got, len(dia))
+		}
+		// [9ms, 20ms) contiene solo las dos quotes del mismo nanosegundo.
+		sameTime, err := ticks.ReadQuotes(h.db, ticks.QueryOptions{
+			SYMBOL: "DIA", FIELDS: []string{"BP"}, FROM: restBase.Add(9 * time.Millisecond), TO: restBase.Add(20 * time.Millisecond)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sameTime) != 2 || sameTime[0].Seq != 0 || sameTime[1].Seq != 1 ||
+			sameTime[0].BP != dia[9].BP || sameTime[1].BP != dia[10].BP || sameTime[0].AP != 0 {
+			t.Errorf("lectura por rango inesperada: %+v", sameTime)
+		}
+		compareTickStores(t, h.db, "DIA", dia)
+		checkTickPartitions(t, h.db, filepath.Join(h.dir, "partitions"), dia)
+	})
+
+	// De 6 quotes de BAD solo se guardan las 2 válidas; el resto queda en cuarentena
+	// con la regla que no cumple, y el checkpoint se completa igualmente. La segunda
+	// descarga no tiene nada nuevo y no repite la cuarentena.
+	t.Run("validation", func(t *testing.T) {
+		h := newRestHarness(t)
+		bad := []QuoteRecord{
+			{AP: 110.87, AS: 6, BP: 109.3, BS: 30, Z: "C"},
+			{AP: -110.87, AS: 6, BP: 109.3, BS: 30, Z: "C"},
+			{AP: 110.87, AS: 6, BP: 111.2, BS: 30, Z: "C"},
+			{AP: 110.87, AS: 6, BP: 109.3, BS: 30, Z: "Q"},
+			{AP: 110.87, AS: 0, BP: 109.3, BS: 30, Z: "C"},
+			{AP: 0, AS: 0, BP: 109.3, BS: 30, Z: "A"}, // Sin ask: válida
+		}
+		for i := range bad {
+			bad[i].T = restBase.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano)
+		}
+		h.addRecords(t, datasetQuotes, "BAD", toInterfaces(bad)...)
+		for i := 0; i < 2; i++ {
+			if _, err := h.download(context.Background(), datasetQuotes, 1, "BAD"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wantRejected := map[string]int{ticks.RulePrice: 1, ticks.RuleCrossed: 1, ticks.RuleTape: 1, ticks.RuleSize: 1}
+		if got := h.ingest.Stats().Rejected; !maps.Equal(got, wantRejected) {
+			t.Errorf("rechazados %v, se esperaban %v", got, wantRejected)
+		}
+		cp, err := LoadCheckpoint(h.db, "BAD", h.req.Feed, checkpointKind(datasetQuotes, h.req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp == nil || !cp.Complete {
+			t.Errorf("checkpoint incompleto %+v", cp)
+		}
+		if got := h.count(t, "BAD", "AP"); got != 2 {
+			t.Errorf("%d quotes guardadas, se esperaban 2", got)
+		}
+		var quarantined []ticks.Quarantined
+		err = h.db.View(func(tx *db.Tx) error {
+			quarantined, err = ticks.QuarantineTx(tx, "BAD")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rules []string
+		for i, q := range quarantined {
+			var record QuoteRecord
+			if err := json.Unmarshal(q.Record, &record); err != nil {
+				t.Fatal(err)
+			}
+			if q.Kind != ticks.KindQuotes || q.Reason == "" || q.At.IsZero() || i+1 >= len(bad) || record.T != bad[i+1].T {
+				t.Errorf("registro en cuarentena inesperado %+v", q)
+			}
+			rules = append(rules, q.Rule)
+		}
+		if want := []string{ticks.RulePrice, ticks.RuleCrossed, ticks.RuleTape, ticks.RuleSize}; !slices.Equal(rules, want) {
+			t.Errorf("reglas en cuarentena %v, se esperaban %v", rules, want)
+		}
+	})
+
+	// Con credenciales inválidas se falla sin reintentos.
+	t.Run("credentials", func(t *testing.T) {
+		h := newRestHarness(t)
+		callOpts := h.callOpts
+		callOpts.secret = "wrong-secret"
+		provider := newAlpacaProvider(h.fake.Protocol(), h.fake.Domain(), 10, callOpts)
+		_, err := provider.FetchQuotes(context.Background(), FetchRequest{Symbols: []string{"QQQ"}}, "",
+			func(string, []QuoteRecord, string) error { return nil })
+		if !errors.Is(err, ErrAlpacaAuth) {
+			t.Fatalf("se esperaba ErrAlpacaAuth, se obtuvo: %v", err)
+		}
+		if n := h.fake.Requests(); n != 1 {
+			t.Errorf("hubo %d peticiones, se esperaba 1", n)
+		}
+	})
+}
+
+// sameTimestampQuotes devuelve 13 quotes de 'restBase' en adelante: la 10ª y la 11ª
+// comparten nanosegundo y la 12ª y la 13ª son idénticas.
+func sameTimestampQuotes() []QuoteRecord {
+	var quotes []QuoteRecord
+	for i := 0; i < 13; i++ {
+		ts := restBase.Add(time.Duration(min(i, 9)) * time.Millisecond)
+		if i >= 11 {
+			ts = restBase.Add(20 * time.Millisecond)
+		}
+		quotes = append(quotes, QuoteRecord{AP: 110.87, AS: 6, AX: "T", BP: 109.3 + float64(min(i, 11))/100,
+			BS: 30, BX: "T", T: ts.Format(time.RFC3339Nano), Z: "C"})
+	}
+	return quotes
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clases de error de la API de Alpaca. `AlpacaAPIError` las envuelve, así que se
+// pueden comprobar con errors.Is(err, ErrAlpacaAuth), etc.
+var (
+	ErrAlpacaAuth        = errors.New("alpaca: autenticación rechazada")       // 401, 403
+	ErrAlpacaBadRequest  = errors.New("alpaca: petición inválida")             // 400, 404, 422 y otros 4xx
+	ErrAlpacaRateLimited = errors.New("alpaca: límite de peticiones excedido") // 429
+	ErrAlpacaServer      = errors.New("alpaca: error del servidor")            // 5xx
+)
+
+// AlpacaAPIError es la respuesta no exitosa (código HTTP fuera de 2xx) de la API de Alpaca.
+type AlpacaAPIError struct {
+	StatusCode int           // Código HTTP de la respuesta
+	Code       int           // Código de error de Alpaca (campo "code" del cuerpo), si lo hay
+	Message    string        // Mensaje de error de Alpaca (campo "message" o el cuerpo en crudo)
+	RetryAfter time.Duration // Espera pedida por el servidor en un 429 (`Retry-After`), 0 si no la indicó
+	class      error         // Una de las clases ErrAlpaca*
+}
+
+func (e *AlpacaAPIError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%v (HTTP %d, código %d): %s", e.class, e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%v (HTTP %d): %s", e.class, e.StatusCode, e.Message)
+}
+
+// Unwrap devuelve la clase del error, para usar con errors.Is.
+func (e *AlpacaAPIError) Unwrap() error { return e.class }
+
+// Transient indica si vale la pena reintentar la petición: solo los límites de
+// tasa (429) y los errores del servidor (5xx). Credenciales inválidas o peticiones
+// mal formadas fallarían igual en cada reintento.
+func (e *AlpacaAPIError) Transient() bool {
+	return e.class == ErrAlpacaRateLimited || e.class == ErrAlpacaServer
+}
+
+// newAlpacaAPIError clasifica una respuesta no exitosa a partir de su código HTTP
+// y extrae el mensaje de error del cuerpo (`{"code": ..., "message": "..."}`).
+func newAlpacaAPIError(statusCode int, body []byte) *AlpacaAPIError {
+	apiErr := &AlpacaAPIError{StatusCode: statusCode}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		apiErr.class = ErrAlpacaAuth
+	case statusCode == http.StatusTooManyRequests:
+		apiErr.class = ErrAlpacaRateLimited
+	case statusCode >= 500:
+		apiErr.class = ErrAlpacaServer
+	default:
+		apiErr.class = ErrAlpacaBadRequest
+	}
+
+	var payload struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil && payload.Message != "" {
+		apiErr.Code = payload.Code
+		apiErr.Message = payload.Message
+	} else {
+		// Cuerpo no JSON (ej. una página de error de un proxy): se usa el texto recortado.
+		apiErr.Message = strings.TrimSpace(string(body))
+		if len(apiErr.Message) > 200 {
+			apiErr.Message = apiErr.Message[:200] + "..."
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(statusCode)
+		}
+	}
+	return apiErr
+}
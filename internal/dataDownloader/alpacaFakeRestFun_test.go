@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeAlpacaREST es un servidor HTTP local que imita los endpoints históricos de
+// market data de Alpaca (`/v2/stocks/{symbol}/{dataset}` y `/v2/stocks/{dataset}?symbols=...`),
+// para probar la descarga completa hasta bbolt sin red ni claves reales.
+//
+// Sirve los registros cargados con `AddRecords` o `LoadFixture` (páginas guardadas
+// como scrap/quote.json), filtrados por start/end y paginados con `limit` y
+// `page_token` igual que Alpaca. Valida los encabezados APCA-API-*, responde los
+// encabezados X-RateLimit-* y permite inyectar fallos con `Inject`.
+//
+// Se le apunta con `newAlpacaProvider(fake.Protocol(), fake.Domain(), ...)`.
+type fakeAlpacaREST struct {
+	key, secret string
+	server      *httptest.Server
+
+	mu       sync.Mutex
+	records  map[string]map[string][]fakeRecord // Dataset -> símbolo -> registros ordenados por timestamp
+	faults   []fakeFault                        // Fallos pendientes, uno por petición
+	requests int                                // Peticiones recibidas desde el arranque
+	served   []time.Time                        // Momento de cada petición recibida
+}
+
+// fakeRecord es un registro crudo con su timestamp ya interpretado.
+type fakeRecord struct {
+	t   time.Time
+	raw json.RawMessage
+}
+
+// fakeFault es un fallo a inyectar en una petición.
+type fakeFault struct {
+	Status     int           // Código HTTP a responder (ej. 429, 500); 0 para responder normalmente
+	RetryAfter string        // Valor del encabezado Retry-After (solo si no está vacío)
+	Delay      time.Duration // Espera antes de responder, para provocar timeouts del cliente
+}
+
+// newFakeAlpacaREST arranca el servidor falso. Solo acepta las credenciales 'key' y 'secret'.
+func newFakeAlpacaREST(key, secret string) *fakeAlpacaREST {
+	f := &fakeAlpacaREST{
+		key:     key,
+		secret:  secret,
+		records: make(map[string]map[string][]fakeRecord),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+// Protocol devuelve el protocolo del servidor ("http"), para `WebQueryAddress.protocol`.
+func (f *fakeAlpacaREST) Protocol() string {
+	u, _ := url.Parse(f.server.URL)
+	return u.Scheme
+}
+
+// Domain devuelve "host:puerto" del servidor, para `WebQueryAddress.domain`.
+func (f *fakeAlpacaREST) Domain() string {
+	u, _ := url.Parse(f.server.URL)
+	return u.Host
+}
+
+// Close detiene el servidor.
+func (f *fakeAlpacaREST) Close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+// Requests devuelve cuántas peticiones ha recibido el servidor desde el arranque.
+func (f *fakeAlpacaREST) Requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// RequestTimes devuelve el momento en que llegó cada petición, en orden.
+func (f *fakeAlpacaREST) RequestTimes() []time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.served)
+}
+
+// Inject encola fallos: cada petición siguiente consume uno, en orden.
+func (f *fakeAlpacaREST) Inject(faults ...fakeFault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, faults...)
+}
+
+// AddRecords añade registros (cualquier valor serializable a JSON con campo "t") al
+// dataset y símbolo indicados.
+func (f *fakeAlpacaREST) AddRecords(dataset, symbol string, records ...interface{}) error {
+	raws := make([]json.RawMessage, 0, len(records))
+	for _, r := range records {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		raws = append(raws, raw)
+	}
+	return f.addRaw(dataset, symbol, raws)
+}
+
+// LoadFixture carga una página de Alpaca guardada en un archivo, en cualquiera de
+// sus dos formas:
+//   - Un símbolo: `{"quotes": [...], "symbol": "QQQ", "next_page_token": ...}`
+//   - Multi-símbolo: `{"quotes": {"QQQ": [...], "SPY": [...]}, "next_page_token": ...}`
+//
+// El dataset se deduce de la clave presente ("quotes", "trades" o "bars").
+func (f *fakeAlpacaREST) LoadFixture(path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var page map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &page); err != nil {
+		return fmt.Errorf("fixture '%s': %w", path, err)
+	}
+	var symbol string
+	json.Unmarshal(page["symbol"], &symbol)
+
+	loaded := false
+	for _, dataset := range []string{datasetQuotes, datasetTrades, datasetBars} {
+		body, ok := page[dataset]
+		if !ok {
+			continue
+		}
+		loaded = true
+		var list []json.RawMessage
+		if err := json.Unmarshal(body, &list); err == nil {
+			if symbol == "" {
+				return fmt.Errorf("fixture '%s': falta el campo symbol", path)
+			}
+			if err := f.addRaw(dataset, symbol, list); err != nil {
+				return fmt.Errorf("fixture '%s': %w", path, err)
+			}
+			continue
+		}
+		var bySymbol map[string][]json.RawMessage
+		if err := json.Unmarshal(body, &bySymbol); err != nil {
+			return fmt.Errorf("fixture '%s': %s no es una lista ni un mapa por símbolo", path, dataset)
+		}
+		for sym, list := range bySymbol {
+			if err := f.addRaw(dataset, sym, list); err != nil {
+				return fmt.Errorf("fixture '%s': %w", path, err)
+			}
+		}
+	}
+	if !loaded {
+		return fmt.Errorf("fixture '%s': no contiene quotes, trades ni bars", path)
+	}
+	return nil
+}
+
+// addRaw añade registros crudos y mantiene el orden por timestamp.
+func (f *fakeAlpacaREST) addRaw(dataset, symbol string, raws []json.RawMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.records[dataset] == nil {
+		f.records[dataset] = make(map[string][]fakeRecord)
+	}
+	for _, raw := range raws {
+		var head struct {
+			T string `json:"t"`
+		}
+		if err := json.Unmarshal(raw, &head); err != nil {
+			return err
+		}
+		t, err := time.Parse(time.RFC3339Nano, head.T)
+		if err != nil {
+			return fmt.Errorf("registro de %s %s con timestamp inválido: %w", symbol, dataset, err)
+		}
+		f.records[dataset][symbol] = append(f.records[dataset][symbol], fakeRecord{t: t, raw: raw})
+	}
+	slices.SortStableFunc(f.records[dataset][symbol], func(a, b fakeRecord) int { return a.t.Compare(b.t) })
+	return nil
+}
+
+// writeFakeError responde un error con el formato JSON de Alpaca.
+func writeFakeError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"code": code, "message": message})
+}
+
+// handle atiende una petición siguiendo el comportamiento de la API de Alpaca.
+func (f *fakeAlpacaREST) handle(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests++
+	f.served = append(f.served, time.Now())
+	remaining := max(0, 10000-f.requests)
+	var fault fakeFault
+	if len(f.faults) > 0 {
+		fault, f.faults = f.faults[0], f.faults[1:]
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("X-RateLimit-Limit", "10000")
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10))
+
+	if fault.Delay > 0 {
+		select {
+		case <-time.After(fault.Delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.Status != 0 {
+		if fault.RetryAfter != "" {
+			w.Header().Set("Retry-After", fault.RetryAfter)
+		}
+		writeFakeError(w, fault.Status, fault.Status*100000, http.StatusText(fault.Status))
+		return
+	}
+
+	if r.Header.Get("APCA-API-KEY-ID") == "" || r.Header.Get("APCA-API-SECRET-KEY") == "" {
+		writeFakeError(w, http.StatusUnauthorized, 40110000, "request is not authorized")
+		return
+	}
+	if r.Header.Get("APCA-API-KEY-ID") != f.key || r.Header.Get("APCA-API-SECRET-KEY") != f.secret {
+		writeFakeError(w, http.StatusForbidden, 40310000, "forbidden.")
+		return
+	}
+
+	// Rutas: /v2/stocks/{symbol}/{dataset} o /v2/stocks/{dataset}?symbols=...
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+	var dataset string
+	var symbols []string
+	multi := false
+	switch {
+	case len(parts) == 4 && parts[0] == "v2" && parts[1] == "stocks":
+		symbols, dataset = []string{parts[2]}, parts[3]
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "stocks":
+		dataset, multi = parts[2], true
+		symbols = strings.Split(query.Get("symbols"), ",")
+		slices.Sort(symbols)
+	default:
+		writeFakeError(w, http.StatusNotFound, 40410000, "endpoint not found")
+		return
+	}
+	if dataset != datasetQuotes && dataset != datasetTrades && dataset != datasetBars {
+		writeFakeError(w, http.StatusNotFound, 40410000, "endpoint not found")
+		return
+	}
+	// El timeframe es obligatorio para las barras, pero el servidor falso sirve las
+	// mismas barras para cualquiera.
+	if dataset == datasetBars && query.Get("timeframe") == "" {
+		writeFakeError(w, http.StatusUnprocessableEntity, 42210000, "invalid timeframe")
+		return
+	}
+
+	var start, end time.Time
+	var err error
+	if v := query.Get("start"); v != "" {
+		if start, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			writeFakeError(w, http.StatusUnprocessableEntity, 42210000, "invalid start")
+			return
+		}
+	}
+	if v := query.Get("end"); v != "" {
+		if end, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			writeFakeError(w, http.StatusUnprocessableEntity, 42210000, "invalid end")
+			return
+		}
+	}
+	limit := 1000
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > 10000 {
+			writeFakeError(w, http.StatusUnprocessableEntity, 42210000, "invalid limit")
+			return
+		}
+	}
+	offset := 0
+	if v := query.Get("page_token"); v != "" {
+		decoded, decErr := base64.URLEncoding.DecodeString(v)
+		if offset, err = strconv.Atoi(string(decoded)); decErr != nil || err != nil {
+			writeFakeError(w, http.StatusBadRequest, 40010000, "invalid page token")
+			return
+		}
+	}
+
+	// Registros en rango, ordenados por símbolo y luego por timestamp (como Alpaca).
+	type entry struct {
+		symbol string
+		raw    json.RawMessage
+	}
+	var matches []entry
+	f.mu.Lock()
+	for _, sym := range symbols {
+		for _, rec := range f.records[dataset][sym] {
+			if (!start.IsZero() && rec.t.Before(start)) || (!end.IsZero() && !rec.t.Before(end)) {
+				continue
+			}
+			matches = append(matches, entry{sym, rec.raw})
+		}
+	}
+	f.mu.Unlock()
+
+	page := matches[min(offset, len(matches)):min(offset+limit, len(matches))]
+	var nextToken interface{} // null en la última página
+	if offset+limit < len(matches) {
+		nextToken = base64.URLEncoding.EncodeToString([]byte(strconv.Itoa(offset + limit)))
+	}
+
+	body := map[string]interface{}{"next_page_token": nextToken}
+	if multi {
+		bySymbol := map[string][]json.RawMessage{}
+		for _, e := range page {
+			bySymbol[e.symbol] = append(bySymbol[e.symbol], e.raw)
+		}
+		body[dataset] = bySymbol
+	} else {
+		list := []json.RawMessage{}
+		for _, e := range page {
+			list = append(list, e.raw)
+		}
+		body[dataset] = list
+		body["symbol"] = symbols[0]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
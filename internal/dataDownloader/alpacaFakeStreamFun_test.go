@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeAlpacaStream es un servidor WebSocket local que imita el protocolo del stream
+// de market data de Alpaca (conexión, autenticación, suscripción y mensajes). Permite
+// probar `AlpacaStream` sin red: se le apunta con `StreamOptions.URL = fake.URL()`.
+type fakeAlpacaStream struct {
+	key, secret string
+	server      *httptest.Server
+	upgrader    websocket.Upgrader
+
+	mu      sync.Mutex
+	conns   map[*websocket.Conn]bool
+	subs    map[string]map[string]bool // Canal ("quotes", "trades", "bars") -> símbolos
+	accepts int                        // Conexiones autenticadas desde el arranque
+	subbed  chan struct{}              // Recibe una señal por cada suscripción confirmada
+}
+
+// newFakeAlpacaStream arranca el servidor falso. Solo acepta las credenciales 'key' y 'secret'.
+func newFakeAlpacaStream(key, secret string) *fakeAlpacaStream {
+	f := &fakeAlpacaStream{
+		key:    key,
+		secret: secret,
+		conns:  make(map[*websocket.Conn]bool),
+		subs: map[string]map[string]bool{
+			datasetQuotes: {}, datasetTrades: {}, datasetBars: {},
+		},
+		subbed: make(chan struct{}, 16),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+// URL devuelve la dirección ws:// del servidor falso.
+func (f *fakeAlpacaStream) URL() string {
+	return "ws" + strings.TrimPrefix(f.server.URL, "http") + "/v2/sip"
+}
+
+// Close detiene el servidor y cierra todas las conexiones.
+func (f *fakeAlpacaStream) Close() {
+	f.DropConnections()
+	f.server.Close()
+}
+
+// Accepts devuelve cuántas conexiones se han autenticado desde el arranque.
+func (f *fakeAlpacaStream) Accepts() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.accepts
+}
+
+// Subscribed devuelve un channel que recibe una señal por cada suscripción confirmada.
+func (f *fakeAlpacaStream) Subscribed() <-chan struct{} {
+	return f.subbed
+}
+
+// DropConnections cierra de golpe todas las conexiones abiertas, para probar la reconexión.
+func (f *fakeAlpacaStream) DropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for conn := range f.conns {
+		conn.Close()
+		delete(f.conns, conn)
+	}
+}
+
+// Publish envía 'msgs' (mensajes "q", "t" o "b" con su campo "S") a todas las conexiones
+// autenticadas, filtrando los símbolos a los que no hay suscripción en ese canal.
+func (f *fakeAlpacaStream) Publish(msgs ...map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	channels := map[string]string{"q": datasetQuotes, "t": datasetTrades, "b": datasetBars}
+	var batch []map[string]interface{}
+	for _, m := range msgs {
+		kind, _ := m["T"].(string)
+		sym, _ := m["S"].(string)
+		if f.subs[channels[kind]][sym] || f.subs[channels[kind]]["*"] {
+			batch = append(batch, m)
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+	for conn := range f.conns {
+		conn.WriteJSON(batch)
+	}
+}
+
+// handle atiende una conexión siguiendo el protocolo de Alpaca.
+func (f *fakeAlpacaStream) handle(w http.ResponseWriter, r *http.Request) {
+	conn, err := f.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	conn.WriteJSON([]map[string]interface{}{{"T": "success", "msg": "connected"}})
+
+	authed := false
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			f.mu.Lock()
+			delete(f.conns, conn)
+			f.mu.Unlock()
+			return
+		}
+		var action struct {
+			Action string   `json:"action"`
+			Key    string   `json:"key"`
+			Secret string   `json:"secret"`
+			Quotes []string `json:"quotes"`
+			Trades []string `json:"trades"`
+			Bars   []string `json:"bars"`
+		}
+		if err := json.Unmarshal(data, &action); err != nil {
+			f.mu.Lock()
+			conn.WriteJSON([]map[string]interface{}{{"T": "error", "code": 400, "msg": "invalid syntax"}})
+			f.mu.Unlock()
+			continue
+		}
+
+		switch {
+		case action.Action == "auth":
+			if action.Key != f.key || action.Secret != f.secret {
+				conn.WriteJSON([]map[string]interface{}{{"T": "error", "code": 402, "msg": "auth failed"}})
+				return
+			}
+			authed = true
+			f.mu.Lock()
+			f.accepts++
+			f.mu.Unlock()
+			conn.WriteJSON([]map[string]interface{}{{"T": "success", "msg": "authenticated"}})
+		case !authed:
+			conn.WriteJSON([]map[string]interface{}{{"T": "error", "code": 401, "msg": "not authenticated"}})
+		case action.Action == "subscribe" || action.Action == "unsubscribe":
+			f.mu.Lock()
+			for channel, symbols := range map[string][]string{
+				datasetQuotes: action.Quotes, datasetTrades: action.Trades, datasetBars: action.Bars,
+			} {
+				for _, sym := range symbols {
+					f.subs[channel][sym] = action.Action == "subscribe"
+				}
+			}
+			f.conns[conn] = true
+			reply := map[string]interface{}{"T": "subscription"}
+			for channel, set := range f.subs {
+				list := []string{}
+				for sym, ok := range set {
+					if ok {
+						list = append(list, sym)
+					}
+				}
+				reply[channel] = list
+			}
+			conn.WriteJSON([]map[string]interface{}{reply})
+			f.mu.Unlock()
+			select {
+			case f.subbed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
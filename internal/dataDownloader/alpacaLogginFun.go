@@ -1,49 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
-	"os"
 	"time"
-
-	env "github.com/joho/godotenv"
 )
 
-// Configs struct para agrupar las configuraciones
-type AppConfig struct {
-	AlpacaAPIKey    string
-	AlpacaSecretKey string
-	DBPath          string // Si decides incluirlo
-}
-
-func loadConfigs() (AppConfig, error) { // Modificado para devolver AppConfig y un error
-	// Carga variables de entorno desde .env. Si no se encuentra, ignora el error
-	err := env.Load("/Users/davidochoacorrales/Documents/GitHub/dxm/internal/dataDownloader/configs/secret/.env") // Ruta relativa desde la raíz de ejecución
-	if err != nil {
-		log.Printf("Advertencia: No se pudo cargar .env, asumiendo variables de entorno configuradas: %v", err)
-	}
-
-	config := AppConfig{
-		AlpacaAPIKey:    os.Getenv("API_KEY_ID"),
-		AlpacaSecretKey: os.Getenv("API_SECRET_KEY"),
-		//DBPath:          os.Getenv("DB_PATH"),
-	}
-
-	if config.AlpacaAPIKey == "" || config.AlpacaSecretKey == "" {
-		return AppConfig{}, fmt.Errorf("las claves api de alpaca no están configuradas en el entorno o en .env")
-	}
-
-	//fmt.Printf("API Key: %s...\n", config.AlpacaAPIKey[:5]) // Mostrar solo los primeros caracteres por seguridad
-	//fmt.Printf("DB Path: %s\n", config.DBPath)
-
-	return config, nil // Devolver la estructura de configuración y nil para el error
-}
+// alpacaHTTPClient es el cliente HTTP de las llamadas REST a Alpaca. El timeout evita
+// que una respuesta que nunca llega bloquee una descarga: se trata como un error
+// transitorio y se reintenta.
+var alpacaHTTPClient = &http.Client{Timeout: 60 * time.Second}
 
 // alpacaCallItOptions contiene las opciones de configuración para una llamada con reintentos a la API de Alpaca.
 type alpacaCallItOptions struct {
 	url            string        // URL completa con parámetros para la petición
+	key            string        // Clave de la API (AppConfig.AlpacaAPIKey)
+	secret         string        // Secreto de la API (AppConfig.AlpacaSecretKey)
 	MaxRetries     int           // Número máximo de reintentos permitidos
 	maxBackoff     time.Duration // Tiempo máximo de espera entre reintentos
 	initialBackoff time.Duration // Tiempo inicial de espera entre reintentos
@@ -59,44 +34,49 @@ type alpacaCallItOptions struct {
 // en caso de fallos transitorios.
 //
 // Parámetros:
+//   - ctx: Contexto de la petición; al cancelarse, la petición en curso se aborta.
 //   - url: La URL completa del endpoint de la API de Alpaca al que se desea llamar
 //     (ej., "[https://data.alpaca.markets/v2/stocks/AAPL/quotes](https://data.alpaca.markets/v2/stocks/AAPL/quotes)").
+//   - key, secret: Credenciales de la cuenta de Alpaca (ver `AppConfig`).
 //
 // Devuelve:
 //   - Una cadena (string) que contiene el cuerpo de la respuesta HTTP si la petición
 //     es exitosa (normalmente un JSON).
 //   - Un error si ocurre algún problema durante la creación de la petición,
-//     la carga de la configuración, la ejecución de la petición HTTP, o la lectura
-//     del cuerpo de la respuesta.
+//     la ejecución de la petición HTTP, o la lectura del cuerpo de la respuesta.
 //
 // Errores comunes que puede retornar:
-//   - Si falla la carga de la configuración (terminará el programa con log.Fatalf).
 //   - Si ocurre un error de red o de conexión durante la petición HTTP.
 //   - Si hay un problema al leer el cuerpo de la respuesta HTTP.
+//   - Un `*AlpacaAPIError` si la API responde con un código fuera de 2xx, clasificado
+//     según el código (ErrAlpacaAuth, ErrAlpacaBadRequest, ErrAlpacaRateLimited,
+//     ErrAlpacaServer) y con el mensaje de error que devolvió Alpaca.
+//
+// Cada petición pasa antes por `alpacaLimiter` (ver alpacaRateLimitFun.go), que reparte
+// el límite de peticiones de la cuenta entre todos los downloaders y workers.
 //
 // Nota: La autenticación se realiza añadiendo los encabezados "APCA-API-KEY-ID"
-// y "APCA-API-SECRET-KEY" con los valores obtenidos de la configuración de la aplicación.
-func callIt(url string) (string, error) {
-
-	// Crea una nueva petición HTTP GET. El tercer argumento (nil) es para el cuerpo de la petición.
-	// El error devuelto por http.NewRequest se ignora aquí, asumiendo que la URL es válida.
-	req, _ := http.NewRequest("GET", url, nil)
+// y "APCA-API-SECRET-KEY" con 'key' y 'secret'.
+func callIt(ctx context.Context, url, key, secret string) (string, error) {
 
-	// Carga la configuración de la aplicación para obtener las claves de la API.
-	// Si hay un error al cargar la configuración, el programa termina aquí.
-	appConfig, err := loadConfigs()
+	// Crea una nueva petición HTTP GET ligada a 'ctx'. El cuarto argumento (nil) es para el cuerpo de la petición.
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Printf("Error al cargar configuración: %v", err)
-		return "", err
+		return "", Permanent(fmt.Errorf("URL inválida '%s': %w", url, err))
 	}
 
 	// Agrega los encabezados HTTP necesarios para la autenticación y el formato de respuesta.
-	req.Header.Add("accept", "application/json")                     // Solicita una respuesta en formato JSON
-	req.Header.Add("APCA-API-KEY-ID", appConfig.AlpacaAPIKey)        // Agrega la clave de API
-	req.Header.Add("APCA-API-SECRET-KEY", appConfig.AlpacaSecretKey) // Agrega la clave secreta
+	req.Header.Add("accept", "application/json")  // Solicita una respuesta en formato JSON
+	req.Header.Add("APCA-API-KEY-ID", key)        // Agrega la clave de API
+	req.Header.Add("APCA-API-SECRET-KEY", secret) // Agrega la clave secreta
 
-	// Ejecuta la petición HTTP utilizando el cliente HTTP por defecto de Go.
-	res, err := http.DefaultClient.Do(req)
+	// Espera turno en el limitador compartido, para no exceder el límite de la cuenta.
+	if err := alpacaLimiter.Wait(ctx); err != nil {
+		return "", err
+	}
+
+	// Ejecuta la petición HTTP con el cliente compartido (con timeout).
+	res, err := alpacaHTTPClient.Do(req)
 	if err != nil {
 		// Si ocurre un error durante la petición (ej. problema de red), se devuelve un error.
 		return "", fmt.Errorf("error making HTTP request: %v", err)
@@ -105,6 +85,9 @@ func callIt(url string) (string, error) {
 	// para liberar recursos de red.
 	defer res.Body.Close()
 
+	// Ajusta el limitador con lo que el servidor dice que queda del presupuesto.
+	alpacaLimiter.Observe(res.Header)
+
 	// Lee todo el contenido del cuerpo de la respuesta HTTP.
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
@@ -113,6 +96,18 @@ func callIt(url string) (string, error) {
 		return "", fmt.Errorf("error reading response body: %w", err)
 	}
 
+	// Un código fuera de 2xx no es un "sin datos": se devuelve como error tipado
+	// para que el llamador decida si reintentar.
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		apiErr := newAlpacaAPIError(res.StatusCode, body)
+		if res.StatusCode == http.StatusTooManyRequests {
+			// Pausa a todos los workers, no solo a este reintento.
+			apiErr.RetryAfter = parseRetryAfter(res.Header.Get("Retry-After"))
+			alpacaLimiter.PauseFor(apiErr.RetryAfter)
+		}
+		return "", apiErr
+	}
+
 	// Convierte el cuerpo de la respuesta (que es un slice de bytes) a una cadena y lo devuelve.
 	return string(body), nil
 }
@@ -126,26 +121,38 @@ func callIt(url string) (string, error) {
 // - Limitaciones de tasa (rate limiting, ej. 429 Too Many Requests)
 //
 // Parámetros:
+//   - ctx: contexto de cancelación, tanto de la petición en curso como de la espera entre reintentos.
 //   - opt: una estructura de tipo `alpacaCallItOptions` que contiene:
 //   - opt.url: URL que se debe consultar (string)
+//   - opt.key, opt.secret: credenciales de Alpaca
 //   - opt.MaxRetries: cantidad máxima de intentos antes de rendirse
 //   - opt.initialBackoff: duración del primer intervalo de espera
 //   - opt.maxBackoff: duración máxima entre reintentos
 //   - opt.logText: nombre descriptivo de la acción para logging
 //
-// La función envuelve la llamada base `callIt(url string) (string, error)` dentro del mecanismo
+// La función envuelve la llamada base `callIt(ctx, url, key, secret) (string, error)` dentro del mecanismo
 // de reintentos definido por `executeActionWithRetries`. Captura y maneja errores, y asegura
 // que el resultado final sea una cadena válida.
 //
+// Solo se reintentan los errores transitorios (red, 429 y 5xx). Los errores permanentes
+// de la API (credenciales inválidas, petición mal formada) se marcan con `Permanent` y
+// fallan al primer intento con el mensaje de Alpaca.
+//
 // Devuelve:
 //   - (string, nil) en caso de éxito
 //   - ("", error) si se agotan los reintentos o el resultado no es del tipo esperado
-func alpacaCallItWithRetries(opt alpacaCallItOptions) (string, error) {
+func alpacaCallItWithRetries(ctx context.Context, opt alpacaCallItOptions) (string, error) {
 	// Paso 1: Ejecutar la llamada con reintentos
 	rawResponse, err := executeActionWithRetries(
+		ctx,
 		func(attempt int) (interface{}, error) {
 			// Lógica real de la llamada
-			res, callErr := callIt(opt.url)
+			res, callErr := callIt(ctx, opt.url, opt.key, opt.secret)
+			// Los errores permanentes de la API no mejoran reintentando.
+			var apiErr *AlpacaAPIError
+			if errors.As(callErr, &apiErr) && !apiErr.Transient() {
+				return nil, Permanent(callErr)
+			}
 			return res, callErr
 		},
 		func(err error, msg string) {
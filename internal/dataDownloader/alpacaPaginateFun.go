@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Conjuntos de datos históricos que se pueden descargar de Alpaca. Cada uno
+// corresponde al último segmento de la ruta `/v2/stocks/{symbol}/{dataset}`.
+const (
+	datasetQuotes = "quotes"
+	datasetTrades = "trades"
+	datasetBars   = "bars"
+)
+
+// alpacaPageOptions agrupa los parámetros de una descarga paginada de datos
+// históricos desde los endpoints `/v2/stocks/{symbol}/{dataset}` de Alpaca, o desde
+// su forma multi-símbolo `/v2/stocks/{dataset}?symbols=...` si hay más de un símbolo.
+type alpacaPageOptions struct {
+	protocol string   // Protocolo de la API; vacío para "https" (ver `WebQuery`)
+	domain   string   // Dominio de la API (ej. "data.alpaca.markets")
+	symbols  []string // Tickers a descargar (ej. ["QQQ"]); con más de uno se usa la forma multi-símbolo
+	dataset  string   // Conjunto de datos: datasetQuotes, datasetTrades, ...
+	start    string   // Fecha inicial RFC3339 (ej. "2016-01-01T00:00:00Z")
+	end      string   // Fecha final RFC3339; vacía para descargar hasta el presente
+	feed     string   // Fuente de datos ("sip", "iex", ...)
+	limit    int      // Número máximo de registros por página (Alpaca admite hasta 10000)
+	// Solo para datasetBars:
+	timeframe  string              // Duración de cada barra ("1Min", "5Min", "1Hour", "1Day", ...)
+	adjustment string              // Ajuste corporativo ("raw", "split", "dividend", "all")
+	callOpts   alpacaCallItOptions // Opciones de reintentos; el campo url se completa por página
+}
+
+// alpacaPageFunc procesa el cuerpo crudo de una página. Recibe el token con el que se
+// pidió la página y la fecha final (cero si no hay) y devuelve el token de la página
+// siguiente, el número de registros procesados y si se alcanzó la fecha final.
+type alpacaPageFunc func(raw []byte, pageToken string, end time.Time) (nextToken string, n int, reachedEnd bool, err error)
+
+// alpacaPageURL construye la URL de una página a partir de las opciones de descarga
+// y del token de página (vacío para la primera página).
+func alpacaPageURL(opt alpacaPageOptions, pageToken string) string {
+	params := url.Values{}
+	if opt.start != "" {
+		params.Set("start", opt.start)
+	}
+	if opt.end != "" {
+		params.Set("end", opt.end)
+	}
+	if opt.feed != "" {
+		params.Set("feed", opt.feed)
+	}
+	if opt.limit > 0 {
+		params.Set("limit", strconv.Itoa(opt.limit))
+	}
+	if opt.dataset == datasetBars {
+		params.Set("timeframe", opt.timeframe)
+		if opt.adjustment != "" {
+			params.Set("adjustment", opt.adjustment)
+		}
+	}
+	params.Set("sort", "asc")
+	if pageToken != "" {
+		params.Set("page_token", pageToken)
+	}
+
+	path := "/v2/stocks/" + opt.symbols[0] + "/" + opt.dataset
+	if len(opt.symbols) > 1 {
+		params.Set("symbols", strings.Join(opt.symbols, ","))
+		path = "/v2/stocks/" + opt.dataset
+	}
+
+	return WebQuery(WebQueryAddress{
+		protocol: opt.protocol,
+		domain:   opt.domain,
+		path:     path,
+		query:    params.Encode(),
+	})
+}
+
+// downloadPaginated pide páginas sucesivas siguiendo `next_page_token` hasta que el
+// token llegue vacío o se alcance la fecha final.
+//
+// Cada página se pide con `alpacaCallItWithRetries`, por lo que hereda el mismo
+// esquema de reintentos y backoff exponencial que una llamada simple. El cuerpo de
+// cada página se entrega a 'onPage', que se encarga de decodificarla y guardarla.
+//
+// Se detiene entre páginas si 'ctx' se cancela; la página en curso ya entregada a
+// 'onPage' se termina de procesar.
+//
+// Parámetros:
+//   - ctx: contexto de cancelación de las peticiones y de la paginación.
+//   - opt: opciones de la descarga (símbolo, dataset, rango de fechas, feed, tamaño de página, reintentos).
+//   - pageToken: token desde el que continuar; vacío para empezar desde 'opt.start'.
+//   - onPage: función que procesa cada página descargada.
+//
+// Devuelve:
+//   - El número total de registros procesados por 'onPage'.
+//   - Un error si falla una descarga o el procesamiento de una página.
+func downloadPaginated(ctx context.Context, opt alpacaPageOptions, pageToken string, onPage alpacaPageFunc) (int, error) {
+	if len(opt.symbols) == 0 {
+		return 0, fmt.Errorf("no se indicó ningún símbolo")
+	}
+	var endTime time.Time
+	if opt.end != "" {
+		t, err := time.Parse(time.RFC3339Nano, opt.end)
+		if err != nil {
+			return 0, fmt.Errorf("fecha final inválida '%s': %w", opt.end, err)
+		}
+		endTime = t
+	}
+
+	total := 0
+	for pageNum := 1; ; pageNum++ {
+		if ctx.Err() != nil {
+			return total, ctx.Err()
+		}
+		callOpts := opt.callOpts
+		callOpts.url = alpacaPageURL(opt, pageToken)
+		callOpts.logText = fmt.Sprintf("%s (%s %s, página %d)", opt.callOpts.logText, symbolKey(opt.symbols), opt.dataset, pageNum)
+
+		res, err := alpacaCallItWithRetries(ctx, callOpts)
+		if err != nil {
+			return total, err
+		}
+
+		nextToken, n, reachedEnd, err := onPage([]byte(res), pageToken, endTime)
+		if err != nil {
+			return total, fmt.Errorf("error al procesar la página %d de %s %s: %w", pageNum, symbolKey(opt.symbols), opt.dataset, err)
+		}
+		total += n
+		log.Printf("Página %d de %s %s: %d registros (acumulado %d).", pageNum, symbolKey(opt.symbols), opt.dataset, n, total)
+
+		if nextToken == "" || reachedEnd {
+			return total, nil
+		}
+		pageToken = nextToken
+	}
+}
+
+// cutAtEnd devuelve cuántos de los 'n' registros de una página tienen timestamp
+// anterior a 'end', y true si alguno quedó fuera del rango. 'timestamp' devuelve el
+// timestamp RFC3339 del registro i. Los registros llegan ordenados ascendentemente
+// (sort=asc), así que basta con cortar en el primero que alcance la fecha final.
+func cutAtEnd(n int, timestamp func(i int) string, end time.Time) (int, bool) {
+	if end.IsZero() {
+		return n, false
+	}
+	for i := 0; i < n; i++ {
+		t, err := time.Parse(time.RFC3339Nano, timestamp(i))
+		if err != nil {
+			continue // El guardado se encarga de registrar los timestamps inválidos
+		}
+		if !t.Before(end) {
+			return i, true
+		}
+	}
+	return n, false
+}
+
+// alpacaPage es una página decodificada de un dataset, de un solo símbolo (`Quote`,
+// `Trade`, `Bar`) o multi-símbolo (`MultiQuote`, ...), con registros de tipo T.
+type alpacaPage[T any] interface {
+	nextToken() string
+	// bySymbol devuelve los registros de la página por símbolo. 'symbol' es el pedido,
+	// para las páginas de un solo símbolo que no lo traen.
+	bySymbol(symbol string) map[string][]T
+}
+
+// datasetPageFunc devuelve la `alpacaPageFunc` de un dataset: decodifica cada página
+// como S (un solo símbolo) o M (multi-símbolo) según 'opt.symbols' y la reparte con
+// `demuxMultiPage`, entregando a 'deliver' los registros de cada símbolo junto con el
+// token con el que se pidió la página.
+func datasetPageFunc[S, M alpacaPage[T], T any](opt alpacaPageOptions, timestamp func(T) string, deliver func(symbol string, records []T, pageToken string) error) alpacaPageFunc {
+	multi := len(opt.symbols) > 1
+	return func(raw []byte, pageToken string, end time.Time) (string, int, bool, error) {
+		var page alpacaPage[T]
+		var err error
+		if multi {
+			var m M
+			err = unmarshalGeneric(raw, &m)
+			page = m
+		} else {
+			var s S
+			err = unmarshalGeneric(raw, &s)
+			page = s
+		}
+		if err != nil {
+			return "", 0, false, fmt.Errorf("error al decodificar %s: %w", opt.dataset, err)
+		}
+		n, reachedEnd, err := demuxMultiPage(page.bySymbol(opt.symbols[0]), timestamp, end, func(symbol string, records []T) error {
+			return deliver(symbol, records, pageToken)
+		})
+		if err != nil {
+			return "", 0, false, err
+		}
+		// Alpaca ordena las respuestas multi-símbolo por símbolo y luego por timestamp:
+		// que un símbolo alcance la fecha final no implica que los siguientes también,
+		// así que ahí el corte definitivo lo hace el parámetro `end` en el servidor.
+		return page.nextToken(), n, reachedEnd && !multi, nil
+	}
+}
+
+// demuxMultiPage entrega a 'deliver' los registros de cada símbolo de una página
+// ('bySymbol'), en orden alfabético, para que cada uno se guarde en el bucket de su
+// propio símbolo. Antes corta los de cada símbolo en la fecha final (ver `cutAtEnd`,
+// con 'timestamp' como el timestamp de cada registro) y omite los que quedan vacíos.
+//
+// Devuelve el número de registros entregados y si algún símbolo alcanzó la fecha final.
+func demuxMultiPage[T any](bySymbol map[string][]T, timestamp func(T) string, end time.Time, deliver func(symbol string, records []T) error) (int, bool, error) {
+	n, reachedEnd := 0, false
+	for _, symbol := range slices.Sorted(maps.Keys(bySymbol)) {
+		records := bySymbol[symbol]
+		cut, reached := cutAtEnd(len(records), func(i int) string { return timestamp(records[i]) }, end)
+		reachedEnd = reachedEnd || reached
+		if cut == 0 {
+			continue
+		}
+		if err := deliver(symbol, records[:cut]); err != nil {
+			return n, reachedEnd, err
+		}
+		n += cut
+	}
+	return n, reachedEnd, nil
+}
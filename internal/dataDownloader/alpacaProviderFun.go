@@ -0,0 +1,52 @@
+package main
+
+import "context"
+
+// alpacaProvider es el `MarketDataProvider` de la API REST de datos históricos de
+// Alpaca. Traduce cada `FetchRequest` a las opciones de `downloadPaginated`; con más
+// de un símbolo usa los endpoints multi-símbolo (`/v2/stocks/{dataset}?symbols=...`).
+// El token de página es el `next_page_token` de Alpaca.
+type alpacaProvider struct {
+	protocol string              // Protocolo de la API; vacío para "https"
+	domain   string              // Dominio de la API (ej. "data.alpaca.markets")
+	limit    int                 // Registros por página (Alpaca admite hasta 10000)
+	callOpts alpacaCallItOptions // Opciones de reintentos de cada página
+}
+
+// newAlpacaProvider crea el proveedor de Alpaca para 'protocol' y 'domain'. Para usar
+// el servidor real basta "https" y "data.alpaca.markets"; para `fakeAlpacaREST`,
+// los valores de `fake.Protocol()` y `fake.Domain()`.
+func newAlpacaProvider(protocol, domain string, limit int, callOpts alpacaCallItOptions) *alpacaProvider {
+	return &alpacaProvider{protocol: protocol, domain: domain, limit: limit, callOpts: callOpts}
+}
+
+func (p *alpacaProvider) Name() string { return "alpaca" }
+
+// pageOptions traduce una petición genérica a las opciones de paginación de Alpaca.
+func (p *alpacaProvider) pageOptions(req FetchRequest, dataset string) alpacaPageOptions {
+	return alpacaPageOptions{
+		protocol:   p.protocol,
+		domain:     p.domain,
+		symbols:    req.Symbols,
+		dataset:    dataset,
+		start:      req.Start,
+		end:        req.End,
+		feed:       req.Feed,
+		limit:      p.limit,
+		timeframe:  req.Timeframe,
+		adjustment: req.Adjustment,
+		callOpts:   p.callOpts,
+	}
+}
+
+func (p *alpacaProvider) FetchQuotes(ctx context.Context, req FetchRequest, pageToken string, handler QuotePageHandler) (int, error) {
+	return downloadQuotesPaginated(ctx, p.pageOptions(req, datasetQuotes), pageToken, handler)
+}
+
+func (p *alpacaProvider) FetchTrades(ctx context.Context, req FetchRequest, pageToken string, handler TradePageHandler) (int, error) {
+	return downloadTradesPaginated(ctx, p.pageOptions(req, datasetTrades), pageToken, handler)
+}
+
+func (p *alpacaProvider) FetchBars(ctx context.Context, req FetchRequest, pageToken string, handler BarPageHandler) (int, error) {
+	return downloadBarsPaginated(ctx, p.pageOptions(req, datasetBars), pageToken, handler)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// alpacaLimiter es el limitador compartido por todas las peticiones REST a Alpaca.
+// `callIt` pasa por él, así que todos los downloaders, grupos y workers del proceso
+// consumen del mismo presupuesto de peticiones. Se crea con el límite por defecto y
+// se ajusta con `SetLimit` al cargar la configuración.
+var alpacaLimiter = newRateLimiter(defaultConfig().RateLimitPerMinute)
+
+// rateLimiter es un token bucket del lado del cliente: 'capacity' peticiones por
+// minuto, rellenado de forma continua. Además del ritmo propio, obedece lo que
+// anuncia el servidor:
+//   - `X-RateLimit-Limit` redimensiona el bucket al límite real de la cuenta.
+//   - `X-RateLimit-Remaining` recorta los tokens locales si el servidor lleva menos.
+//   - `X-RateLimit-Reset` (segundos Unix): con el presupuesto agotado, nadie pide
+//     nada hasta esa hora.
+//   - `Retry-After` (en un 429): pausa a todos los llamadores ese tiempo.
+type rateLimiter struct {
+	mu           sync.Mutex
+	capacity     float64       // Peticiones por minuto (tamaño del bucket)
+	tokens       float64       // Tokens disponibles ahora
+	interval     time.Duration // Tiempo para recuperar un token
+	last         time.Time     // Último relleno del bucket
+	blockedUntil time.Time     // Nadie pasa antes de esta hora (reset o Retry-After)
+}
+
+// newRateLimiter crea un bucket lleno de 'perMinute' peticiones por minuto.
+func newRateLimiter(perMinute int) *rateLimiter {
+	l := &rateLimiter{last: time.Now()}
+	l.resize(perMinute)
+	l.tokens = l.capacity
+	return l
+}
+
+// resize cambia el tamaño del bucket (y su ritmo de relleno). Llamar con mu tomado.
+func (l *rateLimiter) resize(perMinute int) {
+	if perMinute < 1 {
+		perMinute = 1
+	}
+	l.capacity = float64(perMinute)
+	l.interval = time.Minute / time.Duration(perMinute)
+	l.tokens = min(l.tokens, l.capacity)
+}
+
+// SetLimit cambia el límite a 'perMinute' peticiones por minuto. El servidor puede
+// volver a ajustarlo con `X-RateLimit-Limit`.
+func (l *rateLimiter) SetLimit(perMinute int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.resize(perMinute)
+}
+
+// refill suma los tokens recuperados desde el último relleno. Llamar con mu tomado.
+func (l *rateLimiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = min(l.capacity, l.tokens+float64(elapsed)/float64(l.interval))
+		l.last = now
+	}
+}
+
+// Wait bloquea hasta que haya un token disponible y lo consume. Devuelve ctx.Err()
+// si 'ctx' se cancela mientras espera.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.refill(now)
+
+		var wait time.Duration
+		switch {
+		case now.Before(l.blockedUntil):
+			wait = l.blockedUntil.Sub(now)
+		case l.tokens >= 1:
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		default:
+			wait = time.Duration((1 - l.tokens) * float64(l.interval))
+		}
+		l.mu.Unlock()
+
+		if wait > time.Second {
+			log.Printf("rateLimiter: presupuesto de peticiones agotado, esperando %v...", wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// PauseFor impide cualquier petición durante 'd' (ej. el `Retry-After` de un 429).
+func (l *rateLimiter) PauseFor(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	l.pauseUntil(time.Now().Add(d))
+}
+
+// pauseUntil adelanta 'blockedUntil' hasta 't' (nunca lo retrasa).
+func (l *rateLimiter) pauseUntil(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t.After(l.blockedUntil) {
+		l.blockedUntil = t
+		l.tokens = 0
+	}
+}
+
+// Observe ajusta el bucket con los encabezados `X-RateLimit-*` de una respuesta.
+// Los encabezados ausentes o ilegibles se ignoran.
+func (l *rateLimiter) Observe(header http.Header) {
+	limit, limitErr := strconv.Atoi(header.Get("X-RateLimit-Limit"))
+	remaining, remainingErr := strconv.Atoi(header.Get("X-RateLimit-Remaining"))
+	reset, resetErr := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64)
+
+	l.mu.Lock()
+	l.refill(time.Now())
+	if limitErr == nil && limit > 0 && float64(limit) != l.capacity {
+		log.Printf("rateLimiter: límite de la cuenta %d peticiones/min (antes %.0f)", limit, l.capacity)
+		l.resize(limit)
+	}
+	if remainingErr == nil && remaining >= 0 {
+		l.tokens = min(l.tokens, float64(remaining))
+	}
+	l.mu.Unlock()
+
+	if remainingErr == nil && remaining == 0 && resetErr == nil {
+		l.pauseUntil(time.Unix(reset, 0))
+	}
+}
+
+// parseRetryAfter interpreta el encabezado `Retry-After`, que puede venir en
+// segundos ("30") o como fecha HTTP. Devuelve 0 si no está o no se entiende.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(time.Until(at), 0)
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+)
+
+// runStream abre la base de datos y guarda el stream en tiempo real de quotes, trades
+// y barras de los símbolos de 'cfg' hasta recibir SIGINT/SIGTERM. Con 'partitions' las
+// quotes y los trades van a las particiones.
+func runStream(cfg AppConfig, partitions *ticks.PartitionedStore) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dbs := newDBManager(ctx)
+	defer func() {
+		if closeErr := dbs.CloseAll(); closeErr != nil {
+			log.Printf("Error closing database: %v", closeErr)
+		}
+	}()
+	dbInstance, err := dbs.Open(mainDBName, cfg.DBPath, false)
+	if err != nil {
+		log.Fatalf("Fatal: Failed to initialize database: %v", err)
+	}
+
+	ingest, err := NewIngestWriter(cfg.ingestOptions(dbInstance, partitions))
+	if err != nil {
+		log.Printf("Fatal: %v", err)
+		return
+	}
+	defer ingest.Close()
+
+	stream, err := NewAlpacaStream(StreamOptions{
+		URL:    streamURL(cfg.StreamDomain, cfg.Feed),
+		FEED:   cfg.Feed,
+		KEY:    cfg.AlpacaAPIKey,
+		SECRET: cfg.AlpacaSecretKey,
+		QUOTES: cfg.Symbols,
+		TRADES: cfg.Symbols,
+		BARS:   cfg.Symbols,
+		INGEST: ingest,
+	})
+	if err != nil {
+		log.Printf("Fatal: %v", err)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		log.Println("Señal recibida, deteniendo el stream...")
+		stream.Close()
+	}()
+
+	if err := stream.Run(); err != nil {
+		log.Printf("Fatal: el stream terminó con error: %v", err)
+	}
+	printValidationReport(ingest.Stats())
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//
+// STREAMING EN TIEMPO REAL (WEBSOCKET)
+// =========================================
+//
+// Cliente del WebSocket de market data de Alpaca (`wss://stream.data.alpaca.markets/v2/{feed}`).
+// El protocolo intercambia arrays JSON de mensajes con un campo "T" que indica su tipo:
+//
+//	-> [{"T":"success","msg":"connected"}]
+//	<- {"action":"auth","key":"...","secret":"..."}
+//	-> [{"T":"success","msg":"authenticated"}]
+//	<- {"action":"subscribe","quotes":["QQQ"],"trades":["QQQ"],"bars":["QQQ"]}
+//	-> [{"T":"subscription","quotes":["QQQ"],"trades":["QQQ"],"bars":["QQQ"]}]
+//	-> [{"T":"q","S":"QQQ","ap":110.87,...},{"T":"t","S":"QQQ","p":110.85,...}]
+//
+// Los mensajes recibidos se acumulan por símbolo y se entregan periódicamente a un
+// `IngestWriter`, así que terminan en el mismo layout de bbolt que la descarga
+// histórica.
+//
+
+// streamBarsBucket es el bucket donde se guardan las barras del stream: Alpaca
+// publica barras de un minuto sin ajustar.
+var streamBarsBucket = barsBucketName("1Min", "raw")
+
+// streamSource es el proveedor con el que el stream firma los metadatos de cada
+// símbolo (ver `ticks.SymbolMeta`), para distinguirlo de la descarga histórica.
+const streamSource = "alpaca-stream"
+
+// StreamOptions agrupa la configuración del cliente de streaming.
+type StreamOptions struct {
+	// URL del WebSocket (ej. "wss://stream.data.alpaca.markets/v2/sip"). Se puede
+	// apuntar a un servidor local (ver `fakeAlpacaStream`) para pruebas sin red.
+	URL string
+	// FEED es el feed del URL ("sip", "iex", ...), para los metadatos de cada símbolo
+	// (ver `ticks.SymbolMeta`).
+	FEED string
+	// KEY y SECRET son las credenciales de la API de Alpaca.
+	KEY    string
+	SECRET string
+	// QUOTES, TRADES y BARS son los símbolos a suscribir al conectar.
+	QUOTES []string
+	TRADES []string
+	BARS   []string
+	// INGEST es el escritor por el que se guardan los mensajes. El stream no lo cierra.
+	INGEST *IngestWriter
+	// FLUSH_SIZE es el número de mensajes acumulados que fuerza un guardado.
+	FLUSH_SIZE int
+	// FLUSH_INTERVAL es el tiempo máximo que un mensaje espera en memoria antes de guardarse.
+	FLUSH_INTERVAL time.Duration
+	// PING_INTERVAL es cada cuánto se envía un ping de heartbeat; si no llega ningún
+	// mensaje ni pong en dos intervalos la conexión se da por muerta y se reconecta.
+	PING_INTERVAL time.Duration
+	// Reintentos de conexión, con el mismo retroceso exponencial de `executeActionWithRetries`.
+	MaxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+// streamURL devuelve la URL del WebSocket de Alpaca en 'domain' (ej.
+// "stream.data.alpaca.markets") para un feed ("sip", "iex", ...).
+func streamURL(domain, feed string) string {
+	return WebQuery(WebQueryAddress{protocol: "wss", domain: domain, path: "/v2/" + feed})
+}
+
+// streamControl es un mensaje de control del protocolo ("success", "error", "subscription").
+type streamControl struct {
+	T      string   `json:"T"`
+	Msg    string   `json:"msg"`
+	Code   int      `json:"code"`
+	Quotes []string `json:"quotes"`
+	Trades []string `json:"trades"`
+	Bars   []string `json:"bars"`
+}
+
+// streamHeader es la parte común de los mensajes de datos del stream.
+//
+// encoding/json empareja las claves sin distinguir mayúsculas cuando no hay un campo
+// exacto, así que "T" (tipo) acabaría en el campo de "t" (timestamp) y "S" (símbolo)
+// en el de "s" (tamaño). Declarar ambos campos fuerza el emparejamiento exacto.
+type streamHeader struct {
+	Kind string `json:"T"` // Tipo de mensaje ("q", "t", "b", "success", ...)
+	S    string `json:"S"` // Símbolo
+}
+
+// streamQuote es una quote tal como llega por el stream ("T":"q").
+type streamQuote struct {
+	streamHeader
+	AP float64  `json:"ap"`
+	AS int      `json:"as"`
+	AX string   `json:"ax"`
+	BP float64  `json:"bp"`
+	BS int      `json:"bs"`
+	BX string   `json:"bx"`
+	C  []string `json:"c"`
+	T  string   `json:"t"`
+	Z  string   `json:"z"`
+}
+
+// streamTrade es un trade tal como llega por el stream ("T":"t").
+type streamTrade struct {
+	streamHeader
+	oneTrade
+}
+
+// streamBar es una barra de un minuto tal como llega por el stream ("T":"b").
+type streamBar struct {
+	streamHeader
+	oneBar
+}
+
+// AlpacaStream es un cliente del WebSocket de market data con reconexión automática.
+// Se crea con `NewAlpacaStream` y se ejecuta con `Run` hasta que se llama a `Close`.
+type AlpacaStream struct {
+	opt StreamOptions
+
+	connMu sync.Mutex      // Protege conn y las escrituras al WebSocket
+	conn   *websocket.Conn // Conexión actual; nil mientras se reconecta
+
+	subMu  sync.Mutex          // Protege subs
+	subs   map[string][]string // Suscripciones vigentes por canal ("quotes", "trades", "bars")
+	bufMu  sync.Mutex          // Protege los buffers
+	quotes map[string][]QuoteRecord
+	trades map[string][]TradeRecord
+	bars   map[string][]BarRecord
+	buffed int // Mensajes acumulados desde el último guardado
+	// flushNow pide a `flushLoop` un guardado sin esperar a FLUSH_INTERVAL (al llegar a
+	// FLUSH_SIZE). El guardado no se hace en la lectura: mientras espera al escritor no
+	// se leen los pongs y el plazo de lectura vencería.
+	flushNow chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	ctx      context.Context // Se cancela con `Close`; aborta la conexión y sus reintentos
+	cancel   context.CancelFunc
+}
+
+// NewAlpacaStream crea un cliente de streaming con la configuración indicada,
+// completando con valores por defecto los intervalos y reintentos no definidos.
+func NewAlpacaStream(opt StreamOptions) (*AlpacaStream, error) {
+	if opt.INGEST == nil {
+		return nil, fmt.Errorf("escritor de ingesta nulo")
+	}
+	if opt.URL == "" {
+		return nil, fmt.Errorf("URL del stream vacía")
+	}
+	if opt.FLUSH_SIZE <= 0 {
+		opt.FLUSH_SIZE = 1000
+	}
+	if opt.FLUSH_INTERVAL <= 0 {
+		opt.FLUSH_INTERVAL = time.Second
+	}
+	if opt.PING_INTERVAL <= 0 {
+		opt.PING_INTERVAL = 10 * time.Second
+	}
+	if opt.MaxRetries <= 0 {
+		opt.MaxRetries = 10
+	}
+	if opt.initialBackoff <= 0 {
+		opt.initialBackoff = 500 * time.Millisecond
+	}
+	if opt.maxBackoff <= 0 {
+		opt.maxBackoff = 30 * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &AlpacaStream{
+		opt: opt,
+		subs: map[string][]string{
+			datasetQuotes: opt.QUOTES,
+			datasetTrades: opt.TRADES,
+			datasetBars:   opt.BARS,
+		},
+		quotes:   make(map[string][]QuoteRecord),
+		trades:   make(map[string][]TradeRecord),
+		bars:     make(map[string][]BarRecord),
+		flushNow: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Run conecta, se autentica, se suscribe y procesa mensajes hasta que se llama a `Close`.
+//
+// Si la conexión se cae (error de red, heartbeat sin respuesta, cierre del servidor),
+// guarda lo acumulado y vuelve a conectar con `executeActionWithRetries`, re-suscribiendo
+// los mismos símbolos. Devuelve un error solo si se agotan los reintentos de conexión.
+func (s *AlpacaStream) Run() error {
+	flushDone := make(chan struct{})
+	go s.flushLoop(flushDone)
+	defer func() {
+		<-flushDone
+		if err := s.flush(); err != nil {
+			log.Printf("Error al guardar el último lote del stream: %v", err)
+		}
+	}()
+
+	for {
+		if s.stopped() {
+			return nil
+		}
+		conn, err := s.connectWithRetries()
+		if err != nil {
+			if s.stopped() {
+				return nil
+			}
+			s.Close()
+			return err
+		}
+
+		err = s.readLoop(conn)
+		s.setConn(nil)
+		conn.Close()
+		if s.stopped() {
+			return nil
+		}
+		log.Printf("Conexión del stream perdida: %v. Reconectando...", err)
+		if err := s.flush(); err != nil {
+			log.Printf("Error al guardar el lote del stream antes de reconectar: %v", err)
+		}
+	}
+}
+
+// Close detiene el stream: cierra la conexión actual y hace que `Run` guarde lo
+// acumulado y termine. Se puede llamar varias veces.
+func (s *AlpacaStream) Close() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		s.cancel()
+		s.connMu.Lock()
+		if s.conn != nil {
+			s.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			s.conn.Close()
+		}
+		s.connMu.Unlock()
+	})
+}
+
+// Subscribe añade símbolos a los canales de quotes, trades y barras. Si hay una
+// conexión activa se envía la suscripción de inmediato; en cualquier caso se recuerda
+// para las reconexiones.
+func (s *AlpacaStream) Subscribe(quotes, trades, bars []string) error {
+	s.subMu.Lock()
+	s.subs[datasetQuotes] = mergeSymbols(s.subs[datasetQuotes], quotes, true)
+	s.subs[datasetTrades] = mergeSymbols(s.subs[datasetTrades], trades, true)
+	s.subs[datasetBars] = mergeSymbols(s.subs[datasetBars], bars, true)
+	s.subMu.Unlock()
+	return s.sendAction("subscribe", quotes, trades, bars)
+}
+
+// Unsubscribe quita símbolos de los canales de quotes, trades y barras.
+func (s *AlpacaStream) Unsubscribe(quotes, trades, bars []string) error {
+	s.subMu.Lock()
+	s.subs[datasetQuotes] = mergeSymbols(s.subs[datasetQuotes], quotes, false)
+	s.subs[datasetTrades] = mergeSymbols(s.subs[datasetTrades], trades, false)
+	s.subs[datasetBars] = mergeSymbols(s.subs[datasetBars], bars, false)
+	s.subMu.Unlock()
+	return s.sendAction("unsubscribe", quotes, trades, bars)
+}
+
+// mergeSymbols añade (add=true) o quita (add=false) 'symbols' de 'current' sin duplicados.
+func mergeSymbols(current, symbols []string, add bool) []string {
+	set := make(map[string]bool, len(current))
+	for _, sym := range current {
+		set[sym] = true
+	}
+	for _, sym := range symbols {
+		set[sym] = add
+	}
+	merged := make([]string, 0, len(set))
+	for sym, ok := range set {
+		if ok {
+			merged = append(merged, sym)
+		}
+	}
+	return merged
+}
+
+// sendAction envía una acción de suscripción por la conexión activa, si la hay.
+func (s *AlpacaStream) sendAction(action string, quotes, trades, bars []string) error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.conn == nil {
+		return nil // Se enviará al reconectar
+	}
+	return s.conn.WriteJSON(subscriptionMessage(action, quotes, trades, bars))
+}
+
+// subscriptionMessage construye una acción "subscribe"/"unsubscribe", omitiendo los
+// canales sin símbolos (Alpaca rechaza listas nulas).
+func subscriptionMessage(action string, quotes, trades, bars []string) map[string]interface{} {
+	msg := map[string]interface{}{"action": action}
+	if len(quotes) > 0 {
+		msg[datasetQuotes] = quotes
+	}
+	if len(trades) > 0 {
+		msg[datasetTrades] = trades
+	}
+	if len(bars) > 0 {
+		msg[datasetBars] = bars
+	}
+	return msg
+}
+
+func (s *AlpacaStream) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *AlpacaStream) setConn(conn *websocket.Conn) {
+	s.connMu.Lock()
+	s.conn = conn
+	s.connMu.Unlock()
+}
+
+// connectWithRetries abre la conexión, autentica y suscribe, reintentando con el
+// retroceso exponencial de `executeActionWithRetries`.
+func (s *AlpacaStream) connectWithRetries() (*websocket.Conn, error) {
+	rawResponse, err := executeActionWithRetries(
+		s.ctx,
+		func(attempt int) (interface{}, error) {
+			if s.stopped() {
+				return nil, nil
+			}
+			return s.connect()
+		},
+		func(err error, msg string) {
+			handleErrorLogIt(err, msg)
+		},
+		s.opt.MaxRetries,
+		s.opt.initialBackoff,
+		s.opt.maxBackoff,
+		"conexión al stream de Alpaca",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("fallo definitivo al conectar con el stream de Alpaca: %w", err)
+	}
+	conn, ok := rawResponse.(*websocket.Conn)
+	if !ok || conn == nil {
+		return nil, fmt.Errorf("stream detenido durante la conexión")
+	}
+	return conn, nil
+}
+
+// connect realiza el handshake completo: conexión, autenticación y suscripción.
+func (s *AlpacaStream) connect() (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(s.ctx, s.opt.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error al conectar con %s: %w", s.opt.URL, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * s.opt.PING_INTERVAL))
+
+	fail := func(err error) (*websocket.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := expectControl(conn, "success", "connected"); err != nil {
+		return fail(err)
+	}
+	if err := conn.WriteJSON(map[string]string{"action": "auth", "key": s.opt.KEY, "secret": s.opt.SECRET}); err != nil {
+		return fail(fmt.Errorf("error al enviar la autenticación: %w", err))
+	}
+	if err := expectControl(conn, "success", "authenticated"); err != nil {
+		return fail(err)
+	}
+
+	s.subMu.Lock()
+	quotes, trades, bars := s.subs[datasetQuotes], s.subs[datasetTrades], s.subs[datasetBars]
+	s.subMu.Unlock()
+	if len(quotes)+len(trades)+len(bars) > 0 {
+		if err := conn.WriteJSON(subscriptionMessage("subscribe", quotes, trades, bars)); err != nil {
+			return fail(fmt.Errorf("error al enviar la suscripción: %w", err))
+		}
+		if err := expectControl(conn, "subscription", ""); err != nil {
+			return fail(err)
+		}
+	}
+
+	s.setConn(conn)
+	// Close pudo llegar durante el handshake, antes de que la conexión fuera visible.
+	if s.stopped() {
+		conn.Close()
+	}
+	log.Printf("Stream conectado a %s (quotes=%v trades=%v bars=%v).", s.opt.URL, quotes, trades, bars)
+	return conn, nil
+}
+
+// expectControl lee mensajes hasta encontrar un control de tipo 'kind' (y mensaje 'msg'
+// si no está vacío). Un control "error" se devuelve como error.
+func expectControl(conn *websocket.Conn, kind, msg string) error {
+	for {
+		var batch []streamControl
+		if err := conn.ReadJSON(&batch); err != nil {
+			return fmt.Errorf("error esperando '%s %s' del stream: %w", kind, msg, err)
+		}
+		for _, c := range batch {
+			if c.T == "error" {
+				return fmt.Errorf("error del stream de Alpaca (código %d): %s", c.Code, c.Msg)
+			}
+			if c.T == kind && (msg == "" || c.Msg == msg) {
+				return nil
+			}
+		}
+	}
+}
+
+// readLoop lee mensajes hasta que la conexión falla o se cierra. Mantiene el heartbeat:
+// envía pings cada PING_INTERVAL y extiende el plazo de lectura con cada pong o mensaje.
+func (s *AlpacaStream) readLoop(conn *websocket.Conn) error {
+	deadline := 2 * s.opt.PING_INTERVAL
+	conn.SetReadDeadline(time.Now().Add(deadline))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(deadline))
+	})
+
+	pingDone := make(chan struct{})
+	defer close(pingDone)
+	go func() {
+		ticker := time.NewTicker(s.opt.PING_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pingDone:
+				return
+			case <-ticker.C:
+				s.connMu.Lock()
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(s.opt.PING_INTERVAL))
+				s.connMu.Unlock()
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(deadline))
+		if err := s.handleMessages(data); err != nil {
+			log.Printf("Mensaje del stream no válido: %v", err)
+		}
+	}
+}
+
+// handleMessages decodifica un array de mensajes del stream y acumula los datos por símbolo.
+func (s *AlpacaStream) handleMessages(data []byte) error {
+	var batch []json.RawMessage
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return err
+	}
+
+	full := false
+	for _, raw := range batch {
+		// El tipo se lee del mapa crudo para no depender del emparejamiento de campos.
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return err
+		}
+		var kind string
+		json.Unmarshal(fields["T"], &kind)
+
+		switch kind {
+		case "q":
+			var m streamQuote
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return err
+			}
+			q := QuoteRecord{AP: m.AP, AS: m.AS, AX: m.AX, BP: m.BP, BS: m.BS, BX: m.BX,
+				C: m.C, T: m.T, Z: m.Z}
+			full = s.buffer(func() { s.quotes[m.S] = append(s.quotes[m.S], q) })
+		case "t":
+			var m streamTrade
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return err
+			}
+			sym := m.streamHeader.S // oneTrade también tiene un campo S (tamaño)
+			full = s.buffer(func() { s.trades[sym] = append(s.trades[sym], TradeRecord(m.oneTrade)) })
+		case "b":
+			var m streamBar
+			if err := json.Unmarshal(raw, &m); err != nil {
+				return err
+			}
+			full = s.buffer(func() { s.bars[m.S] = append(s.bars[m.S], BarRecord(m.oneBar)) })
+		case "error":
+			var c streamControl
+			json.Unmarshal(raw, &c)
+			log.Printf("Error del stream de Alpaca (código %d): %s", c.Code, c.Msg)
+		case "subscription":
+			log.Printf("Suscripción del stream actualizada: %s", string(raw))
+		}
+	}
+
+	if full {
+		select {
+		case s.flushNow <- struct{}{}:
+		default: // Ya hay un guardado pedido
+		}
+	}
+	return nil
+}
+
+// buffer añade un mensaje a los buffers y devuelve true si se alcanzó FLUSH_SIZE.
+func (s *AlpacaStream) buffer(add func()) bool {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	add()
+	s.buffed++
+	return s.buffed >= s.opt.FLUSH_SIZE
+}
+
+// flushLoop guarda los buffers cada FLUSH_INTERVAL, o antes si lo pide `flushNow`,
+// hasta que el stream se detiene.
+func (s *AlpacaStream) flushLoop(done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(s.opt.FLUSH_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		case <-s.flushNow:
+		}
+		if err := s.flush(); err != nil {
+			log.Printf("Error al guardar el lote del stream (se reintentará): %v", err)
+		}
+	}
+}
+
+// flush guarda todo lo acumulado: entrega al escritor un lote por símbolo y tipo, que
+// se juntan en una transacción, y espera a que se confirmen todos. Los lotes que no se
+// confirman vuelven a los buffers (ver `requeue`) para el siguiente guardado.
+func (s *AlpacaStream) flush() error {
+	s.bufMu.Lock()
+	quotes, trades, bars := s.quotes, s.trades, s.bars
+	s.quotes = make(map[string][]QuoteRecord)
+	s.trades = make(map[string][]TradeRecord)
+	s.bars = make(map[string][]BarRecord)
+	s.buffed = 0
+	s.bufMu.Unlock()
+
+	var batches []IngestBatch
+	for sym, q := range quotes {
+		batches = append(batches, IngestBatch{Symbol: sym, Quotes: q, Feed: s.opt.FEED, Source: streamSource})
+	}
+	for sym, t := range trades {
+		batches = append(batches, IngestBatch{Symbol: sym, Trades: t, Feed: s.opt.FEED, Source: streamSource})
+	}
+	for sym, b := range bars {
+		batches = append(batches, IngestBatch{Symbol: sym, Bars: b, BarsBucket: streamBarsBucket, Feed: s.opt.FEED, Source: streamSource})
+	}
+
+	// Lo ya recibido se guarda siempre, también al cerrar: no se usa s.ctx.
+	ctx := context.Background()
+	pending := make([]<-chan error, len(batches))
+	var errs []error
+	var failed []IngestBatch
+	for i, batch := range batches {
+		done, err := s.opt.INGEST.Submit(ctx, batch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error al guardar el lote del stream de %s: %w", batch.Symbol, err))
+			failed = append(failed, batch)
+			continue
+		}
+		pending[i] = done
+	}
+	for i, done := range pending {
+		if done == nil {
+			continue
+		}
+		if err := <-done; err != nil {
+			errs = append(errs, fmt.Errorf("error al guardar el lote del stream de %s: %w", batches[i].Symbol, err))
+			failed = append(failed, batches[i])
+		}
+	}
+	s.requeue(failed)
+	return errors.Join(errs...)
+}
+
+// requeue devuelve a los buffers los lotes que no se pudieron guardar, delante de lo
+// recibido mientras tanto. Lo que llega por el stream no se puede volver a pedir, así
+// que se reintenta en cada guardado hasta que se confirma.
+func (s *AlpacaStream) requeue(batches []IngestBatch) {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+	for _, b := range batches {
+		switch {
+		case len(b.Quotes) > 0:
+			s.quotes[b.Symbol] = append(b.Quotes, s.quotes[b.Symbol]...)
+		case len(b.Trades) > 0:
+			s.trades[b.Symbol] = append(b.Trades, s.trades[b.Symbol]...)
+		case len(b.Bars) > 0:
+			s.bars[b.Symbol] = append(b.Bars, s.bars[b.Symbol]...)
+		}
+		s.buffed += len(b.Quotes) + len(b.Trades) + len(b.Bars)
+	}
+}
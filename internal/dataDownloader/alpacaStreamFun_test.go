@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// streamHarness es un `AlpacaStream` de QQQ conectado a `fakeAlpacaStream`, sin red,
+// que guarda en una base de datos temporal.
+type streamHarness struct {
+	fake   *fakeAlpacaStream
+	db     *db.DB
+	stream *AlpacaStream
+	runErr chan error
+}
+
+// newStreamHarness arranca el servidor falso y el cliente, y espera a la primera
+// suscripción. Las quotes y los trades van a 'partitions' si no es nil. Todo se cierra
+// al terminar el test.
+func newStreamHarness(t *testing.T, partitions *ticks.PartitionedStore) *streamHarness {
+	t.Helper()
+	h := &streamHarness{fake: newFakeAlpacaStream("test-key", "test-secret"), runErr: make(chan error, 1)}
+	t.Cleanup(h.fake.Close)
+
+	var err error
+	h.db, err = db.Open(filepath.Join(t.TempDir(), "ticks.db"), 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.db.Close() })
+	ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: h.db, PARTITIONS: partitions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ingest.Close() })
+
+	h.stream, err = NewAlpacaStream(StreamOptions{
+		URL:            h.fake.URL(),
+		FEED:           "sip",
+		KEY:            "test-key",
+		SECRET:         "test-secret",
+		QUOTES:         []string{"QQQ"},
+		TRADES:         []string{"QQQ"},
+		BARS:           []string{"QQQ"},
+		INGEST:         ingest,
+		FLUSH_INTERVAL: 50 * time.Millisecond,
+		PING_INTERVAL:  time.Second,
+		MaxRetries:     5,
+		initialBackoff: 10 * time.Millisecond,
+		maxBackoff:     100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { h.runErr <- h.stream.Run() }()
+	t.Cleanup(h.stream.Close)
+	h.waitSubscribed(t)
+	return h
+}
+
+// waitSubscribed espera a que el cliente confirme una suscripción.
+func (h *streamHarness) waitSubscribed(t *testing.T) {
+	t.Helper()
+	select {
+	case <-h.fake.Subscribed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("el cliente no se suscribió a tiempo")
+	}
+}
+
+// stop cierra el stream, deja que el escritor guarde lo recibido y comprueba que
+// `AlpacaStream.Run` termina sin error.
+func (h *streamHarness) stop(t *testing.T) {
+	t.Helper()
+	time.Sleep(200 * time.Millisecond)
+	h.stream.Close()
+	if err := <-h.runErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkCounts comprueba cuántas quotes, trades y barras de QQQ quedaron guardadas.
+func (h *streamHarness) checkCounts(t *testing.T, quotes, trades, bars int) {
+	t.Helper()
+	err := h.db.View(func(tx *db.Tx) error {
+		for _, c := range []struct {
+			path []string
+			want int
+		}{
+			{[]string{"QQQ", "AP"}, quotes},
+			{[]string{"QQQ", ticks.TradesBucket, "P"}, trades},
+			{[]string{"QQQ", streamBarsBucket, "C"}, bars},
+		} {
+			if got := countBucketKeys(tx, c.path...); got != c.want {
+				t.Errorf("%v: %d claves, se esperaban %d", c.path, got, c.want)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// quoteMessage y tradeMessage son mensajes de QQQ como los publica Alpaca.
+func quoteMessage(ts string) map[string]interface{} {
+	return map[string]interface{}{"T": "q", "S": "QQQ", "ap": 110.87, "as": 6, "ax": "T",
+		"bp": 109.3, "bs": 30, "bx": "T", "c": []string{"R"}, "t": ts, "z": "C"}
+}
+
+func tradeMessage(ts string, id int) map[string]interface{} {
+	return map[string]interface{}{"T": "t", "S": "QQQ", "p": 110.85, "s": 100, "x": "V",
+		"i": id, "c": []string{"@"}, "t": ts, "z": "C"}
+}
+
+// TestAlpacaStream ejercita el cliente de streaming de punta a punta contra
+// `fakeAlpacaStream`: conexión, autenticación, suscripción, recepción, reconexión
+// tras una caída y guardado.
+func TestAlpacaStream(t *testing.T) {
+	t.Run("receive", func(t *testing.T) {
+		h := newStreamHarness(t, nil)
+		h.fake.Publish(
+			quoteMessage("2016-01-04T09:00:00.015Z"),
+			tradeMessage("2016-01-04T09:00:00.020Z", 1),
+			map[string]interface{}{"T": "b", "S": "QQQ", "o": 110.0, "h": 111.0, "l": 109.5, "c": 110.5,
+				"v": 1200, "n": 12, "vw": 110.4, "t": "2016-01-04T09:00:00Z"},
+		)
+		h.stop(t)
+		h.checkCounts(t, 1, 1, 1)
+	})
+
+	// Tras la caída de la conexión el cliente reconecta y se vuelve a suscribir solo.
+	t.Run("reconnect", func(t *testing.T) {
+		h := newStreamHarness(t, nil)
+		h.fake.Publish(quoteMessage("2016-01-04T09:00:00.015Z"), tradeMessage("2016-01-04T09:00:00.020Z", 1))
+		time.Sleep(200 * time.Millisecond)
+		h.fake.DropConnections()
+		h.waitSubscribed(t)
+		h.fake.Publish(quoteMessage("2016-01-04T09:00:00.021Z"), tradeMessage("2016-01-04T09:00:00.030Z", 2))
+		h.stop(t)
+		if n := h.fake.Accepts(); n < 2 {
+			t.Errorf("se esperaba una reconexión; conexiones autenticadas: %d", n)
+		}
+		h.checkCounts(t, 2, 2, 0)
+	})
+
+	// Mientras la partición de QQQ no se puede crear, los guardados fallan y lo
+	// recibido vuelve a los buffers; al arreglarse se guarda una sola vez.
+	t.Run("requeue", func(t *testing.T) {
+		root := t.TempDir()
+		partitions, err := ticks.OpenPartitionedStore(ticks.PartitionOptions{ROOT: root, PERIOD: ticks.PeriodDay, MAX_OPEN: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { partitions.Close() })
+		blocker := filepath.Join(root, "QQQ") // Un archivo donde va el directorio de QQQ
+		if err := os.WriteFile(blocker, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		h := newStreamHarness(t, partitions)
+		h.fake.Publish(quoteMessage("2016-01-04T09:00:00.015Z"), tradeMessage("2016-01-04T09:00:00.020Z", 1))
+		time.Sleep(200 * time.Millisecond) // Varios FLUSH_INTERVAL fallidos
+		if stats, err := partitions.Stats(); err != nil || stats.Quotes != 0 {
+			t.Fatalf("Stats: %+v, %v; no se esperaba nada guardado", stats, err)
+		}
+		if err := os.Remove(blocker); err != nil {
+			t.Fatal(err)
+		}
+		h.stop(t)
+		if stats, err := partitions.Stats(); err != nil || stats.Quotes != 1 || stats.Trades != 1 {
+			t.Fatalf("Stats: %+v, %v; se esperaban 1 quote y 1 trade", stats, err)
+		}
+	})
+}
+
+// TestAlpacaStreamFlushSize comprueba que al llegar a FLUSH_SIZE la lectura no guarda
+// ella misma (esperaría al escritor sin leer los pongs): se lo pide a `flushLoop`.
+func TestAlpacaStreamFlushSize(t *testing.T) {
+	dbInstance, err := db.Open(filepath.Join(t.TempDir(), "ticks.db"), 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: dbInstance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest.Close() // Un guardado en la lectura fallaría con ErrIngestClosed
+	stream, err := NewAlpacaStream(StreamOptions{URL: "ws://localhost", INGEST: ingest, FLUSH_SIZE: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, ts := range []string{"2016-01-04T09:00:00.015Z", "2016-01-04T09:00:00.016Z"} {
+		raw, err := json.Marshal([]map[string]interface{}{quoteMessage(ts)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.handleMessages(raw); err != nil {
+			t.Fatalf("mensaje %d: %v", i+1, err)
+		}
+		select {
+		case <-stream.flushNow:
+			if i == 0 {
+				t.Fatal("guardado pedido antes de llegar a FLUSH_SIZE")
+			}
+		default:
+			if i == 1 {
+				t.Fatal("no se pidió el guardado al llegar a FLUSH_SIZE")
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// barFieldBuckets son los sub-buckets de columnas de barras. No se incluye 'T'
+// porque es la clave.
+var barFieldBuckets = []string{"O", "H", "L", "C", "V", "N", "VW"}
+
+// barsBucketName devuelve el sub-bucket, dentro del bucket del símbolo, que agrupa
+// las barras de un timeframe y ajuste (ej. "BARS_1Min_raw"). Cada combinación va en
+// su propio bucket porque sus claves (timestamps) se solapan.
+func barsBucketName(timeframe, adjustment string) string {
+	if adjustment == "" {
+		adjustment = "raw"
+	}
+	return "BARS_" + timeframe + "_" + adjustment
+}
+
+// putBarsTx guarda 'bars' dentro de la transacción de escritura 'tx', bajo
+// `<symbol>/<bucketName>/<campo>`, usando el timestamp de la barra como clave
+// binaria (Unix Nano, big-endian de 8 bytes). A diferencia de quotes y trades no lleva
+// secuencia (ver `ticks.Key`): hay una barra por timestamp y volver a descargarla la reemplaza.
+// Devuelve cuántas barras son nuevas (Written) y cuántas reemplazan a una ya guardada
+// (Existing), y el rango de timestamps del lote, para su checkpoint y los metadatos del
+// símbolo (ver `IngestWriter`).
+func putBarsTx(tx *db.Tx, symbol, bucketName string, bars []BarRecord) (ticks.WriteResult, error) {
+	var res ticks.WriteResult
+	symbolBucket, err := tx.CreateBucketIfNotExists([]byte(symbol))
+	if err != nil {
+		return res, fmt.Errorf("failed to create symbol bucket '%s': %w", symbol, err)
+	}
+	barsBucket, err := symbolBucket.CreateBucketIfNotExists([]byte(bucketName))
+	if err != nil {
+		return res, fmt.Errorf("failed to create bars bucket '%s' for symbol '%s': %w", bucketName, symbol, err)
+	}
+
+	subBuckets := make(map[string]*db.Bucket)
+	for _, field := range barFieldBuckets {
+		subB, err := barsBucket.CreateBucketIfNotExists([]byte(field))
+		if err != nil {
+			return res, fmt.Errorf("failed to create bar sub-bucket '%s' for symbol '%s': %w", field, symbol, err)
+		}
+		subBuckets[field] = subB
+	}
+
+	for _, b := range bars {
+		t, err := time.Parse(time.RFC3339Nano, b.T)
+		if err != nil {
+			log.Printf("Warning: Error parsing bar timestamp '%s': %v. Skipping this bar.", b.T, err)
+			res.Skipped++
+			continue
+		}
+		if res.First.IsZero() || t.Before(res.First) {
+			res.First = t
+		}
+		if t.After(res.Last) {
+			res.Last = t
+		}
+
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+		if subBuckets["C"].Get(key) == nil {
+			res.Written++
+		} else {
+			res.Existing++
+		}
+
+		values := map[string][]byte{
+			"O":  []byte(strconv.FormatFloat(b.O, 'f', -1, 64)),
+			"H":  []byte(strconv.FormatFloat(b.H, 'f', -1, 64)),
+			"L":  []byte(strconv.FormatFloat(b.L, 'f', -1, 64)),
+			"C":  []byte(strconv.FormatFloat(b.C, 'f', -1, 64)),
+			"V":  []byte(strconv.FormatInt(b.V, 10)),
+			"N":  []byte(strconv.FormatInt(b.N, 10)),
+			"VW": []byte(strconv.FormatFloat(b.VW, 'f', -1, 64)),
+		}
+		for _, field := range barFieldBuckets {
+			if err := subBuckets[field].Put(key, values[field]); err != nil {
+				return res, fmt.Errorf("failed to put bar %s for %s: %w", field, b.T, err)
+			}
+		}
+	}
+	return res, nil
+}
@@ -1,31 +1,14 @@
 package main
 
 import (
-	"encoding/binary"
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
-	"strconv"
-	"sync"
 	"time"
 
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
 	db "go.etcd.io/bbolt"
 )
 
-// declaring a struct
-type oneQuote struct {
-	// defining struct variables
-	AP float64 `json:"ap"` // Ask Price (Precio de Venta).
-	AS int     `json:"as"` // Ask Size (Tamaño de Venta).
-	AX string  `json:"ax"` // Ask Exchange (Bolsa de Venta).
-	BP float64 `json:"bp"` // Bid Price (Precio de Compra).
-	BS int     `json:"bs"` // Bid Size (Tamaño de Compra).
-	BX string  `json:"bx"` // Bid Exchange (Bolsa de Compra).
-	C  string  `json:"c"`  // Conditions (Condiciones de la Operación).
-	T  string  `json:"t"`  // Timestamp (Marca de Tiempo).
-	Z  string  `json:"z"`  // Tape (Cinta).
-}
-
 /*
 //
 //
@@ -51,7 +34,7 @@ type BkOptions struct {
 	// representado como uSna cadena.
 	BUCKET_NAME string
 	//
-	ALPACA_QUOTE_BUCKET_SLOTS oneQuote
+	QUOTE_BUCKET_SLOTS QuoteRecord
 }
 
 // initBucket obtiene o crea un bucket dentro de una base de datos bbolt.
@@ -123,6 +106,7 @@ func InitBucket(opt BkOptions) (*db.Bucket, error) {
 // picos de carga en el sistema de almacenamiento, o problemas de concurrencia al inicio.
 //
 // Parámetros:
+//   - ctx: Contexto de cancelación de los reintentos.
 //   - cfg: Una estructura 'bkOptions' que debe contener la instancia de la base de datos
 //     bbolt ('dbInstance *bolt.DB') y el nombre del bucket deseado ('bucketName string').
 //
@@ -136,10 +120,11 @@ func InitBucket(opt BkOptions) (*db.Bucket, error) {
 //   - Máximo de n reintentos.
 //   - Retraso inicial (backoff) de n milisegundos.
 //   - Retraso máximo (maxBackoff) de n segundos.
-func InitBucketWithRetries(cfg BkOptions) (*db.Bucket, error) {
+func InitBucketWithRetries(ctx context.Context, cfg BkOptions) (*db.Bucket, error) {
 	// Llama a executeActionWithRetries para orquestar los reintentos.
 	// La función de acción anónima intenta inicializar el bucket usando initBucket.
 	rawResponse, err := executeActionWithRetries(
+		ctx,
 		func(attempt int) (interface{}, error) {
 			// Intenta obtener o crear el bucket utilizando la instancia de DB y el nombre del bucket
 			// proporcionados en la configuración 'cfg'.
@@ -180,174 +165,16 @@ func InitBucketWithRetries(cfg BkOptions) (*db.Bucket, error) {
 	return bkInstance, nil
 }
 
-// SaveQuotesConcurrently procesa y guarda un slice de Quotes en la DB de forma concurrente.
-// Utiliza un pool de workers para limitar la concurrencia y procesar en lotes.
-func SaveQuotesConcurrently(
-	dbInstance *db.DB,
-	symbol string,
-	quotes []oneQuote, // Asumo que Quote es el tipo de cada elemento en thisQuote.Quotes
-	batchSize int, // Número de quotes a procesar en cada lote/transacción
-	numWorkers int, // Número de goroutines concurrentes
-) error {
-	if dbInstance == nil {
-		return fmt.Errorf("instancia de base de datos nula")
-	}
-	if len(quotes) == 0 {
-		log.Println("No quotes to save.")
-		return nil
-	}
-
-	// Channel para enviar quotes a los workers
-	quotesChan := make(chan oneQuote, numWorkers*2) // Un poco de buffer
-	// WaitGroup para esperar a que todos los workers terminen
-	var wg sync.WaitGroup
-	// Channel para recoger errores de los workers
-	errChan := make(chan error, numWorkers)
-
-	// Nombres de los sub-buckets para cada campo
-	// Deberías usar constantes aquí, por ejemplo:
-	// const (
-	//     AP_BUCKET = "AP"
-	//     AS_BUCKET = "AS"
-	//     // ... etc
-	// )
-	fieldBuckets := []string{"AP", "AS", "AX", "BP", "BS", "BX", "C", "Z"} // No incluyes 'T' porque es la clave
-
-	// Lanzar workers
-	for i := 0; i < numWorkers; i++ {
-		wg.Add(1)
-		go func(workerID int) {
-			defer wg.Done()
-			localBatch := make([]oneQuote, 0, batchSize) // Buffer local para acumular quotes por worker
-
-			for quote := range quotesChan {
-				localBatch = append(localBatch, quote)
-				if len(localBatch) >= batchSize {
-					if err := processAndSaveBatch(dbInstance, symbol, localBatch, fieldBuckets); err != nil {
-						errChan <- fmt.Errorf("worker %d failed to save batch: %w", workerID, err)
-						return // Sale del worker si hay un error fatal
-					}
-					localBatch = make([]oneQuote, 0, batchSize) // Reinicia el lote
-				}
-			}
-			// Guardar cualquier quote restante en el lote final del worker
-			if len(localBatch) > 0 {
-				if err := processAndSaveBatch(dbInstance, symbol, localBatch, fieldBuckets); err != nil {
-					errChan <- fmt.Errorf("worker %d failed to save final batch: %w", workerID, err)
-				}
-			}
-		}(i)
-	}
-
-	// Enviar todas las quotes al channel de entrada
-	for _, q := range quotes {
-		quotesChan <- q
+// openTickPartitions abre el almacén particionado de 'cfg', o devuelve nil si no hay
+// `PartitionDir` configurado.
+func openTickPartitions(cfg AppConfig) (*ticks.PartitionedStore, error) {
+	if cfg.PartitionDir == "" {
+		return nil, nil
 	}
-	close(quotesChan) // Cierra el channel de jobs para indicar que no hay más trabajos
-
-	// Esperar a que todos los workers terminen
-	wg.Wait()
-	close(errChan) // Cierra el channel de errores después de que todos los workers hayan terminado
-
-	// Comprobar si hubo errores
-	for err := range errChan {
-		return fmt.Errorf("uno o más workers fallaron: %w", err)
-	}
-
-	return nil
-}
-
-// processAndSaveBatch procesa un lote de quotes y las guarda en bbolt en una única transacción.
-// Utiliza el timestamp de la quote como clave binaria (Unix Nano).
-func processAndSaveBatch(dbInstance *db.DB, symbol string, quotes []oneQuote, fieldBuckets []string) error {
-	return dbInstance.Update(func(tx *db.Tx) error {
-		// Obtener o crear el bucket principal del símbolo
-		symbolBucket, err := tx.CreateBucketIfNotExists([]byte(symbol))
-		if err != nil {
-			return fmt.Errorf("failed to create symbol bucket '%s': %w", symbol, err)
-		}
-
-		// Crear/obtener sub-buckets para cada campo si no existen
-		subBuckets := make(map[string]*db.Bucket)
-		for _, field := range fieldBuckets {
-			subB, err := symbolBucket.CreateBucketIfNotExists([]byte(field))
-			if err != nil {
-				return fmt.Errorf("failed to create sub-bucket '%s' for symbol '%s': %w", field, symbol, err)
-			}
-			subBuckets[field] = subB
-		}
-
-		// Iterar sobre cada quote en el lote
-		for _, q := range quotes {
-			// --- INICIO: Procesamiento del Timestamp a Unix Nano Key ---
-			timestampStr := q.T // Asumo que q.T es un string (e.g., "2023-10-27T09:30:00.123456789Z")
-
-			// Parsear el timestamp string a time.Time
-			t, err := time.Parse(time.RFC3339Nano, timestampStr)
-			if err != nil {
-				// Es crucial manejar este error. Puedes loggearlo y saltar la quote
-				// o retornar el error para abortar el lote. Depende de tu política de errores.
-				log.Printf("Warning: Error parsing timestamp '%s': %v. Skipping this quote.", timestampStr, err)
-				continue // Saltar esta quote si el timestamp no es válido
-			}
-
-			// Convertir time.Time a Unix Nanoseconds (int64)
-			unixNano := t.UnixNano()
-
-			// Convertir el int64 Unix Nano a un []byte de 8 bytes (Big Endian)
-			// Esto asegura que la clave sea de tamaño fijo y se ordene correctamente.
-			key := make([]byte, 8)
-			binary.BigEndian.PutUint64(key, uint64(unixNano)) // Siempre cast a uint64 para PutUint64
-			// --- FIN: Procesamiento del Timestamp a Unix Nano Key ---
-
-			// Ahora, guarda cada campo en su sub-bucket correspondiente usando 'key'
-			// Asegúrate de que los valores sean convertidos a []byte.
-			// Para números, usa strconv para evitar la asignación de memoria extra de fmt.Sprintf.
-
-			// Ask Price (AP)
-			apBytes := strconv.FormatFloat(q.AP, 'f', -1, 64) // 'f' formato, -1 para menor precisión, 64 bits
-			if err := subBuckets["AP"].Put(key, []byte(apBytes)); err != nil {
-				return fmt.Errorf("failed to put AP for %s: %w", string(key), err)
-			}
-
-			// Ask Size (AS)
-			asBytes := strconv.Itoa(q.AS)
-			if err := subBuckets["AS"].Put(key, []byte(asBytes)); err != nil {
-				return fmt.Errorf("failed to put AS for %s: %w", string(key), err)
-			}
-
-			// Ask Exchange (AX)
-			if err := subBuckets["AX"].Put(key, []byte(q.AX)); err != nil {
-				return fmt.Errorf("failed to put AX for %s: %w", string(key), err)
-			}
-
-			// Repite para BP, BS, BX
-			bpBytes := strconv.FormatFloat(q.BP, 'f', -1, 64)
-			if err := subBuckets["BP"].Put(key, []byte(bpBytes)); err != nil {
-				return fmt.Errorf("failed to put BP for %s: %w", string(key), err)
-			}
-			bsBytes := strconv.Itoa(q.BS)
-			if err := subBuckets["BS"].Put(key, []byte(bsBytes)); err != nil {
-				return fmt.Errorf("failed to put BS for %s: %w", string(key), err)
-			}
-			if err := subBuckets["BX"].Put(key, []byte(q.BX)); err != nil {
-				return fmt.Errorf("failed to put BX for %s: %w", string(key), err)
-			}
-
-			// Para Conditions (C) - slice de strings, serializar a JSON
-			cBytes, err := json.Marshal(q.C)
-			if err != nil {
-				return fmt.Errorf("failed to marshal conditions for %s: %w", string(key), err)
-			}
-			if err := subBuckets["C"].Put(key, cBytes); err != nil {
-				return fmt.Errorf("failed to put C for %s: %w", string(key), err)
-			}
-
-			// Para Tape (Z)
-			if err := subBuckets["Z"].Put(key, []byte(q.Z)); err != nil {
-				return fmt.Errorf("failed to put Z for %s: %w", string(key), err)
-			}
-		}
-		return nil // Transacción exitosa para este lote
+	return ticks.OpenPartitionedStore(ticks.PartitionOptions{
+		ROOT:     cfg.PartitionDir,
+		PERIOD:   cfg.PartitionPeriod,
+		MAX_OPEN: cfg.PartitionMaxOpen,
+		LAYOUT:   cfg.QuoteLayout,
 	})
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+// checkpointBucketName es el bucket raíz donde se guardan los checkpoints de descarga.
+// Empieza con '_' para que nunca choque con el bucket de un ticker.
+const checkpointBucketName = "_checkpoints"
+
+// DownloadCheckpoint registra hasta dónde llegó la descarga de un símbolo, feed y dataset.
+//
+// Se actualiza dentro de la misma transacción que guarda cada lote de quotes
+// (ver `IngestWriter`), por lo que nunca apunta más allá de lo que está
+// realmente escrito en la base de datos.
+//
+// En las descargas multi-símbolo cada símbolo del grupo tiene su propio checkpoint, y
+// Group dice a qué grupo pertenece el PageToken: así cambiar el universo (o el tamaño
+// de los grupos) no hace perder lo ya descargado de cada símbolo. Los checkpoints de
+// versiones anteriores, con la clave del grupo entero ("AAPL,MSFT,..."), se ignoran:
+// esos símbolos se vuelven a descargar una vez, lo que es inocuo porque las claves
+// son idempotentes.
+type DownloadCheckpoint struct {
+	Symbol        string    `json:"symbol"`          // Ticker
+	Group         string    `json:"group,omitempty"` // Símbolos del grupo con el que se pidió PageToken (ver `symbolKey`)
+	Feed          string    `json:"feed"`            // Fuente de datos ("sip", "iex", ...)
+	Kind          string    `json:"kind"`            // Dataset descargado (datasetQuotes, datasetTrades, ...)
+	Source        string    `json:"source"`          // Proveedor que generó PageToken (ver `MarketDataProvider.Name`)
+	Start         string    `json:"start"`           // Fecha inicial con la que se pidió la descarga
+	Since         string    `json:"since,omitempty"` // Desde cuándo está descargado sin huecos hasta LastTimestamp (ver `resumeSince`)
+	End           string    `json:"end"`             // Fecha final con la que se pidió la descarga
+	PageToken     string    `json:"page_token"`      // Token con el que se pidió la última página guardada
+	LastTimestamp time.Time `json:"last_timestamp"`  // Timestamp más reciente ya guardado
+	Complete      bool      `json:"complete"`        // true si la descarga llegó a la última página
+	UpdatedAt     time.Time `json:"updated_at"`      // Momento de la última actualización
+}
+
+// checkpointKey devuelve la clave del checkpoint de un símbolo, feed y dataset (ej. "QQQ/sip/quotes").
+func checkpointKey(symbol, feed, kind string) []byte {
+	return []byte(symbol + "/" + feed + "/" + kind)
+}
+
+// getCheckpointTx lee el checkpoint de un símbolo, feed y dataset dentro de una transacción abierta.
+// Devuelve nil (sin error) si todavía no existe.
+func getCheckpointTx(tx *db.Tx, symbol, feed, kind string) (*DownloadCheckpoint, error) {
+	bucket := tx.Bucket([]byte(checkpointBucketName))
+	if bucket == nil {
+		return nil, nil
+	}
+	raw := bucket.Get(checkpointKey(symbol, feed, kind))
+	if raw == nil {
+		return nil, nil
+	}
+	var cp DownloadCheckpoint
+	if err := json.Unmarshal(raw, &cp); err != nil {
+		return nil, fmt.Errorf("checkpoint corrupto para %s/%s/%s: %w", symbol, feed, kind, err)
+	}
+	return &cp, nil
+}
+
+// putCheckpointTx escribe el checkpoint dentro de una transacción de escritura abierta.
+func putCheckpointTx(tx *db.Tx, cp DownloadCheckpoint) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(checkpointBucketName))
+	if err != nil {
+		return fmt.Errorf("failed to create checkpoint bucket: %w", err)
+	}
+	cp.UpdatedAt = time.Now().UTC()
+	raw, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint for %s/%s/%s: %w", cp.Symbol, cp.Feed, cp.Kind, err)
+	}
+	return bucket.Put(checkpointKey(cp.Symbol, cp.Feed, cp.Kind), raw)
+}
+
+// advanceCheckpointTx actualiza el checkpoint tras guardar un lote cuyo timestamp
+// más reciente es 'batchLast'. Si un lote falla, `IngestWriter` reintenta los demás de
+// su transacción por separado, así que LastTimestamp solo avanza. Solo retrocede si la
+// descarga empezó antes que la que dejó el checkpoint anterior (ver `resumeSince`): lo
+// que este guardaba ya no está unido sin huecos a lo nuevo.
+func advanceCheckpointTx(tx *db.Tx, cp DownloadCheckpoint, batchLast time.Time) error {
+	prev, err := getCheckpointTx(tx, cp.Symbol, cp.Feed, cp.Kind)
+	if err != nil {
+		return err
+	}
+	cp.LastTimestamp = batchLast
+	if prev != nil && prev.since() == cp.Since && prev.LastTimestamp.After(batchLast) {
+		cp.LastTimestamp = prev.LastTimestamp
+	}
+	return putCheckpointTx(tx, cp)
+}
+
+// checkpointKind devuelve el dataset con el que se indexa el checkpoint de una descarga.
+// Las barras llevan además timeframe y ajuste (ej. "bars_1Min_raw") porque cada
+// combinación se descarga y se guarda por separado.
+func checkpointKind(dataset string, req FetchRequest) string {
+	if dataset != datasetBars {
+		return dataset
+	}
+	adjustment := req.Adjustment
+	if adjustment == "" {
+		adjustment = "raw"
+	}
+	return dataset + "_" + req.Timeframe + "_" + adjustment
+}
+
+// LoadCheckpoint lee el checkpoint de un símbolo, feed y dataset. Devuelve nil si no existe.
+func LoadCheckpoint(dbInstance *db.DB, symbol, feed, kind string) (*DownloadCheckpoint, error) {
+	var cp *DownloadCheckpoint
+	err := dbInstance.View(func(tx *db.Tx) error {
+		var txErr error
+		cp, txErr = getCheckpointTx(tx, symbol, feed, kind)
+		return txErr
+	})
+	return cp, err
+}
+
+// since devuelve desde cuándo tiene 'cp' los datos sin huecos. Los checkpoints de
+// versiones anteriores no guardan Since: se usa Start, que es igual o posterior.
+func (cp *DownloadCheckpoint) since() string {
+	if cp.Since != "" {
+		return cp.Since
+	}
+	return cp.Start
+}
+
+// startsBefore dice si 'req' pide datos anteriores a los que cubre 'cp'. Una fecha
+// inicial vacía es el principio del histórico.
+func startsBefore(req FetchRequest, cp *DownloadCheckpoint) bool {
+	since := cp.since()
+	if since == "" {
+		return false
+	}
+	if req.Start == "" {
+		return true
+	}
+	start, err := time.Parse(time.RFC3339Nano, req.Start)
+	sinceTime, sinceErr := time.Parse(time.RFC3339Nano, since)
+	return err == nil && sinceErr == nil && start.Before(sinceTime)
+}
+
+// resumeSince devuelve el Since del checkpoint de un símbolo en una descarga de 'req':
+// el de 'cp' si la descarga continúa lo que este cubre, o 'req.Start' si no hay
+// checkpoint o 'req' pide datos anteriores (ver `resumeStart`).
+func resumeSince(req FetchRequest, cp *DownloadCheckpoint) string {
+	if cp == nil || startsBefore(req, cp) {
+		return req.Start
+	}
+	return cp.since()
+}
+
+// resumeStart decide desde dónde hacen falta los datos de un símbolo a partir de su
+// checkpoint.
+//
+//   - Sin checkpoint, o si 'req.Start' es anterior a lo que cubre el checkpoint (ej.
+//     una ejecución anterior con una fecha inicial más tardía): desde 'req.Start'. Lo
+//     que ya estaba guardado se vuelve a pedir, lo que es inocuo porque las claves son
+//     idempotentes.
+//   - Descarga interrumpida: desde su último timestamp guardado, incluido (puede haber
+//     más ticks con ese mismo timestamp en la página siguiente), o desde el inicio de
+//     aquella ejecución si no llegó a guardar nada.
+//   - Descarga completa: desde el nanosegundo siguiente al último timestamp
+//     confirmado, si es posterior a 'req.Start'.
+//
+// Devuelve el tiempo cero si hay que empezar desde el principio del histórico.
+func resumeStart(req FetchRequest, cp *DownloadCheckpoint) time.Time {
+	start, _ := time.Parse(time.RFC3339Nano, req.Start)
+	switch {
+	case cp == nil || startsBefore(req, cp):
+		return start
+	case !cp.Complete && !cp.LastTimestamp.IsZero():
+		return cp.LastTimestamp
+	case !cp.Complete:
+		if cpStart, err := time.Parse(time.RFC3339Nano, cp.Start); err == nil {
+			return cpStart
+		}
+		return start
+	case !cp.LastTimestamp.IsZero():
+		if next := cp.LastTimestamp.Add(time.Nanosecond); next.After(start) {
+			return next
+		}
+	}
+	return start
+}
+
+// resumePoint decide desde dónde continuar la descarga del grupo 'group' a partir de
+// los checkpoints de sus símbolos ('cps', por símbolo; nil si no tiene).
+//
+//   - Si la última ejecución de este mismo grupo se interrumpió, se repite la última
+//     página guardada con su token (re-escribir esas claves es inocuo porque son
+//     idempotentes) dentro del rango de aquella ejecución. Si cambió la fecha final, si
+//     el token lo generó otro proveedor, o si algún símbolo necesita datos anteriores
+//     al inicio de aquella ejecución, el token ya no es válido.
+//   - Si no, se pide desde la posición más temprana de sus símbolos (ver `resumeStart`).
+//
+// Devuelve la petición ajustada, el token de página con el que empezar y la posición
+// de cada símbolo: lo anterior a ella ya está guardado y se descarta al recibirlo.
+func resumePoint(source, group string, req FetchRequest, cps map[string]*DownloadCheckpoint) (FetchRequest, string, map[string]time.Time) {
+	from := make(map[string]time.Time, len(cps))
+	var earliest time.Time
+	var token *DownloadCheckpoint
+	for i, symbol := range req.Symbols {
+		cp := cps[symbol]
+		from[symbol] = resumeStart(req, cp)
+		if i == 0 || from[symbol].Before(earliest) {
+			earliest = from[symbol]
+		}
+		if cp != nil && !cp.Complete && cp.Group == group && cp.PageToken != "" && cp.End == req.End && cp.Source == source &&
+			(token == nil || cp.UpdatedAt.After(token.UpdatedAt)) {
+			token = cp
+		}
+	}
+	if token != nil {
+		if tokenStart, _ := time.Parse(time.RFC3339Nano, token.Start); earliest.Before(tokenStart) {
+			token = nil // Hay que empezar antes que aquella ejecución
+		}
+	}
+	if token != nil {
+		log.Printf("Reanudando %s/%s/%s desde el token de página guardado (último timestamp %s).",
+			group, token.Feed, token.Kind, token.LastTimestamp.Format(time.RFC3339Nano))
+		req.Start = token.Start
+		return req, token.PageToken, from
+	}
+	if !earliest.IsZero() && earliest.Format(time.RFC3339Nano) != req.Start {
+		req.Start = earliest.Format(time.RFC3339Nano)
+		log.Printf("Reanudando %s desde %s.", group, req.Start)
+	}
+	return req, "", from
+}
+
+// skipBefore descarta los registros de 'records' anteriores a 'from', que ya están
+// guardados. 'timestamp' devuelve el timestamp RFC 3339 de cada registro; los que no
+// se pueden leer se dejan para que los rechace la validación.
+func skipBefore[R any](records []R, from time.Time, timestamp func(R) string) []R {
+	if from.IsZero() {
+		return records
+	}
+	kept := records[:0:0]
+	for _, r := range records {
+		if t, err := time.Parse(time.RFC3339Nano, timestamp(r)); err != nil || !t.Before(from) {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// downloadResumable descarga de 'provider' y guarda el dataset 'dataset' de los
+// símbolos de 'req', retomando automáticamente desde los checkpoints de cada símbolo
+// guardados en 'dbInstance' (ver `resumePoint`).
+//
+// Cada página se entrega a 'ingest' (ver `IngestWriter`) y el checkpoint de su símbolo
+// avanza en la misma transacción que sus ticks. La página no se espera: mientras se
+// guarda se descarga la siguiente, y antes de entregar esa se espera a que la anterior
+// esté confirmada. Así hay como mucho una página en vuelo por descarga y se confirman
+// en orden, de modo que ningún checkpoint salta una página sin guardar.
+// Al llegar a la última página los checkpoints de todos los símbolos se marcan como
+// completos, de modo que la siguiente ejecución solo pide lo nuevo.
+//
+// Si 'ctx' se cancela, la descarga se detiene tras confirmar la página en vuelo y los
+// checkpoints quedan incompletos, listos para reanudar.
+//
+// Devuelve el número de registros guardados en esta ejecución.
+func downloadResumable(ctx context.Context, dbInstance *db.DB, ingest *IngestWriter, provider MarketDataProvider, dataset string, req FetchRequest) (int, error) {
+	kind := checkpointKind(dataset, req)
+	group := symbolKey(req.Symbols)
+	cps := make(map[string]*DownloadCheckpoint, len(req.Symbols))
+	err := dbInstance.View(func(tx *db.Tx) error {
+		for _, symbol := range req.Symbols {
+			cp, err := getCheckpointTx(tx, symbol, req.Feed, kind)
+			if err != nil {
+				return err
+			}
+			cps[symbol] = cp
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	since := make(map[string]string, len(req.Symbols))
+	for _, symbol := range req.Symbols {
+		since[symbol] = resumeSince(req, cps[symbol])
+	}
+	req, pageToken, from := resumePoint(provider.Name(), group, req, cps)
+
+	// pageCheckpoint construye el checkpoint que acompaña a los lotes de una página.
+	pageCheckpoint := func(symbol, pageToken string) *DownloadCheckpoint {
+		return &DownloadCheckpoint{
+			Symbol:    symbol,
+			Group:     group,
+			Feed:      req.Feed,
+			Kind:      kind,
+			Source:    provider.Name(),
+			Start:     req.Start,
+			Since:     since[symbol],
+			End:       req.End,
+			PageToken: pageToken,
+		}
+	}
+
+	// inFlight es el resultado pendiente de la última página entregada.
+	var inFlight <-chan error
+	wait := func() error {
+		if inFlight == nil {
+			return nil
+		}
+		err := <-inFlight
+		inFlight = nil
+		return err
+	}
+	var total int
+	submit := func(batch IngestBatch, n int) error {
+		if err := wait(); err != nil {
+			return err
+		}
+		if n == 0 {
+			return nil
+		}
+		done, err := ingest.Submit(ctx, batch)
+		if err != nil {
+			return err
+		}
+		inFlight = done
+		total += n
+		return nil
+	}
+
+	switch dataset {
+	case datasetQuotes:
+		_, err = provider.FetchQuotes(ctx, req, pageToken, func(symbol string, quotes []QuoteRecord, pageToken string) error {
+			quotes = skipBefore(quotes, from[symbol], func(q QuoteRecord) string { return q.T })
+			log.Printf("Entregando %d quotes de %s al escritor...", len(quotes), symbol)
+			return submit(IngestBatch{Symbol: symbol, Quotes: quotes, Checkpoint: pageCheckpoint(symbol, pageToken)}, len(quotes))
+		})
+	case datasetTrades:
+		_, err = provider.FetchTrades(ctx, req, pageToken, func(symbol string, trades []TradeRecord, pageToken string) error {
+			trades = skipBefore(trades, from[symbol], func(t TradeRecord) string { return t.T })
+			log.Printf("Entregando %d trades de %s al escritor...", len(trades), symbol)
+			return submit(IngestBatch{Symbol: symbol, Trades: trades, Checkpoint: pageCheckpoint(symbol, pageToken)}, len(trades))
+		})
+	case datasetBars:
+		bucketName := barsBucketName(req.Timeframe, req.Adjustment)
+		_, err = provider.FetchBars(ctx, req, pageToken, func(symbol string, bars []BarRecord, pageToken string) error {
+			bars = skipBefore(bars, from[symbol], func(b BarRecord) string { return b.T })
+			log.Printf("Entregando %d barras %s de %s al escritor...", len(bars), req.Timeframe, symbol)
+			return submit(IngestBatch{Symbol: symbol, Bars: bars, BarsBucket: bucketName, Checkpoint: pageCheckpoint(symbol, pageToken)}, len(bars))
+		})
+	default:
+		return 0, fmt.Errorf("dataset no soportado: '%s'", dataset)
+	}
+	// La última página entregada se espera siempre, también si la descarga falló.
+	if waitErr := wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return total, err
+	}
+
+	// Descarga terminada: se marcan como completos los checkpoints de todo el grupo.
+	err = dbInstance.Update(func(tx *db.Tx) error {
+		for _, symbol := range req.Symbols {
+			last, txErr := getCheckpointTx(tx, symbol, req.Feed, kind)
+			if txErr != nil {
+				return txErr
+			}
+			done := *pageCheckpoint(symbol, "")
+			done.Complete = true
+			if last != nil && last.since() == done.Since {
+				done.LastTimestamp = last.LastTimestamp
+			}
+			if txErr := putCheckpointTx(tx, done); txErr != nil {
+				return txErr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return total, fmt.Errorf("error al cerrar los checkpoints de %s/%s/%s: %w", group, req.Feed, kind, err)
+	}
+	return total, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+)
+
+// runFsck verifica con `ticks.CheckFile` que cada clave de quotes y trades esté en
+// todas sus columnas y se pueda decodificar, y que los metadatos de cada símbolo
+// coincidan con sus ticks, en la base de datos y, con -partition-dir, en cada archivo
+// de partición. Muestra los grupos con problemas y algunos ejemplos de cada uno.
+// Sin -repair no escribe nada y termina con error si encuentra algo; con -repair
+// borra las filas afectadas de todas sus columnas y rehace los metadatos.
+//
+// Uso: dataDownloader fsck [-db db/ticks.db] [-partition-dir dir] [-symbols QQQ,SPY] [-issues 5] [-repair]
+func runFsck(args []string) error {
+	fs := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	path := fs.String("db", defaultConfig().DBPath, "archivo bbolt a verificar")
+	partitionDir := fs.String("partition-dir", "", "verificar también cada archivo de partición de esta raíz")
+	var symbols []string
+	fs.Func("symbols", "verificar solo estos símbolos, separados por comas", func(s string) error {
+		symbols = strings.Split(s, ",")
+		return nil
+	})
+	issues := fs.Int("issues", 5, "ejemplos a mostrar por grupo con problemas")
+	repair := fs.Bool("repair", false, "borrar las filas incompletas o ilegibles y rehacer los metadatos")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	paths := []string{*path}
+	if *partitionDir != "" {
+		partitions, err := filepath.Glob(filepath.Join(*partitionDir, "*", "*.db"))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, partitions...)
+	}
+
+	problems := 0
+	for _, p := range paths {
+		report, err := ticks.CheckFile(p, ticks.CheckOptions{
+			REPAIR:     *repair,
+			SYMBOLS:    symbols,
+			MAX_ISSUES: max(*issues, 1),
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		printCheckReport(report, *issues)
+		problems += report.Problems() - report.Repaired()
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problemas sin reparar (-repair borra las filas afectadas)", problems)
+	}
+	return nil
+}
+
+// printCheckReport muestra por consola los grupos y metadatos con problemas de
+// 'report', con hasta 'issues' ejemplos por grupo, y una línea de totales.
+func printCheckReport(report ticks.CheckReport, issues int) {
+	rows := 0
+	for _, g := range report.Groups {
+		rows += g.Rows
+		if g.Bad == 0 {
+			continue
+		}
+		fmt.Printf("%s (%s): %d filas, %d con problemas: %d incompletas (%d huérfanas; faltan %s), ilegibles %s, %d claves inválidas\n",
+			g.Bucket, g.Kind, g.Rows, g.Bad, g.Incomplete, g.Orphans, formatCounts(g.Missing), formatCounts(g.Undecodable), g.BadKeys)
+		for _, issue := range g.Issues[:min(issues, len(g.Issues))] {
+			fmt.Printf("    %s  %s  %s\n", formatTickKey(issue.Key), orDash(issue.Column), issue.Problem)
+		}
+		if g.Repaired > 0 {
+			fmt.Printf("    reparado: %d filas borradas o movidas\n", g.Repaired)
+		}
+	}
+	for _, m := range report.Meta {
+		fixed := ""
+		if m.Fixed {
+			fixed = " (rehechos)"
+		}
+		fmt.Printf("%s (%s): metadatos %d ticks [%s, %s], los ticks dicen %d [%s, %s]%s\n", m.Symbol, m.Kind,
+			m.Stored.Count, formatMetaTime(m.Stored.First), formatMetaTime(m.Stored.Last),
+			m.Actual.Count, formatMetaTime(m.Actual.First), formatMetaTime(m.Actual.Last), fixed)
+	}
+	fmt.Printf("%s: %d grupos, %d filas, %d problemas, %d reparados\n",
+		report.Path, len(report.Groups), rows, report.Problems(), report.Repaired())
+}
+
+// formatCounts devuelve 'counts' como "AS:1 BS:2", ordenado, o "-" si está vacío.
+func formatCounts(counts map[string]int) string {
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(counts)) {
+		parts = append(parts, fmt.Sprintf("%s:%d", name, counts[name]))
+	}
+	return orDash(strings.Join(parts, " "))
+}
+
+// formatTickKey muestra una clave de tick como timestamp y secuencia, o en
+// hexadecimal si no tiene un tamaño de clave válido.
+func formatTickKey(key []byte) string {
+	t, err := ticks.KeyTime(key)
+	if err != nil {
+		return fmt.Sprintf("%x", key)
+	}
+	return fmt.Sprintf("%s #%d", t.Format(time.RFC3339Nano), ticks.KeySeq(key))
+}
+
+// formatMetaTime es `time.RFC3339Nano`, o "-" para el tiempo cero.
+func formatMetaTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// fsckBase es el timestamp de la primera quote que escribe `writeFsckTicks`.
+var fsckBase = time.Date(2024, 1, 2, 14, 30, 0, 0, time.UTC)
+
+// TestCheckFile guarda quotes y trades con los tres layouts y comprueba
+// `ticks.CheckFile` sobre el archivo intacto y estropeado como lo haría una escritura
+// a medias.
+func TestCheckFile(t *testing.T) {
+	// En el archivo intacto no hay nada que encontrar.
+	t.Run("clean", func(t *testing.T) {
+		path := writeFsckTicks(t)
+		report, err := ticks.CheckFile(path, ticks.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Problems() != 0 || len(report.Groups) != 4 {
+			t.Errorf("%d problemas en %d grupos", report.Problems(), len(report.Groups))
+		}
+	})
+
+	// Encuentra la columna que falta, la clave huérfana, el valor ilegible, la fila
+	// corta y el chunk con la clave mal, sin escribir nada.
+	t.Run("detect", func(t *testing.T) {
+		path := writeFsckTicks(t)
+		corruptFsckTicks(t, path)
+		dbInstance, err := InitDB(ReadOnlyOptions(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ticks.ReadQuotes(dbInstance, ticks.QueryOptions{SYMBOL: "FSK"})
+		dbInstance.Close()
+		if !errors.Is(err, ticks.ErrIncompleteTick) {
+			t.Errorf("leer columnas estropeadas: se esperaba ErrIncompleteTick, se obtuvo %v", err)
+		}
+
+		report, err := ticks.CheckFile(path, ticks.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := make(map[string]ticks.CheckGroup)
+		for _, g := range report.Groups {
+			groups[g.Bucket] = g
+		}
+		if g := groups["FSK"]; g.Rows != 5 || g.Bad != 3 || g.Incomplete != 2 || g.Orphans != 1 ||
+			g.Missing["BS"] != 2 || g.Missing["AP"] != 1 || g.Undecodable["AP"] != 1 {
+			t.Errorf("columnas de quotes: %+v", g)
+		}
+		if g := groups["FSK/TRADES"]; g.Rows != 3 || g.Bad != 1 || g.Orphans != 1 || g.Missing["P"] != 1 {
+			t.Errorf("columnas de trades: %+v", g)
+		}
+		if g := groups["FSR/QROWS"]; g.Bad != 1 || g.Undecodable[ticks.QuoteRowsBucket] != 1 {
+			t.Errorf("filas: %+v", g)
+		}
+		if g := groups["FSC/QCHUNKS"]; g.Bad != 1 || g.BadKeys != 1 {
+			t.Errorf("chunks: %+v", g)
+		}
+		// Sin reparar, los metadatos de los símbolos con problemas no se comparan
+		if report.Problems() != 6 || report.Repaired() != 0 || len(report.Meta) != 0 {
+			t.Errorf("%d problemas, %d reparados, metadatos %+v", report.Problems(), report.Repaired(), report.Meta)
+		}
+	})
+
+	// Con REPAIR borra esas filas (mueve el chunk), rehace los metadatos y deja el
+	// archivo limpio y legible de nuevo.
+	t.Run("repair", func(t *testing.T) {
+		path := writeFsckTicks(t)
+		corruptFsckTicks(t, path)
+		report, err := ticks.CheckFile(path, ticks.CheckOptions{REPAIR: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Repaired() != report.Problems() || len(report.Meta) != 3 {
+			t.Errorf("%d problemas, %d reparados, metadatos %+v", report.Problems(), report.Repaired(), report.Meta)
+		}
+		report, err = ticks.CheckFile(path, ticks.CheckOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Problems() != 0 {
+			t.Errorf("tras reparar quedan %d problemas: %+v %+v", report.Problems(), report.Groups, report.Meta)
+		}
+
+		dbInstance, err := InitDB(ReadOnlyOptions(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbInstance.Close()
+		// Quedan 2 quotes de columnas y 2 filas; el chunk movido sigue teniendo 3.
+		for symbol, want := range map[string]int{"FSK": 2, "FSR": 2, "FSC": 3} {
+			got, err := ticks.ReadQuotes(dbInstance, ticks.QueryOptions{SYMBOL: symbol})
+			if err != nil || len(got) != want {
+				t.Errorf("quotes de %s: %d, se esperaban %d (%v)", symbol, len(got), want, err)
+			}
+		}
+		metas, err := ticks.ReadSymbolMeta(dbInstance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range metas {
+			if m.Symbol == "FSK" && m.Kind == ticks.KindQuotes && m.Count != 2 {
+				t.Errorf("metadatos rehechos: %+v", m)
+			}
+		}
+	})
+}
+
+// writeFsckTicks guarda en un archivo temporal cuatro quotes de "FSK" en columnas,
+// con tres trades, y tres quotes de "FSR" en filas y de "FSC" en chunks, a partir de
+// 'fsckBase'. Devuelve la ruta del archivo.
+func writeFsckTicks(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ticks.db")
+	dbInstance, err := InitDB(WriteOptions(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbInstance.Close()
+	quotes := func(n int) []QuoteRecord {
+		var out []QuoteRecord
+		for i := range n {
+			out = append(out, QuoteRecord{AP: 102, AS: 1, BP: float64(100 + i), BS: 1, Z: "C",
+				T: fsckBase.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano)})
+		}
+		return out
+	}
+	var trades []TradeRecord
+	for i := range 3 {
+		trades = append(trades, TradeRecord{P: 100.5, S: 10, X: "V", I: int64(i + 1), Z: "C",
+			T: fsckBase.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano)})
+	}
+	err = dbInstance.Update(func(tx *db.Tx) error {
+		for _, w := range []struct {
+			symbol, layout string
+			n              int
+		}{{"FSK", ticks.LayoutColumns, 4}, {"FSR", ticks.LayoutRows, 3}, {"FSC", ticks.LayoutChunks, 3}} {
+			if _, err := ticks.PutQuotesTx(tx, w.symbol, quotes(w.n), w.layout); err != nil {
+				return err
+			}
+		}
+		_, err := ticks.PutTradesTx(tx, "FSK", trades)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// corruptFsckTicks estropea lo que escribe `writeFsckTicks` sin pasar por el paquete
+// ticks: borra BS de la segunda quote, deja AX de una quote que no existe, escribe un
+// AP ilegible en la cuarta, borra P del primer trade, acorta la segunda fila y mueve
+// el chunk a una clave que no es la de su primera quote.
+func corruptFsckTicks(t *testing.T, path string) {
+	t.Helper()
+	dbInstance, err := db.Open(path, 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbInstance.Close()
+	key := func(ms int) []byte { return ticks.Key(fsckBase.Add(time.Duration(ms)*time.Millisecond).UnixNano(), 0) }
+	err = dbInstance.Update(func(tx *db.Tx) error {
+		fsk := tx.Bucket([]byte("FSK"))
+		chunks := tx.Bucket([]byte("FSC")).Bucket([]byte(ticks.QuoteChunksBucket))
+		chunk := append([]byte(nil), chunks.Get(key(0))...)
+		for _, err := range []error{
+			fsk.Bucket([]byte("BS")).Delete(key(1)),
+			fsk.Bucket([]byte("AX")).Put(key(10), []byte("V")),
+			fsk.Bucket([]byte("AP")).Put(key(3), []byte("abc")),
+			fsk.Bucket([]byte(ticks.TradesBucket)).Bucket([]byte("P")).Delete(key(0)),
+			tx.Bucket([]byte("FSR")).Bucket([]byte(ticks.QuoteRowsBucket)).Put(key(1), []byte{1, 2, 3}),
+			chunks.Delete(key(0)),
+			chunks.Put(key(5), chunk),
+		} {
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
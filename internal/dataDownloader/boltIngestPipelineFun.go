@@ -0,0 +1,585 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE INGESTA CON UN ÚNICO ESCRITOR
+// ===============================
+
+//
+//
+//
+*/
+
+// bbolt admite una sola transacción de escritura a la vez: varias goroutines llamando
+// a `db.Update` solo hacen cola en su lock, y cada transacción paga su propio commit
+// (con su fsync). `IngestWriter` separa el guardado en etapas:
+//
+//	productores (descarga y decodificación de páginas, en paralelo)
+//	    -> cola de entrada (acotada: si se llena, `Submit` espera)
+//	    -> ENCODERS goroutines que codifican los lotes (`ticks.EncodeQuotes`, ...)
+//	    -> cola de escritura (acotada)
+//	    -> un único escritor que junta lotes en una transacción
+//
+// El escritor confirma una transacción cuando junta MAX_BATCH ticks, cuando el primer
+// lote lleva MAX_LATENCY esperando, o en cuanto no queda ningún lote en camino. Cada
+// lote avanza su checkpoint en la misma transacción que sus ticks.
+//
+// Antes de codificarlos, los codificadores validan las quotes y los trades con
+// `ticks.Validator` (ver RULES). Los rechazados no se guardan: van a
+// `ticks.QuarantineBucket` de DB_INSTANCE, con la regla que no cumplen, en la misma
+// transacción que el checkpoint, y se cuentan por regla en `IngestStats.Rejected`.
+
+// IngestOptions configura un `IngestWriter`.
+type IngestOptions struct {
+	// DB_INSTANCE es la base de datos donde se guardan los lotes y los checkpoints.
+	// Con PARTITIONS las quotes y los trades van a las particiones.
+	DB_INSTANCE *db.DB
+	// LAYOUT es el layout de las quotes en DB_INSTANCE (uno de `ticks.QuoteLayouts`);
+	// vacío para `ticks.LayoutColumns`. Las particiones usan el suyo.
+	LAYOUT string
+	// PARTITIONS, si no es nil, es donde se guardan las quotes y los trades en lugar de
+	// DB_INSTANCE (ver `AppConfig.PartitionDir`). Las barras, la cuarentena y los
+	// checkpoints siguen en DB_INSTANCE.
+	PARTITIONS *ticks.PartitionedStore
+	// ENCODERS es el número de goroutines que codifican los lotes antes del escritor.
+	ENCODERS int
+	// MAX_BATCH es el número de ticks a partir del cual el escritor confirma la
+	// transacción sin esperar más lotes. Un lote nunca se parte, así que una
+	// transacción puede pasarse de MAX_BATCH con su último lote.
+	MAX_BATCH int
+	// MAX_LATENCY es lo que el escritor espera, desde el primer lote de una
+	// transacción, a que lleguen más lotes que siguen en camino.
+	MAX_LATENCY time.Duration
+	// QUEUE es el número de lotes que caben en cada cola. Con las colas llenas los
+	// productores esperan en `Submit` (backpressure) en lugar de acumular páginas en
+	// memoria.
+	QUEUE int
+	// RULES son las reglas de `ticks.ValidationRules` que se comprueban antes de
+	// guardar, además de `ticks.RuleTimestamp`, que se comprueba siempre.
+	RULES []string
+}
+
+// IngestBatch es un lote de un símbolo para el escritor: quotes, trades o barras (de
+// uno o varios tipos), y el checkpoint que avanza con ellos.
+type IngestBatch struct {
+	Symbol string
+	Quotes []QuoteRecord
+	Trades []TradeRecord
+	Bars   []BarRecord
+	// BarsBucket es el sub-bucket de las barras (ver `barsBucketName`).
+	BarsBucket string
+	// Checkpoint, si no es nil, se avanza con el timestamp más reciente del lote en la
+	// misma transacción (ver `advanceCheckpointTx`).
+	Checkpoint *DownloadCheckpoint
+	// Feed y Source se guardan en los metadatos del símbolo (ver `ticks.SymbolMeta`).
+	// Vacíos, se toman del checkpoint.
+	Feed   string
+	Source string
+}
+
+// size es el número de ticks del lote.
+func (b IngestBatch) size() int {
+	return len(b.Quotes) + len(b.Trades) + len(b.Bars)
+}
+
+// IngestStats son las métricas de un `IngestWriter` desde que se creó.
+type IngestStats struct {
+	Batches      int            // Lotes confirmados (o fallidos)
+	Failed       int            // Lotes que devolvieron error
+	Transactions int            // Transacciones de escritura confirmadas
+	Ticks        int            // Ticks de los lotes confirmados
+	Written      int            // Ticks nuevos guardados
+	Existing     int            // Ticks que ya estaban guardados
+	Skipped      int            // Ticks descartados por tener un timestamp inválido
+	Rejected     map[string]int // Ticks en cuarentena por regla de validación (ver `ticks.ValidationRules`)
+	Blocked      time.Duration  // Tiempo total de los productores esperando sitio en la cola
+	Wait         time.Duration  // Tiempo total de los lotes desde `Submit` hasta su transacción
+	Busy         time.Duration  // Tiempo del escritor dentro de transacciones
+	Elapsed      time.Duration  // Tiempo desde que se creó el escritor
+}
+
+// String resume las métricas en una línea para el log.
+func (s IngestStats) String() string {
+	perTx, perSecond, wait := 0.0, 0.0, time.Duration(0)
+	if s.Transactions > 0 {
+		perTx = float64(s.Ticks) / float64(s.Transactions)
+	}
+	if s.Elapsed > 0 {
+		perSecond = float64(s.Ticks) / s.Elapsed.Seconds()
+	}
+	if s.Batches > 0 {
+		wait = s.Wait / time.Duration(s.Batches)
+	}
+	return fmt.Sprintf("%d ticks (%d nuevos, %d repetidos, %d descartados, %s) en %d lotes y %d transacciones "+
+		"(%.0f ticks/tx), %.0f ticks/s, espera media %s, productores bloqueados %s, escritor ocupado %s de %s",
+		s.Ticks, s.Written, s.Existing, s.Skipped, s.RejectedSummary(), s.Batches, s.Transactions, perTx, perSecond,
+		wait.Round(time.Microsecond), s.Blocked.Round(time.Millisecond), s.Busy.Round(time.Millisecond),
+		s.Elapsed.Round(time.Millisecond))
+}
+
+// RejectedTotal es el número de ticks en cuarentena.
+func (s IngestStats) RejectedTotal() int {
+	total := 0
+	for _, n := range s.Rejected {
+		total += n
+	}
+	return total
+}
+
+// RejectedSummary describe los ticks en cuarentena por regla, en el orden en que se
+// comprueban las reglas (ej. "3 en cuarentena: price 2, tape 1").
+func (s IngestStats) RejectedSummary() string {
+	total := s.RejectedTotal()
+	if total == 0 {
+		return "0 en cuarentena"
+	}
+	var parts []string
+	for _, rule := range append([]string{ticks.RuleTimestamp}, ticks.ValidationRules...) {
+		if n := s.Rejected[rule]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", rule, n))
+		}
+	}
+	return fmt.Sprintf("%d en cuarentena: %s", total, strings.Join(parts, ", "))
+}
+
+// ErrIngestClosed indica un `Submit` sobre un `IngestWriter` ya cerrado.
+var ErrIngestClosed = errors.New("escritor de ingesta cerrado")
+
+// IngestWriter guarda lotes de ticks con un único escritor (ver el bloque de arriba).
+// Se crea con `NewIngestWriter` y se cierra con `Close`. Es seguro para uso
+// concurrente.
+type IngestWriter struct {
+	opt       IngestOptions
+	validator *ticks.Validator
+
+	mu         sync.RWMutex // Protege closed frente a los envíos a encodeChan
+	closed     bool
+	encodeChan chan *ingestJob
+	writeChan  chan *ingestJob
+	upstream   atomic.Int64 // Lotes entregados que el escritor aún no ha recibido
+	encoders   sync.WaitGroup
+	writerDone chan struct{}
+
+	statsMu sync.Mutex
+	stats   IngestStats
+	started time.Time
+}
+
+// ingestJob es un lote en el pipeline.
+type ingestJob struct {
+	batch    IngestBatch
+	quotes   *ticks.EncodedQuotes // nil con particiones o sin quotes
+	trades   *ticks.EncodedTrades
+	rejected []ticks.Quarantined // Quitados de batch por la validación
+	last     time.Time           // Con particiones: timestamp más reciente ya guardado en ellas
+	res      ticks.WriteResult
+	queued   time.Time
+	done     chan error
+}
+
+// NewIngestWriter crea el escritor y arranca sus goroutines, completando con valores
+// por defecto las opciones no definidas.
+func NewIngestWriter(opt IngestOptions) (*IngestWriter, error) {
+	if opt.DB_INSTANCE == nil {
+		return nil, fmt.Errorf("instancia de base de datos nula")
+	}
+	if opt.ENCODERS <= 0 {
+		opt.ENCODERS = 4
+	}
+	if opt.MAX_BATCH <= 0 {
+		opt.MAX_BATCH = 50000
+	}
+	if opt.MAX_LATENCY <= 0 {
+		opt.MAX_LATENCY = 20 * time.Millisecond
+	}
+	if opt.QUEUE <= 0 {
+		opt.QUEUE = 16
+	}
+	if opt.LAYOUT == "" {
+		opt.LAYOUT = ticks.LayoutColumns
+	}
+	if !slices.Contains(ticks.QuoteLayouts, opt.LAYOUT) {
+		return nil, fmt.Errorf("layout de quotes desconocido %q (se esperaba uno de %v)", opt.LAYOUT, ticks.QuoteLayouts)
+	}
+	validator, err := ticks.NewValidator(opt.RULES)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &IngestWriter{
+		opt:        opt,
+		validator:  validator,
+		encodeChan: make(chan *ingestJob, opt.QUEUE),
+		writeChan:  make(chan *ingestJob, opt.QUEUE),
+		writerDone: make(chan struct{}),
+		started:    time.Now(),
+	}
+	for i := 0; i < opt.ENCODERS; i++ {
+		w.encoders.Add(1)
+		go w.encodeLoop()
+	}
+	go w.writeLoop()
+	return w, nil
+}
+
+// Submit entrega 'batch' al pipeline y devuelve un canal que recibe el resultado de
+// su transacción (nil si se confirmó); un lote vacío se da por confirmado. Si la cola
+// está llena espera a que haya sitio; si 'ctx' se cancela mientras tanto el lote no se
+// entrega y se devuelve ctx.Err(). Un lote ya entregado se guarda aunque después se
+// cancele 'ctx'.
+func (w *IngestWriter) Submit(ctx context.Context, batch IngestBatch) (<-chan error, error) {
+	job := &ingestJob{batch: batch, done: make(chan error, 1)}
+	if batch.size() == 0 {
+		job.done <- nil // Nada que guardar ni checkpoint que avanzar
+		return job.done, nil
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return nil, ErrIngestClosed
+	}
+	w.upstream.Add(1)
+	job.queued = time.Now()
+	select {
+	case w.encodeChan <- job:
+		return job.done, nil
+	default:
+	}
+	// Cola llena: el productor espera (y se mide cuánto).
+	select {
+	case w.encodeChan <- job:
+		w.addStats(func(s *IngestStats) { s.Blocked += time.Since(job.queued) })
+		return job.done, nil
+	case <-ctx.Done():
+		w.upstream.Add(-1)
+		return nil, ctx.Err()
+	}
+}
+
+// Save entrega 'batch' y espera a que se confirme (ver `Submit`).
+func (w *IngestWriter) Save(ctx context.Context, batch IngestBatch) error {
+	done, err := w.Submit(ctx, batch)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// SaveQuotes guarda 'quotes' de 'symbol' y espera a que se confirmen. Si 'checkpoint'
+// no es nil, avanza en la misma transacción.
+func (w *IngestWriter) SaveQuotes(ctx context.Context, symbol string, quotes []QuoteRecord, checkpoint *DownloadCheckpoint) error {
+	return w.Save(ctx, IngestBatch{Symbol: symbol, Quotes: quotes, Checkpoint: checkpoint})
+}
+
+// SaveTrades guarda 'trades' de 'symbol' y espera a que se confirmen.
+func (w *IngestWriter) SaveTrades(ctx context.Context, symbol string, trades []TradeRecord, checkpoint *DownloadCheckpoint) error {
+	return w.Save(ctx, IngestBatch{Symbol: symbol, Trades: trades, Checkpoint: checkpoint})
+}
+
+// SaveBars guarda 'bars' de 'symbol' en el sub-bucket 'bucketName' (ver
+// `barsBucketName`) y espera a que se confirmen.
+func (w *IngestWriter) SaveBars(ctx context.Context, symbol, bucketName string, bars []BarRecord, checkpoint *DownloadCheckpoint) error {
+	return w.Save(ctx, IngestBatch{Symbol: symbol, Bars: bars, BarsBucket: bucketName, Checkpoint: checkpoint})
+}
+
+// Close deja de aceptar lotes, espera a que se guarden todos los entregados y
+// registra las métricas en el log. Se puede llamar varias veces.
+func (w *IngestWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		<-w.writerDone
+		return nil
+	}
+	w.closed = true
+	close(w.encodeChan)
+	w.mu.Unlock()
+
+	w.encoders.Wait()
+	close(w.writeChan)
+	<-w.writerDone
+	log.Printf("Escritor de ingesta cerrado: %s", w.Stats())
+	return nil
+}
+
+// Stats devuelve las métricas acumuladas.
+func (w *IngestWriter) Stats() IngestStats {
+	w.statsMu.Lock()
+	defer w.statsMu.Unlock()
+	stats := w.stats
+	stats.Rejected = maps.Clone(w.stats.Rejected)
+	stats.Elapsed = time.Since(w.started)
+	return stats
+}
+
+func (w *IngestWriter) addStats(fn func(*IngestStats)) {
+	w.statsMu.Lock()
+	fn(&w.stats)
+	w.statsMu.Unlock()
+}
+
+// encodeLoop valida y codifica los lotes de encodeChan y los pasa al escritor. Las
+// quotes y los trades rechazados se quitan del lote y quedan en job.rejected. Las
+// quotes se codifican con `IngestOptions.LAYOUT`; con PARTITIONS no se codifican porque
+// cada partición las escribe con su propio `ticks.PartitionedStore.WriteBatch`.
+func (w *IngestWriter) encodeLoop() {
+	defer w.encoders.Done()
+	for job := range w.encodeChan {
+		var rejectedQuotes, rejectedTrades []ticks.Quarantined
+		job.batch.Quotes, rejectedQuotes = w.validator.FilterQuotes(job.batch.Quotes)
+		job.batch.Trades, rejectedTrades = w.validator.FilterTrades(job.batch.Trades)
+		job.rejected = append(rejectedQuotes, rejectedTrades...)
+
+		var err error
+		if w.opt.PARTITIONS == nil && len(job.batch.Quotes) > 0 {
+			job.quotes, err = ticks.EncodeQuotes(job.batch.Symbol, job.batch.Quotes, w.opt.LAYOUT)
+		}
+		if err == nil && w.opt.PARTITIONS == nil && len(job.batch.Trades) > 0 {
+			job.trades, err = ticks.EncodeTrades(job.batch.Symbol, job.batch.Trades)
+		}
+		if err != nil {
+			w.upstream.Add(-1)
+			w.finish(job, err)
+			continue
+		}
+		w.writeChan <- job
+	}
+}
+
+// writeLoop es el único escritor: junta los lotes de writeChan en transacciones (ver
+// `IngestOptions`) hasta que se cierra el canal.
+func (w *IngestWriter) writeLoop() {
+	defer close(w.writerDone)
+	timer := time.NewTimer(w.opt.MAX_LATENCY)
+	timer.Stop()
+	for first := range w.writeChan {
+		w.upstream.Add(-1)
+		group := []*ingestJob{first}
+		size := first.size()
+		timer.Reset(w.opt.MAX_LATENCY)
+	collect:
+		for size < w.opt.MAX_BATCH {
+			// Lo que ya está en la cola entra sin esperar; si no queda nada en camino, no
+			// tiene sentido esperar a MAX_LATENCY.
+			var job *ingestJob
+			var ok bool
+			select {
+			case job, ok = <-w.writeChan:
+			default:
+				if w.upstream.Load() == 0 {
+					break collect
+				}
+				select {
+				case job, ok = <-w.writeChan:
+				case <-timer.C:
+					break collect
+				}
+			}
+			if !ok {
+				break collect
+			}
+			w.upstream.Add(-1)
+			group = append(group, job)
+			size += job.size()
+		}
+		timer.Stop()
+		w.commit(group)
+	}
+}
+
+// commit guarda 'group' en una transacción. Si falla, cada lote se reintenta en su
+// propia transacción para que el error le llegue solo al lote que lo causa.
+func (w *IngestWriter) commit(group []*ingestJob) {
+	start := time.Now()
+	pending := group[:0:0]
+	for _, job := range group {
+		if err := job.writePartitions(w.opt.PARTITIONS); err != nil {
+			w.finish(job, err)
+			continue
+		}
+		pending = append(pending, job)
+	}
+
+	err := w.update(pending)
+	if err != nil && len(pending) > 1 {
+		for _, job := range pending {
+			w.finish(job, w.update([]*ingestJob{job}))
+		}
+	} else {
+		for _, job := range pending {
+			w.finish(job, err)
+		}
+	}
+	w.addStats(func(s *IngestStats) {
+		s.Busy += time.Since(start)
+		for _, job := range group {
+			s.Wait += start.Sub(job.queued)
+		}
+	})
+}
+
+// update guarda 'jobs' en una única transacción de `IngestOptions.DB_INSTANCE`.
+func (w *IngestWriter) update(jobs []*ingestJob) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	results := make([]ticks.WriteResult, len(jobs))
+	err := w.opt.DB_INSTANCE.Update(func(tx *db.Tx) error {
+		for i, job := range jobs {
+			res, err := job.writeTx(tx)
+			if err != nil {
+				return err
+			}
+			results[i] = res
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i, job := range jobs {
+		job.res.Written += results[i].Written
+		job.res.Existing += results[i].Existing
+		job.res.Skipped += results[i].Skipped
+	}
+	w.addStats(func(s *IngestStats) { s.Transactions++ })
+	return nil
+}
+
+// size es el número de ticks del lote antes de la validación.
+func (job *ingestJob) size() int {
+	return job.batch.size() + len(job.rejected)
+}
+
+// finish entrega el resultado de 'job' y lo suma a las métricas.
+func (w *IngestWriter) finish(job *ingestJob, err error) {
+	if err == nil && job.res.Skipped > 0 {
+		log.Printf("Warning: %d ticks de %s con timestamp inválido; se descartaron.", job.res.Skipped, job.batch.Symbol)
+	}
+	if err == nil && len(job.rejected) > 0 {
+		log.Printf("Warning: %d ticks de %s no pasaron la validación; se guardaron en %s.", len(job.rejected), job.batch.Symbol, ticks.QuarantineBucket)
+	}
+	w.addStats(func(s *IngestStats) {
+		s.Batches++
+		if err != nil {
+			s.Failed++
+			return
+		}
+		s.Ticks += job.size()
+		for _, r := range job.rejected {
+			if s.Rejected == nil {
+				s.Rejected = make(map[string]int)
+			}
+			s.Rejected[r.Rule]++
+		}
+		s.Written += job.res.Written
+		s.Existing += job.res.Existing
+		s.Skipped += job.res.Skipped
+	})
+	job.done <- err
+}
+
+// writePartitions guarda las quotes y los trades del lote en 'partitions', si no es
+// nil. Se hace antes de la transacción del checkpoint, en un commit aparte (ver
+// `ticks.PartitionedStore` sobre un corte entre ambos).
+func (job *ingestJob) writePartitions(partitions *ticks.PartitionedStore) error {
+	if partitions == nil || len(job.batch.Quotes)+len(job.batch.Trades) == 0 || !job.last.IsZero() {
+		return nil // Sin particiones, o ya guardado en un intento anterior
+	}
+	res, err := partitions.WriteBatch(ticks.Batch{Symbol: job.batch.Symbol, Quotes: job.batch.Quotes, Trades: job.batch.Trades})
+	if err != nil {
+		return err
+	}
+	job.last = res.Last
+	job.res = res
+	return nil
+}
+
+// writeTx guarda el lote dentro de 'tx' y pone sus registros rechazados en cuarentena.
+// También actualiza los metadatos del símbolo y avanza su checkpoint. Los rechazados
+// cuentan para el checkpoint: ya se procesaron, y descargarlos otra vez solo los
+// repetiría en la cuarentena.
+func (job *ingestJob) writeTx(tx *db.Tx) (ticks.WriteResult, error) {
+	var res ticks.WriteResult
+	last := job.last
+	symbol := job.batch.Symbol
+	if job.quotes != nil {
+		quotes, err := ticks.PutEncodedQuotesTx(tx, job.quotes)
+		if err != nil {
+			return res, err
+		}
+		res.Add(quotes)
+	}
+	if job.trades != nil {
+		trades, err := ticks.PutEncodedTradesTx(tx, job.trades)
+		if err != nil {
+			return res, err
+		}
+		res.Add(trades)
+	}
+	feed, source := job.batch.Feed, job.batch.Source
+	if cp := job.batch.Checkpoint; cp != nil {
+		feed, source = cmp.Or(feed, cp.Feed), cmp.Or(source, cp.Source)
+	}
+	if len(job.batch.Bars) > 0 {
+		bars, err := putBarsTx(tx, symbol, job.batch.BarsBucket, job.batch.Bars)
+		if err != nil {
+			return res, err
+		}
+		err = ticks.UpdateSymbolMetaTx(tx, symbol, ticks.Kind(job.batch.BarsBucket), ticks.SymbolMetaUpdate{
+			First: bars.First, Last: bars.Last, Written: bars.Written, Feed: feed, Source: source})
+		if err != nil {
+			return res, err
+		}
+		res.Add(bars)
+	}
+	// Los metadatos de quotes y trades ya se actualizaron al guardarlos (en las
+	// particiones, con PARTITIONS); aquí solo se añade de dónde vienen.
+	for kind, n := range map[ticks.Kind]int{ticks.KindQuotes: len(job.batch.Quotes), ticks.KindTrades: len(job.batch.Trades)} {
+		if n > 0 && (feed != "" || source != "") {
+			if err := ticks.UpdateSymbolMetaTx(tx, symbol, kind, ticks.SymbolMetaUpdate{Feed: feed, Source: source}); err != nil {
+				return res, err
+			}
+		}
+	}
+	if res.Last.After(last) {
+		last = res.Last
+	}
+	if err := ticks.PutQuarantineTx(tx, symbol, job.rejected); err != nil {
+		return res, err
+	}
+	for _, r := range job.rejected {
+		if r.Time.After(last) {
+			last = r.Time
+		}
+	}
+
+	// Avanzar el checkpoint de descarga dentro de la misma transacción
+	if job.batch.Checkpoint != nil && !last.IsZero() {
+		if err := advanceCheckpointTx(tx, *job.batch.Checkpoint, last); err != nil {
+			return res, fmt.Errorf("failed to update checkpoint for '%s': %w", symbol, err)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// compareTickStores escribe 'quotes' dos veces en un `ticks.MemoryStore` y comprueba
+// que ve las mismas quotes, el mismo último timestamp y el mismo conteo que el
+// `ticks.BoltStore` sobre 'dbInstance', donde ya están guardadas.
+func compareTickStores(t *testing.T, dbInstance *db.DB, symbol string, quotes []QuoteRecord) {
+	t.Helper()
+	bolt, err := ticks.NewBoltStore(dbInstance, ticks.LayoutColumns) // Sin Close: la base de datos es del test
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := ticks.NewMemoryStore()
+	defer memory.Close()
+	for i := 0; i < 2; i++ {
+		res, err := memory.WriteBatch(ticks.Batch{Symbol: symbol, Quotes: quotes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		written := len(quotes) // La segunda escritura no añade nada
+		if i > 0 {
+			written = 0
+		}
+		if res.Written != written || res.Written+res.Existing != len(quotes) {
+			t.Fatalf("escritura %d en memoria: %+v", i+1, res)
+		}
+	}
+
+	var stores [2][]ticks.Quote
+	for i, store := range []ticks.TickStore{bolt, memory} {
+		for q, err := range store.Quotes(ticks.QueryOptions{SYMBOL: symbol}) {
+			if err != nil {
+				t.Fatal(err)
+			}
+			stores[i] = append(stores[i], q)
+		}
+	}
+	if !reflect.DeepEqual(stores[0], stores[1]) {
+		t.Fatalf("bbolt y memoria difieren:\n%+v\n%+v", stores[0], stores[1])
+	}
+	var last [2]time.Time
+	var counts [2]int
+	for i, store := range []ticks.TickStore{bolt, memory} {
+		if last[i], err = store.LastTimestamp(symbol, ticks.KindQuotes); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := store.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[i] = stats.Symbols[symbol].Quotes
+	}
+	if !last[0].Equal(last[1]) || counts[0] != counts[1] || counts[0] != len(quotes) {
+		t.Fatalf("último timestamp %v / %v, quotes %d / %d", last[0], last[1], counts[0], counts[1])
+	}
+}
+
+// checkTickPartitions guarda 'quotes', repartidas en tres días, con un `IngestWriter`
+// sobre 'dbInstance' y un almacén particionado por día, con un solo archivo abierto y
+// las quotes en chunks comprimidos, y comprueba que se crea una partición por día y
+// que la lectura las recorre todas en orden. Las quotes se entregan en lotes de cuatro
+// sin esperar a cada uno, para que el escritor los junte.
+func checkTickPartitions(t *testing.T, dbInstance *db.DB, root string, quotes []QuoteRecord) {
+	t.Helper()
+	partitions, err := ticks.OpenPartitionedStore(ticks.PartitionOptions{
+		ROOT: root, PERIOD: ticks.PeriodDay, MAX_OPEN: 1, LAYOUT: ticks.LayoutChunks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partitions.Close()
+	ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: dbInstance, ENCODERS: 2, PARTITIONS: partitions})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingest.Close()
+
+	shifted := slices.Clone(quotes)
+	for i := range shifted {
+		ts, err := time.Parse(time.RFC3339Nano, shifted[i].T)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shifted[i].T = ts.Add(time.Duration(i%3) * 24 * time.Hour).Format(time.RFC3339Nano)
+	}
+	for i := 0; i < 2; i++ { // La segunda vez no debe duplicar nada
+		var pending []<-chan error
+		for from := 0; from < len(shifted); from += 4 {
+			done, err := ingest.Submit(context.Background(), IngestBatch{Symbol: "SPY", Quotes: shifted[from:min(from+4, len(shifted))]})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending = append(pending, done)
+		}
+		for _, done := range pending {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	files, err := partitions.Partitions("SPY", time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 3 || partitions.OpenCount() > 1 {
+		t.Fatalf("se esperaban 3 particiones y a lo sumo 1 abierta, hay %d y %d", len(files), partitions.OpenCount())
+	}
+	var read []ticks.Quote
+	for q, err := range partitions.Quotes(ticks.QueryOptions{SYMBOL: "SPY"}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, q)
+	}
+	if len(read) != len(quotes) || !slices.IsSortedFunc(read, func(a, b ticks.Quote) int { return a.Time.Compare(b.Time) }) {
+		t.Fatalf("se esperaban %d quotes ordenadas, se leyeron %d", len(quotes), len(read))
+	}
+	// Los metadatos de las 3 particiones suman las quotes y el rango completo.
+	metas, err := partitions.SymbolMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metas) != 1 || metas[0].Count != len(quotes) || !metas[0].First.Equal(read[0].Time) || !metas[0].Last.Equal(read[len(read)-1].Time) {
+		t.Fatalf("metadatos de las particiones inesperados: %+v", metas)
+	}
+}
+
+// openTestDB abre una base de datos temporal que se cierra al terminar el test.
+func openTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	dbInstance, err := db.Open(filepath.Join(t.TempDir(), "ticks.db"), 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	return dbInstance
+}
+
+// quoteJobs devuelve un lote de quotes de SPY ya codificado, con 'size' quotes, por
+// cada elemento de 'sizes'. Los lotes no se solapan.
+func quoteJobs(t *testing.T, sizes ...int) []*ingestJob {
+	t.Helper()
+	var jobs []*ingestJob
+	for i, size := range sizes {
+		quotes := syntheticPage(0, i, size, 1000)
+		encoded, err := ticks.EncodeQuotes("SPY", quotes, ticks.LayoutColumns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, &ingestJob{batch: IngestBatch{Symbol: "SPY", Quotes: quotes}, quotes: encoded, queued: time.Now(), done: make(chan error, 1)})
+	}
+	return jobs
+}
+
+// deliver pasa 'jobs' directamente al escritor de 'w', como si ya estuvieran
+// codificados, y avisa de 'pending' lotes más que siguen en camino. Todos cuentan como
+// en camino antes de entregar el primero, así que el escritor los puede juntar sin
+// depender de cuándo los recibe.
+func deliver(w *IngestWriter, pending int, jobs ...*ingestJob) {
+	w.upstream.Add(int64(pending + len(jobs)))
+	for _, job := range jobs {
+		w.writeChan <- job
+	}
+}
+
+// waitJobs espera el resultado de cada uno de 'jobs' y los devuelve en orden.
+func waitJobs(jobs []*ingestJob) []error {
+	errs := make([]error, len(jobs))
+	for i, job := range jobs {
+		errs[i] = <-job.done
+	}
+	return errs
+}
+
+// TestIngestWriterGroups comprueba cómo el escritor junta los lotes en transacciones:
+// hasta MAX_BATCH ticks sin esperar a MAX_LATENCY mientras los lotes en camino lleguen,
+// y por separado cuando MAX_LATENCY vence antes de que llegue el siguiente.
+func TestIngestWriterGroups(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxBatch int
+		want     int // Transacciones de 5 lotes de 10 ticks
+	}{
+		{name: "uno por lote", maxBatch: 10, want: 5},
+		{name: "corta al pasar MAX_BATCH", maxBatch: 25, want: 2}, // 30 + 20
+		{name: "todos juntos", maxBatch: 1000, want: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: openTestDB(t), MAX_BATCH: tc.maxBatch, MAX_LATENCY: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ingest.Close()
+			jobs := quoteJobs(t, 10, 10, 10, 10, 10)
+			deliver(ingest, 0, jobs...)
+			for i, err := range waitJobs(jobs) {
+				if err != nil {
+					t.Fatalf("lote %d: %v", i, err)
+				}
+			}
+			if stats := ingest.Stats(); stats.Transactions != tc.want || stats.Batches != 5 || stats.Written != 50 {
+				t.Fatalf("%+v, se esperaban %d transacciones", stats, tc.want)
+			}
+		})
+	}
+
+	t.Run("MAX_LATENCY", func(t *testing.T) {
+		const latency = 50 * time.Millisecond
+		ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: openTestDB(t), MAX_LATENCY: latency})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ingest.Close()
+		jobs := quoteJobs(t, 10, 10)
+		start := time.Now()
+		deliver(ingest, 1, jobs[0]) // El segundo sigue en camino
+		if err := <-jobs[0].done; err != nil {
+			t.Fatal(err)
+		}
+		if waited := time.Since(start); waited < latency {
+			t.Fatalf("el primer lote se confirmó a los %s, antes de MAX_LATENCY", waited)
+		}
+		ingest.upstream.Add(-1) // Ya no está en camino: se entrega aparte
+		deliver(ingest, 0, jobs[1])
+		if err := <-jobs[1].done; err != nil {
+			t.Fatal(err)
+		}
+		if stats := ingest.Stats(); stats.Transactions != 2 {
+			t.Fatalf("%+v, se esperaban 2 transacciones", stats)
+		}
+	})
+}
+
+// TestIngestWriterBackpressure llena las colas mientras el escritor espera el lock de
+// bbolt: `Submit` espera a que haya sitio (y se mide en `IngestStats.Blocked`), un lote
+// cuyo contexto se cancela mientras espera no se entrega, y todo lo entregado se
+// guarda al liberar el lock.
+func TestIngestWriterBackpressure(t *testing.T) {
+	dbInstance := openTestDB(t)
+	ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: dbInstance, ENCODERS: 1, MAX_BATCH: 1, QUEUE: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingest.Close()
+	tx, err := dbInstance.Begin(true) // Bloquea al escritor
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	page := 0
+	submit := func(ctx context.Context) (<-chan error, error) {
+		page++
+		return ingest.Submit(ctx, IngestBatch{Symbol: "SPY", Quotes: syntheticPage(0, page, 10, 1000)})
+	}
+	var pending []<-chan error
+	for len(pending) < 10 {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		done, err := submit(ctx)
+		cancel()
+		if errors.Is(err, context.DeadlineExceeded) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, done)
+	}
+	if len(pending) == 10 {
+		t.Fatal("Submit nunca esperó con las colas llenas")
+	}
+
+	blocked := make(chan (<-chan error), 1)
+	go func() {
+		done, err := submit(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		blocked <- done
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("Submit no esperó con las colas llenas")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	pending = append(pending, <-blocked)
+	for i, done := range pending {
+		if err := <-done; err != nil {
+			t.Fatalf("lote %d: %v", i, err)
+		}
+	}
+
+	stats := ingest.Stats()
+	if stats.Blocked < 50*time.Millisecond || stats.Batches != len(pending) || stats.Written != 10*len(pending) {
+		t.Fatalf("%+v, se esperaban %d lotes guardados y al menos 50ms bloqueados", stats, len(pending))
+	}
+	if err := checkBenchQuotes(dbInstance, 10*len(pending)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIngestWriterRetry junta en una transacción un lote que falla con dos que no: la
+// transacción se deshace, cada lote se reintenta en la suya y el error solo le llega
+// al que lo causa.
+func TestIngestWriterRetry(t *testing.T) {
+	dbInstance := openTestDB(t)
+	ingest, err := NewIngestWriter(IngestOptions{DB_INSTANCE: dbInstance, MAX_LATENCY: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingest.Close()
+	good := quoteJobs(t, 10, 10)
+	bad := &ingestJob{ // Sin BarsBucket: bbolt no crea un bucket sin nombre
+		batch:  IngestBatch{Symbol: "SPY", Bars: []BarRecord{{T: "2016-01-04T14:30:00Z"}}},
+		queued: time.Now(),
+		done:   make(chan error, 1),
+	}
+	jobs := []*ingestJob{good[0], bad, good[1]}
+	deliver(ingest, 0, jobs...)
+
+	errs := waitJobs(jobs)
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("errores %v, se esperaba solo el del lote de barras", errs)
+	}
+	if stats := ingest.Stats(); stats.Batches != 3 || stats.Failed != 1 || stats.Transactions != 2 || stats.Written != 20 {
+		t.Fatalf("%+v, se esperaban 2 transacciones confirmadas y 1 lote fallido", stats)
+	}
+	if err := checkBenchQuotes(dbInstance, 20); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestIngestJobWritePartitions comprueba que un lote se guarda en las particiones una
+// sola vez: con job.last ya definido (guardado en un intento anterior) no se vuelve a
+// escribir, y su resultado se conserva para la transacción del checkpoint.
+func TestIngestJobWritePartitions(t *testing.T) {
+	partitions, err := ticks.OpenPartitionedStore(ticks.PartitionOptions{ROOT: t.TempDir(), PERIOD: ticks.PeriodDay, MAX_OPEN: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partitions.Close()
+	quotes := syntheticPage(0, 0, 10, 1000)
+	last, err := time.Parse(time.RFC3339Nano, quotes[len(quotes)-1].T)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("ya guardado", func(t *testing.T) {
+		job := &ingestJob{batch: IngestBatch{Symbol: "QQQ", Quotes: quotes}, last: last}
+		if err := job.writePartitions(partitions); err != nil {
+			t.Fatal(err)
+		}
+		files, err := partitions.Partitions("QQQ", time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 || job.res != (ticks.WriteResult{}) {
+			t.Fatalf("se volvió a escribir: %d particiones, %+v", len(files), job.res)
+		}
+	})
+
+	t.Run("nuevo", func(t *testing.T) {
+		job := &ingestJob{batch: IngestBatch{Symbol: "SPY", Quotes: quotes}}
+		for i := 0; i < 2; i++ { // El segundo intento no escribe nada
+			if err := job.writePartitions(partitions); err != nil {
+				t.Fatal(err)
+			}
+			if !job.last.Equal(last) || job.res.Written != len(quotes) || job.res.Existing != 0 {
+				t.Fatalf("intento %d: last %v, %+v; se esperaban %d escritas hasta %v", i+1, job.last, job.res, len(quotes), last)
+			}
+		}
+	})
+}
+
+/*
+//
+//
+//
+
+BLOQUE DE BENCHMARK DEL GUARDADO
+// ===============================
+
+//
+//
+//
+*/
+
+// BenchmarkIngest simula un backfill de quotes sintéticas repartidas en páginas de
+// varios símbolos y lo guarda en un archivo nuevo de dos formas:
+//   - workers: el guardado de antes de `IngestWriter` (ver `workerPoolSave`), una
+//     transacción por página con los productores compitiendo por el lock de bbolt;
+//   - pipeline: las mismas páginas entregadas a un `IngestWriter`, como hace
+//     `downloadResumable` (una página en vuelo por productor).
+//
+// Cada productor hace de grupo de `downloadUniverse`: "descarga" una página (la genera
+// y la serializa a JSON) y la decodifica antes de guardarla. Al terminar se comprueba
+// que el archivo tenga todas las quotes. Informa de las quotes por segundo y de las
+// quotes por transacción.
+func BenchmarkIngest(b *testing.B) {
+	const (
+		total     = 200000 // Quotes del backfill
+		symbols   = 8      // Símbolos entre los que se reparten las páginas
+		page      = 10000  // Quotes por página
+		producers = 4      // Páginas descargadas a la vez (como group_workers)
+		workers   = 4      // Workers de guardado por página, o codificadores del pipeline
+	)
+	// Páginas: la i-ésima es del símbolo i % symbols y sigue a la anterior de ese símbolo.
+	// Como los grupos de `downloadUniverse`, cada productor se queda con sus símbolos
+	// (los de s % producers == p) y recorre sus páginas en orden.
+	pages := (total + page - 1) / page
+	producerPages := func(p int) iter.Seq[int] {
+		return func(yield func(int) bool) {
+			for i := 0; i < pages; i++ {
+				if i%symbols%producers == p && !yield(i) {
+					return
+				}
+			}
+		}
+	}
+	fetch := func(i int) (string, []QuoteRecord, error) {
+		symbol := fmt.Sprintf("SYM%02d", i%symbols)
+		raw, err := json.Marshal(syntheticPage(i%symbols, i/symbols, min(page, total-i*page), page))
+		if err != nil {
+			return symbol, nil, err
+		}
+		var quotes []QuoteRecord
+		err = json.Unmarshal(raw, &quotes)
+		return symbol, quotes, err
+	}
+	checkpoint := func(symbol string) *DownloadCheckpoint {
+		return &DownloadCheckpoint{Symbol: symbol, Feed: "sip", Kind: datasetQuotes, Source: "bench"}
+	}
+
+	// run guarda el backfill con 'save' en un archivo nuevo en cada iteración.
+	run := func(b *testing.B, save func(dbInstance *db.DB) (int, error)) {
+		transactions := 0
+		for b.Loop() {
+			dbInstance, err := db.Open(filepath.Join(b.TempDir(), "ticks.db"), 0600, &db.Options{Timeout: time.Second})
+			if err != nil {
+				b.Fatal(err)
+			}
+			saved, err := save(dbInstance)
+			transactions += saved
+			if err == nil {
+				err = checkBenchQuotes(dbInstance, total)
+			}
+			if closeErr := dbInstance.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*total)/b.Elapsed().Seconds(), "quotes/s")
+		b.ReportMetric(float64(b.N*total)/float64(max(transactions, 1)), "quotes/tx")
+	}
+
+	// Diseño anterior: cada productor guarda su página con su propio pool de workers.
+	b.Run("workers", func(b *testing.B) {
+		run(b, func(dbInstance *db.DB) (int, error) {
+			var transactions atomic.Int64
+			err := parallel(producers, func(p int) error {
+				for i := range producerPages(p) {
+					symbol, quotes, err := fetch(i)
+					if err != nil {
+						return err
+					}
+					saved, err := workerPoolSave(dbInstance, symbol, quotes, len(quotes), workers, checkpoint(symbol))
+					transactions.Add(int64(saved))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			return int(transactions.Load()), err
+		})
+	})
+
+	// Pipeline: todos los productores entregan al mismo escritor.
+	b.Run("pipeline", func(b *testing.B) {
+		run(b, func(dbInstance *db.DB) (int, error) {
+			ingest, err := NewIngestWriter(IngestOptions{
+				DB_INSTANCE: dbInstance,
+				ENCODERS:    workers,
+				MAX_BATCH:   defaultConfig().IngestMaxBatch,
+				MAX_LATENCY: defaultConfig().IngestMaxLatency.Duration(),
+				QUEUE:       defaultConfig().IngestQueue,
+			})
+			if err != nil {
+				return 0, err
+			}
+			err = parallel(producers, func(p int) error {
+				var inFlight <-chan error
+				for i := range producerPages(p) {
+					symbol, quotes, err := fetch(i)
+					if err != nil {
+						return err
+					}
+					if inFlight != nil {
+						if err := <-inFlight; err != nil {
+							return err
+						}
+					}
+					if inFlight, err = ingest.Submit(context.Background(), IngestBatch{Symbol: symbol, Quotes: quotes, Checkpoint: checkpoint(symbol)}); err != nil {
+						return err
+					}
+				}
+				if inFlight != nil {
+					return <-inFlight
+				}
+				return nil
+			})
+			ingest.Close()
+			return ingest.Stats().Transactions, err
+		})
+	})
+}
+
+// syntheticPage genera la página 'index' de 'size' quotes del símbolo 'symbol',
+// desplazada para que no se solape con las anteriores ('pageSize' quotes avanzan como
+// mucho 5 ms cada una): timestamps crecientes con saltos de microsegundos, precios de
+// dos decimales alrededor de 110 y tamaños chicos, como las de SIP.
+func syntheticPage(symbol, index, size, pageSize int) []QuoteRecord {
+	rng := rand.New(rand.NewSource(int64(symbol)))
+	exchanges := "ABCDHKLMNPQTVXYZ"
+	ts := time.Date(2016, 1, 4, 14, 30, 0, 0, time.UTC).Add(time.Duration(index*pageSize)*5*time.Millisecond +
+		time.Duration(rng.Intn(1000))*time.Microsecond)
+	bid := 11000
+	quotes := make([]QuoteRecord, size)
+	for i := range quotes {
+		ts = ts.Add(time.Duration(1+rng.Intn(5000)) * time.Microsecond)
+		bid += rng.Intn(3) - 1
+		quotes[i] = QuoteRecord{
+			AP: float64(bid+1+rng.Intn(2)) / 100,
+			AS: 1 + rng.Intn(50),
+			AX: string(exchanges[rng.Intn(len(exchanges))]),
+			BP: float64(bid) / 100,
+			BS: 1 + rng.Intn(50),
+			BX: string(exchanges[rng.Intn(len(exchanges))]),
+			C:  []string{"R"},
+			T:  ts.Format(time.RFC3339Nano),
+			Z:  "C",
+		}
+	}
+	return quotes
+}
+
+// checkBenchQuotes comprueba que 'dbInstance' tenga 'want' quotes.
+func checkBenchQuotes(dbInstance *db.DB, want int) error {
+	store, err := ticks.NewBoltStore(dbInstance, ticks.LayoutColumns) // Sin Close: la base de datos se cierra fuera
+	if err != nil {
+		return err
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	if stats.Quotes != want {
+		return fmt.Errorf("se esperaban %d quotes guardadas, hay %d", want, stats.Quotes)
+	}
+	return nil
+}
+
+// parallel ejecuta 'fn' en 'n' goroutines (con su índice) y devuelve el primer error.
+func parallel(n int, fn func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- fn(i)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// processAndSaveBatch guarda un lote de quotes en bbolt en una única transacción,
+// avanzando 'checkpoint' (si no es nil) en la misma: el guardado por página de antes
+// de `IngestWriter`, sin validación ni particiones.
+func processAndSaveBatch(dbInstance *db.DB, symbol string, quotes []QuoteRecord, checkpoint *DownloadCheckpoint) error {
+	return dbInstance.Update(func(tx *db.Tx) error {
+		res, err := ticks.PutQuotesTx(tx, symbol, quotes, ticks.LayoutColumns)
+		if err != nil {
+			return err
+		}
+		if checkpoint != nil && !res.Last.IsZero() {
+			if err := advanceCheckpointTx(tx, *checkpoint, res.Last); err != nil {
+				return fmt.Errorf("failed to update checkpoint for '%s': %w", symbol, err)
+			}
+		}
+		return nil
+	})
+}
+
+// workerPoolSave es el guardado por página de antes de `IngestWriter`, conservado solo
+// como referencia de `BenchmarkIngest`: 'numWorkers' goroutines se reparten las quotes
+// y cada una confirma sus lotes de 'batchSize' con `processAndSaveBatch`, es decir,
+// con su propio `db.Update`. Devuelve el número de transacciones confirmadas.
+func workerPoolSave(dbInstance *db.DB, symbol string, quotes []QuoteRecord, batchSize, numWorkers int, checkpoint *DownloadCheckpoint) (int, error) {
+	quotesChan := make(chan QuoteRecord, numWorkers*2)
+	var wg sync.WaitGroup
+	var transactions atomic.Int64
+	errChan := make(chan error, numWorkers)
+
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func(workerID int) {
+			defer wg.Done()
+			localBatch := make([]QuoteRecord, 0, batchSize)
+			save := func() bool {
+				if err := processAndSaveBatch(dbInstance, symbol, localBatch, checkpoint); err != nil {
+					errChan <- fmt.Errorf("worker %d failed to save batch: %w", workerID, err)
+					return false
+				}
+				transactions.Add(1)
+				localBatch = make([]QuoteRecord, 0, batchSize)
+				return true
+			}
+			for quote := range quotesChan {
+				localBatch = append(localBatch, quote)
+				if len(localBatch) >= batchSize && !save() {
+					for range quotesChan {
+					}
+					return
+				}
+			}
+			if len(localBatch) > 0 {
+				save()
+			}
+		}(i)
+	}
+	for _, q := range quotes {
+		quotesChan <- q
+	}
+	close(quotesChan)
+	wg.Wait()
+	close(errChan)
+	return int(transactions.Load()), <-errChan
+}
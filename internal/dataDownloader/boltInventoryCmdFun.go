@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// runInventory muestra una tabla con lo que hay guardado de cada símbolo y tipo de
+// dato (quotes, trades y cada sub-bucket de barras), leída de los metadatos que cada
+// escritura mantiene (ver `ticks.SymbolMeta`), sin recorrer los ticks. Con
+// -partition-dir suma los de cada archivo de partición. Las filas cuyo último
+// timestamp tiene más de -stale de antigüedad se marcan para planificar backfills.
+//
+// Uso: dataDownloader inventory [-db db/ticks.db] [-partition-dir dir] [-partition-period month] [-stale 168h]
+func runInventory(args []string) error {
+	fs := flag.NewFlagSet("inventory", flag.ContinueOnError)
+	path := fs.String("db", defaultConfig().DBPath, "archivo bbolt principal")
+	partitionDir := fs.String("partition-dir", "", "raíz de las particiones de quotes y trades, si se usan")
+	partitionPeriod := fs.String("partition-period", defaultConfig().PartitionPeriod, "periodo de las particiones (day, month o year)")
+	stale := fs.Duration("stale", 7*24*time.Hour, "marcar los datos cuyo último timestamp es más antiguo que esto (0 = no marcar)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	version, _, err := fileSchemaVersion(*path)
+	if err != nil {
+		return err
+	}
+	if version < 4 {
+		fmt.Printf("%s es v%d: sus metadatos están incompletos hasta migrarlo (dataDownloader migrate -db %s)\n", *path, version, *path)
+	}
+	opts := ReadOnlyOptions(*path)
+	dbInstance, err := db.Open(opts.PATH, opts.FILE_MODE, opts.BOLT_OPTS)
+	if err != nil {
+		return fmt.Errorf("no se pudo abrir '%s': %w", *path, err)
+	}
+	metas, err := ticks.ReadSymbolMeta(dbInstance)
+	dbInstance.Close()
+	if err != nil {
+		return err
+	}
+	if *partitionDir != "" {
+		partitions, err := ticks.OpenPartitionedStore(ticks.PartitionOptions{
+			ROOT:      *partitionDir,
+			PERIOD:    *partitionPeriod,
+			MAX_OPEN:  defaultConfig().PartitionMaxOpen,
+			READ_ONLY: true,
+		})
+		if err != nil {
+			return err
+		}
+		partitioned, err := partitions.SymbolMeta()
+		partitions.Close()
+		if err != nil {
+			return err
+		}
+		metas = ticks.MergeSymbolMeta(metas, partitioned)
+	}
+
+	if len(metas) == 0 {
+		fmt.Println("Sin metadatos de símbolos.")
+		return nil
+	}
+	printInventory(metas, *stale, time.Now())
+	return nil
+}
+
+// printInventory escribe 'metas' como tabla en la salida estándar. Con 'stale' > 0
+// marca las filas cuyo Last es anterior a 'now' - 'stale'.
+func printInventory(metas []ticks.SymbolMeta, stale time.Duration, now time.Time) {
+	const layout = "2006-01-02 15:04:05"
+	format := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.UTC().Format(layout)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SÍMBOLO\tTIPO\tREGISTROS\tDESDE\tHASTA\tFEED\tFUENTE\tACTUALIZADO\tESQUEMA\tESTADO")
+	staleCount := 0
+	for _, m := range metas {
+		mark := ""
+		if stale > 0 && m.Count > 0 && now.Sub(m.Last) > stale {
+			mark = "desactualizado"
+			staleCount++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\tv%d\t%s\n", m.Symbol, m.Kind, m.Count, format(m.First), format(m.Last),
+			orDash(m.Feed), orDash(m.Source), format(m.UpdatedAt), m.SchemaVersion, mark)
+	}
+	w.Flush()
+	if staleCount > 0 {
+		fmt.Printf("%d de %d con el último dato hace más de %s.\n", staleCount, len(metas), stale)
+	}
+}
+
+// orDash devuelve 's', o "-" si está vacío.
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// runMigrate lleva una base de datos de ticks (y, con -partition-dir, cada archivo de
+// partición) a la versión de esquema actual con `ticks.MigrateFile`, mostrando el
+// avance y la verificación. Con -out se migra una copia y el original no se toca.
+// Con -list solo se muestran los pasos conocidos y la versión del archivo.
+//
+// Uso: dataDownloader migrate [-db db/ticks.db] [-out copia.db] [-to N] [-partition-dir dir] [-list]
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	path := fs.String("db", defaultConfig().DBPath, "archivo bbolt a migrar")
+	out := fs.String("out", "", "migrar una copia en este archivo nuevo en lugar del original")
+	to := fs.Int("to", 0, "versión de destino (0 = la actual)")
+	partitionDir := fs.String("partition-dir", "", "migrar también cada archivo de partición de esta raíz (en el sitio)")
+	list := fs.Bool("list", false, "mostrar los pasos y la versión del archivo sin migrar")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out != "" && *partitionDir != "" {
+		return fmt.Errorf("-out no se puede combinar con -partition-dir")
+	}
+
+	paths := []string{*path}
+	if *partitionDir != "" {
+		partitions, err := filepath.Glob(filepath.Join(*partitionDir, "*", "*.db"))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, partitions...)
+	}
+
+	if *list {
+		fmt.Printf("esquema actual: v%d\n", ticks.SchemaVersion)
+		for _, m := range ticks.Migrations() {
+			fmt.Printf("  v%d  %s\n", m.Version, m.Name)
+		}
+		for _, p := range paths {
+			version, stored, err := fileSchemaVersion(p)
+			if err != nil {
+				return err
+			}
+			note := ""
+			if !stored {
+				note = " (sin versión guardada; deducida del contenido)"
+			}
+			fmt.Printf("%s: v%d%s\n", p, version, note)
+		}
+		return nil
+	}
+
+	for _, p := range paths {
+		report, err := ticks.MigrateFile(p, ticks.MigrateOptions{
+			OUTPUT: *out,
+			TARGET: *to,
+			PROGRESS: func(progress ticks.MigrationProgress) {
+				if progress.Version > 0 {
+					fmt.Printf("  v%d %s: %s, %d ticks\n", progress.Version, progress.Step, progress.Symbol, progress.Done)
+				} else {
+					fmt.Printf("  %s: %s, %d ticks leídos\n", progress.Step, progress.Symbol, progress.Done)
+				}
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		applied := "nada que migrar"
+		if len(report.Applied) > 0 {
+			applied = fmt.Sprint(report.Applied)
+		}
+		fmt.Printf("%s: v%d -> v%d (%s); %d quotes y %d trades verificados\n",
+			report.Path, report.From, report.To, applied, report.Ticks.Quotes, report.Ticks.Trades)
+	}
+	return nil
+}
+
+// fileSchemaVersion abre 'path' en solo lectura y devuelve su versión de esquema, sea
+// cual sea (`InitDB` rechaza las posteriores a la actual).
+func fileSchemaVersion(path string) (version int, stored bool, err error) {
+	opts := ReadOnlyOptions(path)
+	dbInstance, err := db.Open(opts.PATH, opts.FILE_MODE, opts.BOLT_OPTS)
+	if err != nil {
+		return 0, false, fmt.Errorf("no se pudo abrir '%s': %w", path, err)
+	}
+	defer dbInstance.Close()
+	err = dbInstance.View(func(tx *db.Tx) error {
+		version, stored, err = ticks.SchemaVersionTx(tx)
+		return err
+	})
+	return version, stored, err
+}
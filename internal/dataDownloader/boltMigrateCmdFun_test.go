@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	db "go.etcd.io/bbolt"
+)
+
+// legacyBase es el timestamp de la primera quote que escribe `writeLegacyTicks`.
+var legacyBase = time.Date(2024, 1, 2, 14, 30, 0, 0, time.UTC)
+
+// TestSchemaMigration parte de una base de datos con el formato v1 (claves de 8
+// bytes, más una quote ya guardada con el formato nuevo en uno de los timestamps).
+func TestSchemaMigration(t *testing.T) {
+	// `InitDB` se niega a escribir en ella.
+	t.Run("outdated", func(t *testing.T) {
+		legacyPath := writeLegacyTicks(t)
+		dbInstance, err := InitDB(WriteOptions(legacyPath))
+		if dbInstance != nil {
+			dbInstance.Close()
+		}
+		if !errors.Is(err, ticks.ErrSchemaOutdated) {
+			t.Fatalf("se esperaba ErrSchemaOutdated, se obtuvo %v", err)
+		}
+	})
+
+	// `ticks.MigrateFile` con OUTPUT migra una copia sin tocar el original. La copia
+	// queda en `ticks.SchemaVersion`, con los mismos ticks, la quote antigua detrás de
+	// la nueva de su timestamp y las condiciones antiguas (una cadena JSON) leídas
+	// como lista. Migrarla otra vez no cambia nada.
+	t.Run("copy", func(t *testing.T) {
+		legacyPath := writeLegacyTicks(t)
+		migratedPath := filepath.Join(t.TempDir(), "migrated.db")
+		report, err := ticks.MigrateFile(legacyPath, ticks.MigrateOptions{OUTPUT: migratedPath})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.From != 1 || report.To != ticks.SchemaVersion || report.Ticks.Quotes != 4 || report.Ticks.Trades != 1 {
+			t.Errorf("resultado inesperado %+v", report)
+		}
+		if version, stored, err := fileSchemaVersion(legacyPath); err != nil || version != 1 || stored {
+			t.Errorf("el original cambió: v%d guardada=%v (%v)", version, stored, err)
+		}
+
+		dbInstance, err := InitDB(WriteOptions(migratedPath))
+		if err != nil {
+			t.Fatalf("abrir la copia migrada: %v", err)
+		}
+		quotes, err := ticks.ReadQuotes(dbInstance, ticks.QueryOptions{SYMBOL: "OLD"})
+		dbInstance.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// La quote nueva de base+1ms ya tenía la secuencia 0; la antigua pasa a la 1.
+		if len(quotes) != 4 || quotes[1].Seq != 0 || quotes[1].BP != 99 || quotes[2].Seq != 1 || quotes[2].BP != 101 ||
+			!slices.Equal(quotes[2].C, []string{"R", "I"}) || len(quotes[1].C) != 0 {
+			t.Errorf("quotes migradas inesperadas: %+v", quotes)
+		}
+
+		again, err := ticks.MigrateFile(migratedPath, ticks.MigrateOptions{})
+		if err != nil || len(again.Applied) != 0 || again.From != ticks.SchemaVersion {
+			t.Errorf("segunda migración: %+v (%v)", again, err)
+		}
+	})
+
+	// Una base de datos nueva nace versionada.
+	t.Run("fresh", func(t *testing.T) {
+		freshPath := filepath.Join(t.TempDir(), "fresh.db")
+		fresh, err := InitDB(WriteOptions(freshPath))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fresh.Close()
+		if version, stored, err := fileSchemaVersion(freshPath); err != nil || version != ticks.SchemaVersion || !stored {
+			t.Errorf("v%d guardada=%v (%v)", version, stored, err)
+		}
+	})
+}
+
+// writeLegacyTicks escribe en un archivo temporal tres quotes y un trade de "OLD" con
+// claves de 8 bytes y las condiciones de quote en cadena JSON, como antes de las
+// secuencias, y una quote más con el formato actual en el timestamp de la segunda.
+// Devuelve la ruta del archivo.
+func writeLegacyTicks(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	dbInstance, err := db.Open(path, 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dbInstance.Close()
+	err = dbInstance.Update(func(tx *db.Tx) error {
+		symbol, err := tx.CreateBucketIfNotExists([]byte("OLD"))
+		if err != nil {
+			return err
+		}
+		put := func(parent *db.Bucket, fields []string, key []byte, values [][]byte) error {
+			for i, field := range fields {
+				column, err := parent.CreateBucketIfNotExists([]byte(field))
+				if err != nil {
+					return err
+				}
+				if err := column.Put(key, values[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for i := 0; i < 3; i++ {
+			ts := legacyBase.Add(time.Duration(i) * time.Millisecond)
+			values := ticks.EncodeQuoteColumns(QuoteRecord{AP: 102, AS: 1, BP: float64(100 + i), BS: 1, Z: "C"})
+			values[slices.Index(ticks.QuoteFields, "C")] = []byte(`"RI"`) // Hasta la v2, una cadena JSON
+			if err := put(symbol, ticks.QuoteFields, ticks.KeyPrefix(ts), values); err != nil {
+				return err
+			}
+		}
+		trades, err := symbol.CreateBucketIfNotExists([]byte(ticks.TradesBucket))
+		if err != nil {
+			return err
+		}
+		values, err := ticks.EncodeTradeColumns(TradeRecord{P: 100.5, S: 10, X: "V", I: 1, Z: "C"})
+		if err != nil {
+			return err
+		}
+		if err := put(trades, ticks.TradeFields, ticks.KeyPrefix(legacyBase), values); err != nil {
+			return err
+		}
+		_, err = ticks.PutQuotesTx(tx, "OLD", []QuoteRecord{
+			{AP: 102, AS: 1, BP: 99, BS: 1, Z: "C", T: legacyBase.Add(time.Millisecond).Format(time.RFC3339Nano)},
+		}, ticks.LayoutColumns)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
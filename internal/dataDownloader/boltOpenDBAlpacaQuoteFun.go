@@ -1,20 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
 	db "go.etcd.io/bbolt"
+	berrors "go.etcd.io/bbolt/errors"
 )
 
-type Quote struct {
-	// defining struct variables
-	NextPageToken string     `json:"next_page_token"` // Cryptographic value.
-	Quotes        []oneQuote `json:"quotes"`          // Quotes Body
-	Symbol        string     `json:"symbol"`          // ticker
-}
-
 /*
 //
 //
@@ -82,36 +81,107 @@ var RaedConfig = DBOptions{
 	},
 }
 
-// initDB inicializa y abre una conexión a la base de datos bbolt.
+// Errores de apertura de una base de datos. `InitDB` los envuelve con la ruta y el
+// detalle, así que se comprueban con errors.Is.
+var (
+	ErrDBOptions  = errors.New("opciones de base de datos inválidas")
+	ErrDBNotFound = errors.New("la base de datos no existe")
+	ErrDBLocked   = errors.New("la base de datos está bloqueada por otro proceso")
+)
+
+// WriteOptions devuelve `WriteConfig` apuntando a 'path'. Las opciones de bbolt se
+// copian, así que modificarlas no altera el preset.
+func WriteOptions(path string) DBOptions {
+	return WriteConfig.withPath(path)
+}
+
+// ReadOnlyOptions devuelve `RaedConfig` apuntando a 'path' (ej. una copia archivada
+// de ticks.db que se quiere consultar sin riesgo de modificarla).
+func ReadOnlyOptions(path string) DBOptions {
+	return RaedConfig.withPath(path)
+}
+
+// withPath copia las opciones (incluidas las de bbolt) con otra ruta.
+func (o DBOptions) withPath(path string) DBOptions {
+	o.PATH = path
+	if o.BOLT_OPTS != nil {
+		boltOpts := *o.BOLT_OPTS
+		o.BOLT_OPTS = &boltOpts
+	}
+	return o
+}
+
+// ReadOnly indica si las opciones abren la base de datos en modo de solo lectura.
+func (o DBOptions) ReadOnly() bool {
+	return o.BOLT_OPTS != nil && o.BOLT_OPTS.ReadOnly
+}
+
+// Validate comprueba que las opciones se puedan usar tal cual, sin sustituir nada:
+//   - PATH no puede estar vacío.
+//   - BOLT_OPTS es obligatorio y su Timeout debe ser positivo (con 0 bbolt espera
+//     el bloqueo del archivo indefinidamente).
+//   - En lectura/escritura, FILE_MODE debe dar lectura y escritura al propietario y
+//     no dar escritura al grupo ni a otros. En solo lectura FILE_MODE no se usa.
+//
+// Devuelve un error que envuelve `ErrDBOptions` con el motivo, o nil.
+func (o DBOptions) Validate() error {
+	var problems []string
+	if o.PATH == "" {
+		problems = append(problems, "PATH vacío")
+	}
+	if o.BOLT_OPTS == nil {
+		problems = append(problems, "BOLT_OPTS es nil")
+	} else if o.BOLT_OPTS.Timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("Timeout debe ser positivo (es %v)", o.BOLT_OPTS.Timeout))
+	}
+	if !o.ReadOnly() {
+		switch {
+		case o.FILE_MODE&^os.ModePerm != 0:
+			problems = append(problems, fmt.Sprintf("FILE_MODE %v no es un permiso de archivo", o.FILE_MODE))
+		case o.FILE_MODE&0600 != 0600:
+			problems = append(problems, fmt.Sprintf("FILE_MODE %#o no da lectura y escritura al propietario", o.FILE_MODE))
+		case o.FILE_MODE&0022 != 0:
+			problems = append(problems, fmt.Sprintf("error de seguridad: FILE_MODE %#o da escritura al grupo u otros", o.FILE_MODE))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w '%s': %s", ErrDBOptions, o.PATH, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// InitDB abre la base de datos bbolt descrita por 'cfg', respetando su ruta, permisos
+// y opciones de bbolt (ver `DBOptions.Validate`). `WriteConfig` y `RaedConfig` son
+// solo presets de partida; `WriteOptions` y `ReadOnlyOptions` los copian con otra ruta.
 //
-// El parámetro 'class' determina el modo de apertura de la base de datos:
-//   - "write": Abre la base de datos en modo de lectura/escritura (usando WriteConfig).
-//   - "read": Abre la base de datos en modo de solo lectura (usando RaedConfig).
+//   - Lectura/escritura: crea el archivo (y su carpeta) si no existe.
+//   - Solo lectura: el archivo debe existir; varias aperturas de solo lectura del mismo
+//     archivo pueden convivir, incluso entre procesos.
 //
-// Devuelve un puntero a un 'bolt.DB' si la conexión es exitosa, junto con 'nil' como error.
-// Si ocurre un error al abrir la base de datos o si la clase especificada no es válida,
-// devuelve 'nil' y un 'error' descriptivo.
+// Devuelve la base de datos abierta, o un error que envuelve `ErrDBOptions`,
+// `ErrDBNotFound`, `ErrDBLocked`, `ticks.ErrSchemaOutdated` (hay que ejecutar
+// 'dataDownloader migrate') o `ticks.ErrSchemaTooNew` según el caso, u otro error de
+// bbolt.
 //
 // Ejemplos de uso:
 //
-//	dbInstance, err := initDB(WriteConfig) // Abrir para escritura
-//	dbInstance, err := initDB(RaedConfig)  // Abrir para solo lectura
+//	dbInstance, err := InitDB(WriteOptions("db/ticks.db"))             // Abrir para escritura
+//	archive, err := InitDB(ReadOnlyOptions("archive/2023/ticks.db")) // Abrir para solo lectura
 func InitDB(cfg DBOptions) (*db.DB, error) {
-	// Declara 'cfg' en el ámbito de la función initDB
-	//var cfg DBOptions
-	//
-	switch cfg.FILE_MODE {
-	case 0600:
-		cfg = WriteConfig
-	case 0400:
-		cfg = RaedConfig
-	default:
-		// Manejo de error si 'FileMode' no es ni 0600 ni 0400
-		return nil, fmt.Errorf("error de seguridad: %v. Modo no valido", cfg.FILE_MODE)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	mode := modeName(cfg)
+	if cfg.ReadOnly() {
+		if _, err := os.Stat(cfg.PATH); err != nil {
+			return nil, fmt.Errorf("%w: '%s' (%v)", ErrDBNotFound, cfg.PATH, err)
+		}
+	} else if dir := filepath.Dir(cfg.PATH); dir != "." {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("no se pudo crear la carpeta de la base de datos '%s': %w", dir, err)
+		}
 	}
-	//
-	// Abrimos db con el archivo de configuración elegido
-	// 'cfg' ahora es accesible aquí
+
 	database, err := db.Open(cfg.PATH, cfg.FILE_MODE, cfg.BOLT_OPTS)
 	if err != nil {
 		//
@@ -119,8 +189,16 @@ func InitDB(cfg DBOptions) (*db.DB, error) {
 		// defer database.Close()
 		//
 		// En lugar de log.Fatal, devuelve el error para que la función que llama lo maneje.
-		// log.Fatal termina el programa inmediatamente, lo cual no siempre es deseable.
-		return nil, fmt.Errorf("error al abrir la base de datos bbolt: %w", err)
+		if errors.Is(err, berrors.ErrTimeout) {
+			return nil, fmt.Errorf("%w: '%s' sigue bloqueada tras %v (%s)", ErrDBLocked, cfg.PATH, cfg.BOLT_OPTS.Timeout, mode)
+		}
+		return nil, fmt.Errorf("error al abrir la base de datos bbolt '%s' (%s): %w", cfg.PATH, mode, err)
+	}
+	// El formato de los ticks debe ser el que entiende este programa (ver
+	// `ticks.EnsureSchema`); si no, se cierra sin tocar nada.
+	if err := ticks.EnsureSchema(database); err != nil {
+		database.Close()
+		return nil, err
 	}
 	// Si logra abrir, entrega la instancia de la base de datos y nulo para el error
 	return database, nil
@@ -135,6 +213,7 @@ func InitDB(cfg DBOptions) (*db.DB, error) {
 // pueden no estar inmediatamente disponibles.
 //
 // Parámetros:
+//   - ctx: Contexto de cancelación de los reintentos.
 //   - cfg: Una estructura `DBOptions` que contiene la configuración necesaria para la apertura
 //     de la base de datos (ruta, permisos y opciones específicas de bbolt).
 //
@@ -144,14 +223,25 @@ func InitDB(cfg DBOptions) (*db.DB, error) {
 //   - `nil` y un `error` si se agotan todos los reintentos o si el resultado obtenido
 //     no es del tipo esperado `*bolt.DB`.
 //
+// Las opciones inválidas (`ErrDBOptions`), los archivos de solo lectura que no existen
+// (`ErrDBNotFound`) y los de otro esquema fallan al primer intento.
+//
 // Configuración de reintentos interna:
 //   - Máximo de N reintentos.
 //   - Retraso inicial (backoff) de N milisegundos.
 //   - Retraso máximo (maxBackoff) de N segundos.
-func initDBWithRetries(cfg DBOptions) (*db.DB, error) {
+func initDBWithRetries(ctx context.Context, cfg DBOptions) (*db.DB, error) {
 	rawResponse, err := executeActionWithRetries(
+		ctx,
 		func(attempt int) (interface{}, error) {
 			dbInstance, dbErr := InitDB(cfg)
+			// Reintentar no arregla unas opciones inválidas, ni crea un archivo que falta,
+			// ni migra su esquema; solo tiene sentido esperar a que otro proceso suelte
+			// el bloqueo.
+			if errors.Is(dbErr, ErrDBOptions) || errors.Is(dbErr, ErrDBNotFound) ||
+				errors.Is(dbErr, ticks.ErrSchemaOutdated) || errors.Is(dbErr, ticks.ErrSchemaTooNew) {
+				return nil, Permanent(dbErr)
+			}
 			return dbInstance, dbErr
 		},
 		func(err error, msg string) {
@@ -178,3 +268,28 @@ func initDBWithRetries(cfg DBOptions) (*db.DB, error) {
 
 	return dbInstance, nil
 }
+
+// mainDBName es el nombre de `AppConfig.DBPath` en el `ticks.DBManager` de los
+// subcomandos que descargan (ver `newDBManager`).
+const mainDBName = "ticks"
+
+// newDBManager crea un `ticks.DBManager` que abre cada base de datos con
+// `initDBWithRetries`, a partir de `WriteOptions` o `ReadOnlyOptions` según el modo,
+// mientras 'ctx' no se cancele.
+func newDBManager(ctx context.Context) *ticks.DBManager {
+	return ticks.NewDBManager(func(path string, readOnly bool) (*db.DB, error) {
+		opts := WriteOptions(path)
+		if readOnly {
+			opts = ReadOnlyOptions(path)
+		}
+		return initDBWithRetries(ctx, opts)
+	})
+}
+
+// modeName describe el modo de apertura para los mensajes de error.
+func modeName(opts DBOptions) string {
+	if opts.ReadOnly() {
+		return "solo lectura"
+	}
+	return "lectura/escritura"
+}
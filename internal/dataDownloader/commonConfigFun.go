@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+	env "github.com/joho/godotenv"
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE CONFIGURACIÓN
+// ===============================
+
+//
+//
+//
+*/
+
+// Rutas por defecto, relativas al directorio desde el que se ejecuta el binario
+// (normalmente la raíz del repositorio).
+const (
+	defaultConfigPath  = "configs/dataDownloader.json" // Archivo de configuración (si existe)
+	defaultEnvFilePath = "configs/secret/.env"         // Secretos en formato .env (si existe)
+)
+
+// AppConfig agrupa toda la configuración del downloader.
+//
+// Cada valor se resuelve en este orden de precedencia (el último gana):
+//  1. Valores por defecto (`defaultConfig`).
+//  2. Archivo JSON de configuración (`-config`, `DXM_CONFIG` o `configs/dataDownloader.json`).
+//  3. Variables de entorno (`DXM_<NOMBRE>`; las claves de Alpaca usan `API_KEY_ID` y
+//     `API_SECRET_KEY`), incluidas las cargadas del archivo .env.
+//  4. Flags de línea de comandos (`-<nombre>`), salvo las credenciales.
+//
+// Los nombres de los flags coinciden con las claves del archivo JSON cambiando '_' por '-'
+// (ej. `page_limit` en el archivo, `-page-limit` en la línea de comandos, `DXM_PAGE_LIMIT`
+// en el entorno).
+type AppConfig struct {
+	// Credenciales de Alpaca
+	AlpacaAPIKey    string `json:"api_key_id"`
+	AlpacaSecretKey string `json:"api_secret_key"`
+
+	// Endpoints
+	Protocol     string `json:"protocol"`      // Protocolo de la API REST ("https", o "http" para un servidor local)
+	Domain       string `json:"domain"`        // Dominio de la API REST de datos históricos
+	StreamDomain string `json:"stream_domain"` // Dominio del WebSocket de market data
+
+	// Base de datos
+	DBPath      string `json:"db_path"`      // Archivo bbolt donde se guardan los ticks
+	QuoteLayout string `json:"quote_layout"` // Cómo se guardan las quotes: "columns" (un sub-bucket por campo), "rows" (fila binaria) o "chunks" (bloques comprimidos)
+
+	// Particiones por tiempo (quotes y trades en un archivo bbolt por símbolo y periodo)
+	PartitionDir     string `json:"partition_dir"`      // Raíz de las particiones; vacío = todo en db_path
+	PartitionPeriod  string `json:"partition_period"`   // Periodo de cada archivo ("day", "month" o "year")
+	PartitionMaxOpen int    `json:"partition_max_open"` // Archivos de partición abiertos a la vez como máximo
+
+	// Qué descargar
+	Symbols       []string `json:"symbols"`        // Universo de tickers
+	Start         string   `json:"start"`          // Inicio del histórico (RFC3339)
+	End           string   `json:"end"`            // Fin del histórico (RFC3339); vacío = hasta el presente
+	Feed          string   `json:"feed"`           // Fuente de datos ("sip", "iex", ...)
+	Datasets      []string `json:"datasets"`       // Datasets a descargar (quotes, trades, bars)
+	BarTimeframe  string   `json:"bar_timeframe"`  // Timeframe de las barras ("1Min", "5Min", "1Hour", "1Day")
+	BarAdjustment string   `json:"bar_adjustment"` // Ajuste de las barras ("raw", "split", "dividend", "all")
+	Source        string   `json:"source"`         // Proveedor de datos históricos ("alpaca" o "file")
+	SourceDir     string   `json:"source_dir"`     // Carpeta de archivos planos para Source = "file"
+
+	// Paginación, límites y reintentos
+	PageLimit          int            `json:"page_limit"`            // Registros por página (máximo de Alpaca: 10000)
+	RateLimitPerMinute int            `json:"rate_limit_per_minute"` // Peticiones REST por minuto (se ajusta con X-RateLimit-Limit)
+	HTTPTimeout        configDuration `json:"http_timeout"`          // Timeout de cada petición REST
+	MaxRetries         int            `json:"max_retries"`           // Intentos por página antes de rendirse
+	InitialBackoff     configDuration `json:"initial_backoff"`       // Primera espera entre reintentos
+	MaxBackoff         configDuration `json:"max_backoff"`           // Espera máxima entre reintentos
+
+	// Concurrencia
+	GroupSize        int            `json:"group_size"`         // Tickers por petición multi-símbolo (symbols=...)
+	GroupWorkers     int            `json:"group_workers"`      // Grupos de tickers descargados a la vez
+	SaveWorkers      int            `json:"save_workers"`       // Goroutines que codifican las páginas antes del escritor único de bbolt
+	IngestMaxBatch   int            `json:"ingest_max_batch"`   // Ticks a partir de los cuales el escritor confirma la transacción
+	IngestMaxLatency configDuration `json:"ingest_max_latency"` // Espera máxima del escritor por más páginas antes de confirmar
+	IngestQueue      int            `json:"ingest_queue"`       // Páginas en cola hacia el escritor; con la cola llena la descarga espera
+
+	// Validación
+	ValidationRules []string `json:"validation_rules"` // Reglas de ticks.ValidationRules; los ticks que no las cumplen van a cuarentena
+}
+
+// defaultConfig devuelve la configuración con la que funciona el downloader si no se
+// indica nada más: QQQ desde 2016 por el feed SIP de Alpaca, guardado en db/ticks.db.
+func defaultConfig() AppConfig {
+	return AppConfig{
+		Protocol:           "https",
+		Domain:             "data.alpaca.markets",
+		StreamDomain:       "stream.data.alpaca.markets",
+		DBPath:             "db/ticks.db",
+		QuoteLayout:        ticks.LayoutColumns,
+		PartitionPeriod:    ticks.PeriodMonth,
+		PartitionMaxOpen:   16,
+		Symbols:            []string{"QQQ"},
+		Start:              "2016-01-01T00:00:00Z",
+		Feed:               "sip",
+		Datasets:           []string{datasetQuotes, datasetTrades, datasetBars},
+		BarTimeframe:       "1Min",
+		BarAdjustment:      "raw",
+		Source:             "alpaca",
+		SourceDir:          "data",
+		PageLimit:          10000,
+		RateLimitPerMinute: 200,
+		HTTPTimeout:        configDuration(60 * time.Second),
+		MaxRetries:         3,
+		InitialBackoff:     configDuration(50 * time.Millisecond),
+		MaxBackoff:         configDuration(2 * time.Second),
+		GroupSize:          50,
+		GroupWorkers:       4,
+		SaveWorkers:        4,
+		IngestMaxBatch:     50000,
+		IngestMaxLatency:   configDuration(20 * time.Millisecond),
+		IngestQueue:        16,
+		ValidationRules:    slices.Clone(ticks.ValidationRules),
+	}
+}
+
+// configDuration es un time.Duration que en el archivo JSON se escribe como texto
+// (ej. "500ms", "2s", "1m").
+type configDuration time.Duration
+
+func (d configDuration) Duration() time.Duration { return time.Duration(d) }
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *configDuration) UnmarshalJSON(raw []byte) error {
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		return fmt.Errorf("se esperaba una duración como texto (ej. \"2s\"): %s", raw)
+	}
+	parsed, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(parsed)
+	return nil
+}
+
+// configSetting describe un valor configurable por entorno y por flag.
+type configSetting struct {
+	name   string                                   // Nombre del flag (sin '-'); el del entorno se deriva de él
+	env    string                                   // Variable de entorno; vacío para "DXM_" + name en mayúsculas
+	usage  string                                   // Ayuda del flag
+	noFlag bool                                     // true para valores que no deben pasar por la línea de comandos (secretos)
+	set    func(cfg *AppConfig, value string) error // Interpreta 'value' y lo guarda en 'cfg'
+}
+
+// envName devuelve la variable de entorno del valor (ej. "page-limit" -> "DXM_PAGE_LIMIT").
+func (s configSetting) envName() string {
+	if s.env != "" {
+		return s.env
+	}
+	return "DXM_" + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// configSettings enumera todo lo que se puede cambiar por entorno o flag.
+var configSettings = []configSetting{
+	{name: "api-key-id", env: "API_KEY_ID", usage: "clave de la API de Alpaca", noFlag: true,
+		set: setString(func(c *AppConfig) *string { return &c.AlpacaAPIKey })},
+	{name: "api-secret-key", env: "API_SECRET_KEY", usage: "secreto de la API de Alpaca", noFlag: true,
+		set: setString(func(c *AppConfig) *string { return &c.AlpacaSecretKey })},
+	{name: "protocol", usage: "protocolo de la API REST (https o http)",
+		set: setString(func(c *AppConfig) *string { return &c.Protocol })},
+	{name: "domain", usage: "dominio de la API REST de datos históricos",
+		set: setString(func(c *AppConfig) *string { return &c.Domain })},
+	{name: "stream-domain", usage: "dominio del WebSocket de market data",
+		set: setString(func(c *AppConfig) *string { return &c.StreamDomain })},
+	{name: "db-path", usage: "archivo bbolt donde se guardan los ticks",
+		set: setString(func(c *AppConfig) *string { return &c.DBPath })},
+	{name: "quote-layout", usage: "cómo se guardan las quotes: columns (un sub-bucket por campo), rows (fila binaria) o chunks (bloques comprimidos)",
+		set: setString(func(c *AppConfig) *string { return &c.QuoteLayout })},
+	{name: "partition-dir", usage: "raíz de las particiones por tiempo de quotes y trades; vacío = todo en -db-path",
+		set: setString(func(c *AppConfig) *string { return &c.PartitionDir })},
+	{name: "partition-period", usage: "periodo de cada archivo de partición (day, month o year)",
+		set: setString(func(c *AppConfig) *string { return &c.PartitionPeriod })},
+	{name: "partition-max-open", usage: "archivos de partición abiertos a la vez como máximo",
+		set: setInt(func(c *AppConfig) *int { return &c.PartitionMaxOpen })},
+	{name: "symbols", usage: "tickers separados por comas (ej. QQQ,SPY)",
+		set: setList(func(c *AppConfig) *[]string { return &c.Symbols })},
+	{name: "start", usage: "inicio del histórico (RFC3339)",
+		set: setString(func(c *AppConfig) *string { return &c.Start })},
+	{name: "end", usage: "fin del histórico (RFC3339); vacío = hasta el presente",
+		set: setString(func(c *AppConfig) *string { return &c.End })},
+	{name: "feed", usage: "fuente de datos (sip, iex, ...)",
+		set: setString(func(c *AppConfig) *string { return &c.Feed })},
+	{name: "datasets", usage: "datasets separados por comas (quotes,trades,bars)",
+		set: setList(func(c *AppConfig) *[]string { return &c.Datasets })},
+	{name: "bar-timeframe", usage: "timeframe de las barras (1Min, 5Min, 1Hour, 1Day, ...)",
+		set: setString(func(c *AppConfig) *string { return &c.BarTimeframe })},
+	{name: "bar-adjustment", usage: "ajuste de las barras (raw, split, dividend, all)",
+		set: setString(func(c *AppConfig) *string { return &c.BarAdjustment })},
+	{name: "source", usage: "proveedor de datos históricos (alpaca o file)",
+		set: setString(func(c *AppConfig) *string { return &c.Source })},
+	{name: "source-dir", usage: "carpeta de archivos planos para -source file",
+		set: setString(func(c *AppConfig) *string { return &c.SourceDir })},
+	{name: "page-limit", usage: "registros por página (1 a 10000)",
+		set: setInt(func(c *AppConfig) *int { return &c.PageLimit })},
+	{name: "rate-limit-per-minute", usage: "peticiones REST por minuto de la cuenta",
+		set: setInt(func(c *AppConfig) *int { return &c.RateLimitPerMinute })},
+	{name: "http-timeout", usage: "timeout de cada petición REST (ej. 60s)",
+		set: setDuration(func(c *AppConfig) *configDuration { return &c.HTTPTimeout })},
+	{name: "max-retries", usage: "intentos por página antes de rendirse",
+		set: setInt(func(c *AppConfig) *int { return &c.MaxRetries })},
+	{name: "initial-backoff", usage: "primera espera entre reintentos (ej. 50ms)",
+		set: setDuration(func(c *AppConfig) *configDuration { return &c.InitialBackoff })},
+	{name: "max-backoff", usage: "espera máxima entre reintentos (ej. 2s)",
+		set: setDuration(func(c *AppConfig) *configDuration { return &c.MaxBackoff })},
+	{name: "group-size", usage: "tickers por petición multi-símbolo",
+		set: setInt(func(c *AppConfig) *int { return &c.GroupSize })},
+	{name: "group-workers", usage: "grupos de tickers descargados a la vez",
+		set: setInt(func(c *AppConfig) *int { return &c.GroupWorkers })},
+	{name: "save-workers", usage: "goroutines que codifican las páginas antes del escritor único de bbolt",
+		set: setInt(func(c *AppConfig) *int { return &c.SaveWorkers })},
+	{name: "ingest-max-batch", usage: "ticks a partir de los cuales el escritor confirma la transacción",
+		set: setInt(func(c *AppConfig) *int { return &c.IngestMaxBatch })},
+	{name: "ingest-max-latency", usage: "espera máxima del escritor por más páginas antes de confirmar (ej. 20ms)",
+		set: setDuration(func(c *AppConfig) *configDuration { return &c.IngestMaxLatency })},
+	{name: "ingest-queue", usage: "páginas en cola hacia el escritor; con la cola llena la descarga espera",
+		set: setInt(func(c *AppConfig) *int { return &c.IngestQueue })},
+	{name: "validation-rules", usage: "reglas de validación separadas por comas (price,size,crossed,tape); vacío = solo el timestamp",
+		set: setList(func(c *AppConfig) *[]string { return &c.ValidationRules })},
+}
+
+func setString(field func(*AppConfig) *string) func(*AppConfig, string) error {
+	return func(c *AppConfig, value string) error {
+		*field(c) = strings.TrimSpace(value)
+		return nil
+	}
+}
+
+func setList(field func(*AppConfig) *[]string) func(*AppConfig, string) error {
+	return func(c *AppConfig, value string) error {
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		*field(c) = items
+		return nil
+	}
+}
+
+func setInt(field func(*AppConfig) *int) func(*AppConfig, string) error {
+	return func(c *AppConfig, value string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("se esperaba un entero: %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setDuration(field func(*AppConfig) *configDuration) func(*AppConfig, string) error {
+	return func(c *AppConfig, value string) error {
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("se esperaba una duración (ej. 2s): %q", value)
+		}
+		*field(c) = configDuration(d)
+		return nil
+	}
+}
+
+// loadConfigs resuelve la configuración del subcomando 'command' a partir de los
+// valores por defecto, el archivo de configuración, el entorno y los flags de 'args'
+// (ver `AppConfig` para la precedencia), y la valida.
+//
+// Parámetros:
+//   - command: subcomando que se va a ejecutar ("download", "stream"); decide qué es obligatorio.
+//   - args: argumentos de línea de comandos tras el subcomando (ej. os.Args[2:]).
+//
+// Devuelve:
+//   - La configuración lista para usar.
+//   - flag.ErrHelp si se pidió la ayuda (-h), o un error que explica cada valor
+//     inválido y de dónde se leyó.
+func loadConfigs(command string, args []string) (AppConfig, error) {
+	fs := flag.NewFlagSet(command, flag.ContinueOnError)
+	configPath := fs.String("config", "", "archivo JSON de configuración (por defecto "+defaultConfigPath+" si existe; env DXM_CONFIG)")
+	envFile := fs.String("env-file", "", "archivo .env con los secretos (por defecto "+defaultEnvFilePath+" si existe; env DXM_ENV_FILE)")
+
+	// Los flags se guardan y se aplican al final, para que ganen al archivo y al entorno.
+	type flagValue struct {
+		setting configSetting
+		value   string
+	}
+	var flagValues []flagValue
+	for _, setting := range configSettings {
+		if setting.noFlag {
+			continue
+		}
+		fs.Func(setting.name, setting.usage+" (env "+setting.envName()+")", func(value string) error {
+			flagValues = append(flagValues, flagValue{setting, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return AppConfig{}, err
+	}
+	if fs.NArg() > 0 {
+		return AppConfig{}, fmt.Errorf("argumentos no reconocidos: %v", fs.Args())
+	}
+
+	// Secretos del archivo .env: solo rellenan variables que no estén ya en el entorno.
+	if err := loadEnvFile(firstNonEmpty(*envFile, os.Getenv("DXM_ENV_FILE"))); err != nil {
+		return AppConfig{}, err
+	}
+
+	cfg := defaultConfig()
+	if err := cfg.loadFile(firstNonEmpty(*configPath, os.Getenv("DXM_CONFIG"))); err != nil {
+		return AppConfig{}, err
+	}
+	for _, setting := range configSettings {
+		if value := os.Getenv(setting.envName()); value != "" {
+			if err := setting.set(&cfg, value); err != nil {
+				return AppConfig{}, fmt.Errorf("variable de entorno %s: %w", setting.envName(), err)
+			}
+		}
+	}
+	for _, fv := range flagValues {
+		if err := fv.setting.set(&cfg, fv.value); err != nil {
+			return AppConfig{}, fmt.Errorf("flag -%s: %w", fv.setting.name, err)
+		}
+	}
+
+	if err := cfg.validate(command); err != nil {
+		return AppConfig{}, err
+	}
+	return cfg, nil
+}
+
+// loadEnvFile carga un archivo .env. Con 'path' vacío se usa `defaultEnvFilePath` y
+// que no exista no es un error; un archivo pedido explícitamente sí debe existir.
+func loadEnvFile(path string) error {
+	if path == "" {
+		if _, err := os.Stat(defaultEnvFilePath); err != nil {
+			log.Printf("loadConfigs: sin %s, se usan las variables de entorno", defaultEnvFilePath)
+			return nil
+		}
+		path = defaultEnvFilePath
+	}
+	if err := env.Load(path); err != nil {
+		return fmt.Errorf("no se pudo cargar el archivo .env '%s': %w", path, err)
+	}
+	return nil
+}
+
+// loadFile superpone sobre 'c' los valores del archivo JSON 'path'. Solo cambian
+// las claves presentes en el archivo; una clave desconocida es un error (suele ser
+// una errata). Con 'path' vacío se usa `defaultConfigPath` si existe.
+func (c *AppConfig) loadFile(path string) error {
+	if path == "" {
+		if _, err := os.Stat(defaultConfigPath); err != nil {
+			return nil
+		}
+		path = defaultConfigPath
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("no se pudo leer el archivo de configuración: %w", err)
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(raw)))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("archivo de configuración '%s': %w", path, err)
+	}
+	log.Printf("loadConfigs: configuración leída de %s", path)
+	return nil
+}
+
+// Valores admitidos por la API de Alpaca.
+var (
+	validFeeds    = []string{"sip", "iex", "delayed_sip", "boats", "overnight", "otc"}
+	validDatasets = []string{datasetQuotes, datasetTrades, datasetBars}
+)
+
+// minInitialBackoff es la menor espera inicial entre reintentos que se admite: por
+// debajo el backoff exponencial no da tiempo a que se recupere nada.
+const minInitialBackoff = time.Millisecond
+
+// validate normaliza los símbolos a mayúsculas y comprueba que todos los valores sean
+// usables por el subcomando 'command'. Devuelve un único error con todos los problemas
+// encontrados, para poder corregirlos de una vez.
+func (c *AppConfig) validate(command string) error {
+	var problems []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	needsAlpaca := c.Source == "alpaca" || command == "stream"
+	check(!needsAlpaca || (c.AlpacaAPIKey != "" && c.AlpacaSecretKey != ""),
+		"las claves de Alpaca no están configuradas (API_KEY_ID y API_SECRET_KEY, en el entorno o en %s)", defaultEnvFilePath)
+	check(c.Protocol == "https" || c.Protocol == "http", "protocol: se esperaba https o http, no %q", c.Protocol)
+	check(c.Domain != "", "domain: no puede estar vacío")
+	check(c.StreamDomain != "", "stream_domain: no puede estar vacío")
+	check(c.DBPath != "", "db_path: no puede estar vacío")
+	check(slices.Contains(ticks.QuoteLayouts, c.QuoteLayout), "quote_layout: se esperaba uno de %v, no %q", ticks.QuoteLayouts, c.QuoteLayout)
+	check(slices.Contains([]string{ticks.PeriodDay, ticks.PeriodMonth, ticks.PeriodYear}, c.PartitionPeriod),
+		"partition_period: se esperaba %s, %s o %s, no %q", ticks.PeriodDay, ticks.PeriodMonth, ticks.PeriodYear, c.PartitionPeriod)
+	check(c.PartitionMaxOpen >= 1, "partition_max_open: debe ser al menos 1, no %d", c.PartitionMaxOpen)
+
+	for i, sym := range c.Symbols {
+		c.Symbols[i] = strings.ToUpper(strings.TrimSpace(sym))
+		check(c.Symbols[i] != "" && !strings.ContainsAny(c.Symbols[i], " ,/"), "symbols: ticker inválido %q", sym)
+	}
+	check(len(c.Symbols) > 0, "symbols: se necesita al menos un ticker")
+
+	start, startErr := time.Parse(time.RFC3339, c.Start)
+	check(startErr == nil, "start: se esperaba una fecha RFC3339 (ej. 2016-01-01T00:00:00Z), no %q", c.Start)
+	if c.End != "" {
+		end, endErr := time.Parse(time.RFC3339, c.End)
+		check(endErr == nil, "end: se esperaba una fecha RFC3339 o vacío, no %q", c.End)
+		check(endErr != nil || startErr != nil || end.After(start), "end (%s) debe ser posterior a start (%s)", c.End, c.Start)
+	}
+	check(slices.Contains(validFeeds, c.Feed), "feed: se esperaba uno de %v, no %q", validFeeds, c.Feed)
+
+	check(len(c.Datasets) > 0, "datasets: se necesita al menos uno de %v", validDatasets)
+	for _, dataset := range c.Datasets {
+		check(slices.Contains(validDatasets, dataset), "datasets: se esperaba uno de %v, no %q", validDatasets, dataset)
+	}
+	barsErr := validateBarOptions(c.BarTimeframe, c.BarAdjustment)
+	check(barsErr == nil, "bar_timeframe/bar_adjustment: %v", barsErr)
+	check(c.Source == "alpaca" || c.Source == "file", "source: se esperaba alpaca o file, no %q", c.Source)
+	check(c.Source != "file" || c.SourceDir != "", "source_dir: no puede estar vacío con source = file")
+
+	check(c.PageLimit >= 1 && c.PageLimit <= 10000, "page_limit: debe estar entre 1 y 10000, no %d", c.PageLimit)
+	check(c.RateLimitPerMinute >= 1, "rate_limit_per_minute: debe ser al menos 1, no %d", c.RateLimitPerMinute)
+	check(c.HTTPTimeout > 0, "http_timeout: debe ser positivo")
+	check(c.MaxRetries >= 1, "max_retries: debe ser al menos 1, no %d", c.MaxRetries)
+	check(c.InitialBackoff.Duration() >= minInitialBackoff, "initial_backoff: debe ser al menos %v, no %v",
+		minInitialBackoff, c.InitialBackoff.Duration())
+	check(c.MaxBackoff >= c.InitialBackoff, "max_backoff (%v) no puede ser menor que initial_backoff (%v)",
+		c.MaxBackoff.Duration(), c.InitialBackoff.Duration())
+	check(c.GroupSize >= 1, "group_size: debe ser al menos 1, no %d", c.GroupSize)
+	check(c.GroupWorkers >= 1, "group_workers: debe ser al menos 1, no %d", c.GroupWorkers)
+	check(c.SaveWorkers >= 1, "save_workers: debe ser al menos 1, no %d", c.SaveWorkers)
+	check(c.IngestMaxBatch >= 1, "ingest_max_batch: debe ser al menos 1, no %d", c.IngestMaxBatch)
+	check(c.IngestMaxLatency > 0, "ingest_max_latency: debe ser positivo")
+	check(c.IngestQueue >= 1, "ingest_queue: debe ser al menos 1, no %d", c.IngestQueue)
+	for _, rule := range c.ValidationRules {
+		check(slices.Contains(ticks.ValidationRules, rule), "validation_rules: se esperaba una de %v, no %q", ticks.ValidationRules, rule)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("configuración inválida:\n%w", errors.Join(problems...))
+	}
+	return nil
+}
+
+// callOptions devuelve las opciones de reintentos de las llamadas REST a Alpaca.
+func (c AppConfig) callOptions() alpacaCallItOptions {
+	return alpacaCallItOptions{
+		key:            c.AlpacaAPIKey,
+		secret:         c.AlpacaSecretKey,
+		MaxRetries:     c.MaxRetries,
+		initialBackoff: c.InitialBackoff.Duration(),
+		maxBackoff:     c.MaxBackoff.Duration(),
+		logText:        "Descarga de Alpaca",
+	}
+}
+
+// ingestOptions devuelve las opciones del escritor de ingesta sobre 'dbInstance' y,
+// si no es nil, 'partitions' (ver `openTickPartitions`).
+func (c AppConfig) ingestOptions(dbInstance *db.DB, partitions *ticks.PartitionedStore) IngestOptions {
+	return IngestOptions{
+		DB_INSTANCE: dbInstance,
+		LAYOUT:      c.QuoteLayout,
+		PARTITIONS:  partitions,
+		ENCODERS:    c.SaveWorkers,
+		MAX_BATCH:   c.IngestMaxBatch,
+		MAX_LATENCY: c.IngestMaxLatency.Duration(),
+		QUEUE:       c.IngestQueue,
+		RULES:       c.ValidationRules,
+	}
+}
+
+// firstNonEmpty devuelve el primer valor no vacío.
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
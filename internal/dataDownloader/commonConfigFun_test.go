@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		backoff time.Duration
+		valid   bool
+	}{
+		{time.Nanosecond, false},
+		{time.Millisecond - 1, false},
+		{time.Millisecond, true},
+		{50 * time.Millisecond, true},
+	} {
+		cfg := defaultConfig()
+		cfg.Source = "file"
+		cfg.SourceDir = t.TempDir()
+		cfg.InitialBackoff = configDuration(tc.backoff)
+		err := cfg.validate("download")
+		if got := err == nil || !strings.Contains(err.Error(), "initial_backoff"); got != tc.valid {
+			t.Errorf("initial_backoff %v: válido %v, se esperaba %v (%v)", tc.backoff, got, tc.valid, err)
+		}
+	}
+}
+
+// bar_timeframe y bar_adjustment siguen la misma gramática que `validateBarOptions`.
+func TestValidateBarOptions(t *testing.T) {
+	for _, tc := range []struct {
+		timeframe, adjustment string
+		valid                 bool
+	}{
+		{"1Min", "raw", true},
+		{"59T", "split", true},
+		{"23Hour", "all", true},
+		{"1Day", "", true},
+		{"12Month", "dividend", true},
+		{"60Min", "raw", false},
+		{"24H", "raw", false},
+		{"2Day", "raw", false},
+		{"5Month", "raw", false},
+		{"0Min", "raw", false},
+		{"Min", "raw", false},
+		{"1Min", "adjusted", false},
+	} {
+		cfg := defaultConfig()
+		cfg.Source = "file"
+		cfg.SourceDir = t.TempDir()
+		cfg.BarTimeframe, cfg.BarAdjustment = tc.timeframe, tc.adjustment
+		err := cfg.validate("download")
+		if got := err == nil || !strings.Contains(err.Error(), "bar_timeframe"); got != tc.valid {
+			t.Errorf("%q %q: válido %v, se esperaba %v (%v)", tc.timeframe, tc.adjustment, got, tc.valid, err)
+		}
+	}
+}
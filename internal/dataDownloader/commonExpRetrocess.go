@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -16,6 +18,27 @@ type ActionFunc func(attempt int) (interface{}, error)
 // Recibe el error producido y un mensaje personalizado asociado con la acción.
 type ErrorHandlerFunc func(err error, message string)
 
+// PermanentError marca un error que no se debe reintentar: `executeActionWithRetries`
+// abandona en cuanto una acción lo devuelve, en lugar de esperar y repetir.
+// Se crea con `Permanent`.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+
+// Unwrap permite que errors.Is / errors.As lleguen al error original.
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+// Permanent envuelve 'err' para indicar a `executeActionWithRetries` que no vale la
+// pena reintentar (ej. credenciales inválidas o una petición mal formada).
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
 // executeActionWithRetries intenta ejecutar una acción con múltiples reintentos,
 // aplicando retroceso exponencial con "jitter" aleatorio para suavizar las colisiones.
 //
@@ -26,6 +49,7 @@ type ErrorHandlerFunc func(err error, message string)
 //   - Servicios de almacenamiento o red saturados
 //
 // Parámetros:
+// - ctx: contexto de cancelación; si se cancela, se deja de reintentar y la espera entre intentos se interrumpe.
 // - action: función que encapsula la operación a ejecutar con reintentos.
 // - errorHandler: función llamada tras cada fallo para loguear o gestionar el error.
 // - maxRetries: número máximo de intentos permitidos.
@@ -35,7 +59,7 @@ type ErrorHandlerFunc func(err error, message string)
 //
 // Devuelve:
 // - El resultado (`interface{}`) retornado por la acción en caso de éxito.
-// - Un error si se agotaron los reintentos sin éxito.
+// - Un error si se agotaron los reintentos, al primer error marcado con `Permanent`, o si se canceló 'ctx' (envuelve ctx.Err()).
 //
 // Ejemplo de retroceso exponencial con jitter:
 //
@@ -43,6 +67,7 @@ type ErrorHandlerFunc func(err error, message string)
 //	Intento 2: espera 200ms + jitter
 //	Intento 3: espera 400ms + jitter (hasta maxBackoff)
 func executeActionWithRetries(
+	ctx context.Context,
 	action ActionFunc,
 	errorHandler ErrorHandlerFunc,
 	maxRetries int,
@@ -55,6 +80,9 @@ func executeActionWithRetries(
 	var result interface{}
 
 	for i := 1; i <= maxRetries; i++ {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("'%s' cancelado antes del intento %d: %w", actionName, i, ctx.Err())
+		}
 		log.Printf("Intentando '%s' (Intento %d)...", actionName, i)
 
 		res, err := action(i)
@@ -65,18 +93,39 @@ func executeActionWithRetries(
 
 		errorHandler(err, fmt.Sprintf("Fallo en '%s'", actionName))
 
+		// Cancelación: el error de la acción es consecuencia de ella, no se reintenta.
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("'%s' cancelado en el intento %d: %w", actionName, i, errors.Join(ctx.Err(), err))
+		}
+
+		var permanent *PermanentError
+		if errors.As(err, &permanent) {
+			log.Printf("executeActionWithRetries: Error permanente en '%s' (intento %d), no se reintenta: %v",
+				actionName, i, err)
+			return nil, fmt.Errorf("fallo permanente de '%s': %w", actionName, err)
+		}
+
 		if i < maxRetries {
-			// Retroceso exponencial con jitter aleatorio (50% del backoff)
+			// Retroceso exponencial con jitter aleatorio (50% del backoff); con esperas de
+			// 1ns no hay margen para el jitter
 			backoff := initialBackoff * time.Duration(1<<uint(i-1))
 			if backoff > maxBackoff {
 				backoff = maxBackoff
 			}
-			jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
-			sleepDuration := backoff + jitter
+			sleepDuration := backoff
+			if half := int64(backoff) / 2; half > 0 {
+				sleepDuration += time.Duration(rand.Int63n(half))
+			}
 
 			log.Printf("Esperando %v antes del próximo reintento de '%s' (Intento %d/%d)...",
 				sleepDuration, actionName, i+1, maxRetries)
-			time.Sleep(sleepDuration)
+			timer := time.NewTimer(sleepDuration)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, fmt.Errorf("'%s' cancelado esperando el reintento %d: %w", actionName, i+1, ctx.Err())
+			}
 		} else {
 			log.Printf("executeActionWithRetries: Se agotaron los reintentos para '%s' después de %d intentos. Fallo definitivo.",
 				actionName, maxRetries)
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Con esperas de 1ns no hay margen para el jitter: se reintenta sin él.
+func TestExecuteActionWithRetriesTinyBackoff(t *testing.T) {
+	for _, backoff := range []time.Duration{time.Nanosecond, 2 * time.Nanosecond, time.Millisecond} {
+		res, err := executeActionWithRetries(context.Background(),
+			func(attempt int) (interface{}, error) {
+				if attempt < 3 {
+					return nil, errors.New("fallo transitorio")
+				}
+				return attempt, nil
+			},
+			func(error, string) {}, 3, backoff, backoff, "tiny-backoff")
+		if err != nil || res != 3 {
+			t.Errorf("backoff %v: resultado %v, error %v", backoff, res, err)
+		}
+	}
+}
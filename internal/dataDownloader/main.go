@@ -2,198 +2,214 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	db "go.etcd.io/bbolt"
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
 )
 
-var symbol = "QQQ"
-var domain = "data.alpaca.markets"
-var path = "/v2/stocks/" + symbol + "/quotes"
-var query = "start=2016-01-01T00%3A00%3A00Z&limit=2&feed=sip&sort=asc"
-var fAddress = WebQuery(WebQueryAddress{domain: domain, path: path, query: query})
 var LogBuffer bytes.Buffer // Un buffer en memoria para capturar los logs
 
-// defining a struct instance
-var thisQuote Quote
-
 func main() {
-	var thisDB *db.DB = nil
 	// 1. Initialize log process early
 	LogInit()
 	log.Println("Application started. Logs redirected to in-memory buffer.")
 
-	//
-	// 2. Call Alpaca API with retries
-	// Using config.cfgAlpacaConnect assuming it's in your config package
-	res, _ := alpacaCallItWithRetries(
-		alpacaCallItOptions{
-			url:            fAddress,              //	url string,
-			MaxRetries:     3,                     //	maxRetries int,
-			maxBackoff:     2 * time.Second,       //	maxBackoff time.Duration,
-			initialBackoff: 50 * time.Millisecond, //	initialBackoff time.Duration,
-			logText:        "Descarga de Alpaca",  //	logText string
-		})
-
-	// 3. Decode the Alpaca response into thisQuote
-	// This populates thisQuote.Symbol, which is needed later
-	unmarshalGeneric([]byte(res), &thisQuote)
-	//log.Println("Alpaca data downloaded for symbol: %s", thisQuote.Symbol)
-
-	// 4. Initialize DB with retries
-	// Use config.WriteConfig for DB options
-	var err error         // Declare err here for main's scope
-	var dbInstance *db.DB // Declare a local variable for the DB instance
+	// Subcomandos: sin subcomando se hace la descarga histórica. Lo que sigue al
+	// subcomando son flags de configuración (ver `loadConfigs`).
+	command, args := "download", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "download", "stream":
+		cfg, err := loadConfigs(command, args)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(2)
+		}
+		alpacaHTTPClient.Timeout = cfg.HTTPTimeout.Duration()
+		alpacaLimiter.SetLimit(cfg.RateLimitPerMinute)
+		partitions, err := openTickPartitions(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+		if command == "download" {
+			err = runDownload(cfg, partitions)
+		} else {
+			runStream(cfg, partitions)
+		}
+		if partitions != nil {
+			if err := partitions.Close(); err != nil {
+				log.Printf("Error closing tick partitions: %v", err)
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+	case "migrate":
+		if err := runMigrate(args); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+	case "inventory":
+		if err := runInventory(args); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+	case "fsck":
+		if err := runFsck(args); err != nil && !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command, err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Printf("Subcomando desconocido '%s'. Uso: dataDownloader [download|stream|migrate|inventory|fsck] [flags]\n", command)
+		os.Exit(2)
+	}
+}
 
-	// Call initDBWithRetries and assign its result to dbInstance
-	dbInstance, err = initDBWithRetries(WriteConfig)
-	if err != nil {
-		log.Fatalf("Fatal: Failed to initialize database: %v", err)
+// printValidationReport muestra por consola cuántos ticks rechazó la validación, por
+// regla, y dónde quedaron. Los logs van a `LogBuffer`: este resumen tiene que verse.
+func printValidationReport(stats IngestStats) {
+	if stats.RejectedTotal() == 0 {
+		fmt.Println("Validación: ningún tick rechazado.")
+		return
 	}
-	// Set the global thisDB AFTER it's successfully initialized
-	thisDB = dbInstance // <--- THIS IS THE CRITICAL LINE!
-	log.Println("Database initialized successfully.")
+	fmt.Printf("Validación: %s (ver el bucket %s).\n", stats.RejectedSummary(), ticks.QuarantineBucket)
+}
 
-	// IMPORTANT: Defer closing the DB connection
+// runDownload descarga el histórico de todos los datasets y símbolos de 'cfg'. Con
+// 'partitions' las quotes y los trades van a las particiones. Devuelve un error si no
+// se puede preparar la descarga; los errores de cada dataset solo se registran en el
+// log, y una interrupción no es un error.
+func runDownload(cfg AppConfig, partitions *ticks.PartitionedStore) error {
+	// SIGINT/SIGTERM cancelan el contexto: las peticiones en curso se abortan, los
+	// lotes ya entregados al escritor se confirman y la base de datos se cierra
+	// con el defer de abajo. El checkpoint permite reanudar en la siguiente ejecución.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 2. Open the DB (with retries) through the DB manager, which closes it on return
+	dbs := newDBManager(ctx)
 	defer func() {
-		if thisDB != nil {
-			closeErr := thisDB.Close()
-			if closeErr != nil {
-				log.Printf("Error closing database: %v", closeErr)
-			} else {
-				log.Println("Database closed successfully.")
-			}
+		if closeErr := dbs.CloseAll(); closeErr != nil {
+			log.Printf("Error closing database: %v", closeErr)
+		} else {
+			log.Println("Database closed successfully.")
 		}
 	}()
-
-	// 5. Load the symbol bucket
-	// NOW, initialize thisTickerUpdater with the VALID dbInstance
-	// You cannot use the global `config.thisTickerUpdater` directly if it was initialized
-	// with a nil `dbInstance` at package-level. You need to create a new one, or
-	// modify the existing one.
-	bucket, err := InitBucketWithRetries(
-		BkOptions{
-			DB_INSTANCE: thisDB,
-			BUCKET_NAME: symbol, // Se asume que 'thisQuote' es accesible y tiene un campo 'Symbol'
-			ALPACA_QUOTE_BUCKET_SLOTS: oneQuote{
-				AP: 0,
-				AS: 0,
-				AX: "",
-				BP: 0,
-				BS: 0,
-				BX: "",
-				C:  "",
-				Z:  "",
-				T:  "",
-			},
-		}) // Pass the local config
+	dbInstance, err := dbs.Open(mainDBName, cfg.DBPath, false)
 	if err != nil {
-		log.Fatalf("Fatal: Failed to initialize symbol bucket: %v", err)
+		return fmt.Errorf("failed to initialize database: %w", err)
 	}
-	log.Printf("Bucket '%s' initialized successfully. Bucket pointer: %v", thisQuote.Symbol, bucket)
-	//fmt.Print(thisQuote.Quotes)
-
-	//  'thisQuote' es de tipo QuoteResponse y tiene un campo 'Quotes'
-	// que es un slice de alpaca.Quote
-	quotesToSave := thisQuote.Quotes
-	symbolToSave := thisQuote.Symbol // O QQQ si es constante
+	log.Println("Database initialized successfully.")
 
-	batchSize := len(quotesToSave) // Número de quotes por transacción
-	numWorkers := 4                // Número de goroutines concurrentes (ajusta según CPU y IO)
+	// Every page is saved through a single writer goroutine (bbolt allows only one
+	// writer). It is closed before the DB, after the last page has been committed.
+	ingest, err := NewIngestWriter(cfg.ingestOptions(dbInstance, partitions))
+	if err != nil {
+		return err
+	}
+	defer ingest.Close()
+
+	// 3. Create the bucket of every symbol up front; the pages are saved into it by the
+	// ingest writer as they are downloaded
+	for _, symbol := range cfg.Symbols {
+		bucket, err := InitBucketWithRetries(ctx,
+			BkOptions{
+				DB_INSTANCE: dbInstance,
+				BUCKET_NAME: symbol,
+				QUOTE_BUCKET_SLOTS: QuoteRecord{
+					AP: 0,
+					AS: 0,
+					AX: "",
+					BP: 0,
+					BS: 0,
+					BX: "",
+					C:  nil,
+					Z:  "",
+					T:  "",
+				},
+			})
+		if err != nil {
+			return fmt.Errorf("failed to initialize symbol bucket '%s': %w", symbol, err)
+		}
+		log.Printf("Bucket '%s' initialized successfully. Bucket pointer: %v", symbol, bucket)
+	}
 
-	log.Printf("Iniciando guardado concurrente de %d quotes para %s...", len(quotesToSave), symbolToSave)
-	err = SaveQuotesConcurrently(dbInstance, symbolToSave, quotesToSave, batchSize, numWorkers)
+	// 4. Download every page from the configured provider and save each one as it
+	// arrives, resuming from the checkpoint stored in the DB if a previous run was
+	// interrupted. Symbols are requested in groups through the multi-symbol endpoints.
+	provider, err := newProvider(cfg)
 	if err != nil {
-		log.Printf("Fatal: Error al guardar quotes: %v", err)
+		return err
 	}
-	log.Println("Quotes guardadas exitosamente.")
+	for _, dataset := range cfg.Datasets {
+		total, err := downloadUniverse(
+			ctx,
+			dbInstance,
+			provider,
+			dataset,
+			FetchRequest{
+				Start:      cfg.Start,
+				End:        cfg.End,
+				Feed:       cfg.Feed,
+				Timeframe:  cfg.BarTimeframe,
+				Adjustment: cfg.BarAdjustment,
+			},
+			UniverseOptions{
+				SYMBOLS:       cfg.Symbols,
+				GROUP_SIZE:    cfg.GroupSize,
+				GROUP_WORKERS: cfg.GroupWorkers,
+				INGEST:        ingest,
+			})
+		if ctx.Err() != nil {
+			log.Printf("Descarga de %s interrumpida (%d guardadas); se reanudará desde el checkpoint.", dataset, total)
+			printValidationReport(ingest.Stats())
+			return nil
+		}
+		if err != nil {
+			log.Printf("Fatal: Error al descargar o guardar %s: %v", dataset, err)
+		} else {
+			log.Printf("%s guardadas exitosamente: %d en total.", dataset, total)
+		}
+	}
+	printValidationReport(ingest.Stats())
 
 	//
 	// ==
 	//
 
 	// retrieve the data
-	dbInstance.View(func(tx *db.Tx) error {
-		// 1. Obtén el bucket principal del símbolo (ej. "QQQ")
-		symbolBucket := tx.Bucket([]byte(symbol))
-		if symbolBucket == nil {
-			return fmt.Errorf("Bucket '%s' no encontrado", symbol)
-		}
-
-		// Nombres de los sub-buckets para iterar
-		fieldBuckets := []string{"AP", "AS", "AX", "BP", "BS", "BX", "C", "Z"}
-
-		// 2. Itera sobre cada sub-bucket dentro del bucket del símbolo
-		for _, fieldName := range fieldBuckets {
-			subBucket := symbolBucket.Bucket([]byte(fieldName))
-			if subBucket == nil {
-				// Esto podría pasar si un sub-bucket aún no se ha creado
-				// (ej. si no hay datos para ese campo todavía)
-				fmt.Printf("Sub-bucket '%s' para símbolo '%s' no encontrado.\n", fieldName, symbol)
-				continue // Pasa al siguiente sub-bucket
-			}
-
-			fmt.Printf("--- Datos para Símbolo: %s, Campo: %s ---\n", symbol, fieldName)
-
-			// 3. Dentro de cada sub-bucket, itera sobre los pares clave-valor (timestamp -> valor del campo)
-			err := subBucket.ForEach(func(k, v []byte) error {
-				// Convierte la clave (timestamp Unix Nano []byte) de nuevo a int64 y luego a time.Time para legibilidad
-				unixNano := int64(binary.BigEndian.Uint64(k))
-				t := time.Unix(0, unixNano) // Convertir a time.Time
-
-				// Imprime la clave (timestamp) y el valor
-				// Nota: v es []byte. Si sabes el tipo original, puedes convertirlo de nuevo.
-				// Por ejemplo, si es un float, strconv.ParseFloat. Si es JSON, json.Unmarshal.
-				fmt.Printf("  Key (Timestamp): %s, Value: %s\n", t.Format(time.RFC3339Nano), string(v))
-				return nil
-			})
-			if err != nil {
-				return fmt.Errorf("Error al iterar sub-bucket '%s': %w", fieldName, err)
-			}
-		}
-
-		return nil
-	})
-	/*
-		for i, q := range thisQuote.Quotes {
-			//
-			// timestamp parsing
-			// Example timestamp from Alpaca
-			timestampStr := q.T
-
-			// Go's time package understands RFC3339 very well
-			t, err := time.Parse(time.RFC3339Nano, timestampStr) // Use RFC3339Nano for sub-second precision
+	var store ticks.TickStore
+	if partitions != nil {
+		store = partitions
+	} else if store, err = ticks.NewBoltStore(dbInstance, cfg.QuoteLayout); err != nil {
+		return err
+	}
+	for _, symbol := range cfg.Symbols {
+		fmt.Printf("--- Quotes de %s ---\n", symbol)
+		for q, err := range store.Quotes(ticks.QueryOptions{SYMBOL: symbol}) {
 			if err != nil {
-				log.Fatalf("Error parsing timestamp: %v", err)
+				fmt.Fprintf(os.Stderr, "Error al leer las quotes de %s: %v\n", symbol, err)
+				break
 			}
-			// Convert time.Time to int64 Unix Nanoseconds
-			unixNano := t.UnixNano() // This gives you an int64
-			// This int64 represents the number of nanoseconds since January 1, 1970 UTC.
-			// This number *always* increases monotonically with time.
-			key := make([]byte, 8)                            // An int64 is 8 bytes
-			binary.BigEndian.PutUint64(key, uint64(unixNano)) // Cast to uint64 for PutUint6
-			fmt.Printf("--- Quote %d ---\n", i+1)
-			fmt.Printf("  AP: %f, AS: %d, AX: %s\n", q.AP, q.AS, q.AX)
-			fmt.Printf("  BP: %f, BS: %d, BX: %s\n", q.BP, q.BS, q.BX)
-			fmt.Printf("  Conditions: %v\n", q.C)
-			fmt.Printf("  Tape: %v\n", q.Z)
-			//
-			fmt.Printf("  Timestamp: %v\n", unixNano)
-			//
-			//
-			//
-			// INICIA INYECCION DE DATOS
-			//
-			//
-			//
-			//
-			// SIEMPRE SE CIERRA TRAS LA OPERACION
-			defer thisDB.Close() // ¡Recuerda cerrar la DB!
-
+			fmt.Printf("  %s #%d  bid %v x %d (%s)  ask %v x %d (%s)  c=%q z=%s\n",
+				q.Time.Format(time.RFC3339Nano), q.Seq, q.BP, q.BS, q.BX, q.AP, q.AS, q.AX, ticks.QuoteConditionNames(q.QuoteRecord), q.Z)
 		}
-	*/
-	defer thisDB.Close() // ¡Recuerda cerrar la DB!
+	}
+	return nil
 }
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	db "go.etcd.io/bbolt"
+)
+
+// TestMain descarta los logs, como hace `LogInit` con `LogBuffer` en el programa:
+// los tests informan con 't' y no deben llenar la salida de `go test`.
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// countBucketKeys cuenta las claves del bucket anidado en 'path' (0 si no existe).
+func countBucketKeys(tx *db.Tx, path ...string) int {
+	bucket := tx.Bucket([]byte(path[0]))
+	for _, name := range path[1:] {
+		if bucket == nil {
+			return 0
+		}
+		bucket = bucket.Bucket([]byte(name))
+	}
+	if bucket == nil {
+		return 0
+	}
+	return bucket.Stats().KeyN
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileProvider es un `MarketDataProvider` que lee archivos planos locales, para
+// rellenar el histórico con archivos de proveedores que ya tenemos.
+//
+// Estructura esperada bajo 'dir':
+//
+//	{dir}/{SYMBOL}/quotes/*.csv|*.json|*.jsonl
+//	{dir}/{SYMBOL}/trades/*.csv|*.json|*.jsonl
+//	{dir}/{SYMBOL}/bars/{timeframe}/*.csv|*.json|*.jsonl
+//
+// Los archivos de cada carpeta se leen en orden alfabético (se espera que el nombre
+// ordene cronológicamente, ej. "2016-01-04.csv") y sus registros en orden ascendente
+// de timestamp. Formatos:
+//   - .csv: primera fila con los nombres de columna cortos de docs/rawData.json
+//     (ap, as, ax, bp, bs, bx, c, t, z / p, s, x, i, c, t, z / o, h, l, c, v, n, vw, t).
+//     La columna 'c' lleva las condiciones separadas por espacios.
+//   - .json: un array de registros, o una página guardada tal cual de Alpaca
+//     (`{"quotes": [...]}`, `{"trades": [...]}`, `{"bars": [...]}`).
+//   - .jsonl / .ndjson: un registro JSON por línea.
+//
+// Cada archivo se carga completo en memoria y se entrega en páginas de 'pageSize'
+// registros. El token de página es "SYMBOL/archivo/desplazamiento". El feed y el
+// ajuste de las barras se ignoran: los datos se guardan tal como vienen.
+type fileProvider struct {
+	dir      string
+	pageSize int
+}
+
+// newFileProvider crea el proveedor de archivos planos bajo 'dir'.
+func newFileProvider(dir string, pageSize int) (*fileProvider, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("carpeta de archivos del proveedor: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("'%s' no es una carpeta", dir)
+	}
+	if pageSize < 1 {
+		pageSize = 10000
+	}
+	return &fileProvider{dir: dir, pageSize: pageSize}, nil
+}
+
+func (p *fileProvider) Name() string { return "file" }
+
+func (p *fileProvider) FetchQuotes(ctx context.Context, req FetchRequest, pageToken string, handler QuotePageHandler) (int, error) {
+	return fetchFromFiles(ctx, p, req, pageToken, datasetQuotes, parseQuoteRow,
+		func(q QuoteRecord) string { return q.T }, handler)
+}
+
+func (p *fileProvider) FetchTrades(ctx context.Context, req FetchRequest, pageToken string, handler TradePageHandler) (int, error) {
+	return fetchFromFiles(ctx, p, req, pageToken, datasetTrades, parseTradeRow,
+		func(t TradeRecord) string { return t.T }, handler)
+}
+
+func (p *fileProvider) FetchBars(ctx context.Context, req FetchRequest, pageToken string, handler BarPageHandler) (int, error) {
+	if req.Timeframe == "" {
+		return 0, fmt.Errorf("falta el timeframe de las barras")
+	}
+	return fetchFromFiles(ctx, p, req, pageToken, datasetBars, parseBarRow,
+		func(b BarRecord) string { return b.T }, handler)
+}
+
+// datasetDir devuelve la carpeta con los archivos de un símbolo y dataset.
+func (p *fileProvider) datasetDir(symbol, dataset string, req FetchRequest) string {
+	if dataset == datasetBars {
+		return filepath.Join(p.dir, symbol, dataset, req.Timeframe)
+	}
+	return filepath.Join(p.dir, symbol, dataset)
+}
+
+// fetchFromFiles recorre los archivos de cada símbolo de 'req' y entrega a 'handler'
+// los registros dentro de [req.Start, req.End), en páginas de 'p.pageSize'. Si
+// 'pageToken' no está vacío, continúa desde la página que lo generó. Se detiene
+// entre páginas si 'ctx' se cancela.
+func fetchFromFiles[R any](
+	ctx context.Context,
+	p *fileProvider,
+	req FetchRequest,
+	pageToken string,
+	dataset string,
+	parseRow func(row map[string]string) (R, error),
+	timestamp func(R) string,
+	handler func(symbol string, records []R, pageToken string) error,
+) (int, error) {
+	start, end, err := fileRange(req)
+	if err != nil {
+		return 0, err
+	}
+	resumeSymbol, resumeFile, resumeOffset, err := parseFileToken(pageToken)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, symbol := range req.Symbols {
+		if resumeSymbol != "" && symbol != resumeSymbol {
+			continue // Símbolos ya terminados antes de la interrupción
+		}
+		resumeSymbol = ""
+
+		dir := p.datasetDir(symbol, dataset, req)
+		files, err := listRecordFiles(dir)
+		if err != nil {
+			return total, err
+		}
+
+	files:
+		for _, name := range files {
+			if name < resumeFile {
+				continue
+			}
+			offset := 0
+			if name == resumeFile {
+				offset = resumeOffset
+			}
+			resumeFile = ""
+
+			records, err := readRecordFile(filepath.Join(dir, name), dataset, parseRow)
+			if err != nil {
+				return total, err
+			}
+
+			for ; offset < len(records); offset += p.pageSize {
+				if ctx.Err() != nil {
+					return total, ctx.Err()
+				}
+				chunk := records[offset:min(offset+p.pageSize, len(records))]
+				page := make([]R, 0, len(chunk))
+				reachedEnd := false
+				for _, r := range chunk {
+					t, err := time.Parse(time.RFC3339Nano, timestamp(r))
+					if err == nil && !start.IsZero() && t.Before(start) {
+						continue
+					}
+					if err == nil && !end.IsZero() && !t.Before(end) {
+						reachedEnd = true
+						break
+					}
+					page = append(page, r) // Timestamps inválidos pasan: el guardado los registra y descarta
+				}
+				if len(page) > 0 {
+					if err := handler(symbol, page, fileToken(symbol, name, offset)); err != nil {
+						return total, err
+					}
+					total += len(page)
+				}
+				if reachedEnd {
+					break files // Los registros están ordenados: nada más de este símbolo entra en el rango
+				}
+			}
+		}
+	}
+	return total, nil
+}
+
+// fileRange interpreta el rango [Start, End) de la petición; un extremo vacío queda en cero.
+func fileRange(req FetchRequest) (start, end time.Time, err error) {
+	if req.Start != "" {
+		if start, err = time.Parse(time.RFC3339Nano, req.Start); err != nil {
+			return start, end, fmt.Errorf("fecha inicial inválida '%s': %w", req.Start, err)
+		}
+	}
+	if req.End != "" {
+		if end, err = time.Parse(time.RFC3339Nano, req.End); err != nil {
+			return start, end, fmt.Errorf("fecha final inválida '%s': %w", req.End, err)
+		}
+	}
+	return start, end, nil
+}
+
+// fileToken construye el token de la página que empieza en 'offset' dentro de 'file'.
+func fileToken(symbol, file string, offset int) string {
+	return symbol + "/" + file + "/" + strconv.Itoa(offset)
+}
+
+// parseFileToken descompone un token de `fileToken`. Un token vacío devuelve todo vacío.
+func parseFileToken(token string) (symbol, file string, offset int, err error) {
+	if token == "" {
+		return "", "", 0, nil
+	}
+	parts := strings.Split(token, "/")
+	if len(parts) != 3 {
+		return "", "", 0, fmt.Errorf("token de página de archivos inválido '%s'", token)
+	}
+	offset, err = strconv.Atoi(parts[2])
+	if err != nil || offset < 0 {
+		return "", "", 0, fmt.Errorf("token de página de archivos inválido '%s'", token)
+	}
+	return parts[0], parts[1], offset, nil
+}
+
+// listRecordFiles devuelve, en orden alfabético, los archivos de datos de 'dir'.
+// Si la carpeta no existe no hay nada que leer y se devuelve una lista vacía.
+func listRecordFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al listar '%s': %w", dir, err)
+	}
+	var files []string
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".csv", ".json", ".jsonl", ".ndjson":
+			if !e.IsDir() {
+				files = append(files, e.Name())
+			}
+		}
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// readRecordFile lee todos los registros de un archivo según su extensión (ver `fileProvider`).
+func readRecordFile[R any](path, dataset string, parseRow func(row map[string]string) (R, error)) ([]R, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error al leer '%s': %w", path, err)
+	}
+
+	var records []R
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		records, err = readCSVRecords(raw, parseRow)
+	case ".json":
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) > 0 && trimmed[0] == '{' {
+			// Página de Alpaca guardada tal cual: los registros van bajo la clave del dataset.
+			var page map[string]json.RawMessage
+			if err = json.Unmarshal(trimmed, &page); err == nil {
+				err = json.Unmarshal(page[dataset], &records)
+			}
+		} else {
+			err = json.Unmarshal(trimmed, &records)
+		}
+	default: // .jsonl, .ndjson
+		scanner := bufio.NewScanner(bytes.NewReader(raw))
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var r R
+			if err = json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				err = fmt.Errorf("línea %d: %w", line, err)
+				break
+			}
+			records = append(records, r)
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error al decodificar '%s': %w", path, err)
+	}
+	return records, nil
+}
+
+// readCSVRecords decodifica un CSV con fila de encabezados, convirtiendo cada fila con 'parseRow'.
+func readCSVRecords[R any](raw []byte, parseRow func(row map[string]string) (R, error)) ([]R, error) {
+	reader := csv.NewReader(bytes.NewReader(raw))
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("falta la fila de encabezados: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(header[i]))
+	}
+
+	var records []R
+	row := make(map[string]string, len(header))
+	for line := 2; ; line++ {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for i, name := range header {
+			row[name] = strings.TrimSpace(fields[i])
+		}
+		r, err := parseRow(row)
+		if err != nil {
+			return nil, fmt.Errorf("fila %d: %w", line, err)
+		}
+		records = append(records, r)
+	}
+}
+
+// csvFields convierte las columnas numéricas de una fila; guarda el primer error.
+type csvFields struct {
+	row map[string]string
+	err error
+}
+
+func (f *csvFields) float(name string) float64 {
+	if f.row[name] == "" || f.err != nil {
+		return 0
+	}
+	v, err := strconv.ParseFloat(f.row[name], 64)
+	if err != nil {
+		f.err = fmt.Errorf("columna '%s': %w", name, err)
+	}
+	return v
+}
+
+func (f *csvFields) int(name string) int64 {
+	if f.row[name] == "" || f.err != nil {
+		return 0
+	}
+	v, err := strconv.ParseInt(f.row[name], 10, 64)
+	if err != nil {
+		f.err = fmt.Errorf("columna '%s': %w", name, err)
+	}
+	return v
+}
+
+// parseQuoteRow convierte una fila CSV de quotes; las condiciones van separadas por espacios.
+func parseQuoteRow(row map[string]string) (QuoteRecord, error) {
+	f := csvFields{row: row}
+	q := QuoteRecord{
+		AP: f.float("ap"), AS: int(f.int("as")), AX: row["ax"],
+		BP: f.float("bp"), BS: int(f.int("bs")), BX: row["bx"],
+		C: strings.Fields(row["c"]), T: row["t"], Z: row["z"],
+	}
+	return q, f.err
+}
+
+// parseTradeRow convierte una fila CSV de trades; las condiciones van separadas por espacios.
+func parseTradeRow(row map[string]string) (TradeRecord, error) {
+	f := csvFields{row: row}
+	t := TradeRecord{
+		P: f.float("p"), S: int(f.int("s")), X: row["x"], I: f.int("i"),
+		C: strings.Fields(row["c"]), T: row["t"], Z: row["z"],
+	}
+	return t, f.err
+}
+
+// parseBarRow convierte una fila CSV de barras.
+func parseBarRow(row map[string]string) (BarRecord, error) {
+	f := csvFields{row: row}
+	b := BarRecord{
+		O: f.float("o"), H: f.float("h"), L: f.float("l"), C: f.float("c"),
+		V: f.int("v"), N: f.int("n"), VW: f.float("vw"), T: row["t"],
+	}
+	return b, f.err
+}
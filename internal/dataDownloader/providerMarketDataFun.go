@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/devicemxl/dxm/internal/pkg/ticks"
+)
+
+// Registros normalizados, independientes del proveedor. Los define el paquete ticks,
+// que fija el formato de guardado y la lectura (ver `ticks.QuoteRecord`).
+type (
+	QuoteRecord = ticks.QuoteRecord
+	TradeRecord = ticks.TradeRecord
+	BarRecord   = ticks.BarRecord
+)
+
+// QuotePageHandler recibe cada página de quotes de un símbolo. pageToken es el token
+// (opaco, propio de cada proveedor) con el que se pidió la página; vacío para la
+// primera. Si devuelve un error, la descarga se detiene.
+type QuotePageHandler func(symbol string, quotes []QuoteRecord, pageToken string) error
+
+// TradePageHandler recibe cada página de trades de un símbolo (ver `QuotePageHandler`).
+type TradePageHandler func(symbol string, trades []TradeRecord, pageToken string) error
+
+// BarPageHandler recibe cada página de barras de un símbolo (ver `QuotePageHandler`).
+type BarPageHandler func(symbol string, bars []BarRecord, pageToken string) error
+
+// FetchRequest describe qué datos pedir a un proveedor: símbolos y rango [Start, End).
+type FetchRequest struct {
+	Symbols []string // Tickers a pedir; con más de uno el proveedor puede agruparlos en una sola petición
+	Start   string   // Fecha inicial RFC3339 (incluida)
+	End     string   // Fecha final RFC3339 (excluida); vacía para pedir hasta el presente
+	Feed    string   // Fuente de datos ("sip", "iex", ...); los proveedores que no la usan la ignoran
+	// Solo para barras:
+	Timeframe  string // Duración de cada barra ("1Min", "5Min", "1Hour", "1Day", ...)
+	Adjustment string // Ajuste corporativo ("raw", "split", "dividend", "all")
+}
+
+// MarketDataProvider es una fuente de datos históricos de mercado.
+//
+// Cada método recorre las páginas de un dataset para los símbolos y el rango de
+// 'req', en orden ascendente de timestamp por símbolo, entregando cada página a
+// 'handler'. 'pageToken' permite continuar desde una página entregada antes (su
+// formato solo lo entiende el proveedor que lo generó); vacío para empezar desde
+// 'req.Start'. Si 'ctx' se cancela se detienen entre páginas y devuelven ctx.Err().
+// Devuelven el número de registros entregados.
+//
+// Implementaciones: `alpacaProvider` (API REST de Alpaca) y `fileProvider`
+// (archivos CSV/JSON locales).
+type MarketDataProvider interface {
+	// Name identifica al proveedor en logs y checkpoints (ej. "alpaca", "file").
+	Name() string
+	FetchQuotes(ctx context.Context, req FetchRequest, pageToken string, handler QuotePageHandler) (int, error)
+	FetchTrades(ctx context.Context, req FetchRequest, pageToken string, handler TradePageHandler) (int, error)
+	FetchBars(ctx context.Context, req FetchRequest, pageToken string, handler BarPageHandler) (int, error)
+}
+
+// symbolKey identifica el símbolo (o grupo de símbolos) de una descarga en logs y
+// checkpoints: el ticker si es uno solo y "AAPL,MSFT,..." si son varios.
+func symbolKey(symbols []string) string {
+	return strings.Join(symbols, ",")
+}
+
+// newProvider crea el proveedor de datos elegido en 'cfg.Source'.
+//   - "alpaca": API REST de Alpaca en cfg.Protocol://cfg.Domain.
+//   - "file": archivos planos bajo 'cfg.SourceDir' (ver `fileProvider`).
+func newProvider(cfg AppConfig) (MarketDataProvider, error) {
+	switch cfg.Source {
+	case "alpaca":
+		return newAlpacaProvider(cfg.Protocol, cfg.Domain, cfg.PageLimit, cfg.callOptions()), nil
+	case "file":
+		return newFileProvider(cfg.SourceDir, cfg.PageLimit)
+	default:
+		return nil, fmt.Errorf("proveedor de datos desconocido '%s': se esperaba alpaca o file", cfg.Source)
+	}
+}
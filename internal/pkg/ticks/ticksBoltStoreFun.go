@@ -0,0 +1,284 @@
+package ticks
+
+import (
+	"fmt"
+	"iter"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE ALMACÉN BBOLT
+// ===============================
+
+//
+//
+//
+*/
+
+// Layouts de guardado de quotes en bbolt. La lectura los entiende todos, aunque
+// convivan en un mismo símbolo.
+const (
+	// LayoutColumns guarda cada campo en su sub-bucket (`<sym>/AP`, `<sym>/AS`, ...)
+	// como texto: ocho Put por quote y ocho búsquedas para leerla.
+	LayoutColumns = "columns"
+	// LayoutRows guarda cada quote como una fila binaria de ancho fijo en
+	// `<sym>/QROWS` (ver `EncodeQuoteRow`): un Put por quote y una búsqueda para leerla.
+	// Las quotes que no caben en una fila van a las columnas de `LayoutColumns`.
+	LayoutRows = "rows"
+	// LayoutChunks guarda bloques de hasta `QuoteChunkSize` quotes comprimidas en
+	// `<sym>/QCHUNKS` (ver `EncodeQuoteChunk`): el que menos ocupa, a cambio de
+	// reescribir un chunk en cada escritura y decodificar chunks enteros al leer.
+	LayoutChunks = "chunks"
+)
+
+// QuoteLayouts son los layouts de quotes admitidos.
+var QuoteLayouts = []string{LayoutColumns, LayoutRows, LayoutChunks}
+
+// checkLayout comprueba que 'layout' sea uno de `QuoteLayouts`.
+func checkLayout(layout string) error {
+	if !slices.Contains(QuoteLayouts, layout) {
+		return fmt.Errorf("layout de quotes desconocido %q (se esperaba uno de %v)", layout, QuoteLayouts)
+	}
+	return nil
+}
+
+// PutQuotesTx guarda 'quotes' en el bucket de 'symbol' dentro de la transacción de
+// escritura 'tx', con el layout 'layout' (uno de `QuoteLayouts`).
+//
+// La clave de cada quote es su timestamp más una secuencia (ver `KeyAllocator`): las
+// quotes que comparten nanosegundo no se pisan y las que ya estaban guardadas con el
+// mismo contenido no se duplican, aunque estén en otro layout. Las quotes con un timestamp que no es RFC3339 se
+// descartan y se cuentan en `WriteResult.Skipped`. Una quote que no cabe en la fila
+// binaria se guarda en las columnas; una que no cabe en el chunk aborta el lote en
+// lugar de perderse.
+//
+// Equivale a `EncodeQuotes` seguido de `PutEncodedQuotesTx`.
+func PutQuotesTx(tx *db.Tx, symbol string, quotes []QuoteRecord, layout string) (WriteResult, error) {
+	enc, err := EncodeQuotes(symbol, quotes, layout)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return PutEncodedQuotesTx(tx, enc)
+}
+
+// PutTradesTx guarda 'trades' bajo `<symbol>/TRADES/<campo>` dentro de la transacción
+// de escritura 'tx', con las mismas reglas de claves que `PutQuotesTx`.
+//
+// Equivale a `EncodeTrades` seguido de `PutEncodedTradesTx`.
+func PutTradesTx(tx *db.Tx, symbol string, trades []TradeRecord) (WriteResult, error) {
+	enc, err := EncodeTrades(symbol, trades)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return PutEncodedTradesTx(tx, enc)
+}
+
+// BoltStore es el `TickStore` sobre una base de datos bbolt con el layout del
+// descargador.
+type BoltStore struct {
+	db     *db.DB
+	layout string
+	closed atomic.Bool
+}
+
+// NewBoltStore envuelve una base de datos bbolt ya abierta. 'layout' es el layout con
+// el que se guardan las quotes (uno de `QuoteLayouts`). `BoltStore.Close` cierra la
+// base de datos.
+func NewBoltStore(dbInstance *db.DB, layout string) (*BoltStore, error) {
+	if dbInstance == nil {
+		return nil, fmt.Errorf("instancia de base de datos nula")
+	}
+	if err := checkLayout(layout); err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: dbInstance, layout: layout}, nil
+}
+
+// OpenDB abre el archivo bbolt 'path' (esperando hasta un segundo si otro proceso lo
+// tiene bloqueado) y comprueba su esquema (ver `EnsureSchema`). Con 'readOnly' el
+// archivo debe existir; varios procesos pueden abrirlo así a la vez, pero no mientras
+// otro lo tenga abierto en lectura/escritura (bbolt bloquea el archivo).
+func OpenDB(path string, readOnly bool) (*db.DB, error) {
+	dbInstance, err := db.Open(path, 0600, &db.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo abrir '%s': %w", path, err)
+	}
+	if err := EnsureSchema(dbInstance); err != nil {
+		dbInstance.Close()
+		return nil, err
+	}
+	return dbInstance, nil
+}
+
+// OpenBoltStore abre el archivo bbolt 'path' con `OpenDB` y el layout de columnas.
+// Con 'readOnly' `BoltStore.WriteBatch` falla.
+func OpenBoltStore(path string, readOnly bool) (*BoltStore, error) {
+	dbInstance, err := OpenDB(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return NewBoltStore(dbInstance, LayoutColumns)
+}
+
+// DB devuelve la base de datos bbolt del almacén, para operaciones que no cubre
+// `TickStore` (ej. checkpoints).
+func (s *BoltStore) DB() *db.DB {
+	return s.db
+}
+
+// WriteBatch guarda el lote en una única transacción (ver `PutQuotesTx` y `PutTradesTx`).
+func (s *BoltStore) WriteBatch(batch Batch) (WriteResult, error) {
+	var res WriteResult
+	if s.closed.Load() {
+		return res, ErrStoreClosed
+	}
+	err := s.db.Update(func(tx *db.Tx) error {
+		quotes, err := PutQuotesTx(tx, batch.Symbol, batch.Quotes, s.layout)
+		if err != nil {
+			return err
+		}
+		trades, err := PutTradesTx(tx, batch.Symbol, batch.Trades)
+		if err != nil {
+			return err
+		}
+		res.Add(quotes)
+		res.Add(trades)
+		return nil
+	})
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return res, nil
+}
+
+// Quotes recorre las quotes de 'opts' (ver `Quotes`).
+func (s *BoltStore) Quotes(opts QueryOptions) iter.Seq2[Quote, error] {
+	if s.closed.Load() {
+		return failSeq[Quote](ErrStoreClosed)
+	}
+	return Quotes(s.db, opts)
+}
+
+// Trades recorre los trades de 'opts' (ver `Trades`).
+func (s *BoltStore) Trades(opts QueryOptions) iter.Seq2[Trade, error] {
+	if s.closed.Load() {
+		return failSeq[Trade](ErrStoreClosed)
+	}
+	return Trades(s.db, opts)
+}
+
+// LastTimestamp devuelve el timestamp de la última clave de 'kind' de 'symbol': para
+// quotes, la más reciente entre las columnas, las filas y los chunks.
+func (s *BoltStore) LastTimestamp(symbol string, kind Kind) (time.Time, error) {
+	var last time.Time
+	if s.closed.Load() {
+		return last, ErrStoreClosed
+	}
+	err := s.db.View(func(tx *db.Tx) error {
+		symbolBucket := tx.Bucket([]byte(symbol))
+		if symbolBucket == nil {
+			return nil
+		}
+		var indexes []*db.Bucket
+		switch kind {
+		case KindQuotes:
+			indexes = []*db.Bucket{symbolBucket.Bucket([]byte(QuoteFields[0])), symbolBucket.Bucket([]byte(QuoteRowsBucket))}
+		case KindTrades:
+			if trades := symbolBucket.Bucket([]byte(TradesBucket)); trades != nil {
+				indexes = []*db.Bucket{trades.Bucket([]byte(TradeFields[0]))}
+			}
+		default:
+			return fmt.Errorf("tipo de tick desconocido %q", kind)
+		}
+		if kind == KindQuotes {
+			// La clave de un chunk es la de su primera quote: hay que leer la última.
+			if chunks := symbolBucket.Bucket([]byte(QuoteChunksBucket)); chunks != nil {
+				if k, v := chunks.Cursor().Last(); k != nil {
+					quotes, err := DecodeQuoteChunk(v)
+					if err != nil {
+						return err
+					}
+					last = quotes[len(quotes)-1].Time
+				}
+			}
+		}
+		for _, index := range indexes {
+			if index == nil {
+				continue
+			}
+			k, _ := index.Cursor().Last()
+			if k == nil {
+				continue
+			}
+			t, err := KeyTime(k)
+			if err != nil {
+				return err
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+		return nil
+	})
+	return last, err
+}
+
+// Stats cuenta las claves de las columnas índice ("AP", "QROWS" y "TRADES/P") y las
+// quotes de los chunks de cada símbolo. Los buckets raíz que empiezan con '_' (ej.
+// checkpoints) no son símbolos.
+func (s *BoltStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+	if s.closed.Load() {
+		return stats, ErrStoreClosed
+	}
+	err := s.db.View(func(tx *db.Tx) error {
+		return tx.ForEach(func(name []byte, symbolBucket *db.Bucket) error {
+			if strings.HasPrefix(string(name), "_") {
+				return nil
+			}
+			var sym SymbolStats
+			sym.Quotes = keyCount(symbolBucket.Bucket([]byte(QuoteFields[0]))) + keyCount(symbolBucket.Bucket([]byte(QuoteRowsBucket)))
+			if chunks := symbolBucket.Bucket([]byte(QuoteChunksBucket)); chunks != nil {
+				err := chunks.ForEach(func(_, v []byte) error {
+					n, err := quoteChunkCount(v)
+					sym.Quotes += n
+					return err
+				})
+				if err != nil {
+					return fmt.Errorf("chunks de %s: %w", name, err)
+				}
+			}
+			if trades := symbolBucket.Bucket([]byte(TradesBucket)); trades != nil {
+				sym.Trades = keyCount(trades.Bucket([]byte(TradeFields[0])))
+			}
+			stats.addSymbol(string(name), sym)
+			return nil
+		})
+	})
+	return stats, err
+}
+
+// Close cierra la base de datos. Cerrar dos veces no es un error.
+func (s *BoltStore) Close() error {
+	if s.closed.Swap(true) {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// keyCount devuelve el número de claves de 'bucket' (0 si no existe).
+func keyCount(bucket *db.Bucket) int {
+	if bucket == nil {
+		return 0
+	}
+	return bucket.Stats().KeyN
+}
@@ -0,0 +1,465 @@
+package ticks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE VERIFICACIÓN DE COLUMNAS
+// ===============================
+
+//
+//
+//
+*/
+
+// Con el layout de columnas cada campo de un tick vive en su propio sub-bucket (`AP`,
+// `AS`, ... o `P`, `S`, ... bajo `TRADES`) con la misma clave. Una escritura a medias
+// o un error puede dejar una clave en unas columnas y no en otras: `QuotesBetween`
+// falla con `ErrIncompleteTick` si falta un valor de la columna índice en adelante,
+// pero una clave que no está en el índice nunca se lee y nadie la ve. `CheckFile`
+// recorre en paralelo las columnas de cada grupo (y las filas y los chunks) para
+// encontrarlas, y opcionalmente repararlas.
+
+// DefaultCheckIssues es el número de ejemplos que `CheckFile` guarda por grupo si
+// `CheckOptions.MAX_ISSUES` es 0.
+const DefaultCheckIssues = 20
+
+// CheckOptions configura `CheckFile`.
+type CheckOptions struct {
+	// REPAIR borra las filas incompletas o ilegibles de todas las columnas de su grupo
+	// (los chunks ilegibles enteros), mueve los chunks con la clave mal y rehace los
+	// metadatos de los símbolos afectados. Sin REPAIR el archivo se abre de solo
+	// lectura.
+	REPAIR bool
+	// SYMBOLS limita la verificación a esos símbolos; vacío para todos.
+	SYMBOLS []string
+	// MAX_ISSUES es el número de ejemplos guardados por grupo en `CheckGroup.Issues`;
+	// 0 para `DefaultCheckIssues`. Los contadores incluyen todos.
+	MAX_ISSUES int
+	// PROGRESS, si no es nil, se llama al terminar cada símbolo con las filas vistas.
+	PROGRESS func(symbol string, rows int)
+}
+
+// CheckIssue es un problema concreto de una fila.
+type CheckIssue struct {
+	Key     []byte // Clave de la fila (o del chunk)
+	Column  string // Columnas o bucket afectados (ej. "AS,BS" o "QCHUNKS")
+	Problem string // Descripción legible
+}
+
+// CheckGroup es el resultado de un grupo de buckets que comparten claves: las
+// columnas de quotes o de trades de un símbolo, sus filas o sus chunks.
+type CheckGroup struct {
+	Symbol string
+	Kind   Kind
+	Bucket string // Ruta del grupo desde la raíz (ej. "QQQ/TRADES" o "QQQ/QROWS")
+	Rows   int    // Claves distintas vistas en alguna columna
+	// Bad son las filas con algún problema: las que la reparación borra (o mueve).
+	Bad int
+	// Incomplete son las claves que faltan en alguna columna; de ellas, Orphans son las
+	// que faltan en la columna índice y por eso no se leen nunca.
+	Incomplete int
+	Orphans    int
+	Missing    map[string]int // Claves que faltan, por columna
+	// Undecodable son los valores que no se pueden decodificar, por columna (o por
+	// bucket en las filas y los chunks).
+	Undecodable map[string]int
+	BadKeys     int // Claves que no tienen `KeySize` bytes, o chunks con la clave mal
+	Repaired    int // Filas borradas o movidas por la reparación
+	// Issues son los primeros problemas encontrados, hasta `CheckOptions.MAX_ISSUES`.
+	Issues []CheckIssue
+}
+
+// MetaMismatch es un tipo de un símbolo cuyos metadatos en `SymbolsBucket` no
+// coinciden con sus ticks.
+type MetaMismatch struct {
+	Symbol string
+	Kind   Kind
+	Stored SymbolMeta // Cero si no hay
+	Actual SymbolMeta // Calculado recorriendo los índices; cero si no hay ticks
+	Fixed  bool       // La reparación los rehizo
+}
+
+// CheckReport resume `CheckFile`.
+type CheckReport struct {
+	Path   string
+	Groups []CheckGroup // Todos los grupos verificados, con problemas o sin ellos
+	Meta   []MetaMismatch
+}
+
+// Problems es el número de filas con problemas más el de metadatos que no coinciden.
+func (r CheckReport) Problems() int {
+	n := len(r.Meta)
+	for _, g := range r.Groups {
+		n += g.Bad
+	}
+	return n
+}
+
+// Repaired es el número de filas y metadatos que arregló la reparación.
+func (r CheckReport) Repaired() int {
+	n := 0
+	for _, g := range r.Groups {
+		n += g.Repaired
+	}
+	for _, m := range r.Meta {
+		if m.Fixed {
+			n++
+		}
+	}
+	return n
+}
+
+// checkFix es un cambio de la reparación en un grupo: borrar 'key' de todas sus
+// columnas o, con 'moveTo', moverlo a esa clave.
+type checkFix struct {
+	key, moveTo []byte
+}
+
+// checkedGroup es un grupo verificado con lo necesario para repararlo.
+type checkedGroup struct {
+	path    []string // Del bucket padre, desde la raíz
+	columns []string
+	fixes   []checkFix
+}
+
+// CheckFile verifica el archivo bbolt 'path', que tiene que estar en `SchemaVersion`
+// (`ErrSchemaOutdated` si no: hay que migrarlo antes). Por cada símbolo recorre con
+// cursores paralelos las columnas de quotes y de trades y comprueba que cada clave
+// esté en todas, que tenga `KeySize` bytes y que todos sus valores se puedan
+// decodificar; las filas y los chunks, que no tienen columnas, solo se decodifican.
+// Por último compara los metadatos de `SymbolsBucket` con los ticks (salvo en los
+// símbolos con problemas sin reparar, cuyos índices pueden no poder leerse).
+//
+// Con `CheckOptions.REPAIR` borra las filas con problemas en transacciones de hasta
+// `migrationBatch` filas y rehace los metadatos de los símbolos tocados. Una fila
+// incompleta no se puede reconstruir: se pierde entera, pero lo que queda vuelve a
+// leerse sin errores.
+func CheckFile(path string, opts CheckOptions) (CheckReport, error) {
+	report := CheckReport{Path: path}
+	dbInstance, err := db.Open(path, 0600, &db.Options{Timeout: time.Second, ReadOnly: !opts.REPAIR})
+	if err != nil {
+		return report, fmt.Errorf("no se pudo abrir '%s': %w", path, err)
+	}
+	defer dbInstance.Close()
+	if opts.MAX_ISSUES == 0 {
+		opts.MAX_ISSUES = DefaultCheckIssues
+	}
+
+	var symbols []string
+	err = dbInstance.View(func(tx *db.Tx) error {
+		version, _, err := SchemaVersionTx(tx)
+		switch {
+		case err != nil:
+			return err
+		case version > SchemaVersion:
+			return fmt.Errorf("%w: '%s' es v%d y este programa conoce hasta la v%d", ErrSchemaTooNew, path, version, SchemaVersion)
+		case version < SchemaVersion:
+			return fmt.Errorf("%w: '%s' es v%d y se verifica la v%d; hay que migrarla", ErrSchemaOutdated, path, version, SchemaVersion)
+		}
+		return tx.ForEach(func(name []byte, _ *db.Bucket) error {
+			symbol := string(name)
+			if !strings.HasPrefix(symbol, "_") && (len(opts.SYMBOLS) == 0 || slices.Contains(opts.SYMBOLS, symbol)) {
+				symbols = append(symbols, symbol)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, symbol := range symbols {
+		groups, checked, err := checkSymbol(dbInstance, symbol, opts.MAX_ISSUES)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", symbol, err)
+		}
+		bad := 0
+		for i := range groups {
+			bad += groups[i].Bad
+			if opts.REPAIR && len(checked[i].fixes) > 0 {
+				if groups[i].Repaired, err = repairGroup(dbInstance, checked[i]); err != nil {
+					return report, fmt.Errorf("%s: %w", groups[i].Bucket, err)
+				}
+			}
+		}
+		report.Groups = append(report.Groups, groups...)
+		if bad == 0 || opts.REPAIR {
+			mismatches, err := checkSymbolMeta(dbInstance, symbol, opts.REPAIR)
+			if err != nil {
+				return report, fmt.Errorf("%s: %w", symbol, err)
+			}
+			report.Meta = append(report.Meta, mismatches...)
+		}
+		if opts.PROGRESS != nil {
+			rows := 0
+			for _, g := range groups {
+				rows += g.Rows
+			}
+			opts.PROGRESS(symbol, rows)
+		}
+	}
+	return report, nil
+}
+
+// checkSymbol verifica los grupos de 'symbol' en una transacción de lectura.
+func checkSymbol(dbInstance *db.DB, symbol string, maxIssues int) ([]CheckGroup, []checkedGroup, error) {
+	var groups []CheckGroup
+	var checked []checkedGroup
+	err := dbInstance.View(func(tx *db.Tx) error {
+		symbolBucket := tx.Bucket([]byte(symbol))
+		if symbolBucket == nil {
+			return nil
+		}
+		newGroup := func(kind Kind, path []string, columns []string) (*CheckGroup, *checkedGroup) {
+			groups = append(groups, CheckGroup{
+				Symbol:      symbol,
+				Kind:        kind,
+				Bucket:      strings.Join(append(slices.Clone(path), columns[0]), "/"),
+				Missing:     make(map[string]int),
+				Undecodable: make(map[string]int),
+			})
+			checked = append(checked, checkedGroup{path: path, columns: columns})
+			return &groups[len(groups)-1], &checked[len(checked)-1]
+		}
+		// Los punteros de newGroup solo valen hasta la siguiente llamada
+		if hasAnyBucket(symbolBucket, QuoteFields) {
+			g, c := newGroup(KindQuotes, []string{symbol}, QuoteFields)
+			g.Bucket = symbol
+			checkColumns(symbolBucket, g, c, maxIssues, func(_ []byte, field string, value []byte) error {
+				var q QuoteRecord
+				return DecodeQuoteField(&q, field, value)
+			})
+		}
+		if symbolBucket.Bucket([]byte(QuoteRowsBucket)) != nil {
+			g, c := newGroup(KindQuotes, []string{symbol}, []string{QuoteRowsBucket})
+			checkColumns(symbolBucket, g, c, maxIssues, func(key []byte, _ string, value []byte) error {
+				_, err := DecodeQuoteRow(key, value)
+				return err
+			})
+		}
+		if chunks := symbolBucket.Bucket([]byte(QuoteChunksBucket)); chunks != nil {
+			g, c := newGroup(KindQuotes, []string{symbol}, []string{QuoteChunksBucket})
+			checkChunks(chunks, g, c, maxIssues)
+		}
+		if trades := symbolBucket.Bucket([]byte(TradesBucket)); trades != nil && hasAnyBucket(trades, TradeFields) {
+			g, c := newGroup(KindTrades, []string{symbol, TradesBucket}, TradeFields)
+			g.Bucket = symbol + "/" + TradesBucket
+			checkColumns(trades, g, c, maxIssues, func(_ []byte, field string, value []byte) error {
+				var tr TradeRecord
+				return DecodeTradeField(&tr, field, value)
+			})
+		}
+		return nil
+	})
+	return groups, checked, err
+}
+
+// hasAnyBucket indica si 'parent' tiene alguno de los sub-buckets 'names'.
+func hasAnyBucket(parent *db.Bucket, names []string) bool {
+	return slices.ContainsFunc(names, func(name string) bool { return parent.Bucket([]byte(name)) != nil })
+}
+
+// checkColumns recorre a la vez con un cursor por columna los sub-buckets 'columns'
+// de 'parent', avanzando en cada paso los que están en la clave más pequeña: una
+// columna que no está en esa clave no la tiene. Cada valor se pasa a 'decode'. Una
+// columna que no existe cuenta como vacía.
+func checkColumns(parent *db.Bucket, g *CheckGroup, c *checkedGroup, maxIssues int, decode func(key []byte, column string, value []byte) error) {
+	issue := func(key []byte, column, problem string) {
+		if len(g.Issues) < maxIssues {
+			g.Issues = append(g.Issues, CheckIssue{Key: bytes.Clone(key), Column: column, Problem: problem})
+		}
+	}
+	cursors := make([]*db.Cursor, len(c.columns))
+	keys := make([][]byte, len(c.columns))
+	values := make([][]byte, len(c.columns))
+	for i, column := range c.columns {
+		if bucket := parent.Bucket([]byte(column)); bucket != nil {
+			cursors[i] = bucket.Cursor()
+			keys[i], values[i] = cursors[i].First()
+		}
+	}
+	for {
+		var key []byte
+		for _, k := range keys {
+			if k != nil && (key == nil || bytes.Compare(k, key) < 0) {
+				key = k
+			}
+		}
+		if key == nil {
+			return
+		}
+		key = bytes.Clone(key) // Los cursores reutilizan la memoria al avanzar
+		g.Rows++
+		bad := false
+		if len(key) != KeySize {
+			g.BadKeys++
+			issue(key, "", fmt.Sprintf("clave de %d bytes, se esperaban %d", len(key), KeySize))
+			bad = true
+		}
+		var missing []string
+		for i, column := range c.columns {
+			if keys[i] == nil || !bytes.Equal(keys[i], key) {
+				missing = append(missing, column)
+				g.Missing[column]++
+				continue
+			}
+			if err := decode(key, column, values[i]); err != nil {
+				g.Undecodable[column]++
+				issue(key, column, err.Error())
+				bad = true
+			}
+			keys[i], values[i] = cursors[i].Next()
+		}
+		if len(missing) > 0 {
+			g.Incomplete++
+			problem := "incompleta"
+			if missing[0] == c.columns[0] {
+				g.Orphans++
+				problem = "huérfana: no está en el índice " + c.columns[0]
+			}
+			issue(key, strings.Join(missing, ","), problem)
+			bad = true
+		}
+		if bad {
+			g.Bad++
+			c.fixes = append(c.fixes, checkFix{key: key})
+		}
+	}
+}
+
+// checkChunks decodifica cada chunk de 'chunks' y comprueba que su clave sea la de su
+// primera quote, como la escribe `putQuoteChunks`: si no, `seekChunk` podría saltárselo.
+func checkChunks(chunks *db.Bucket, g *CheckGroup, c *checkedGroup, maxIssues int) {
+	issue := func(key []byte, problem string) {
+		if len(g.Issues) < maxIssues {
+			g.Issues = append(g.Issues, CheckIssue{Key: bytes.Clone(key), Column: QuoteChunksBucket, Problem: problem})
+		}
+	}
+	chunks.ForEach(func(k, v []byte) error {
+		g.Rows++
+		quotes, err := DecodeQuoteChunk(v)
+		if err != nil {
+			g.Bad++
+			g.Undecodable[QuoteChunksBucket]++
+			issue(k, err.Error())
+			c.fixes = append(c.fixes, checkFix{key: bytes.Clone(k)})
+			return nil
+		}
+		if want := Key(quotes[0].Time.UnixNano(), quotes[0].Seq); !bytes.Equal(k, want) {
+			g.Bad++
+			g.BadKeys++
+			issue(k, fmt.Sprintf("la clave no es la de su primera quote (%x)", want))
+			c.fixes = append(c.fixes, checkFix{key: bytes.Clone(k), moveTo: want})
+		}
+		return nil
+	})
+}
+
+// repairGroup aplica los cambios de 'c' en transacciones de hasta `migrationBatch`
+// filas y devuelve cuántos aplicó.
+func repairGroup(dbInstance *db.DB, c checkedGroup) (int, error) {
+	done := 0
+	for from := 0; from < len(c.fixes); from += migrationBatch {
+		batch := c.fixes[from:min(from+migrationBatch, len(c.fixes))]
+		err := dbInstance.Update(func(tx *db.Tx) error {
+			parent := tx.Bucket([]byte(c.path[0]))
+			for _, name := range c.path[1:] {
+				if parent != nil {
+					parent = parent.Bucket([]byte(name))
+				}
+			}
+			if parent == nil {
+				return nil
+			}
+			for _, column := range c.columns {
+				bucket := parent.Bucket([]byte(column))
+				if bucket == nil {
+					continue
+				}
+				for _, fix := range batch {
+					value := bytes.Clone(bucket.Get(fix.key))
+					if value == nil {
+						continue
+					}
+					if err := bucket.Delete(fix.key); err != nil {
+						return err
+					}
+					if fix.moveTo != nil {
+						if err := bucket.Put(fix.moveTo, value); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return done, err
+		}
+		done += len(batch)
+	}
+	return done, nil
+}
+
+// checkSymbolMeta compara los metadatos de quotes y trades de 'symbol' con los que
+// salen de recorrer sus índices y, con 'repair', los rehace si no coinciden.
+func checkSymbolMeta(dbInstance *db.DB, symbol string, repair bool) ([]MetaMismatch, error) {
+	var mismatches []MetaMismatch
+	check := func(tx *db.Tx) error {
+		symbolBucket := tx.Bucket([]byte(symbol))
+		if symbolBucket == nil {
+			return nil
+		}
+		scanned, err := scanTickMeta(symbolBucket)
+		if err != nil {
+			return err
+		}
+		var stored *db.Bucket
+		if root := tx.Bucket([]byte(SymbolsBucket)); root != nil {
+			stored = root.Bucket([]byte(symbol))
+		}
+		for _, kind := range []Kind{KindQuotes, KindTrades} {
+			m := MetaMismatch{Symbol: symbol, Kind: kind, Actual: scanned[kind]}
+			if stored != nil {
+				if raw := stored.Get([]byte(kind)); raw != nil {
+					if err := json.Unmarshal(raw, &m.Stored); err != nil {
+						m.Stored = SymbolMeta{} // Ilegibles: cuentan como que no hay
+					}
+				}
+			}
+			if m.Stored.Count == m.Actual.Count && m.Stored.First.Equal(m.Actual.First) && m.Stored.Last.Equal(m.Actual.Last) {
+				continue
+			}
+			m.Stored.Symbol, m.Stored.Kind = symbol, kind
+			m.Actual.Symbol, m.Actual.Kind = symbol, kind
+			mismatches = append(mismatches, m)
+		}
+		if len(mismatches) == 0 || !repair {
+			return nil
+		}
+		if _, err := rebuildSymbolMetaTx(tx, symbol, SchemaVersion); err != nil {
+			return err
+		}
+		for i := range mismatches {
+			mismatches[i].Fixed = true
+		}
+		return nil
+	}
+	if repair {
+		return mismatches, dbInstance.Update(check)
+	}
+	return mismatches, dbInstance.View(check)
+}
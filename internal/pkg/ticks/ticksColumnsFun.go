@@ -0,0 +1,131 @@
+package ticks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE LAYOUT DE COLUMNAS
+// ===============================
+
+//
+//
+//
+*/
+
+// Layout de buckets de cada símbolo:
+//
+//	<símbolo>/AP, AS, AX, BP, BS, BX, C, Z   quotes en columnas (`QuoteFields`)
+//	<símbolo>/QROWS                          quotes en filas binarias (`QuoteRowsBucket`)
+//	<símbolo>/TRADES/P, S, X, I, C, Z        trades en columnas (`TradeFields`)
+//
+// Todas las columnas de un mismo tipo comparten las claves (ver `Key`): el valor de
+// cada campo de un tick está en su columna bajo la misma clave.
+
+// QuoteFields son los sub-buckets del layout de columnas, uno por campo de la
+// quote. No se incluye 'T' porque es la clave.
+var QuoteFields = []string{"AP", "AS", "AX", "BP", "BS", "BX", "C", "Z"}
+
+// TradesBucket es el sub-bucket, dentro del bucket del símbolo, que agrupa las
+// columnas de trades. Las quotes ocupan directamente el bucket del símbolo
+// ("AP", "AS", ...); los trades van un nivel más abajo para no mezclar columnas.
+const TradesBucket = "TRADES"
+
+// TradeFields son los sub-buckets de columnas dentro de `TradesBucket`.
+// No se incluye 'T' porque es la clave.
+var TradeFields = []string{"P", "S", "X", "I", "C", "Z"}
+
+// EncodeQuoteColumns codifica una quote como texto para el layout de columnas, un
+// valor por sub-bucket en el orden de `QuoteFields`. Las condiciones van en texto
+// compacto (ver `EncodeConditions`).
+func EncodeQuoteColumns(q QuoteRecord) [][]byte {
+	return [][]byte{
+		[]byte(strconv.FormatFloat(q.AP, 'f', -1, 64)), // 'f' formato, -1 para menor precisión, 64 bits
+		[]byte(strconv.Itoa(q.AS)),
+		[]byte(q.AX),
+		[]byte(strconv.FormatFloat(q.BP, 'f', -1, 64)),
+		[]byte(strconv.Itoa(q.BS)),
+		[]byte(q.BX),
+		EncodeConditions(q.C),
+		[]byte(q.Z),
+	}
+}
+
+// DecodeQuoteField escribe en 'q' el valor 'value' de la columna 'field' (uno de
+// `QuoteFields`). Es la inversa de `EncodeQuoteColumns` campo a campo.
+func DecodeQuoteField(q *QuoteRecord, field string, value []byte) error {
+	var err error
+	switch field {
+	case "AP":
+		q.AP, err = strconv.ParseFloat(string(value), 64)
+	case "AS":
+		q.AS, err = strconv.Atoi(string(value))
+	case "AX":
+		q.AX = string(value)
+	case "BP":
+		q.BP, err = strconv.ParseFloat(string(value), 64)
+	case "BS":
+		q.BS, err = strconv.Atoi(string(value))
+	case "BX":
+		q.BX = string(value)
+	case "C":
+		q.C, err = DecodeConditions(value)
+	case "Z":
+		q.Z = string(value)
+	default:
+		return fmt.Errorf("%w: '%s' no es un campo de quote", ErrUnknownField, field)
+	}
+	if err != nil {
+		return fmt.Errorf("columna %s = %q: %w", field, value, err)
+	}
+	return nil
+}
+
+// EncodeTradeColumns codifica un trade como texto para el layout de columnas, un
+// valor por sub-bucket en el orden de `TradeFields`.
+func EncodeTradeColumns(tr TradeRecord) ([][]byte, error) {
+	c, err := json.Marshal(tr.C)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal trade conditions for %s: %w", tr.T, err)
+	}
+	return [][]byte{
+		[]byte(strconv.FormatFloat(tr.P, 'f', -1, 64)),
+		[]byte(strconv.Itoa(tr.S)),
+		[]byte(tr.X),
+		[]byte(strconv.FormatInt(tr.I, 10)),
+		c,
+		[]byte(tr.Z),
+	}, nil
+}
+
+// DecodeTradeField escribe en 'tr' el valor 'value' de la columna 'field' (uno de
+// `TradeFields`). Es la inversa de `EncodeTradeColumns` campo a campo.
+func DecodeTradeField(tr *TradeRecord, field string, value []byte) error {
+	var err error
+	switch field {
+	case "P":
+		tr.P, err = strconv.ParseFloat(string(value), 64)
+	case "S":
+		tr.S, err = strconv.Atoi(string(value))
+	case "X":
+		tr.X = string(value)
+	case "I":
+		tr.I, err = strconv.ParseInt(string(value), 10, 64)
+	case "C":
+		err = json.Unmarshal(value, &tr.C)
+	case "Z":
+		tr.Z = string(value)
+	default:
+		return fmt.Errorf("%w: '%s' no es un campo de trade", ErrUnknownField, field)
+	}
+	if err != nil {
+		return fmt.Errorf("columna %s = %q: %w", field, value, err)
+	}
+	return nil
+}
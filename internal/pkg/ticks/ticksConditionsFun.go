@@ -0,0 +1,286 @@
+package ticks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE DICCIONARIO DE CONDICIONES Y EXCHANGES
+// ===============================
+
+//
+//
+//
+*/
+
+// Condition es un código de condición de quote o de trade del SIP con su nombre.
+// Los códigos son de un carácter y su significado depende del plan que publica el
+// valor: CTA para las tapes A y B (NYSE y resto de bolsas) y UTP para la tape C
+// (NASDAQ). docs/rawData.json reproduce estas tablas.
+type Condition struct {
+	Code    string
+	Name    string
+	NonFirm bool // Quote no firme: no se puede ejecutar contra sus precios
+	Halt    bool // El valor está suspendido o todavía sin apertura
+}
+
+// Planes del SIP, según la tape (ver `ConditionPlan`).
+const (
+	PlanCTA = "CTA"
+	PlanUTP = "UTP"
+)
+
+// quoteConditions son las condiciones de quote de cada plan.
+var quoteConditions = map[string][]Condition{
+	PlanCTA: {
+		{Code: "A", Name: "Slow on Ask"},
+		{Code: "B", Name: "Slow on Bid"},
+		{Code: "C", Name: "Closing"},
+		{Code: "D", Name: "News Dissemination", Halt: true},
+		{Code: "E", Name: "Slow on Bid (LRP or Gap Quote)"},
+		{Code: "F", Name: "Fast Trading"},
+		{Code: "G", Name: "Trading Range Indication"},
+		{Code: "H", Name: "Slow on Bid and Ask"},
+		{Code: "I", Name: "Order Imbalance", Halt: true},
+		{Code: "J", Name: "Due to Related - News Dissemination", Halt: true},
+		{Code: "K", Name: "Due to Related - News Pending", Halt: true},
+		{Code: "L", Name: "Closed Market Maker", NonFirm: true},
+		{Code: "M", Name: "Additional Information", Halt: true},
+		{Code: "N", Name: "Non Firm Quote", NonFirm: true},
+		{Code: "O", Name: "Opening Quote"},
+		{Code: "P", Name: "News Pending", Halt: true},
+		{Code: "Q", Name: "Additional Information - Due to Related", Halt: true},
+		{Code: "R", Name: "Regular, Two-Sided Open"},
+		{Code: "S", Name: "Due to Related", Halt: true},
+		{Code: "T", Name: "Resume"},
+		{Code: "U", Name: "Slow on Bid and Ask (LRP or Gap Quote)"},
+		{Code: "V", Name: "In View of Common", Halt: true},
+		{Code: "W", Name: "Slow on Bid and Ask (Non-Firm)", NonFirm: true},
+		{Code: "X", Name: "Equipment Changeover", Halt: true},
+		{Code: "Y", Name: "Regular, One-Sided Open"},
+		{Code: "Z", Name: "No Open / No Resume", Halt: true},
+		{Code: "4", Name: "On Demand Intra Day Auction"},
+	},
+	PlanUTP: {
+		{Code: "A", Name: "Manual Ask, Automated Bid"},
+		{Code: "B", Name: "Manual Bid, Automated Ask"},
+		{Code: "F", Name: "Fast Trading"},
+		{Code: "H", Name: "Manual Bid and Ask"},
+		{Code: "I", Name: "Order Imbalance", Halt: true},
+		{Code: "L", Name: "Closed Quote", NonFirm: true},
+		{Code: "N", Name: "Non Firm Quote", NonFirm: true},
+		{Code: "O", Name: "Opening Quote Automated"},
+		{Code: "R", Name: "Regular, Two-Sided Open"},
+		{Code: "U", Name: "Manual Bid and Ask (Non-Firm)", NonFirm: true},
+		{Code: "X", Name: "Order Influx", Halt: true},
+		{Code: "Y", Name: "No Offer, No Bid, One-Sided Automated"},
+		{Code: "Z", Name: "No Open / No Resume", Halt: true},
+		{Code: "4", Name: "On Demand Intra Day Auction"},
+	},
+}
+
+// tradeConditions son las condiciones de trade de cada plan.
+var tradeConditions = map[string][]Condition{
+	PlanCTA: {
+		{Code: "@", Name: "Regular Sale"},
+		{Code: "B", Name: "Average Price Trade"},
+		{Code: "C", Name: "Cash Trade (Same Day Clearing)"},
+		{Code: "E", Name: "Automatic Execution"},
+		{Code: "F", Name: "Intermarket Sweep Order"},
+		{Code: "H", Name: "Price Variation Trade"},
+		{Code: "I", Name: "Odd Lot Trade"},
+		{Code: "K", Name: "Rule 127 (NYSE) or Rule 155 (NYSE American)"},
+		{Code: "L", Name: "Sold Last (Late Reporting)"},
+		{Code: "M", Name: "Market Center Official Close"},
+		{Code: "N", Name: "Next Day Trade (Next Day Clearing)"},
+		{Code: "O", Name: "Market Center Opening Trade"},
+		{Code: "P", Name: "Prior Reference Price"},
+		{Code: "Q", Name: "Market Center Official Open"},
+		{Code: "R", Name: "Seller"},
+		{Code: "T", Name: "Extended Hours Trade"},
+		{Code: "U", Name: "Extended Hours Sold (Out of Sequence)"},
+		{Code: "V", Name: "Contingent Trade"},
+		{Code: "X", Name: "Cross Trade"},
+		{Code: "Z", Name: "Sold (Out of Sequence)"},
+		{Code: "4", Name: "Derivatively Priced"},
+		{Code: "5", Name: "Market Center Reopening Trade"},
+		{Code: "6", Name: "Market Center Closing Trade"},
+		{Code: "7", Name: "Qualified Contingent Trade"},
+		{Code: "9", Name: "Corrected Consolidated Close (per Listing Market)"},
+	},
+	PlanUTP: {
+		{Code: "@", Name: "Regular Sale"},
+		{Code: "A", Name: "Acquisition"},
+		{Code: "B", Name: "Bunched Trade"},
+		{Code: "C", Name: "Cash Sale"},
+		{Code: "D", Name: "Distribution"},
+		{Code: "F", Name: "Intermarket Sweep"},
+		{Code: "G", Name: "Bunched Sold Trade"},
+		{Code: "H", Name: "Price Variation Trade"},
+		{Code: "I", Name: "Odd Lot Trade"},
+		{Code: "K", Name: "Rule 155 Trade (NYSE American)"},
+		{Code: "L", Name: "Sold Last"},
+		{Code: "M", Name: "Market Center Official Close"},
+		{Code: "N", Name: "Next Day"},
+		{Code: "O", Name: "Opening Prints"},
+		{Code: "P", Name: "Prior Reference Price"},
+		{Code: "Q", Name: "Market Center Official Open"},
+		{Code: "R", Name: "Seller"},
+		{Code: "S", Name: "Split Trade"},
+		{Code: "T", Name: "Form T"},
+		{Code: "U", Name: "Extended Trading Hours (Sold Out of Sequence)"},
+		{Code: "V", Name: "Contingent Trade"},
+		{Code: "W", Name: "Average Price Trade"},
+		{Code: "X", Name: "Cross Trade"},
+		{Code: "Y", Name: "Yellow Flag Regular Trade"},
+		{Code: "Z", Name: "Sold (Out of Sequence)"},
+		{Code: "1", Name: "Stopped Stock (Regular Trade)"},
+		{Code: "4", Name: "Derivatively Priced"},
+		{Code: "5", Name: "Re-Opening Prints"},
+		{Code: "6", Name: "Closing Prints"},
+		{Code: "7", Name: "Qualified Contingent Trade"},
+		{Code: "9", Name: "Corrected Consolidated Close (per Listing Market)"},
+	},
+}
+
+// exchanges son los códigos de exchange del SIP (AX, BX y X) con su nombre.
+var exchanges = map[string]string{
+	"A": "NYSE American (AMEX)",
+	"B": "NASDAQ OMX BX",
+	"C": "National Stock Exchange",
+	"D": "FINRA ADF",
+	"E": "Market Independent (generado por el SIP)",
+	"H": "MIAX",
+	"I": "International Securities Exchange",
+	"J": "Cboe EDGA",
+	"K": "Cboe EDGX",
+	"L": "Long Term Stock Exchange",
+	"M": "Chicago Stock Exchange",
+	"N": "New York Stock Exchange",
+	"P": "NYSE Arca",
+	"Q": "NASDAQ OMX",
+	"S": "NASDAQ Small Cap",
+	"T": "NASDAQ Int",
+	"U": "Members Exchange",
+	"V": "IEX",
+	"W": "CBOE",
+	"X": "NASDAQ OMX PSX",
+	"Y": "Cboe BYX",
+	"Z": "Cboe BZX",
+}
+
+// ConditionPlan devuelve el plan cuyas condiciones usa la tape 'tape' (el campo Z), o
+// "" si la tape no es A, B ni C.
+func ConditionPlan(tape string) string {
+	switch tape {
+	case "A", "B":
+		return PlanCTA
+	case "C":
+		return PlanUTP
+	}
+	return ""
+}
+
+// QuoteCondition busca el código 'code' entre las condiciones de quote del plan de
+// 'tape'. Devuelve false si la tape o el código no están en el diccionario.
+func QuoteCondition(tape, code string) (Condition, bool) {
+	return findCondition(quoteConditions[ConditionPlan(tape)], code)
+}
+
+// TradeCondition busca el código 'code' entre las condiciones de trade del plan de
+// 'tape'. Devuelve false si la tape o el código no están en el diccionario.
+func TradeCondition(tape, code string) (Condition, bool) {
+	return findCondition(tradeConditions[ConditionPlan(tape)], code)
+}
+
+// findCondition busca 'code' en 'conditions'.
+func findCondition(conditions []Condition, code string) (Condition, bool) {
+	for _, c := range conditions {
+		if c.Code == code {
+			return c, true
+		}
+	}
+	return Condition{}, false
+}
+
+// ExchangeName devuelve el nombre del exchange 'code' (AX, BX o el X de un trade).
+func ExchangeName(code string) (string, bool) {
+	name, ok := exchanges[code]
+	return name, ok
+}
+
+// Firm indica si la quote es firme y el valor cotiza: ninguna de sus condiciones es
+// NonFirm ni Halt en el plan de su tape. Los códigos que no están en el diccionario
+// no cuentan.
+func (q QuoteRecord) Firm() bool {
+	for _, code := range q.C {
+		if c, ok := QuoteCondition(q.Z, code); ok && (c.NonFirm || c.Halt) {
+			return false
+		}
+	}
+	return true
+}
+
+// QuoteConditionNames devuelve el nombre de cada condición de 'q', o el código tal
+// cual si no está en el diccionario.
+func QuoteConditionNames(q QuoteRecord) []string {
+	names := make([]string, len(q.C))
+	for i, code := range q.C {
+		names[i] = code
+		if c, ok := QuoteCondition(q.Z, code); ok {
+			names[i] = c.Name
+		}
+	}
+	return names
+}
+
+// EncodeConditions codifica una lista de condiciones como texto compacto: los códigos
+// seguidos ("R", "RI") cuando todos son de un carácter, que es lo normal, y si no, un
+// array JSON. Lo usan la columna C de las quotes y los chunks.
+func EncodeConditions(conditions []string) []byte {
+	compact := true
+	for i, code := range conditions {
+		if len(code) != 1 || (i == 0 && (code[0] == '[' || code[0] == '"')) {
+			compact = false
+			break
+		}
+	}
+	if compact {
+		return []byte(strings.Join(conditions, ""))
+	}
+	raw, _ := json.Marshal(conditions) // Serializar un []string no falla
+	return raw
+}
+
+// DecodeConditions es la inversa de `EncodeConditions`. También lee el formato de la
+// columna C de las quotes hasta la v2 del esquema: una cadena JSON con los códigos
+// seguidos. Sin condiciones devuelve nil.
+func DecodeConditions(value []byte) ([]string, error) {
+	switch {
+	case len(value) == 0:
+		return nil, nil
+	case value[0] == '[':
+		var conditions []string
+		if err := json.Unmarshal(value, &conditions); err != nil {
+			return nil, fmt.Errorf("condiciones %q: %w", value, err)
+		}
+		return conditions, nil
+	case value[0] == '"':
+		var legacy string
+		if err := json.Unmarshal(value, &legacy); err != nil {
+			return nil, fmt.Errorf("condiciones %q: %w", value, err)
+		}
+		value = []byte(legacy)
+	}
+	var conditions []string
+	for _, code := range string(value) {
+		conditions = append(conditions, string(code))
+	}
+	return conditions, nil
+}
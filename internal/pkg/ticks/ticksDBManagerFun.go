@@ -0,0 +1,169 @@
+package ticks
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE VARIAS BASES DE DATOS ABIERTAS
+// ===============================
+
+//
+//
+//
+*/
+
+// DBOpener abre el archivo bbolt 'path', en solo lectura si 'readOnly'. `OpenDB` es
+// el de por defecto; un programa puede pasar el suyo a `NewDBManager` (ej. con sus
+// propias opciones de bbolt y reintentos).
+type DBOpener func(path string, readOnly bool) (*db.DB, error)
+
+// DBManager mantiene varias bases de datos bbolt abiertas a la vez, cada una con un
+// nombre (ej. "stocks" y "crypto", o "ticks" y "archivo-2023"), para que un mismo
+// proceso pueda escribir en una y consultar copias archivadas en solo lectura.
+//
+// Un archivo solo puede estar abierto una vez en lectura/escritura: bbolt bloquea el
+// archivo y una segunda apertura desde el mismo proceso esperaría su propio bloqueo
+// hasta el timeout. El manager lo detecta antes y devuelve un error claro. Varias
+// aperturas de solo lectura del mismo archivo sí pueden convivir.
+//
+// Es seguro para uso concurrente.
+type DBManager struct {
+	open DBOpener
+
+	mu  sync.Mutex
+	dbs map[string]*managedDB
+}
+
+// managedDB es una base de datos abierta por el manager.
+type managedDB struct {
+	path     string // Ruta con la que se abrió
+	absPath  string
+	readOnly bool
+	db       *db.DB
+}
+
+// NewDBManager crea un manager sin bases de datos abiertas que las abre con 'open'
+// (`OpenDB` si es nil).
+func NewDBManager(open DBOpener) *DBManager {
+	if open == nil {
+		open = OpenDB
+	}
+	return &DBManager{open: open, dbs: make(map[string]*managedDB)}
+}
+
+// Open abre 'path' con el nombre 'name', en solo lectura si 'readOnly', y la devuelve.
+//
+// Si 'name' ya está abierto con la misma ruta y modo devuelve la misma instancia; con
+// otra ruta o modo es un error. También es un error abrir en lectura/escritura un
+// archivo que el manager ya tiene abierto con otro nombre, o abrir en solo lectura uno
+// que tiene abierto en lectura/escritura (se usaría la instancia existente).
+func (m *DBManager) Open(name, path string, readOnly bool) (*db.DB, error) {
+	if name == "" {
+		return nil, fmt.Errorf("el nombre de la base de datos no puede estar vacío")
+	}
+	if path == "" {
+		return nil, fmt.Errorf("base de datos '%s': ruta vacía", name)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("base de datos '%s': ruta '%s': %w", name, path, err)
+	}
+
+	// Se mantiene el candado durante la apertura para que dos llamadas no abran el
+	// mismo archivo a la vez.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if open, ok := m.dbs[name]; ok {
+		if open.absPath == absPath && open.readOnly == readOnly {
+			return open.db, nil
+		}
+		return nil, fmt.Errorf("la base de datos '%s' ya está abierta con '%s' (%s)", name, open.path, modeName(open.readOnly))
+	}
+	for other, open := range m.dbs {
+		if open.absPath == absPath && (!open.readOnly || !readOnly) {
+			return nil, fmt.Errorf("'%s' ya está abierta como '%s' en %s; no se puede abrir también como '%s' en %s",
+				path, other, modeName(open.readOnly), name, modeName(readOnly))
+		}
+	}
+
+	dbInstance, err := m.open(path, readOnly)
+	if err != nil {
+		return nil, fmt.Errorf("base de datos '%s': %w", name, err)
+	}
+	m.dbs[name] = &managedDB{path: path, absPath: absPath, readOnly: readOnly, db: dbInstance}
+	return dbInstance, nil
+}
+
+// OpenReadOnly abre 'path' en solo lectura con el nombre 'name' (ver `DBManager.Open`).
+func (m *DBManager) OpenReadOnly(name, path string) (*db.DB, error) {
+	return m.Open(name, path, true)
+}
+
+// Get devuelve la base de datos abierta con el nombre 'name'.
+func (m *DBManager) Get(name string) (*db.DB, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	open, ok := m.dbs[name]
+	if !ok {
+		return nil, false
+	}
+	return open.db, true
+}
+
+// Names devuelve los nombres de las bases de datos abiertas, ordenados.
+func (m *DBManager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	names := make([]string, 0, len(m.dbs))
+	for name := range m.dbs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Close cierra la base de datos 'name' y la olvida. Cerrar un nombre que no está
+// abierto no es un error.
+func (m *DBManager) Close(name string) error {
+	m.mu.Lock()
+	open, ok := m.dbs[name]
+	delete(m.dbs, name)
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if err := open.db.Close(); err != nil {
+		return fmt.Errorf("error al cerrar la base de datos '%s' (%s): %w", name, open.path, err)
+	}
+	return nil
+}
+
+// CloseAll cierra todas las bases de datos abiertas y devuelve los errores de cierre
+// combinados.
+func (m *DBManager) CloseAll() error {
+	var errs []error
+	for _, name := range m.Names() {
+		errs = append(errs, m.Close(name))
+	}
+	return errors.Join(errs...)
+}
+
+// modeName describe el modo de apertura para los mensajes de error.
+func modeName(readOnly bool) string {
+	if readOnly {
+		return "solo lectura"
+	}
+	return "lectura/escritura"
+}
@@ -0,0 +1,94 @@
+package ticks
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+
+	db "go.etcd.io/bbolt"
+)
+
+func TestDBManager(t *testing.T) {
+	dir := t.TempDir()
+	live, archive := filepath.Join(dir, "ticks.db"), filepath.Join(dir, "archive.db")
+	opens := 0
+	m := NewDBManager(func(path string, readOnly bool) (*db.DB, error) {
+		opens++
+		return OpenDB(path, readOnly)
+	})
+	t.Cleanup(func() { m.CloseAll() })
+
+	// El archivo se crea en lectura/escritura y se cierra para abrirlo luego en solo lectura.
+	if _, err := m.Open("archive", archive, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close("archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	liveDB, err := m.Open("ticks", live, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := m.OpenReadOnly("archive", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := m.OpenReadOnly("archive-2", archive)
+	if err != nil {
+		t.Fatalf("dos aperturas de solo lectura del mismo archivo deben convivir: %v", err)
+	}
+	if first == second {
+		t.Error("cada nombre debe tener su propia instancia")
+	}
+	if again, err := m.Open("ticks", filepath.Join(dir, ".", "ticks.db"), false); err != nil || again != liveDB {
+		t.Errorf("abrir otra vez el mismo nombre, ruta y modo debe devolver la misma instancia (%v)", err)
+	}
+	if opens != 4 {
+		t.Errorf("%d aperturas, se esperaban 4", opens)
+	}
+	if names := m.Names(); !slices.Equal(names, []string{"archive", "archive-2", "ticks"}) {
+		t.Errorf("nombres %v", names)
+	}
+	if got, ok := m.Get("ticks"); !ok || got != liveDB {
+		t.Error("Get no devuelve la base de datos abierta")
+	}
+	if _, ok := m.Get("crypto"); ok {
+		t.Error("Get devuelve un nombre que no está abierto")
+	}
+
+	for _, tc := range []struct {
+		name, path string
+		readOnly   bool
+		problem    string
+	}{
+		{"", live, false, "nombre vacío"},
+		{"crypto", "", false, "ruta vacía"},
+		{"ticks", archive, false, "el mismo nombre con otra ruta"},
+		{"ticks", live, true, "el mismo nombre con otro modo"},
+		{"copy", live, false, "un archivo abierto en lectura/escritura con otro nombre"},
+		{"copy", live, true, "en solo lectura un archivo abierto en lectura/escritura"},
+		{"copy", archive, false, "en lectura/escritura un archivo abierto en solo lectura"},
+	} {
+		if _, err := m.Open(tc.name, tc.path, tc.readOnly); err == nil {
+			t.Errorf("se esperaba un error al abrir %s", tc.problem)
+		}
+	}
+	if opens != 4 {
+		t.Errorf("los errores no deben llegar a abrir el archivo: %d aperturas", opens)
+	}
+
+	if err := m.Close("crypto"); err != nil {
+		t.Errorf("cerrar un nombre que no está abierto: %v", err)
+	}
+	if err := m.CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if names := m.Names(); len(names) != 0 {
+		t.Errorf("tras CloseAll quedan %v", names)
+	}
+	// Cerrado el de lectura/escritura, el archivo se puede volver a abrir con otro nombre.
+	if _, err := m.OpenReadOnly("copy", live); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,274 @@
+package ticks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE CODIFICACIÓN PREVIA A LA ESCRITURA
+// ===============================
+
+//
+//
+//
+*/
+
+// Guardar un lote tiene dos partes: interpretar y codificar cada tick (timestamps,
+// texto de las columnas, filas binarias), que no necesita la base de datos, y asignar
+// claves y escribir, que necesita la transacción de escritura. bbolt admite un solo
+// escritor a la vez, así que la primera parte se puede sacar de la transacción
+// (`EncodeQuotes`, `EncodeTrades`) y hacerse en paralelo para varios lotes, dejando al
+// escritor solo la segunda (`PutEncodedQuotesTx`, `PutEncodedTradesTx`).
+
+// EncodedQuotes son las quotes de un lote ya interpretadas y codificadas para un
+// layout, listas para `PutEncodedQuotesTx`. Se crean con `EncodeQuotes` y no se
+// modifican después: se pueden escribir otra vez si la transacción falla.
+type EncodedQuotes struct {
+	Symbol string
+	Layout string
+	ticks  encodedTicks
+	// records son las quotes tal cual en `LayoutChunks`: un chunk se codifica junto
+	// con lo que ya está guardado, así que no se puede preparar antes.
+	records []QuoteRecord
+}
+
+// EncodedTrades son los trades de un lote listos para `PutEncodedTradesTx`. Se
+// crean con `EncodeTrades`.
+type EncodedTrades struct {
+	Symbol string
+	ticks  encodedTicks
+}
+
+// encodedTicks son los ticks válidos de un lote, en el orden en que llegaron.
+type encodedTicks struct {
+	ticks   []encodedTick
+	skipped int       // Ticks con un timestamp que no es RFC3339
+	first   time.Time // Timestamp más antiguo; cero si no hay ticks válidos
+	last    time.Time // Timestamp más reciente; cero si no hay ticks válidos
+	count   int       // Ticks recibidos, válidos o no
+}
+
+// encodedTick es un tick con su timestamp interpretado y un valor por bucket del
+// índice (una columna, o la fila). En `LayoutRows`, una quote que no cabe en la fila
+// lleva sus columnas (ver `putEncodedQuotes`).
+type encodedTick struct {
+	t      time.Time
+	ts     string // El timestamp original, para los mensajes de error
+	values [][]byte
+	quote  QuoteRecord // Solo quotes: para compararla con las de otros layouts
+}
+
+// add interpreta el timestamp 'ts' y, si es válido, añade el tick con los valores que
+// devuelve 'encode'.
+func (e *encodedTicks) add(ts string, encode func() ([][]byte, error)) error {
+	e.count++
+	t, ok := parseTickTime(ts)
+	if !ok {
+		e.skipped++
+		return nil
+	}
+	if e.first.IsZero() || t.Before(e.first) {
+		e.first = t
+	}
+	if t.After(e.last) {
+		e.last = t
+	}
+	values, err := encode()
+	if err != nil {
+		return err
+	}
+	e.ticks = append(e.ticks, encodedTick{t: t, ts: ts, values: values})
+	return nil
+}
+
+// Len devuelve el número de quotes del lote, válidas o no.
+func (e *EncodedQuotes) Len() int {
+	if e.Layout == LayoutChunks {
+		return len(e.records)
+	}
+	return e.ticks.count
+}
+
+// Len devuelve el número de trades del lote, válidos o no.
+func (e *EncodedTrades) Len() int {
+	return e.ticks.count
+}
+
+// EncodeQuotes prepara 'quotes' de 'symbol' para guardarlas con el layout 'layout'
+// (uno de `QuoteLayouts`) con `PutEncodedQuotesTx`. Las quotes con un timestamp que no
+// es RFC3339 se cuentan como descartadas; las que no caben en la fila binaria se
+// preparan para las columnas, como en `PutQuotesTx`.
+func EncodeQuotes(symbol string, quotes []QuoteRecord, layout string) (*EncodedQuotes, error) {
+	if err := checkLayout(layout); err != nil {
+		return nil, err
+	}
+	enc := &EncodedQuotes{Symbol: symbol, Layout: layout}
+	if layout == LayoutChunks {
+		enc.records = quotes
+		return enc, nil
+	}
+	enc.ticks.ticks = make([]encodedTick, 0, len(quotes))
+	for _, q := range quotes {
+		n := len(enc.ticks.ticks)
+		err := enc.ticks.add(q.T, func() ([][]byte, error) {
+			if layout == LayoutRows {
+				row, err := EncodeQuoteRow(q)
+				if errors.Is(err, ErrQuoteRowEncode) {
+					return EncodeQuoteColumns(q), nil // No cabe en la fila: va a las columnas
+				}
+				return [][]byte{row}, err
+			}
+			return EncodeQuoteColumns(q), nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("quote %s de %s: %w", q.T, symbol, err)
+		}
+		if len(enc.ticks.ticks) > n {
+			enc.ticks.ticks[n].quote = q
+		}
+	}
+	return enc, nil
+}
+
+// EncodeTrades prepara 'trades' de 'symbol' para `PutEncodedTradesTx`.
+func EncodeTrades(symbol string, trades []TradeRecord) (*EncodedTrades, error) {
+	enc := &EncodedTrades{Symbol: symbol}
+	enc.ticks.ticks = make([]encodedTick, 0, len(trades))
+	for _, tr := range trades {
+		err := enc.ticks.add(tr.T, func() ([][]byte, error) { return EncodeTradeColumns(tr) })
+		if err != nil {
+			return nil, fmt.Errorf("trade %s de %s: %w", tr.T, symbol, err)
+		}
+	}
+	return enc, nil
+}
+
+// PutEncodedQuotesTx guarda las quotes de 'enc' dentro de la transacción de escritura
+// 'tx', con las reglas de claves de `PutQuotesTx`, y actualiza los metadatos del
+// símbolo (ver `SymbolMeta`).
+func PutEncodedQuotesTx(tx *db.Tx, enc *EncodedQuotes) (WriteResult, error) {
+	symbolBucket, err := tx.CreateBucketIfNotExists([]byte(enc.Symbol))
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("failed to create symbol bucket '%s': %w", enc.Symbol, err)
+	}
+	var res WriteResult
+	switch enc.Layout {
+	case LayoutChunks:
+		res, err = putQuoteChunks(symbolBucket, enc.Symbol, enc.records)
+	default:
+		// Layouts de columnas y de filas: las columnas son un sub-bucket por campo, en el
+		// orden de `QuoteFields` (el de `EncodeQuoteColumns`), y las filas un único
+		// sub-bucket con una fila binaria por quote.
+		res, err = putEncodedQuotes(symbolBucket, enc.Symbol, enc.ticks)
+	}
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return res, updateTickMetaTx(tx, enc.Symbol, KindQuotes, res)
+}
+
+// PutEncodedTradesTx guarda los trades de 'enc' bajo `<symbol>/TRADES/<campo>` dentro
+// de la transacción de escritura 'tx', con las reglas de claves de `PutTradesTx`, y
+// actualiza los metadatos del símbolo.
+func PutEncodedTradesTx(tx *db.Tx, enc *EncodedTrades) (WriteResult, error) {
+	symbolBucket, err := tx.CreateBucketIfNotExists([]byte(enc.Symbol))
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("failed to create symbol bucket '%s': %w", enc.Symbol, err)
+	}
+	tradesBucket, err := symbolBucket.CreateBucketIfNotExists([]byte(TradesBucket))
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("failed to create trades bucket for symbol '%s': %w", enc.Symbol, err)
+	}
+	res, err := putEncodedTicks(tradesBucket, enc.Symbol, "trade", TradeFields, enc.ticks)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	return res, updateTickMetaTx(tx, enc.Symbol, KindTrades, res)
+}
+
+// putEncodedTicks escribe 'enc' en los sub-buckets 'names' de 'parent' (el primero es
+// el índice de claves; ver `KeyAllocator`), creándolos si no existen.
+func putEncodedTicks(parent *db.Bucket, symbol, kind string, names []string, enc encodedTicks) (WriteResult, error) {
+	res := WriteResult{Skipped: enc.skipped, First: enc.first, Last: enc.last}
+	buckets := make([]*db.Bucket, len(names))
+	for i, name := range names {
+		var err error
+		buckets[i], err = parent.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return WriteResult{}, fmt.Errorf("failed to create %s sub-bucket '%s' for symbol '%s': %w", kind, name, symbol, err)
+		}
+	}
+	keys := NewKeyAllocator()
+
+	for _, tick := range enc.ticks {
+		key, existing, err := keys.Assign(buckets[0], tick.t, SameColumns(buckets, tick.values))
+		if err != nil {
+			return WriteResult{}, fmt.Errorf("%s %s de %s: %w", kind, tick.ts, symbol, err)
+		}
+		if existing {
+			res.Existing++ // Ya guardado (ej. página repetida al reanudar)
+			continue
+		}
+		// bbolt exige que el valor siga vivo hasta el commit: cada tick tiene los suyos.
+		for i, name := range names {
+			if err := buckets[i].Put(key, tick.values[i]); err != nil {
+				return WriteResult{}, fmt.Errorf("failed to put %s %s for %s: %w", kind, name, tick.ts, err)
+			}
+		}
+		res.Written++
+	}
+	return res, nil
+}
+
+// putEncodedQuotes escribe las quotes de 'enc' en las columnas de 'symbolBucket' o,
+// las que vienen codificadas como fila, en las filas; cada sub-bucket se crea con la
+// primera quote que lo necesita. Las claves se asignan mirando todos los layouts (ver
+// `quoteKeys`), así que ninguna se repite entre ellos.
+func putEncodedQuotes(symbolBucket *db.Bucket, symbol string, enc encodedTicks) (WriteResult, error) {
+	res := WriteResult{Skipped: enc.skipped, First: enc.first, Last: enc.last}
+	stored, _, err := loadChunks(symbolBucket.Bucket([]byte(QuoteChunksBucket)), symbol, enc.first, enc.last)
+	if err != nil {
+		return WriteResult{}, err
+	}
+	var columns, rows []*db.Bucket // Se abren o se crean con la primera quote de cada layout
+	keys := newQuoteKeys(symbolBucket, stored)
+
+	for _, tick := range enc.ticks {
+		names, buckets := QuoteFields, &columns
+		if len(tick.values) == 1 {
+			names, buckets = []string{QuoteRowsBucket}, &rows
+		}
+		if *buckets == nil {
+			*buckets = make([]*db.Bucket, len(names))
+			for i, name := range names {
+				if (*buckets)[i], err = symbolBucket.CreateBucketIfNotExists([]byte(name)); err != nil {
+					return WriteResult{}, fmt.Errorf("failed to create quote sub-bucket '%s' for symbol '%s': %w", name, symbol, err)
+				}
+			}
+		}
+		key, existing, err := keys.assign(tick.t, tick.quote, tick.values)
+		if err != nil {
+			return WriteResult{}, fmt.Errorf("quote %s de %s: %w", tick.ts, symbol, err)
+		}
+		if existing {
+			res.Existing++ // Ya guardada (ej. página repetida al reanudar)
+			continue
+		}
+		// bbolt exige que el valor siga vivo hasta el commit: cada quote tiene los suyos.
+		for i, name := range names {
+			if err := (*buckets)[i].Put(key, tick.values[i]); err != nil {
+				return WriteResult{}, fmt.Errorf("failed to put quote %s for %s: %w", name, tick.ts, err)
+			}
+		}
+		res.Written++
+	}
+	return res, nil
+}
@@ -0,0 +1,185 @@
+package ticks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE CLAVES DE TICKS
+// ===============================
+
+//
+//
+//
+*/
+
+// Claves de quotes y trades (10 bytes, big-endian):
+//
+//	offset  tamaño  campo
+//	0       8       timestamp en UnixNano (int64 como uint64)
+//	8       2       secuencia entre los ticks del mismo timestamp (uint16)
+//
+// En SIP es habitual que varias quotes o trades compartan el nanosegundo; con la clave
+// de solo 8 bytes se pisaban entre sí. La secuencia va después del timestamp, así que
+// el orden de las claves sigue siendo el orden temporal.
+//
+// Las bases de datos anteriores tienen claves de 8 bytes (solo el timestamp). Los
+// helpers de lectura aceptan ambas; una clave de 8 bytes ordena antes que cualquier
+// clave de 10 bytes del mismo timestamp. Las barras siguen usando 8 bytes: solo hay
+// una barra por timestamp y timeframe, y volver a descargarla debe reemplazarla.
+const (
+	KeySize       = 10
+	LegacyKeySize = 8
+)
+
+// Key devuelve la clave del tick número 'seq' con timestamp 'unixNano'.
+func Key(unixNano int64, seq uint16) []byte {
+	key := make([]byte, KeySize)
+	binary.BigEndian.PutUint64(key, uint64(unixNano))
+	binary.BigEndian.PutUint16(key[8:], seq)
+	return key
+}
+
+// KeyPrefix devuelve los 8 bytes del timestamp, que ordenan antes que todas las
+// claves de ese instante: sirve como punto de `Cursor.Seek` para empezar un rango.
+func KeyPrefix(t time.Time) []byte {
+	key := make([]byte, LegacyKeySize)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// KeyTime devuelve el timestamp (UTC) de una clave de 8 o 10 bytes.
+func KeyTime(key []byte) (time.Time, error) {
+	if len(key) != KeySize && len(key) != LegacyKeySize {
+		return time.Time{}, fmt.Errorf("clave de tick de %d bytes, se esperaban %d u %d", len(key), KeySize, LegacyKeySize)
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key))).UTC(), nil
+}
+
+// KeySeq devuelve la secuencia de una clave (0 para las claves de 8 bytes).
+func KeySeq(key []byte) uint16 {
+	if len(key) != KeySize {
+		return 0
+	}
+	return binary.BigEndian.Uint16(key[8:])
+}
+
+// Seek coloca 'c' en la primera clave con timestamp igual o posterior a 'from'; con
+// 'from' cero, en la primera clave del bucket (el tiempo cero no tiene UnixNano).
+func Seek(c *db.Cursor, from time.Time) (key, value []byte) {
+	if from.IsZero() {
+		return c.First()
+	}
+	return c.Seek(KeyPrefix(from))
+}
+
+// ForEach llama a 'fn' con cada clave y valor de 'bucket' cuyo timestamp está en
+// [from, to), en orden. Con 'from' cero se empieza por el principio y con 'to' cero
+// se recorre hasta el final. Si 'fn' devuelve un error el recorrido se detiene y se
+// devuelve ese error.
+func ForEach(bucket *db.Bucket, from, to time.Time, fn func(key, value []byte) error) error {
+	c := bucket.Cursor()
+	for k, v := Seek(c, from); k != nil; k, v = c.Next() {
+		t, err := KeyTime(k)
+		if err != nil {
+			return err
+		}
+		if !to.IsZero() && !t.Before(to) {
+			return nil
+		}
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// KeyAllocator asigna claves a los ticks de una transacción de escritura.
+//
+// Para cada tick busca las claves ya guardadas con su mismo timestamp:
+//   - Si alguna guarda exactamente el mismo tick (según 'same') y no se ha usado aún
+//     en esta transacción, se reutiliza y no hay nada que escribir. Así repetir una
+//     página al reanudar una descarga no duplica datos.
+//   - Si no, el tick recibe la siguiente secuencia libre de ese timestamp, contando
+//     también las asignadas antes en esta transacción.
+//
+// Dos ticks idénticos en la misma transacción ocupan claves distintas; uno idéntico a
+// otro ya guardado en una transacción anterior se considera el mismo tick.
+type KeyAllocator struct {
+	claimed map[string]struct{}
+	next    map[int64]int // Siguiente secuencia por timestamp según lo ya asignado
+}
+
+// NewKeyAllocator crea un asignador para una transacción.
+func NewKeyAllocator() *KeyAllocator {
+	return &KeyAllocator{claimed: make(map[string]struct{}), next: make(map[int64]int)}
+}
+
+// Assign devuelve la clave del tick con timestamp 't' en 'index' (el bucket cuyas
+// claves representan a todos los del tick, ej. la columna "AP"). 'existing' es true
+// si el tick ya estaba guardado bajo esa clave.
+func (a *KeyAllocator) Assign(index *db.Bucket, t time.Time, same func(key []byte) bool) (key []byte, existing bool, err error) {
+	return a.AssignKeys(t, keysAt(index, t), same)
+}
+
+// AssignKeys es `Assign` con las claves ya guardadas con el timestamp 't' en 'stored',
+// en orden: sirve cuando un tick puede estar en varios índices (ej. las quotes en
+// columnas, filas y chunks; ver `quoteKeys`). 'same' recibe claves de todos ellos.
+func (a *KeyAllocator) AssignKeys(t time.Time, stored [][]byte, same func(key []byte) bool) (key []byte, existing bool, err error) {
+	next := a.next[t.UnixNano()]
+	for _, k := range stored {
+		if _, used := a.claimed[string(k)]; !used && same(k) {
+			a.claimed[string(k)] = struct{}{}
+			return k, true, nil
+		}
+		if len(k) == KeySize {
+			next = max(next, int(KeySeq(k))+1)
+		}
+	}
+	if next > math.MaxUint16 {
+		return nil, false, fmt.Errorf("más de %d ticks con el timestamp %s", math.MaxUint16+1, t.Format(time.RFC3339Nano))
+	}
+	key = Key(t.UnixNano(), uint16(next))
+	a.claimed[string(key)] = struct{}{}
+	a.next[t.UnixNano()] = next + 1
+	return key, false, nil
+}
+
+// keysAt devuelve las claves de 'index' con el timestamp 't', en orden (ninguna si
+// 'index' es nil).
+func keysAt(index *db.Bucket, t time.Time) [][]byte {
+	if index == nil {
+		return nil
+	}
+	var keys [][]byte
+	prefix := KeyPrefix(t)
+	c := index.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// SameColumns devuelve una función 'same' para `KeyAllocator.Assign` que compara
+// los valores de un tick guardado en columnas ('buckets[i]' guarda 'values[i]').
+func SameColumns(buckets []*db.Bucket, values [][]byte) func(key []byte) bool {
+	return func(key []byte) bool {
+		for i, bucket := range buckets {
+			stored := bucket.Get(key)
+			if stored == nil || !bytes.Equal(stored, values[i]) {
+				return false
+			}
+		}
+		return true
+	}
+}
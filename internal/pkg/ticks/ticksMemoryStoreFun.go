@@ -0,0 +1,349 @@
+package ticks
+
+import (
+	"cmp"
+	"fmt"
+	"iter"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE ALMACÉN EN MEMORIA
+// ===============================
+
+//
+//
+//
+*/
+
+// MemoryStore es un `TickStore` en memoria, para tests y backtests. Sigue las mismas
+// reglas de orden, secuencias y duplicados que `BoltStore`, así que un consumidor ve
+// los mismos ticks en uno y otro.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	closed  bool
+	symbols map[string]*memorySymbol
+}
+
+// memorySymbol son los ticks de un símbolo, ordenados por (Time, Seq).
+type memorySymbol struct {
+	quotes []Quote
+	trades []Trade
+}
+
+// NewMemoryStore crea un almacén en memoria vacío.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{symbols: make(map[string]*memorySymbol)}
+}
+
+// WriteBatch guarda el lote bajo el candado de escritura.
+func (s *MemoryStore) WriteBatch(batch Batch) (WriteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return WriteResult{}, ErrStoreClosed
+	}
+	sym := s.symbols[batch.Symbol]
+	if sym == nil {
+		sym = &memorySymbol{}
+	}
+
+	quotes, addedQuotes, err := planTicks(sym.quotes, batch.Quotes,
+		func(q QuoteRecord) string { return q.T },
+		func(t time.Time, seq uint16, q QuoteRecord) Quote { return Quote{Time: t, Seq: seq, QuoteRecord: q} },
+		Quote.key,
+		func(stored Quote, q QuoteRecord) bool { return sameQuote(stored.QuoteRecord, q) })
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("quotes de %s: %w", batch.Symbol, err)
+	}
+	trades, addedTrades, err := planTicks(sym.trades, batch.Trades,
+		func(tr TradeRecord) string { return tr.T },
+		func(t time.Time, seq uint16, tr TradeRecord) Trade { return Trade{Time: t, Seq: seq, TradeRecord: tr} },
+		Trade.key,
+		func(stored Trade, tr TradeRecord) bool { return sameTrade(stored.TradeRecord, tr) })
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("trades de %s: %w", batch.Symbol, err)
+	}
+
+	// Nada falla a partir de aquí: el lote se aplica entero.
+	sym.quotes = mergeSorted(sym.quotes, addedQuotes, Quote.key)
+	sym.trades = mergeSorted(sym.trades, addedTrades, Trade.key)
+	if len(sym.quotes) > 0 || len(sym.trades) > 0 {
+		s.symbols[batch.Symbol] = sym
+	}
+	var res WriteResult
+	res.Add(quotes)
+	res.Add(trades)
+	return res, nil
+}
+
+// Quotes recorre una copia de las quotes de 'opts' tomada al empezar, así que el
+// bucle puede escribir en el almacén sin bloquearse.
+func (s *MemoryStore) Quotes(opts QueryOptions) iter.Seq2[Quote, error] {
+	fields, err := opts.fields(QuoteFields)
+	if err != nil {
+		return failSeq[Quote](err)
+	}
+	return func(yield func(Quote, error) bool) {
+		quotes, err := snapshot(s, opts, func(sym *memorySymbol) []Quote { return rangeOf(sym.quotes, opts, Quote.key) })
+		if err != nil {
+			yield(Quote{}, err)
+			return
+		}
+		for _, q := range quotes {
+			q.QuoteRecord = selectQuoteFields(q.QuoteRecord, fields)
+			q.T = q.Time.Format(time.RFC3339Nano)
+			if !yield(q, nil) {
+				return
+			}
+		}
+	}
+}
+
+// Trades recorre una copia de los trades de 'opts' (ver `MemoryStore.Quotes`).
+func (s *MemoryStore) Trades(opts QueryOptions) iter.Seq2[Trade, error] {
+	fields, err := opts.fields(TradeFields)
+	if err != nil {
+		return failSeq[Trade](err)
+	}
+	return func(yield func(Trade, error) bool) {
+		trades, err := snapshot(s, opts, func(sym *memorySymbol) []Trade { return rangeOf(sym.trades, opts, Trade.key) })
+		if err != nil {
+			yield(Trade{}, err)
+			return
+		}
+		for _, tr := range trades {
+			tr.TradeRecord = selectTradeFields(tr.TradeRecord, fields)
+			tr.T = tr.Time.Format(time.RFC3339Nano)
+			if !yield(tr, nil) {
+				return
+			}
+		}
+	}
+}
+
+// LastTimestamp devuelve el timestamp del último tick de 'kind' de 'symbol'.
+func (s *MemoryStore) LastTimestamp(symbol string, kind Kind) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return time.Time{}, ErrStoreClosed
+	}
+	sym := s.symbols[symbol]
+	switch {
+	case kind != KindQuotes && kind != KindTrades:
+		return time.Time{}, fmt.Errorf("tipo de tick desconocido %q", kind)
+	case sym == nil:
+		return time.Time{}, nil
+	case kind == KindQuotes && len(sym.quotes) > 0:
+		return sym.quotes[len(sym.quotes)-1].Time, nil
+	case kind == KindTrades && len(sym.trades) > 0:
+		return sym.trades[len(sym.trades)-1].Time, nil
+	}
+	return time.Time{}, nil
+}
+
+// Stats cuenta los ticks de cada símbolo.
+func (s *MemoryStore) Stats() (StoreStats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var stats StoreStats
+	if s.closed {
+		return stats, ErrStoreClosed
+	}
+	for name, sym := range s.symbols {
+		stats.addSymbol(name, SymbolStats{Quotes: len(sym.quotes), Trades: len(sym.trades)})
+	}
+	return stats, nil
+}
+
+// Close descarta los ticks. Cerrar dos veces no es un error.
+func (s *MemoryStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.symbols = nil
+	return nil
+}
+
+// snapshot copia, bajo el candado de lectura de 's', los ticks que 'pick' elige del
+// símbolo de 'opts'.
+func snapshot[T any](s *MemoryStore, opts QueryOptions, pick func(*memorySymbol) []T) ([]T, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	sym := s.symbols[opts.SYMBOL]
+	if sym == nil {
+		return nil, nil
+	}
+	return slices.Clone(pick(sym)), nil
+}
+
+// key devuelve la posición de la quote en el orden de `Key`.
+func (q Quote) key() (time.Time, uint16) { return q.Time, q.Seq }
+
+// key devuelve la posición del trade en el orden de `Key`.
+func (tr Trade) key() (time.Time, uint16) { return tr.Time, tr.Seq }
+
+// rangeOf devuelve la parte de 'ticks' (ordenados) con timestamp en [FROM, TO).
+func rangeOf[T any](ticks []T, opts QueryOptions, key func(T) (time.Time, uint16)) []T {
+	byTime := func(tick T, t time.Time) int {
+		tickTime, _ := key(tick)
+		return tickTime.Compare(t)
+	}
+	lo := 0
+	if !opts.FROM.IsZero() {
+		lo, _ = slices.BinarySearchFunc(ticks, opts.FROM, byTime)
+	}
+	hi := len(ticks)
+	if !opts.TO.IsZero() {
+		hi, _ = slices.BinarySearchFunc(ticks, opts.TO, byTime)
+	}
+	return ticks[lo:max(lo, hi)]
+}
+
+// planTicks decide qué ticks de 'records' son nuevos respecto a 'stored' (ordenados)
+// sin modificarlo, con las reglas de `KeyAllocator`: un tick idéntico a uno guardado
+// que no se haya emparejado ya en este lote es el mismo tick; si no, recibe la
+// siguiente secuencia de su timestamp. Devuelve los ticks nuevos ordenados.
+func planTicks[R, T any](
+	stored []T,
+	records []R,
+	timestamp func(R) string,
+	build func(time.Time, uint16, R) T,
+	key func(T) (time.Time, uint16),
+	same func(T, R) bool,
+) (WriteResult, []T, error) {
+	var res WriteResult
+	var added []T
+	claimed := make(map[int]bool)  // Índices de 'stored' ya emparejados
+	nextSeq := make(map[int64]int) // Siguiente secuencia por timestamp
+	for _, rec := range records {
+		t, ok := parseTickTime(timestamp(rec))
+		if !ok {
+			res.Skipped++
+			continue
+		}
+		t = t.UTC()
+		if res.First.IsZero() || t.Before(res.First) {
+			res.First = t
+		}
+		if t.After(res.Last) {
+			res.Last = t
+		}
+
+		lo, _ := slices.BinarySearchFunc(stored, t, func(tick T, t time.Time) int {
+			tickTime, _ := key(tick)
+			return tickTime.Compare(t)
+		})
+		hi := lo
+		matched := false
+		for ; hi < len(stored); hi++ {
+			tickTime, _ := key(stored[hi])
+			if !tickTime.Equal(t) {
+				break
+			}
+			if !matched && !claimed[hi] && same(stored[hi], rec) {
+				claimed[hi] = true
+				matched = true
+			}
+		}
+		if matched {
+			res.Existing++
+			continue
+		}
+
+		seq, seen := nextSeq[t.UnixNano()]
+		if !seen && hi > lo {
+			_, last := key(stored[hi-1])
+			seq = int(last) + 1
+		}
+		if seq > math.MaxUint16 {
+			return WriteResult{}, nil, fmt.Errorf("más de %d ticks con el timestamp %s", math.MaxUint16+1, t.Format(time.RFC3339Nano))
+		}
+		nextSeq[t.UnixNano()] = seq + 1
+		added = append(added, build(t, uint16(seq), rec))
+		res.Written++
+	}
+	slices.SortStableFunc(added, func(a, b T) int { return compareTicks(key, a, b) })
+	return res, added, nil
+}
+
+// compareTicks compara dos ticks por (timestamp, secuencia).
+func compareTicks[T any](key func(T) (time.Time, uint16), a, b T) int {
+	ta, seqA := key(a)
+	tb, seqB := key(b)
+	if c := ta.Compare(tb); c != 0 {
+		return c
+	}
+	return cmp.Compare(seqA, seqB)
+}
+
+// mergeSorted une 'added' (ordenado) a 'stored' (ordenado). Si todo 'added' va
+// después de 'stored', como al escribir en orden, basta con añadirlo al final.
+func mergeSorted[T any](stored, added []T, key func(T) (time.Time, uint16)) []T {
+	if len(added) == 0 {
+		return stored
+	}
+	if len(stored) == 0 || compareTicks(key, stored[len(stored)-1], added[0]) < 0 {
+		return append(stored, added...)
+	}
+	merged := make([]T, 0, len(stored)+len(added))
+	i, j := 0, 0
+	for i < len(stored) && j < len(added) {
+		if compareTicks(key, stored[i], added[j]) <= 0 {
+			merged = append(merged, stored[i])
+			i++
+		} else {
+			merged = append(merged, added[j])
+			j++
+		}
+	}
+	merged = append(merged, stored[i:]...)
+	return append(merged, added[j:]...)
+}
+
+// sameQuote compara dos quotes sin su timestamp (la clave ya coincide).
+func sameQuote(a, b QuoteRecord) bool {
+	return a.AP == b.AP && a.AS == b.AS && a.AX == b.AX && a.BP == b.BP && a.BS == b.BS &&
+		a.BX == b.BX && slices.Equal(a.C, b.C) && a.Z == b.Z
+}
+
+// sameTrade compara dos trades sin su timestamp (la clave ya coincide).
+func sameTrade(a, b TradeRecord) bool {
+	return a.P == b.P && a.S == b.S && a.X == b.X && a.I == b.I && slices.Equal(a.C, b.C) && a.Z == b.Z
+}
+
+// selectTradeFields devuelve 'tr' con solo los campos 'fields' (ver `QueryOptions.FIELDS`).
+func selectTradeFields(tr TradeRecord, fields []string) TradeRecord {
+	if len(fields) == len(TradeFields) {
+		return tr
+	}
+	var out TradeRecord
+	for _, field := range fields {
+		switch field {
+		case "P":
+			out.P = tr.P
+		case "S":
+			out.S = tr.S
+		case "X":
+			out.X = tr.X
+		case "I":
+			out.I = tr.I
+		case "C":
+			out.C = tr.C
+		case "Z":
+			out.Z = tr.Z
+		}
+	}
+	return out
+}
@@ -0,0 +1,582 @@
+package ticks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE MIGRACIONES
+// ===============================
+
+//
+//
+//
+*/
+
+// Migration es un paso del esquema: lleva un archivo de la versión Version-1 a
+// Version.
+type Migration struct {
+	Version int
+	Name    string
+	// Apply migra 'dbInstance'. Puede usar varias transacciones para no cargar el
+	// archivo entero en una, así que debe poder repetirse si se interrumpe a medias:
+	// la versión guardada solo avanza cuando termina y Verify da el visto bueno.
+	// 'progress' recibe el símbolo en curso y los ticks migrados de él hasta ahora.
+	Apply func(dbInstance *db.DB, progress func(symbol string, done int)) error
+	// Verify comprueba que no quede nada en el formato anterior.
+	Verify func(tx *db.Tx) error
+}
+
+// migrations son los pasos del esquema, en orden de versión. La versión 1 es el
+// formato de partida y no tiene paso.
+var migrations = []Migration{
+	{Version: 2, Name: "claves con secuencia", Apply: migrateSequenceKeys, Verify: verifySequenceKeys},
+	{Version: 3, Name: "condiciones de quote como lista", Apply: migrateQuoteConditions, Verify: verifyQuoteConditions},
+	{Version: 4, Name: "metadatos por símbolo", Apply: migrateSymbolMeta, Verify: verifySymbolMeta},
+}
+
+// Migrations devuelve los pasos del esquema, en orden de versión.
+func Migrations() []Migration {
+	return slices.Clone(migrations)
+}
+
+// ErrMigration indica que una migración no se pudo aplicar o no pasó la verificación.
+var ErrMigration = errors.New("migración de esquema fallida")
+
+// MigrateOptions configura `MigrateFile`.
+type MigrateOptions struct {
+	// OUTPUT, si no está vacío, es un archivo nuevo donde se copia la base de datos
+	// antes de migrarla; el original no se modifica. Vacío para migrar en el sitio.
+	OUTPUT string
+	// TARGET es la versión a la que migrar; 0 para `SchemaVersion`. No se puede bajar
+	// de versión.
+	TARGET int
+	// PROGRESS, si no es nil, recibe el avance de cada paso.
+	PROGRESS func(MigrationProgress)
+}
+
+// MigrationProgress es el avance de `MigrateFile`.
+type MigrationProgress struct {
+	Version int    // Versión del paso en curso (0 en la verificación final)
+	Step    string // Nombre del paso, o "verificación"
+	Symbol  string
+	Done    int // Ticks procesados de Symbol
+}
+
+// MigrateReport resume una migración.
+type MigrateReport struct {
+	Path     string // Archivo migrado (OUTPUT si se indicó)
+	From, To int
+	Applied  []string   // Pasos aplicados, en orden
+	Ticks    StoreStats // Ticks del archivo, iguales antes y después
+}
+
+// MigrateFile lleva el archivo bbolt 'path' a la versión `MigrateOptions.TARGET`
+// aplicando en orden los pasos de `Migrations`, y guarda la versión tras cada uno.
+// Si se interrumpe, volver a llamarla continúa desde el último paso completado.
+//
+// Al terminar verifica el archivo: el número de quotes y trades de cada símbolo debe
+// ser el de antes de migrar y todos deben poder leerse. Un archivo que ya está en la
+// versión pedida solo se verifica (y se marca con ella si no la tenía guardada).
+func MigrateFile(path string, opts MigrateOptions) (MigrateReport, error) {
+	report := MigrateReport{Path: path}
+	if opts.OUTPUT != "" {
+		if err := copyDBFile(path, opts.OUTPUT); err != nil {
+			return report, err
+		}
+		report.Path = opts.OUTPUT
+	}
+	dbInstance, err := db.Open(report.Path, 0600, &db.Options{Timeout: time.Second})
+	if err != nil {
+		return report, fmt.Errorf("no se pudo abrir '%s': %w", report.Path, err)
+	}
+	defer dbInstance.Close()
+	progress := func(p MigrationProgress) {
+		if opts.PROGRESS != nil {
+			opts.PROGRESS(p)
+		}
+	}
+
+	err = dbInstance.View(func(tx *db.Tx) error {
+		report.From, _, err = SchemaVersionTx(tx)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+	target := opts.TARGET
+	if target == 0 {
+		target = SchemaVersion
+	}
+	switch {
+	case report.From > SchemaVersion:
+		return report, fmt.Errorf("%w: '%s' es v%d y este programa conoce hasta la v%d", ErrSchemaTooNew, report.Path, report.From, SchemaVersion)
+	case target > SchemaVersion || target < report.From:
+		return report, fmt.Errorf("%w: no se puede migrar de v%d a v%d (versiones conocidas: 1 a %d)", ErrMigration, report.From, target, SchemaVersion)
+	}
+	report.To = report.From
+
+	store, err := NewBoltStore(dbInstance, LayoutColumns) // Sin Close: la base de datos se cierra arriba
+	if err != nil {
+		return report, err
+	}
+	if report.Ticks, err = store.Stats(); err != nil {
+		return report, err
+	}
+	for _, m := range migrations {
+		if m.Version <= report.From || m.Version > target {
+			continue
+		}
+		err := m.Apply(dbInstance, func(symbol string, done int) {
+			progress(MigrationProgress{Version: m.Version, Step: m.Name, Symbol: symbol, Done: done})
+		})
+		if err == nil {
+			err = dbInstance.View(m.Verify)
+		}
+		if err == nil {
+			err = dbInstance.Update(func(tx *db.Tx) error { return setSchemaVersionTx(tx, m.Version) })
+		}
+		if err != nil {
+			return report, fmt.Errorf("%w: v%d (%s): %w", ErrMigration, m.Version, m.Name, err)
+		}
+		report.To = m.Version
+		report.Applied = append(report.Applied, fmt.Sprintf("v%d %s", m.Version, m.Name))
+	}
+	if len(report.Applied) == 0 {
+		if err := dbInstance.Update(func(tx *db.Tx) error { return setSchemaVersionTx(tx, report.To) }); err != nil {
+			return report, err
+		}
+	}
+
+	if err := verifyTicks(store, report.Ticks, progress); err != nil {
+		return report, fmt.Errorf("%w: verificación: %w", ErrMigration, err)
+	}
+	return report, nil
+}
+
+// copyDBFile copia la base de datos 'from' a 'to', que no debe existir, dentro de una
+// transacción de lectura para obtener una copia consistente.
+func copyDBFile(from, to string) error {
+	if _, err := os.Stat(to); err == nil {
+		return fmt.Errorf("'%s' ya existe", to)
+	}
+	src, err := db.Open(from, 0600, &db.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("no se pudo abrir '%s': %w", from, err)
+	}
+	defer src.Close()
+	return src.View(func(tx *db.Tx) error { return tx.CopyFile(to, 0600) })
+}
+
+// verifyTicks comprueba que 'store' tenga los mismos ticks por símbolo que 'want' y
+// que todos se puedan leer.
+func verifyTicks(store *BoltStore, want StoreStats, progress func(MigrationProgress)) error {
+	got, err := store.Stats()
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("los ticks cambiaron: antes %+v, después %+v", want, got)
+	}
+	for symbol := range want.Symbols {
+		done := 0
+		for _, err := range store.Quotes(QueryOptions{SYMBOL: symbol}) {
+			if err != nil {
+				return fmt.Errorf("quotes de %s: %w", symbol, err)
+			}
+			done++
+		}
+		for _, err := range store.Trades(QueryOptions{SYMBOL: symbol}) {
+			if err != nil {
+				return fmt.Errorf("trades de %s: %w", symbol, err)
+			}
+			done++
+		}
+		progress(MigrationProgress{Step: "verificación", Symbol: symbol, Done: done})
+	}
+	return nil
+}
+
+// migrationBatch es el máximo de ticks que una migración cambia por transacción.
+const migrationBatch = 10000
+
+// migrateSequenceKeys (v2) pasa cada clave de 8 bytes (solo el timestamp) a la clave
+// de 10 bytes con la siguiente secuencia libre de su timestamp, en todas las columnas
+// del tick a la vez. Los ticks no se deduplican: cada clave antigua es un tick.
+func migrateSequenceKeys(dbInstance *db.DB, progress func(symbol string, done int)) error {
+	var groups []tickIndex // Sin 'parent', que solo vale dentro de su transacción
+	err := dbInstance.View(func(tx *db.Tx) error {
+		return tickIndexes(tx, func(index tickIndex) error {
+			index.parent = nil
+			groups = append(groups, index)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		symbol := g.path[0]
+		var resume []byte // Las claves anteriores ya no tienen claves antiguas
+		done := 0
+		for {
+			moved := 0
+			err := dbInstance.Update(func(tx *db.Tx) error {
+				parent := tx.Bucket([]byte(g.path[0]))
+				for _, name := range g.path[1:] {
+					parent = parent.Bucket([]byte(name))
+				}
+				columns := make([]*db.Bucket, len(g.columns))
+				for i, name := range g.columns {
+					columns[i] = parent.Bucket([]byte(name))
+				}
+
+				var legacy [][]byte
+				c := columns[0].Cursor()
+				k, _ := c.First()
+				if resume != nil {
+					k, _ = c.Seek(resume)
+				}
+				for ; k != nil && len(legacy) < migrationBatch; k, _ = c.Next() {
+					if len(k) == LegacyKeySize {
+						legacy = append(legacy, bytes.Clone(k))
+					}
+				}
+				for _, old := range legacy {
+					t, err := KeyTime(old)
+					if err != nil {
+						return err
+					}
+					// Ningún tick guardado es "el mismo": la clave es la siguiente secuencia.
+					key, _, err := NewKeyAllocator().Assign(columns[0], t, func([]byte) bool { return false })
+					if err != nil {
+						return err
+					}
+					for _, column := range columns {
+						var value []byte
+						if column != nil {
+							value = column.Get(old)
+						}
+						if value == nil {
+							continue // Tick incompleto: se migra lo que hay
+						}
+						if err := column.Put(key, bytes.Clone(value)); err != nil {
+							return err
+						}
+						if err := column.Delete(old); err != nil {
+							return err
+						}
+					}
+				}
+				moved = len(legacy)
+				if moved > 0 {
+					resume = legacy[moved-1]
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", strings.Join(g.path, "/"), g.columns[0], err)
+			}
+			if moved == 0 {
+				break
+			}
+			done += moved
+			progress(symbol, done)
+		}
+	}
+	return nil
+}
+
+// verifySequenceKeys comprueba que no quede ninguna clave de 8 bytes.
+func verifySequenceKeys(tx *db.Tx) error {
+	legacy, err := hasLegacyKeys(tx)
+	if err == nil && legacy {
+		err = errors.New("quedan claves de 8 bytes")
+	}
+	return err
+}
+
+// migrateQuoteConditions (v3) reescribe la columna C de las quotes de cada símbolo de
+// la cadena JSON con los códigos seguidos ("\"R\"") al texto compacto de
+// `EncodeConditions` ("R"). Las filas ya guardaban un bitset y los chunks los códigos
+// seguidos, que es el mismo texto, así que no cambian.
+func migrateQuoteConditions(dbInstance *db.DB, progress func(symbol string, done int)) error {
+	var symbols []string
+	err := dbInstance.View(func(tx *db.Tx) error {
+		return tx.ForEach(func(name []byte, symbol *db.Bucket) error {
+			if !strings.HasPrefix(string(name), "_") && symbol.Bucket([]byte("C")) != nil {
+				symbols = append(symbols, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, symbol := range symbols {
+		var resume []byte // Las claves anteriores ya están en el formato nuevo
+		done := 0
+		for {
+			changed := 0
+			err := dbInstance.Update(func(tx *db.Tx) error {
+				column := tx.Bucket([]byte(symbol)).Bucket([]byte("C"))
+				type update struct{ key, value []byte }
+				var updates []update
+				c := column.Cursor()
+				k, v := c.First()
+				if resume != nil {
+					k, v = c.Seek(resume)
+				}
+				for ; k != nil && len(updates) < migrationBatch; k, v = c.Next() {
+					if len(v) == 0 || v[0] != '"' {
+						continue
+					}
+					conditions, err := DecodeConditions(v)
+					if err != nil {
+						return fmt.Errorf("clave %x: %w", k, err)
+					}
+					updates = append(updates, update{bytes.Clone(k), EncodeConditions(conditions)})
+				}
+				for _, u := range updates {
+					if err := column.Put(u.key, u.value); err != nil {
+						return err
+					}
+				}
+				changed = len(updates)
+				if changed > 0 {
+					resume = updates[changed-1].key
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s/C: %w", symbol, err)
+			}
+			if changed == 0 {
+				break
+			}
+			done += changed
+			progress(symbol, done)
+		}
+	}
+	return nil
+}
+
+// verifyQuoteConditions comprueba que ninguna columna C de quotes siga en cadena JSON.
+func verifyQuoteConditions(tx *db.Tx) error {
+	return tx.ForEach(func(name []byte, symbol *db.Bucket) error {
+		column := symbol.Bucket([]byte("C"))
+		if strings.HasPrefix(string(name), "_") || column == nil {
+			return nil
+		}
+		c := column.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if len(v) > 0 && v[0] == '"' {
+				return fmt.Errorf("%s/C: quedan condiciones en cadena JSON (clave %x)", name, k)
+			}
+		}
+		return nil
+	})
+}
+
+// migrateSymbolMeta (v4) calcula los metadatos de quotes y trades de cada símbolo
+// recorriendo sus índices (ver `scanTickMeta`), en una transacción por símbolo. Si ya
+// había metadatos, conserva su Feed, Source y UpdatedAt.
+func migrateSymbolMeta(dbInstance *db.DB, progress func(symbol string, done int)) error {
+	var symbols []string
+	err := dbInstance.View(func(tx *db.Tx) error {
+		return tx.ForEach(func(name []byte, _ *db.Bucket) error {
+			if !strings.HasPrefix(string(name), "_") {
+				symbols = append(symbols, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, symbol := range symbols {
+		var done int
+		err := dbInstance.Update(func(tx *db.Tx) error {
+			var err error
+			done, err = rebuildSymbolMetaTx(tx, symbol, 4) // La versión de este paso
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", symbol, err)
+		}
+		progress(symbol, done)
+	}
+	return nil
+}
+
+// rebuildSymbolMetaTx recalcula recorriendo sus índices los metadatos de quotes y
+// trades de 'symbol' (ver `scanTickMeta`) y los guarda con SchemaVersion 'version'.
+// Conserva Feed, Source y UpdatedAt de los guardados; los de un tipo sin ticks quedan
+// a cero (en la base de datos principal de un almacén particionado solo guardan de
+// dónde vienen los datos). Devuelve el número de ticks contados.
+func rebuildSymbolMetaTx(tx *db.Tx, symbol string, version int) (int, error) {
+	symbolBucket := tx.Bucket([]byte(symbol))
+	if symbolBucket == nil {
+		return 0, nil
+	}
+	scanned, err := scanTickMeta(symbolBucket)
+	if err != nil {
+		return 0, err
+	}
+	root := tx.Bucket([]byte(SymbolsBucket))
+	if len(scanned) == 0 && (root == nil || root.Bucket([]byte(symbol)) == nil) {
+		return 0, nil
+	}
+	if root, err = tx.CreateBucketIfNotExists([]byte(SymbolsBucket)); err != nil {
+		return 0, err
+	}
+	bucket, err := root.CreateBucketIfNotExists([]byte(symbol))
+	if err != nil {
+		return 0, err
+	}
+	done := 0
+	for _, kind := range []Kind{KindQuotes, KindTrades} {
+		meta, ok := scanned[kind]
+		raw := bucket.Get([]byte(kind))
+		if !ok && raw == nil {
+			continue
+		}
+		if raw != nil {
+			var stored SymbolMeta
+			if err := json.Unmarshal(raw, &stored); err != nil {
+				return 0, fmt.Errorf("metadatos %s: %w", kind, err)
+			}
+			meta.Feed, meta.Source, meta.UpdatedAt = stored.Feed, stored.Source, stored.UpdatedAt
+		}
+		if meta.UpdatedAt.IsZero() {
+			meta.UpdatedAt = time.Now().UTC()
+		}
+		meta.SchemaVersion = version
+		if err := putSymbolMeta(bucket, kind, meta); err != nil {
+			return 0, err
+		}
+		done += meta.Count
+	}
+	return done, nil
+}
+
+// verifySymbolMeta comprueba que los metadatos de quotes y trades de cada símbolo
+// coincidan con sus ticks.
+func verifySymbolMeta(tx *db.Tx) error {
+	root := tx.Bucket([]byte(SymbolsBucket))
+	return tx.ForEach(func(name []byte, symbol *db.Bucket) error {
+		if strings.HasPrefix(string(name), "_") {
+			return nil
+		}
+		scanned, err := scanTickMeta(symbol)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		for kind, want := range scanned {
+			var got SymbolMeta
+			var raw []byte
+			if root != nil && root.Bucket(name) != nil {
+				raw = root.Bucket(name).Get([]byte(kind))
+			}
+			if raw == nil {
+				return fmt.Errorf("%s: faltan los metadatos de %s", name, kind)
+			}
+			if err := json.Unmarshal(raw, &got); err != nil {
+				return fmt.Errorf("%s: metadatos de %s: %w", name, kind, err)
+			}
+			if got.Count != want.Count || !got.First.Equal(want.First) || !got.Last.Equal(want.Last) {
+				return fmt.Errorf("%s: metadatos de %s %d ticks [%s, %s], se esperaban %d [%s, %s]", name, kind,
+					got.Count, got.First, got.Last, want.Count, want.First, want.Last)
+			}
+		}
+		return nil
+	})
+}
+
+// scanTickMeta calcula Count, First y Last de las quotes (columnas, filas y chunks) y
+// de los trades de 'symbolBucket' recorriendo sus índices. Solo devuelve los tipos con
+// algún tick.
+func scanTickMeta(symbolBucket *db.Bucket) (map[Kind]SymbolMeta, error) {
+	scanned := make(map[Kind]SymbolMeta)
+	add := func(kind Kind, meta SymbolMeta) {
+		if meta.Count == 0 {
+			return
+		}
+		m := scanned[kind]
+		m.merge(meta)
+		scanned[kind] = m
+	}
+	for _, name := range []string{QuoteFields[0], QuoteRowsBucket} {
+		meta, err := indexMeta(symbolBucket.Bucket([]byte(name)))
+		if err != nil {
+			return nil, err
+		}
+		add(KindQuotes, meta)
+	}
+	if chunks := symbolBucket.Bucket([]byte(QuoteChunksBucket)); chunks != nil {
+		var meta SymbolMeta
+		err := chunks.ForEach(func(k, v []byte) error {
+			quotes, err := DecodeQuoteChunk(v)
+			if err != nil {
+				return fmt.Errorf("chunk %x: %w", k, err)
+			}
+			if len(quotes) > 0 {
+				meta.merge(SymbolMeta{First: quotes[0].Time, Last: quotes[len(quotes)-1].Time, Count: len(quotes)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		add(KindQuotes, meta)
+	}
+	if trades := symbolBucket.Bucket([]byte(TradesBucket)); trades != nil {
+		meta, err := indexMeta(trades.Bucket([]byte(TradeFields[0])))
+		if err != nil {
+			return nil, err
+		}
+		add(KindTrades, meta)
+	}
+	return scanned, nil
+}
+
+// indexMeta devuelve el número de claves de la columna índice 'index' y los
+// timestamps de la primera y la última (nada si no existe).
+func indexMeta(index *db.Bucket) (SymbolMeta, error) {
+	var meta SymbolMeta
+	if index == nil {
+		return meta, nil
+	}
+	c := index.Cursor()
+	first, _ := c.First()
+	last, _ := c.Last()
+	if first == nil {
+		return meta, nil
+	}
+	var err error
+	if meta.First, err = KeyTime(first); err != nil {
+		return meta, err
+	}
+	if meta.Last, err = KeyTime(last); err != nil {
+		return meta, err
+	}
+	meta.Count = keyCount(index)
+	return meta, nil
+}
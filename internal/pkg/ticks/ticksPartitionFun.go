@@ -0,0 +1,550 @@
+package ticks
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE PARTICIONES POR TIEMPO
+// ===============================
+
+//
+//
+//
+*/
+
+// Periodos de partición (ver `PartitionOptions.PERIOD`).
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+	PeriodYear  = "year"
+)
+
+// partitionManifest es el archivo, en la raíz, que fija el periodo de las particiones:
+// cambiarlo dejaría sin leer los archivos con nombres del periodo anterior.
+const partitionManifest = "partitions.json"
+
+// ErrPartitionOptions indica unas `PartitionOptions` inválidas o incompatibles con
+// las particiones que ya hay en la raíz.
+var ErrPartitionOptions = errors.New("opciones de partición inválidas")
+
+// PartitionOptions configura un `PartitionedStore`.
+type PartitionOptions struct {
+	// ROOT es el directorio raíz. Cada partición es el archivo
+	// `<ROOT>/<símbolo>/<periodo>.db` (ej. `ticks/QQQ/2024-01.db`).
+	ROOT string
+	// PERIOD es la duración de cada partición: `PeriodDay`, `PeriodMonth` o
+	// `PeriodYear` (en UTC). Queda fijado en la raíz la primera vez que se escribe.
+	PERIOD string
+	// MAX_OPEN es el máximo de archivos abiertos a la vez; los menos usados se cierran.
+	// Se puede superar mientras haya más particiones en uso simultáneo (ej. recorridos
+	// en curso).
+	MAX_OPEN int
+	// LAYOUT es el layout de las quotes (uno de `QuoteLayouts`).
+	LAYOUT string
+	// READ_ONLY abre las particiones en solo lectura; las escrituras fallan.
+	READ_ONLY bool
+	// TIMEOUT es lo que se espera el bloqueo de un archivo que tiene otro proceso.
+	TIMEOUT time.Duration
+}
+
+// PartitionedStore es un `TickStore` que reparte los ticks en un archivo bbolt por
+// símbolo y periodo, con el layout de `BoltStore` dentro de cada uno. Así cada mes (o
+// día, o año) de un símbolo se puede archivar, copiar o borrar por separado, y un
+// archivo bbolt, que nunca se encoge, no crece sin límite.
+//
+// Las particiones se abren al usarlas, comprobando su esquema (ver `EnsureSchema`), y
+// se mantienen abiertas en un LRU de `PartitionOptions.MAX_OPEN` archivos. Las lecturas por rango recorren en orden las
+// particiones que se solapan con el rango.
+//
+// Un lote que abarca varias particiones no es atómico en conjunto: cada partición se
+// confirma por separado, en orden temporal. Si falla a medias, repetirlo es seguro
+// porque los ticks ya guardados no se duplican (ver `KeyAllocator`).
+//
+// Tampoco es atómico con otro archivo: quien guarde en otra base de datos algo que
+// avanza con los ticks (el descargador guarda ahí el checkpoint, la cuarentena y las
+// barras) hace dos commits, primero el de las particiones. Si el proceso se corta
+// entre los dos, los ticks quedan guardados y el checkpoint en su valor anterior: la
+// siguiente ejecución vuelve a descargar desde ahí y repite el lote, que las
+// particiones cuentan como ya guardado. Lo único que se pierde es el trabajo repetido.
+type PartitionedStore struct {
+	opts PartitionOptions
+
+	mu     sync.Mutex
+	closed bool
+	open   map[string]*partition // Por ruta del archivo
+	lru    *list.List            // De *partition; el frente es el más reciente
+}
+
+// partition es un archivo de partición abierto.
+type partition struct {
+	path string
+	db   *db.DB
+	refs int           // Usos en curso; no se cierra mientras sea > 0
+	elem *list.Element // Posición en el LRU
+}
+
+// OpenPartitionedStore prepara el almacén particionado de 'opts'. No abre ninguna
+// partición todavía. En lectura/escritura crea la raíz y fija el periodo; en solo
+// lectura la raíz debe existir.
+func OpenPartitionedStore(opts PartitionOptions) (*PartitionedStore, error) {
+	if opts.ROOT == "" {
+		return nil, fmt.Errorf("%w: falta el directorio raíz", ErrPartitionOptions)
+	}
+	if opts.PERIOD == "" {
+		opts.PERIOD = PeriodMonth
+	}
+	if _, err := periodFormat(opts.PERIOD); err != nil {
+		return nil, err
+	}
+	if opts.MAX_OPEN < 1 {
+		return nil, fmt.Errorf("%w: MAX_OPEN debe ser al menos 1", ErrPartitionOptions)
+	}
+	if opts.LAYOUT == "" {
+		opts.LAYOUT = LayoutColumns
+	}
+	if err := checkLayout(opts.LAYOUT); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrPartitionOptions, err)
+	}
+	if opts.TIMEOUT <= 0 {
+		opts.TIMEOUT = time.Second
+	}
+	if err := checkManifest(opts); err != nil {
+		return nil, err
+	}
+	return &PartitionedStore{opts: opts, open: make(map[string]*partition), lru: list.New()}, nil
+}
+
+// checkManifest compara el periodo de 'opts' con el fijado en la raíz, y lo fija si la
+// raíz es nueva.
+func checkManifest(opts PartitionOptions) error {
+	path := filepath.Join(opts.ROOT, partitionManifest)
+	var manifest struct {
+		Period string `json:"period"`
+	}
+	raw, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(raw, &manifest); err != nil {
+			return fmt.Errorf("%w: '%s' corrupto: %v", ErrPartitionOptions, path, err)
+		}
+		if manifest.Period != opts.PERIOD {
+			return fmt.Errorf("%w: '%s' está particionado por %s, no por %s", ErrPartitionOptions, opts.ROOT, manifest.Period, opts.PERIOD)
+		}
+		return nil
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	case opts.READ_ONLY:
+		return fmt.Errorf("%w: '%s' no es una raíz de particiones (falta %s)", ErrPartitionOptions, opts.ROOT, partitionManifest)
+	}
+	if err := os.MkdirAll(opts.ROOT, 0700); err != nil {
+		return err
+	}
+	manifest.Period = opts.PERIOD
+	raw, _ = json.Marshal(manifest)
+	return os.WriteFile(path, raw, 0600)
+}
+
+// periodFormat devuelve el formato de fecha con que se nombran las particiones.
+func periodFormat(period string) (string, error) {
+	switch period {
+	case PeriodDay:
+		return "2006-01-02", nil
+	case PeriodMonth:
+		return "2006-01", nil
+	case PeriodYear:
+		return "2006", nil
+	}
+	return "", fmt.Errorf("%w: periodo %q (se esperaba %s, %s o %s)", ErrPartitionOptions, period, PeriodDay, PeriodMonth, PeriodYear)
+}
+
+// periodStart devuelve el inicio (UTC) del periodo que contiene 't'.
+func (s *PartitionedStore) periodStart(t time.Time) time.Time {
+	t = t.UTC()
+	switch s.opts.PERIOD {
+	case PeriodDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	case PeriodYear:
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// periodEnd devuelve el inicio del periodo siguiente al que empieza en 'start'.
+func (s *PartitionedStore) periodEnd(start time.Time) time.Time {
+	switch s.opts.PERIOD {
+	case PeriodDay:
+		return start.AddDate(0, 0, 1)
+	case PeriodYear:
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// symbolDir devuelve el directorio de un símbolo. El símbolo se escapa para que
+// "BTC/USD" no cree subdirectorios.
+func (s *PartitionedStore) symbolDir(symbol string) string {
+	return filepath.Join(s.opts.ROOT, url.PathEscape(symbol))
+}
+
+// partitionPath devuelve el archivo de la partición de 'symbol' que empieza en 'start'.
+func (s *PartitionedStore) partitionPath(symbol string, start time.Time) string {
+	format, _ := periodFormat(s.opts.PERIOD)
+	return filepath.Join(s.symbolDir(symbol), start.Format(format)+".db")
+}
+
+// PartitionFile es un archivo de partición existente.
+type PartitionFile struct {
+	Symbol string
+	Start  time.Time // Inicio del periodo (incluido)
+	End    time.Time // Inicio del periodo siguiente (excluido)
+	Path   string
+}
+
+// Partitions devuelve, en orden temporal, las particiones existentes de 'symbol' que
+// se solapan con [from, to) ('from' o 'to' cero no limitan). Los archivos de la
+// carpeta que no son particiones se ignoran.
+func (s *PartitionedStore) Partitions(symbol string, from, to time.Time) ([]PartitionFile, error) {
+	format, _ := periodFormat(s.opts.PERIOD)
+	entries, err := os.ReadDir(s.symbolDir(symbol))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []PartitionFile
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".db")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		start, err := time.Parse(format, name)
+		if err != nil {
+			continue
+		}
+		file := PartitionFile{Symbol: symbol, Start: start, End: s.periodEnd(start), Path: filepath.Join(s.symbolDir(symbol), entry.Name())}
+		if (!to.IsZero() && !file.Start.Before(to)) || (!from.IsZero() && !file.End.After(from)) {
+			continue
+		}
+		files = append(files, file)
+	}
+	slices.SortFunc(files, func(a, b PartitionFile) int { return a.Start.Compare(b.Start) })
+	return files, nil
+}
+
+// Symbols devuelve los símbolos con alguna carpeta de particiones, ordenados.
+func (s *PartitionedStore) Symbols() ([]string, error) {
+	entries, err := os.ReadDir(s.opts.ROOT)
+	if err != nil {
+		return nil, err
+	}
+	var symbols []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		symbol, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			continue
+		}
+		symbols = append(symbols, symbol)
+	}
+	slices.Sort(symbols)
+	return symbols, nil
+}
+
+// checkOpen devuelve `ErrStoreClosed` si el almacén ya se cerró.
+func (s *PartitionedStore) checkOpen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	return nil
+}
+
+// acquire devuelve la partición 'path' abierta (abriéndola si hace falta) y marca un
+// uso; hay que devolverla con `release`.
+func (s *PartitionedStore) acquire(path string) (*partition, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, ErrStoreClosed
+	}
+	if p, ok := s.open[path]; ok {
+		p.refs++
+		s.lru.MoveToFront(p.elem)
+		return p, nil
+	}
+
+	if !s.opts.READ_ONLY {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+	}
+	dbInstance, err := db.Open(path, 0600, &db.Options{Timeout: s.opts.TIMEOUT, ReadOnly: s.opts.READ_ONLY})
+	if err != nil {
+		return nil, fmt.Errorf("no se pudo abrir la partición '%s': %w", path, err)
+	}
+	if err := EnsureSchema(dbInstance); err != nil {
+		dbInstance.Close()
+		return nil, err
+	}
+	p := &partition{path: path, db: dbInstance, refs: 1}
+	p.elem = s.lru.PushFront(p)
+	s.open[path] = p
+	s.evictLocked()
+	return p, nil
+}
+
+// release devuelve un uso de 'p'. Si el almacén está cerrado o sobra en el LRU, se
+// cierra al quedar libre.
+func (s *PartitionedStore) release(p *partition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p.refs--
+	if s.closed && p.refs == 0 {
+		p.db.Close()
+		return
+	}
+	s.evictLocked()
+}
+
+// evictLocked cierra las particiones libres menos usadas hasta volver a MAX_OPEN.
+func (s *PartitionedStore) evictLocked() {
+	for e := s.lru.Back(); e != nil && s.lru.Len() > s.opts.MAX_OPEN; {
+		p := e.Value.(*partition)
+		prev := e.Prev()
+		if p.refs == 0 {
+			s.lru.Remove(e)
+			delete(s.open, p.path)
+			p.db.Close()
+		}
+		e = prev
+	}
+}
+
+// OpenCount devuelve cuántas particiones hay abiertas.
+func (s *PartitionedStore) OpenCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+// WriteBatch reparte el lote por partición y guarda cada parte en su archivo (ver
+// `PutQuotesTx` y `PutTradesTx`), en orden temporal de partición. Cada parte es
+// atómica, el lote entero no: si una partición falla, las anteriores ya están
+// confirmadas y el resultado las cuenta.
+func (s *PartitionedStore) WriteBatch(batch Batch) (WriteResult, error) {
+	var res WriteResult
+	if err := s.checkOpen(); err != nil {
+		return res, err
+	}
+	if s.opts.READ_ONLY {
+		return res, fmt.Errorf("almacén particionado '%s' abierto en solo lectura", s.opts.ROOT)
+	}
+	parts := make(map[time.Time]*Batch)
+	part := func(ts string) *Batch {
+		t, ok := parseTickTime(ts)
+		if !ok {
+			return nil
+		}
+		start := s.periodStart(t)
+		if parts[start] == nil {
+			parts[start] = &Batch{Symbol: batch.Symbol}
+		}
+		return parts[start]
+	}
+	for _, q := range batch.Quotes {
+		if b := part(q.T); b != nil {
+			b.Quotes = append(b.Quotes, q)
+		} else {
+			res.Skipped++
+		}
+	}
+	for _, tr := range batch.Trades {
+		if b := part(tr.T); b != nil {
+			b.Trades = append(b.Trades, tr)
+		} else {
+			res.Skipped++
+		}
+	}
+
+	starts := make([]time.Time, 0, len(parts))
+	for start := range parts {
+		starts = append(starts, start)
+	}
+	slices.SortFunc(starts, time.Time.Compare)
+	for _, start := range starts {
+		p, err := s.acquire(s.partitionPath(batch.Symbol, start))
+		if err != nil {
+			return res, err
+		}
+		b := parts[start]
+		var quotes, trades WriteResult
+		err = p.db.Update(func(tx *db.Tx) error {
+			var err error
+			if quotes, err = PutQuotesTx(tx, b.Symbol, b.Quotes, s.opts.LAYOUT); err != nil {
+				return err
+			}
+			trades, err = PutTradesTx(tx, b.Symbol, b.Trades)
+			return err
+		})
+		s.release(p)
+		if err != nil {
+			return res, fmt.Errorf("partición %s de %s: %w", start.Format(time.DateOnly), batch.Symbol, err)
+		}
+		res.Add(quotes) // Solo lo confirmado
+		res.Add(trades)
+	}
+	return res, nil
+}
+
+// Quotes recorre las quotes de 'opts' partición por partición (ver `QuotesTx`).
+func (s *PartitionedStore) Quotes(opts QueryOptions) iter.Seq2[Quote, error] {
+	return partitionSeq(s, opts, QuoteFields, QuotesTx)
+}
+
+// Trades recorre los trades de 'opts' partición por partición (ver `TradesTx`).
+func (s *PartitionedStore) Trades(opts QueryOptions) iter.Seq2[Trade, error] {
+	return partitionSeq(s, opts, TradeFields, TradesTx)
+}
+
+// partitionSeq encadena 'read' sobre cada partición que se solapa con 'opts'. Las
+// particiones no se solapan en el tiempo, así que el resultado sigue ordenado. Cada
+// partición se lee en su propia transacción y queda en uso solo mientras se recorre.
+func partitionSeq[T any](s *PartitionedStore, opts QueryOptions, fields []string, read func(*db.Tx, QueryOptions) iter.Seq2[T, error]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		if _, err := opts.fields(fields); err != nil {
+			yield(zero, err)
+			return
+		}
+		if err := s.checkOpen(); err != nil {
+			yield(zero, err)
+			return
+		}
+		files, err := s.Partitions(opts.SYMBOL, opts.FROM, opts.TO)
+		if err != nil {
+			yield(zero, err)
+			return
+		}
+		for _, file := range files {
+			p, err := s.acquire(file.Path)
+			if err != nil {
+				yield(zero, err)
+				return
+			}
+			stopped := false
+			for v, err := range viewSeq(p.db, func(tx *db.Tx) iter.Seq2[T, error] { return read(tx, opts) }) {
+				if !yield(v, err) || err != nil {
+					stopped = true
+					break
+				}
+			}
+			s.release(p)
+			if stopped {
+				return
+			}
+		}
+	}
+}
+
+// LastTimestamp busca desde la partición más reciente hacia atrás (ver
+// `BoltStore.LastTimestamp`).
+func (s *PartitionedStore) LastTimestamp(symbol string, kind Kind) (time.Time, error) {
+	if err := s.checkOpen(); err != nil {
+		return time.Time{}, err
+	}
+	files, err := s.Partitions(symbol, time.Time{}, time.Time{})
+	if err != nil {
+		return time.Time{}, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		last, err := withPartition(s, files[i].Path, func(store *BoltStore) (time.Time, error) {
+			return store.LastTimestamp(symbol, kind)
+		})
+		if err != nil || !last.IsZero() {
+			return last, err
+		}
+	}
+	return time.Time{}, nil
+}
+
+// Stats suma las estadísticas de todas las particiones.
+func (s *PartitionedStore) Stats() (StoreStats, error) {
+	var stats StoreStats
+	if err := s.checkOpen(); err != nil {
+		return stats, err
+	}
+	symbols, err := s.Symbols()
+	if err != nil {
+		return stats, err
+	}
+	for _, symbol := range symbols {
+		files, err := s.Partitions(symbol, time.Time{}, time.Time{})
+		if err != nil {
+			return stats, err
+		}
+		var sym SymbolStats
+		for _, file := range files {
+			partStats, err := withPartition(s, file.Path, (*BoltStore).Stats)
+			if err != nil {
+				return stats, err
+			}
+			sym.Quotes += partStats.Symbols[symbol].Quotes
+			sym.Trades += partStats.Symbols[symbol].Trades
+		}
+		stats.addSymbol(symbol, sym)
+	}
+	return stats, nil
+}
+
+// withPartition llama a 'fn' con la partición 'path' vista como `BoltStore`.
+func withPartition[T any](s *PartitionedStore, path string, fn func(*BoltStore) (T, error)) (T, error) {
+	p, err := s.acquire(path)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer s.release(p)
+	return fn(&BoltStore{db: p.db, layout: s.opts.LAYOUT})
+}
+
+// Close cierra las particiones libres; las que estén en uso se cierran al terminar
+// su recorrido. Cerrar dos veces no es un error.
+func (s *PartitionedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	var errs []error
+	for path, p := range s.open {
+		if p.refs == 0 {
+			errs = append(errs, p.db.Close())
+		}
+		delete(s.open, path)
+	}
+	s.lru.Init()
+	return errors.Join(errs...)
+}
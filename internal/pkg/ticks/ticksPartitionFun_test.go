@@ -0,0 +1,45 @@
+package ticks
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPartitionedStoreWriteBatchPartial guarda un lote de dos particiones diarias cuya
+// segunda parte falla: la primera queda confirmada y contada, como dice el contrato
+// de `TickStore.WriteBatch`, y repetir el lote corregido no la duplica.
+func TestPartitionedStoreWriteBatchPartial(t *testing.T) {
+	store, err := OpenPartitionedStore(PartitionOptions{ROOT: t.TempDir(), PERIOD: PeriodDay, MAX_OPEN: 1, LAYOUT: LayoutChunks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	quotes := []QuoteRecord{
+		{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", T: chunkBase.Format(time.RFC3339Nano), Z: "C"},
+		{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", T: chunkBase.Add(time.Millisecond).Format(time.RFC3339Nano), Z: "C"},
+		// Al día siguiente, con un exchange que no cabe en un chunk
+		{AP: 110.87, AS: 6, AX: strings.Repeat("T", 256), BP: 109.3, BS: 30, BX: "T", T: chunkBase.Add(24 * time.Hour).Format(time.RFC3339Nano), Z: "C"},
+	}
+	res, err := store.WriteBatch(Batch{Symbol: "SPY", Quotes: quotes})
+	if !errors.Is(err, ErrQuoteChunkEncode) {
+		t.Fatalf("se esperaba ErrQuoteChunkEncode, error %v", err)
+	}
+	if res.Written != 2 {
+		t.Fatalf("%+v, se esperaban las 2 quotes de la primera partición", res)
+	}
+	if stats, err := store.Stats(); err != nil || stats.Quotes != 2 {
+		t.Fatalf("Stats: %+v, %v; se esperaban 2 quotes", stats, err)
+	}
+
+	quotes[2].AX = "T"
+	res, err = store.WriteBatch(Batch{Symbol: "SPY", Quotes: quotes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Written != 1 || res.Existing != 2 {
+		t.Fatalf("%+v, se esperaban 1 escrita y 2 existentes", res)
+	}
+}
@@ -0,0 +1,485 @@
+package ticks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"slices"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE CHUNKS COMPRIMIDOS DE QUOTES
+// ===============================
+
+//
+//
+//
+*/
+
+// QuoteChunksBucket es el sub-bucket del símbolo con las quotes en chunks comprimidos.
+// Cada valor guarda hasta `QuoteChunkSize` quotes consecutivas; la clave es la de la
+// primera quote del chunk (ver `Key`).
+const QuoteChunksBucket = "QCHUNKS"
+
+// QuoteChunkSize es el máximo de quotes por chunk. Más quotes por chunk comprimen algo
+// mejor, pero cada escritura reescribe el chunk en el que cae y cada lectura decodifica
+// chunks enteros.
+const QuoteChunkSize = 1024
+
+// Formato de chunk v1: un byte de versión (quoteChunkVersion1), el número de quotes
+// (uvarint) y un flujo de bits con las quotes en orden de clave, cada campo comprimido
+// respecto al de la quote anterior, al estilo de Gorilla (Facebook, 2015):
+//
+//	timestamp  delta-of-delta en nanosegundos; la primera quote lleva los 64 bits
+//	           '0' = igual delta; '10' + 12 bits, '110' + 20, '1110' + 32 o
+//	           '1111' + 64 bits con el delta-of-delta en zigzag
+//	secuencia  '0' = 0; '1' + 16 bits
+//	AP, AS     AP en XOR con el precio anterior: '0' = igual; '10' + los bits
+//	BP, BS     significativos dentro de la ventana anterior; '11' + 5 bits de ceros
+//	           iniciales + 6 bits de (longitud - 1) + los bits significativos.
+//	           AS: '0' = igual; '1' + 7 bits de ancho + la diferencia en zigzag.
+//	           Igual BP y BS
+//	AX, BX,    '0' = igual; '1' + 8 bits de longitud + los bytes. C va en el texto
+//	C, Z       compacto de `EncodeConditions`
+//
+// Los precios se guardan como float64 sin redondear, así que, a diferencia de la fila
+// binaria, cualquier quote cabe salvo textos de más de 255 bytes.
+const quoteChunkVersion1 = 1
+
+// Errores del formato de chunk. Se comprueban con errors.Is.
+var (
+	ErrQuoteChunkEncode = errors.New("quote no representable en el formato de chunk")
+	ErrQuoteChunkDecode = errors.New("chunk de quotes inválido")
+)
+
+// Cubetas del delta-of-delta de los timestamps: ancho en bits tras cada prefijo.
+var quoteChunkTimeWidths = [...]uint{12, 20, 32, 64}
+
+// EncodeQuoteChunk comprime 'quotes', ya ordenadas por (Time, Seq), en un chunk v1.
+// El 'T' de cada quote se ignora: cuenta 'Time'.
+func EncodeQuoteChunk(quotes []Quote) ([]byte, error) {
+	if len(quotes) == 0 {
+		return nil, fmt.Errorf("%w: chunk vacío", ErrQuoteChunkEncode)
+	}
+	w := bitWriter{buf: binary.AppendUvarint([]byte{quoteChunkVersion1}, uint64(len(quotes)))}
+	var prev Quote
+	var prevC string // Condiciones de 'prev' en texto compacto
+	var prevDelta int64
+	var ap, bp xorState
+	for i, q := range quotes {
+		ts := q.Time.UnixNano()
+		if i == 0 {
+			w.writeBits(uint64(ts), 64)
+		} else {
+			delta := ts - prev.Time.UnixNano()
+			if delta < 0 || (delta == 0 && q.Seq <= prev.Seq) {
+				return nil, fmt.Errorf("%w: quotes fuera de orden en %s", ErrQuoteChunkEncode, q.Time.Format(time.RFC3339Nano))
+			}
+			w.writeTimeDelta(delta - prevDelta)
+			prevDelta = delta
+		}
+		if q.Seq == 0 {
+			w.writeBit(false)
+		} else {
+			w.writeBit(true)
+			w.writeBits(uint64(q.Seq), 16)
+		}
+		ap.write(&w, q.AP)
+		w.writeInt(int64(q.AS), int64(prev.AS), i == 0)
+		bp.write(&w, q.BP)
+		w.writeInt(int64(q.BS), int64(prev.BS), i == 0)
+		c := string(EncodeConditions(q.C))
+		for _, f := range [...]struct{ name, cur, prev string }{
+			{"AX", q.AX, prev.AX}, {"BX", q.BX, prev.BX}, {"C", c, prevC}, {"Z", q.Z, prev.Z},
+		} {
+			if err := w.writeString(f.name, f.cur, f.prev, i == 0); err != nil {
+				return nil, err
+			}
+		}
+		prev, prevC = q, c
+	}
+	return w.buf, nil
+}
+
+// DecodeQuoteChunk es la inversa de `EncodeQuoteChunk`. Las quotes devueltas llevan
+// 'T' en RFC3339Nano UTC.
+func DecodeQuoteChunk(value []byte) ([]Quote, error) {
+	if len(value) == 0 || value[0] != quoteChunkVersion1 {
+		return nil, fmt.Errorf("%w: versión desconocida", ErrQuoteChunkDecode)
+	}
+	count, n := binary.Uvarint(value[1:])
+	if n <= 0 || count == 0 || count > uint64(len(value))*8 { // Cada quote ocupa más de un bit
+		return nil, fmt.Errorf("%w: número de quotes inválido", ErrQuoteChunkDecode)
+	}
+	r := bitReader{buf: value[1+n:]}
+	quotes := make([]Quote, count)
+	var prev Quote
+	var prevC string
+	var ts, delta int64
+	var ap, bp xorState
+	for i := range quotes {
+		q := &quotes[i]
+		if i == 0 {
+			ts = int64(r.readBits(64))
+		} else {
+			delta += r.readTimeDelta()
+			ts += delta
+		}
+		q.Time = time.Unix(0, ts).UTC()
+		if r.readBit() {
+			q.Seq = uint16(r.readBits(16))
+		}
+		q.AP = ap.read(&r)
+		q.AS = int(r.readInt(int64(prev.AS), i == 0))
+		q.BP = bp.read(&r)
+		q.BS = int(r.readInt(int64(prev.BS), i == 0))
+		q.AX = r.readString(prev.AX, i == 0)
+		q.BX = r.readString(prev.BX, i == 0)
+		c := r.readString(prevC, i == 0)
+		q.Z = r.readString(prev.Z, i == 0)
+		if r.err == nil && c != prevC {
+			q.C, r.err = DecodeConditions([]byte(c))
+		} else {
+			q.C = prev.C
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: quote %d de %d: %v", ErrQuoteChunkDecode, i+1, count, r.err)
+		}
+		q.T = q.Time.Format(time.RFC3339Nano)
+		prev, prevC = *q, c
+	}
+	return quotes, nil
+}
+
+// quoteChunkCount devuelve el número de quotes de un chunk sin decodificarlo.
+func quoteChunkCount(value []byte) (int, error) {
+	if len(value) == 0 || value[0] != quoteChunkVersion1 {
+		return 0, fmt.Errorf("%w: versión desconocida", ErrQuoteChunkDecode)
+	}
+	count, n := binary.Uvarint(value[1:])
+	if n <= 0 {
+		return 0, fmt.Errorf("%w: número de quotes inválido", ErrQuoteChunkDecode)
+	}
+	return int(count), nil
+}
+
+// putQuoteChunks guarda 'quotes' en los chunks de 'symbolBucket' con las mismas
+// reglas de claves que el resto de layouts (ver `quoteKeys`).
+//
+// Se decodifican los chunks que cubren el rango de tiempo del lote (más el anterior,
+// que puede acabar dentro del rango o estar a medio llenar), se les une lo nuevo y se
+// vuelven a partir en chunks de `QuoteChunkSize`. Al escribir en orden, como al
+// descargar, solo se reescribe el último chunk.
+func putQuoteChunks(symbolBucket *db.Bucket, symbol string, quotes []QuoteRecord) (WriteResult, error) {
+	var res WriteResult
+	for _, q := range quotes {
+		if t, ok := parseTickTime(q.T); ok {
+			t = t.UTC()
+			if res.First.IsZero() || t.Before(res.First) {
+				res.First = t
+			}
+			if t.After(res.Last) {
+				res.Last = t
+			}
+		}
+	}
+	chunks, err := symbolBucket.CreateBucketIfNotExists([]byte(QuoteChunksBucket))
+	if err != nil {
+		return WriteResult{}, fmt.Errorf("failed to create sub-bucket '%s' for symbol '%s': %w", QuoteChunksBucket, symbol, err)
+	}
+	stored, oldKeys, err := loadChunks(chunks, symbol, res.First, res.Last)
+	if err != nil {
+		return WriteResult{}, err
+	}
+
+	var added []Quote
+	keys := newQuoteKeys(symbolBucket, stored)
+	for _, q := range quotes {
+		t, ok := parseTickTime(q.T)
+		if !ok {
+			res.Skipped++
+			continue
+		}
+		key, existing, err := keys.assign(t, q, nil)
+		if err != nil {
+			return WriteResult{}, fmt.Errorf("quote %s de %s: %w", q.T, symbol, err)
+		}
+		if existing {
+			res.Existing++
+			continue
+		}
+		added = append(added, Quote{Time: t.UTC(), Seq: KeySeq(key), QuoteRecord: q})
+		res.Written++
+	}
+	if len(added) == 0 {
+		return res, nil
+	}
+	slices.SortStableFunc(added, func(a, b Quote) int { return compareTicks(Quote.key, a, b) })
+	merged := mergeSorted(stored, added, Quote.key)
+
+	for _, k := range oldKeys {
+		if err := chunks.Delete(k); err != nil {
+			return WriteResult{}, fmt.Errorf("failed to delete %s chunk for %s: %w", QuoteChunksBucket, symbol, err)
+		}
+	}
+	for from := 0; from < len(merged); from += QuoteChunkSize {
+		part := merged[from:min(from+QuoteChunkSize, len(merged))]
+		value, err := EncodeQuoteChunk(part)
+		if err != nil {
+			return WriteResult{}, fmt.Errorf("quotes de %s: %w", symbol, err)
+		}
+		if err := chunks.Put(Key(part[0].Time.UnixNano(), part[0].Seq), value); err != nil {
+			return WriteResult{}, fmt.Errorf("failed to put %s chunk for %s: %w", QuoteChunksBucket, symbol, err)
+		}
+	}
+	return res, nil
+}
+
+// seekChunk coloca 'c' en el primer chunk que puede contener quotes con timestamp
+// 'from' o posterior: el anterior al primero que empieza en 'from' o después, porque
+// ese puede acabar más allá de 'from'. Con 'from' cero, en el primer chunk.
+func seekChunk(c *db.Cursor, from time.Time) (key, value []byte) {
+	if from.IsZero() {
+		return c.First()
+	}
+	if k, _ := c.Seek(KeyPrefix(from)); k == nil {
+		return c.Last()
+	}
+	if pk, pv := c.Prev(); pk != nil {
+		return pk, pv
+	}
+	return c.First()
+}
+
+// xorState es el estado de la compresión XOR de una columna de precios: el valor
+// anterior y la ventana de bits significativos usada por última vez.
+type xorState struct {
+	prev              uint64
+	leading, trailing uint
+	window            bool // Si ya hay una ventana que reutilizar
+}
+
+func (s *xorState) write(w *bitWriter, v float64) {
+	cur := math.Float64bits(v)
+	xor := cur ^ s.prev
+	s.prev = cur
+	if xor == 0 {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+	leading := min(uint(bits.LeadingZeros64(xor)), 31)
+	trailing := uint(bits.TrailingZeros64(xor))
+	if s.window && leading >= s.leading && trailing >= s.trailing {
+		w.writeBit(false)
+		w.writeBits(xor>>s.trailing, 64-s.leading-s.trailing)
+		return
+	}
+	w.writeBit(true)
+	s.leading, s.trailing, s.window = leading, trailing, true
+	length := 64 - leading - trailing
+	w.writeBits(uint64(leading), 5)
+	w.writeBits(uint64(length-1), 6)
+	w.writeBits(xor>>trailing, length)
+}
+
+func (s *xorState) read(r *bitReader) float64 {
+	if r.readBit() {
+		if r.readBit() {
+			s.leading = uint(r.readBits(5))
+			length := uint(r.readBits(6)) + 1
+			if s.leading+length > 64 {
+				r.fail("ventana XOR fuera de rango")
+				return 0
+			}
+			s.trailing = 64 - s.leading - length
+			s.window = true
+		} else if !s.window {
+			r.fail("ventana XOR sin definir")
+			return 0
+		}
+		s.prev ^= r.readBits(64-s.leading-s.trailing) << s.trailing
+	}
+	return math.Float64frombits(s.prev)
+}
+
+// bitWriter escribe un flujo de bits, del más significativo al menos, detrás de 'buf'.
+type bitWriter struct {
+	buf  []byte
+	free uint // Bits libres en el último byte de 'buf'
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.buf = append(w.buf, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.buf[len(w.buf)-1] |= 1 << w.free
+	}
+}
+
+// writeBits escribe los 'n' bits bajos de 'v'.
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		if w.free == 0 {
+			w.buf = append(w.buf, 0)
+			w.free = 8
+		}
+		take := min(n, w.free)
+		n -= take
+		w.free -= take
+		chunk := byte(v>>n) & (1<<take - 1)
+		w.buf[len(w.buf)-1] |= chunk << w.free
+	}
+}
+
+// writeTimeDelta escribe un delta-of-delta de timestamps con las cubetas de
+// `quoteChunkTimeWidths`.
+func (w *bitWriter) writeTimeDelta(dod int64) {
+	if dod == 0 {
+		w.writeBit(false)
+		return
+	}
+	z := zigzag(dod)
+	last := len(quoteChunkTimeWidths) - 1
+	for i, width := range quoteChunkTimeWidths {
+		switch {
+		case i == last:
+			w.writeBits(1<<(i+1)-1, uint(i+1)) // '1111'
+		case bits.Len64(z) <= int(width):
+			w.writeBits(1<<(i+2)-2, uint(i+2)) // '10', '110', '1110'
+		default:
+			continue
+		}
+		w.writeBits(z, width)
+		return
+	}
+}
+
+// writeInt escribe 'v' como diferencia respecto a 'prev' ('first' para la primera
+// quote, que siempre se escribe).
+func (w *bitWriter) writeInt(v, prev int64, first bool) {
+	if v == prev && !first {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+	z := zigzag(v - prev)
+	width := uint(bits.Len64(z))
+	w.writeBits(uint64(width), 7)
+	w.writeBits(z, width)
+}
+
+// writeString escribe 's' si cambia respecto a 'prev' ('first' para la primera quote).
+func (w *bitWriter) writeString(field, s, prev string, first bool) error {
+	if s == prev && !first {
+		w.writeBit(false)
+		return nil
+	}
+	if len(s) > math.MaxUint8 {
+		return fmt.Errorf("%w: %s de %d bytes (máximo %d)", ErrQuoteChunkEncode, field, len(s), math.MaxUint8)
+	}
+	w.writeBit(true)
+	w.writeBits(uint64(len(s)), 8)
+	for i := 0; i < len(s); i++ {
+		w.writeBits(uint64(s[i]), 8)
+	}
+	return nil
+}
+
+// bitReader lee el flujo de `bitWriter`. El primer error se queda en 'err' y a partir
+// de ahí todas las lecturas devuelven cero.
+type bitReader struct {
+	buf []byte
+	pos uint // Bit siguiente
+	err error
+}
+
+func (r *bitReader) fail(reason string) {
+	if r.err == nil {
+		r.err = errors.New(reason)
+	}
+}
+
+func (r *bitReader) readBit() bool {
+	return r.readBits(1) == 1
+}
+
+func (r *bitReader) readBits(n uint) uint64 {
+	if r.err != nil {
+		return 0
+	}
+	if r.pos+n > uint(len(r.buf))*8 {
+		r.fail("faltan bits")
+		return 0
+	}
+	var v uint64
+	for n > 0 {
+		avail := 8 - r.pos%8
+		take := min(n, avail)
+		b := r.buf[r.pos/8] >> (avail - take) & (1<<take - 1)
+		v = v<<take | uint64(b)
+		r.pos += take
+		n -= take
+	}
+	return v
+}
+
+func (r *bitReader) readTimeDelta() int64 {
+	if !r.readBit() {
+		return 0
+	}
+	for i, width := range quoteChunkTimeWidths {
+		if i == len(quoteChunkTimeWidths)-1 || !r.readBit() {
+			return unzigzag(r.readBits(width))
+		}
+	}
+	return 0
+}
+
+func (r *bitReader) readInt(prev int64, first bool) int64 {
+	if !r.readBit() {
+		if first {
+			r.fail("primer valor ausente")
+		}
+		return prev
+	}
+	width := uint(r.readBits(7))
+	if width > 64 {
+		r.fail("ancho de entero fuera de rango")
+		return 0
+	}
+	return prev + unzigzag(r.readBits(width))
+}
+
+func (r *bitReader) readString(prev string, first bool) string {
+	if !r.readBit() {
+		if first {
+			r.fail("primer valor ausente")
+		}
+		return prev
+	}
+	n := int(r.readBits(8))
+	s := make([]byte, n)
+	for i := range s {
+		s[i] = byte(r.readBits(8))
+	}
+	return string(s)
+}
+
+// zigzag lleva los enteros con signo a sin signo de forma que los de valor absoluto
+// pequeño ocupen pocos bits (0, -1, 1, -2... -> 0, 1, 2, 3...).
+func zigzag(v int64) uint64 { return uint64(v<<1) ^ uint64(v>>63) }
+
+func unzigzag(z uint64) int64 { return int64(z>>1) ^ -int64(z&1) }
@@ -0,0 +1,161 @@
+package ticks
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE CLAVES DE QUOTES ENTRE LAYOUTS
+// ===============================
+
+//
+//
+//
+*/
+
+// Las quotes de un símbolo pueden estar repartidas entre las columnas, las filas
+// (`QuoteRowsBucket`) y los chunks (`QuoteChunksBucket`): al cambiar de layout, o en
+// `LayoutRows` con las quotes que no caben en una fila. La lectura une los tres, así
+// que una clave no puede estar en dos de ellos. `quoteKeys` asigna las claves de un
+// lote mirando todos los layouts: una quote ya guardada en cualquiera de ellos se
+// reconoce como existente, y una nueva recibe una secuencia libre en todos.
+
+// quoteKeys asigna las claves de las quotes de un símbolo en una transacción de
+// escritura (ver `KeyAllocator`).
+type quoteKeys struct {
+	keys    *KeyAllocator
+	symbol  *db.Bucket
+	columns []*db.Bucket // Las columnas `QuoteFields`; nil mientras no exista "AP"
+	rows    *db.Bucket   // nil mientras no exista
+	// chunks son las quotes de los chunks en el rango del lote, en orden de clave (ver
+	// `loadChunks`). Los chunks nuevos no se añaden: `KeyAllocator` ya conoce sus claves.
+	chunks []Quote
+}
+
+// newQuoteKeys prepara la asignación de claves de un lote de quotes de 'symbolBucket'.
+// 'chunks' son las quotes guardadas en chunks que cubren el rango del lote.
+func newQuoteKeys(symbolBucket *db.Bucket, chunks []Quote) *quoteKeys {
+	return &quoteKeys{keys: NewKeyAllocator(), symbol: symbolBucket, chunks: chunks}
+}
+
+// assign devuelve la clave de la quote 'q' con timestamp 't'. 'existing' es true si
+// ya estaba guardada, en cualquier layout. 'values' es 'q' ya codificada para el
+// layout en el que se va a escribir (las columnas, la fila, o nil en chunks): se
+// compara tal cual con las quotes de ese layout, y 'q' se codifica para los demás
+// solo si hay quotes suyas con el mismo timestamp.
+func (k *quoteKeys) assign(t time.Time, q QuoteRecord, values [][]byte) (key []byte, existing bool, err error) {
+	if k.columns == nil {
+		if index := k.symbol.Bucket([]byte(QuoteFields[0])); index != nil {
+			k.columns = make([]*db.Bucket, len(QuoteFields))
+			for i, name := range QuoteFields {
+				k.columns[i] = k.symbol.Bucket([]byte(name))
+			}
+		}
+	}
+	if k.rows == nil {
+		k.rows = k.symbol.Bucket([]byte(QuoteRowsBucket))
+	}
+
+	var stored [][]byte
+	if k.columns != nil {
+		stored = keysAt(k.columns[0], t)
+	}
+	stored = append(stored, keysAt(k.rows, t)...)
+	chunks := k.chunksAt(t)
+	for _, c := range chunks {
+		stored = append(stored, Key(c.Time.UnixNano(), c.Seq))
+	}
+	if len(stored) == 0 {
+		return k.keys.AssignKeys(t, nil, nil)
+	}
+	slices.SortFunc(stored, bytes.Compare)
+
+	var columns, row [][]byte // 'q' en los layouts de las quotes guardadas
+	switch len(values) {
+	case len(QuoteFields):
+		columns = values
+	case 1:
+		row = values
+	}
+	return k.keys.AssignKeys(t, stored, func(key []byte) bool {
+		if k.columns != nil && k.columns[0].Get(key) != nil {
+			if columns == nil {
+				columns = EncodeQuoteColumns(q)
+			}
+			for i, column := range k.columns {
+				if column == nil || !bytes.Equal(column.Get(key), columns[i]) {
+					return false
+				}
+			}
+			return true
+		}
+		if k.rows != nil {
+			if stored := k.rows.Get(key); stored != nil {
+				if row == nil {
+					encoded, err := EncodeQuoteRow(q)
+					if err != nil {
+						return false // No cabe en una fila: no puede ser la guardada
+					}
+					row = [][]byte{encoded}
+				}
+				return bytes.Equal(stored, row[0])
+			}
+		}
+		for _, c := range chunks {
+			if bytes.Equal(Key(c.Time.UnixNano(), c.Seq), key) {
+				return sameQuote(c.QuoteRecord, q)
+			}
+		}
+		return false
+	})
+}
+
+// chunksAt devuelve las quotes de 'k.chunks' con el timestamp 't'.
+func (k *quoteKeys) chunksAt(t time.Time) []Quote {
+	lo, found := slices.BinarySearchFunc(k.chunks, t, func(q Quote, t time.Time) int { return q.Time.Compare(t) })
+	if !found {
+		return nil
+	}
+	hi := lo
+	for hi < len(k.chunks) && k.chunks[hi].Time.Equal(t) {
+		hi++
+	}
+	return k.chunks[lo:hi]
+}
+
+// loadChunks decodifica los chunks de 'chunks' que pueden tener quotes con timestamp
+// en [first, last] (ver `seekChunk`) y devuelve sus quotes, en orden de clave, y sus
+// claves. 'chunks' puede ser nil.
+func loadChunks(chunks *db.Bucket, symbol string, first, last time.Time) ([]Quote, [][]byte, error) {
+	if chunks == nil || last.IsZero() {
+		return nil, nil, nil
+	}
+	var quotes []Quote
+	var keys [][]byte
+	c := chunks.Cursor()
+	for k, v := seekChunk(c, first); k != nil; k, v = c.Next() {
+		t, err := KeyTime(k)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.After(last) {
+			break
+		}
+		decoded, err := DecodeQuoteChunk(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("chunk %s de %s: %w", t.Format(time.RFC3339Nano), symbol, err)
+		}
+		quotes = append(quotes, decoded...)
+		keys = append(keys, k)
+	}
+	return quotes, keys, nil
+}
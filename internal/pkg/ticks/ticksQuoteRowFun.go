@@ -0,0 +1,213 @@
+package ticks
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE FILAS BINARIAS DE QUOTES
+// ===============================
+
+//
+//
+//
+*/
+
+// QuoteRowsBucket es el sub-bucket del símbolo con las quotes en filas binarias.
+// La clave es la misma que en las columnas (ver `Key`).
+const QuoteRowsBucket = "QROWS"
+
+// Formato de fila v1 (36 bytes, enteros en big-endian):
+//
+//	offset  tamaño  campo
+//	0       1       versión (quoteRowVersion1)
+//	1       8       AP: precio ask en millonésimas (int64)
+//	9       4       AS: tamaño ask (uint32)
+//	13      1       AX: exchange ask (byte ASCII, 0 si no hay)
+//	14      8       BP: precio bid en millonésimas (int64)
+//	22      4       BS: tamaño bid (uint32)
+//	26      1       BX: exchange bid (byte ASCII, 0 si no hay)
+//	27      8       C: condiciones como bitset sobre `quoteConditionCodes` (uint64)
+//	35      1       Z: tape (byte ASCII, 0 si no hay)
+//
+// El timestamp no se repite en la fila: es la clave.
+const (
+	quoteRowVersion1 = 1
+	QuoteRowSize     = 36
+	quotePriceScale  = 1_000_000 // Precios en millonésimas de dólar
+)
+
+// quoteConditionCodes son los códigos de condición de quote que caben en la fila: el
+// código i-ésimo ocupa el bit i del bitset. Las condiciones de quote de SIP son un
+// carácter (ver `QuoteCondition`); '?' es el que pone Alpaca cuando la quote llega sin
+// condición conocida. Solo se añaden códigos al final, para no cambiar los bits ya
+// guardados.
+const quoteConditionCodes = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789?"
+
+// Errores del formato de fila. Se comprueban con errors.Is.
+var (
+	ErrQuoteRowEncode = errors.New("quote no representable en el formato de fila binaria")
+	ErrQuoteRowDecode = errors.New("fila binaria de quote inválida")
+)
+
+// EncodeQuoteRow codifica 'q' (sin su timestamp, que va en la clave) en una fila v1.
+//
+// Devuelve un error que envuelve `ErrQuoteRowEncode` si algún campo no cabe sin perder
+// información: precios negativos, no finitos o con más de seis decimales, tamaños
+// fuera de uint32, exchanges o tape de más de un carácter, o condiciones fuera de
+// `quoteConditionCodes`.
+func EncodeQuoteRow(q QuoteRecord) ([]byte, error) {
+	return AppendQuoteRow(make([]byte, 0, QuoteRowSize), q)
+}
+
+// AppendQuoteRow es `EncodeQuoteRow` escribiendo al final de 'dst', para reutilizar
+// el buffer al codificar lotes.
+func AppendQuoteRow(dst []byte, q QuoteRecord) ([]byte, error) {
+	ap, err := scalePrice("AP", q.AP)
+	if err != nil {
+		return dst, err
+	}
+	as, err := quoteSize("AS", q.AS)
+	if err != nil {
+		return dst, err
+	}
+	ax, err := asciiCode("AX", q.AX)
+	if err != nil {
+		return dst, err
+	}
+	bp, err := scalePrice("BP", q.BP)
+	if err != nil {
+		return dst, err
+	}
+	bs, err := quoteSize("BS", q.BS)
+	if err != nil {
+		return dst, err
+	}
+	bx, err := asciiCode("BX", q.BX)
+	if err != nil {
+		return dst, err
+	}
+	conditions, err := conditionBits(q.C)
+	if err != nil {
+		return dst, err
+	}
+	z, err := asciiCode("Z", q.Z)
+	if err != nil {
+		return dst, err
+	}
+
+	dst = append(dst, quoteRowVersion1)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(ap))
+	dst = binary.BigEndian.AppendUint32(dst, as)
+	dst = append(dst, ax)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(bp))
+	dst = binary.BigEndian.AppendUint32(dst, bs)
+	dst = append(dst, bx)
+	dst = binary.BigEndian.AppendUint64(dst, conditions)
+	dst = append(dst, z)
+	return dst, nil
+}
+
+// DecodeQuoteRow reconstruye la quote guardada bajo 'key' (ver `Key`) con
+// la fila 'row'. T se devuelve en RFC3339Nano UTC y las condiciones en el orden de
+// `quoteConditionCodes`.
+func DecodeQuoteRow(key, row []byte) (QuoteRecord, error) {
+	ts, err := KeyTime(key)
+	if err != nil {
+		return QuoteRecord{}, fmt.Errorf("%w: %v", ErrQuoteRowDecode, err)
+	}
+	if len(row) == 0 || row[0] != quoteRowVersion1 {
+		return QuoteRecord{}, fmt.Errorf("%w: versión desconocida", ErrQuoteRowDecode)
+	}
+	if len(row) != QuoteRowSize {
+		return QuoteRecord{}, fmt.Errorf("%w: %d bytes, se esperaban %d", ErrQuoteRowDecode, len(row), QuoteRowSize)
+	}
+	return QuoteRecord{
+		AP: float64(int64(binary.BigEndian.Uint64(row[1:9]))) / quotePriceScale,
+		AS: int(binary.BigEndian.Uint32(row[9:13])),
+		AX: asciiString(row[13]),
+		BP: float64(int64(binary.BigEndian.Uint64(row[14:22]))) / quotePriceScale,
+		BS: int(binary.BigEndian.Uint32(row[22:26])),
+		BX: asciiString(row[26]),
+		C:  conditionList(binary.BigEndian.Uint64(row[27:35])),
+		T:  ts.Format(time.RFC3339Nano),
+		Z:  asciiString(row[35]),
+	}, nil
+}
+
+// scalePrice convierte un precio a millonésimas, exigiendo que la conversión sea exacta.
+func scalePrice(field string, price float64) (int64, error) {
+	if math.IsNaN(price) || math.IsInf(price, 0) || price < 0 || price > math.MaxInt64/quotePriceScale {
+		return 0, fmt.Errorf("%w: %s = %v fuera de rango", ErrQuoteRowEncode, field, price)
+	}
+	scaled := math.Round(price * quotePriceScale)
+	if scaled/quotePriceScale != price {
+		return 0, fmt.Errorf("%w: %s = %v tiene más de seis decimales", ErrQuoteRowEncode, field, price)
+	}
+	return int64(scaled), nil
+}
+
+// quoteSize comprueba que un tamaño quepa en uint32.
+func quoteSize(field string, size int) (uint32, error) {
+	if size < 0 || size > math.MaxUint32 {
+		return 0, fmt.Errorf("%w: %s = %d fuera de rango", ErrQuoteRowEncode, field, size)
+	}
+	return uint32(size), nil
+}
+
+// asciiCode convierte un código de un carácter ASCII (exchange, tape) a un byte; el
+// texto vacío se guarda como 0.
+func asciiCode(field, code string) (byte, error) {
+	switch {
+	case code == "":
+		return 0, nil
+	case len(code) == 1 && code[0] > ' ' && code[0] < 0x7f:
+		return code[0], nil
+	default:
+		return 0, fmt.Errorf("%w: %s = %q no es un código de un carácter", ErrQuoteRowEncode, field, code)
+	}
+}
+
+// asciiString es la inversa de `asciiCode`.
+func asciiString(code byte) string {
+	if code == 0 {
+		return ""
+	}
+	return string(rune(code))
+}
+
+// conditionBits convierte las condiciones al bitset de `quoteConditionCodes`.
+func conditionBits(conditions []string) (uint64, error) {
+	var bits uint64
+	for _, code := range conditions {
+		i := -1
+		if len(code) == 1 {
+			i = strings.IndexByte(quoteConditionCodes, code[0])
+		}
+		if i < 0 {
+			return 0, fmt.Errorf("%w: condición %q fuera del diccionario", ErrQuoteRowEncode, code)
+		}
+		bits |= 1 << uint(i)
+	}
+	return bits, nil
+}
+
+// conditionList es la inversa de `conditionBits`.
+func conditionList(bits uint64) []string {
+	var conditions []string
+	for i := 0; i < len(quoteConditionCodes); i++ {
+		if bits&(1<<uint(i)) != 0 {
+			conditions = append(conditions, quoteConditionCodes[i:i+1])
+		}
+	}
+	return conditions
+}
@@ -0,0 +1,193 @@
+package ticks
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+func TestQuoteRowRoundTrip(t *testing.T) {
+	key := Key(chunkBase.UnixNano(), 3)
+	all := strings.Split(quoteConditionCodes, "")
+	for _, tc := range []struct {
+		name string
+		in   QuoteRecord
+		want QuoteRecord // Vacía si es igual a 'in'
+	}{
+		{name: "quote de SIP", in: QuoteRecord{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "Q", C: []string{"R"}, Z: "C"}},
+		{name: "campos vacíos", in: QuoteRecord{}},
+		{name: "seis decimales", in: QuoteRecord{AP: 0.000001, BP: 123456.654321}},
+		{name: "precio máximo", in: QuoteRecord{AP: 9_000_000_000_000, BP: 1}},
+		{name: "tamaño máximo", in: QuoteRecord{AS: math.MaxUint32, BS: math.MaxUint32}},
+		{name: "códigos ASCII", in: QuoteRecord{AX: "!", BX: "~", Z: "0"}},
+		{name: "todas las condiciones", in: QuoteRecord{C: all}},
+		{
+			name: "condiciones desordenadas y repetidas",
+			in:   QuoteRecord{C: []string{"R", "?", "I", "R"}},
+			want: QuoteRecord{C: []string{"I", "R", "?"}}, // En el orden del diccionario
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			row, err := EncodeQuoteRow(tc.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(row) != QuoteRowSize {
+				t.Fatalf("fila de %d bytes, se esperaban %d", len(row), QuoteRowSize)
+			}
+			got, err := DecodeQuoteRow(key, row)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.in
+			if tc.want.C != nil {
+				want = tc.want
+			}
+			want.T = chunkBase.Format(time.RFC3339Nano)
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("\n got  %+v\n want %+v", got, want)
+			}
+			// AppendQuoteRow escribe detrás de lo que ya hay en el buffer.
+			appended, err := AppendQuoteRow([]byte("xx"), tc.in)
+			if err != nil || string(appended[:2]) != "xx" || string(appended[2:]) != string(row) {
+				t.Fatalf("AppendQuoteRow = %x, %v", appended, err)
+			}
+		})
+	}
+}
+
+func TestEncodeQuoteRowErrors(t *testing.T) {
+	valid := QuoteRecord{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, Z: "C"}
+	for _, tc := range []struct {
+		name   string
+		modify func(q *QuoteRecord)
+	}{
+		{"precio NaN", func(q *QuoteRecord) { q.AP = math.NaN() }},
+		{"precio infinito", func(q *QuoteRecord) { q.BP = math.Inf(1) }},
+		{"precio negativo", func(q *QuoteRecord) { q.BP = -0.01 }},
+		{"precio fuera de int64", func(q *QuoteRecord) { q.AP = math.MaxInt64 / quotePriceScale * 2 }},
+		{"siete decimales en AP", func(q *QuoteRecord) { q.AP = 110.8712345 }},
+		{"siete decimales en BP", func(q *QuoteRecord) { q.BP = 0.0000001 }},
+		{"tamaño negativo", func(q *QuoteRecord) { q.AS = -1 }},
+		{"tamaño fuera de uint32", func(q *QuoteRecord) { q.BS = math.MaxUint32 + 1 }},
+		{"exchange de dos caracteres", func(q *QuoteRecord) { q.AX = "TT" }},
+		{"exchange espacio", func(q *QuoteRecord) { q.BX = " " }},
+		{"exchange no ASCII", func(q *QuoteRecord) { q.BX = "é" }},
+		{"tape de control", func(q *QuoteRecord) { q.Z = "\x7f" }},
+		{"condición minúscula", func(q *QuoteRecord) { q.C = []string{"R", "r"} }},
+		{"condición de dos caracteres", func(q *QuoteRecord) { q.C = []string{"RI"} }},
+		{"condición vacía", func(q *QuoteRecord) { q.C = []string{""} }},
+		{"condición fuera del diccionario", func(q *QuoteRecord) { q.C = []string{"@"} }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := valid
+			tc.modify(&q)
+			if row, err := EncodeQuoteRow(q); !errors.Is(err, ErrQuoteRowEncode) {
+				t.Fatalf("se esperaba ErrQuoteRowEncode, fila %x, error %v", row, err)
+			}
+			if dst, err := AppendQuoteRow([]byte("xx"), q); err == nil || string(dst) != "xx" {
+				t.Fatalf("AppendQuoteRow con error debe dejar 'dst' como estaba: %q", dst)
+			}
+		})
+	}
+}
+
+func TestDecodeQuoteRowErrors(t *testing.T) {
+	row, err := EncodeQuoteRow(QuoteRecord{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, Z: "C"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := Key(chunkBase.UnixNano(), 0)
+	for _, tc := range []struct {
+		name     string
+		key, row []byte
+	}{
+		{"clave corta", key[:KeySize-1], row},
+		{"fila vacía", key, nil},
+		{"versión 0", key, append([]byte{0}, row[1:]...)},
+		{"versión desconocida", key, append([]byte{quoteRowVersion1 + 1}, row[1:]...)},
+		{"fila corta", key, row[:QuoteRowSize-1]},
+		{"fila larga", key, append(row[:QuoteRowSize:QuoteRowSize], 0)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := DecodeQuoteRow(tc.key, tc.row); !errors.Is(err, ErrQuoteRowDecode) {
+				t.Fatalf("se esperaba ErrQuoteRowDecode, error %v", err)
+			}
+		})
+	}
+}
+
+// TestPutQuotesTxRowFallback guarda con `LayoutRows` un lote con quotes que no caben
+// en una fila: deben quedar en las columnas, sin errores, sin compartir claves con las
+// filas del mismo nanosegundo y sin duplicarse al repetir el lote.
+func TestPutQuotesTxRowFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ticks.db")
+	dbInstance, err := OpenDB(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+
+	ts := chunkBase.Format(time.RFC3339Nano)
+	later := chunkBase.Add(time.Millisecond).Format(time.RFC3339Nano)
+	quotes := []QuoteRecord{
+		{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, T: ts, Z: "C"},
+		{AP: 110.8712345, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, T: ts, Z: "C"}, // Siete decimales
+		{AP: 110.88, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, T: ts, Z: "C"},
+		{AP: 110.88, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"@"}, T: later, Z: "C"}, // Condición desconocida
+	}
+	for i, want := range []WriteResult{{Written: 4}, {Existing: 4}} {
+		var res WriteResult
+		err := dbInstance.Update(func(tx *db.Tx) error {
+			res, err = PutQuotesTx(tx, "SPY", quotes, LayoutRows)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("escritura %d: %v", i+1, err)
+		}
+		if res.Written != want.Written || res.Existing != want.Existing {
+			t.Fatalf("escritura %d: %+v, se esperaba %+v", i+1, res, want)
+		}
+	}
+
+	err = dbInstance.View(func(tx *db.Tx) error {
+		symbol := tx.Bucket([]byte("SPY"))
+		if n, m := keyCount(symbol.Bucket([]byte(QuoteRowsBucket))), keyCount(symbol.Bucket([]byte(QuoteFields[0]))); n != 2 || m != 2 {
+			t.Errorf("%d filas y %d quotes en columnas, se esperaban 2 y 2", n, m)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadQuotes(dbInstance, QueryOptions{SYMBOL: "SPY"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != len(quotes) {
+		t.Fatalf("se leyeron %d quotes, se esperaban %d", len(read), len(quotes))
+	}
+	for i, q := range read {
+		if q.Seq != [...]uint16{0, 1, 2, 0}[i] || q.T != quotes[i].T || !reflect.DeepEqual(q.C, quotes[i].C) || q.AP != quotes[i].AP {
+			t.Errorf("quote %d: %+v, se esperaba %+v", i, q, quotes[i])
+		}
+	}
+
+	// fsck acepta el símbolo con los dos layouts.
+	if err := dbInstance.Close(); err != nil {
+		t.Fatal(err)
+	}
+	report, err := CheckFile(path, CheckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Problems() != 0 {
+		t.Fatalf("fsck encuentra problemas: %+v", report)
+	}
+}
@@ -0,0 +1,455 @@
+package ticks
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"slices"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE LECTURA POR RANGO
+// ===============================
+
+//
+//
+//
+*/
+
+// Errores de lectura. Se comprueban con errors.Is.
+var (
+	// ErrInvalidQuery indica unas `QueryOptions` inválidas (símbolo vacío, rango
+	// invertido o campo desconocido).
+	ErrInvalidQuery = errors.New("consulta de ticks inválida")
+	// ErrUnknownField indica un nombre de columna que no pertenece al tipo de tick.
+	ErrUnknownField = errors.New("campo desconocido")
+	// ErrIncompleteTick indica una clave presente en una columna y ausente en otra
+	// del mismo tick (ej. una escritura parcial).
+	ErrIncompleteTick = errors.New("tick incompleto")
+	// ErrDuplicateKey indica una clave guardada en dos layouts con ticks distintos.
+	ErrDuplicateKey = errors.New("clave de tick repetida")
+)
+
+// QueryOptions describe una lectura de ticks de un símbolo por rango de tiempo.
+type QueryOptions struct {
+	// SYMBOL es el bucket del símbolo (ej. "QQQ").
+	SYMBOL string
+	// FIELDS son los campos a leer (ej. {"AP", "BP"} para quotes, ver `QuoteFields` y
+	// `TradeFields`); vacío para leer todos. En el layout de columnas solo se recorren
+	// esas columnas; los demás campos del registro quedan en su valor cero.
+	FIELDS []string
+	// FROM es el inicio del rango (incluido); cero para empezar desde el primer tick.
+	FROM time.Time
+	// TO es el final del rango (excluido); cero para leer hasta el último tick.
+	TO time.Time
+}
+
+// Quote es una quote leída de la base de datos: el registro guardado con su timestamp
+// ya interpretado ('T' también se rellena, en RFC3339Nano UTC) y su secuencia entre
+// las quotes del mismo nanosegundo (ver `Key`).
+type Quote struct {
+	Time time.Time
+	Seq  uint16
+	QuoteRecord
+}
+
+// Trade es un trade leído de la base de datos (ver `Quote`).
+type Trade struct {
+	Time time.Time
+	Seq  uint16
+	TradeRecord
+}
+
+// Quotes devuelve un iterador sobre las quotes de 'opts' en orden de clave (tiempo y
+// secuencia), reuniendo las columnas `QuoteFields`, las filas de `QuoteRowsBucket` y
+// los chunks de `QuoteChunksBucket` si el símbolo tiene varios layouts.
+//
+// La lectura se hace en una sola transacción de solo lectura que dura lo que dure el
+// bucle: mientras tanto bbolt no puede hacer crecer el archivo, así que un bucle largo
+// retrasa a los escritores. Para recorridos largos conviene procesar rápido o partir
+// el rango. Si hay un error se entrega como último elemento y el recorrido termina.
+// Un símbolo sin datos no es un error: el iterador queda vacío.
+//
+// Ejemplo:
+//
+//	for q, err := range ticks.Quotes(dbInstance, ticks.QueryOptions{SYMBOL: "QQQ", FROM: from, TO: to}) {
+//		if err != nil {
+//			return err
+//		}
+//		fmt.Println(q.Time, q.BP, q.AP)
+//	}
+func Quotes(dbInstance *db.DB, opts QueryOptions) iter.Seq2[Quote, error] {
+	return viewSeq(dbInstance, func(tx *db.Tx) iter.Seq2[Quote, error] { return QuotesTx(tx, opts) })
+}
+
+// ReadQuotes devuelve en un slice las quotes de 'opts' (ver `Quotes`).
+func ReadQuotes(dbInstance *db.DB, opts QueryOptions) ([]Quote, error) {
+	return collect(Quotes(dbInstance, opts))
+}
+
+// QuotesTx es `Quotes` dentro de una transacción ya abierta. El iterador solo es
+// válido mientras 'tx' siga abierta.
+func QuotesTx(tx *db.Tx, opts QueryOptions) iter.Seq2[Quote, error] {
+	fields, err := opts.fields(QuoteFields)
+	if err != nil {
+		return failSeq[Quote](err)
+	}
+	symbol := tx.Bucket([]byte(opts.SYMBOL))
+	if symbol == nil {
+		return emptySeq[Quote]()
+	}
+	ticks := columnTicks(symbol, fields, opts, DecodeQuoteField)
+	if rows := symbol.Bucket([]byte(QuoteRowsBucket)); rows != nil {
+		ticks = mergeTicks(ticks, rowTicks(rows, fields, opts), sameReadQuote)
+	}
+	if chunks := symbol.Bucket([]byte(QuoteChunksBucket)); chunks != nil {
+		ticks = mergeTicks(ticks, chunkTicks(chunks, fields, opts), sameReadQuote)
+	}
+	return quoteSeq(ticks)
+}
+
+// Trades devuelve un iterador sobre los trades de 'opts' en orden de clave, reuniendo
+// las columnas de `TradesBucket` (ver `Quotes`).
+func Trades(dbInstance *db.DB, opts QueryOptions) iter.Seq2[Trade, error] {
+	return viewSeq(dbInstance, func(tx *db.Tx) iter.Seq2[Trade, error] { return TradesTx(tx, opts) })
+}
+
+// ReadTrades devuelve en un slice los trades de 'opts' (ver `Trades`).
+func ReadTrades(dbInstance *db.DB, opts QueryOptions) ([]Trade, error) {
+	return collect(Trades(dbInstance, opts))
+}
+
+// TradesTx es `Trades` dentro de una transacción ya abierta. El iterador solo es
+// válido mientras 'tx' siga abierta.
+func TradesTx(tx *db.Tx, opts QueryOptions) iter.Seq2[Trade, error] {
+	fields, err := opts.fields(TradeFields)
+	if err != nil {
+		return failSeq[Trade](err)
+	}
+	symbol := tx.Bucket([]byte(opts.SYMBOL))
+	if symbol == nil {
+		return emptySeq[Trade]()
+	}
+	trades := symbol.Bucket([]byte(TradesBucket))
+	if trades == nil {
+		return emptySeq[Trade]()
+	}
+	return func(yield func(Trade, error) bool) {
+		for kt, err := range columnTicks(trades, fields, opts, DecodeTradeField) {
+			tr := Trade{Time: kt.time, Seq: KeySeq(kt.key), TradeRecord: kt.rec}
+			tr.T = kt.time.Format(time.RFC3339Nano)
+			if !yield(tr, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// fields valida 'opts' y devuelve los campos a leer: 'all' si FIELDS está vacío.
+func (opts QueryOptions) fields(all []string) ([]string, error) {
+	if opts.SYMBOL == "" {
+		return nil, fmt.Errorf("%w: falta el símbolo", ErrInvalidQuery)
+	}
+	if !opts.TO.IsZero() && opts.TO.Before(opts.FROM) {
+		return nil, fmt.Errorf("%w: el final del rango (%s) es anterior al inicio (%s)",
+			ErrInvalidQuery, opts.TO.Format(time.RFC3339Nano), opts.FROM.Format(time.RFC3339Nano))
+	}
+	if len(opts.FIELDS) == 0 {
+		return all, nil
+	}
+	for _, field := range opts.FIELDS {
+		if !slices.Contains(all, field) {
+			return nil, fmt.Errorf("%w: %w '%s' (válidos: %v)", ErrInvalidQuery, ErrUnknownField, field, all)
+		}
+	}
+	return opts.FIELDS, nil
+}
+
+// keyedTick es un registro a medio leer junto con su clave.
+type keyedTick[R any] struct {
+	key  []byte
+	time time.Time
+	rec  R
+}
+
+// columnTicks recorre a la vez las columnas 'fields' de 'bucket', un cursor por
+// columna, y reconstruye cada tick con 'decode'. La primera columna marca las claves;
+// si a otra le falta una de ellas, o falta la primera y las demás existen, se devuelve
+// `ErrIncompleteTick`. Un tipo de tick sin ninguna de las columnas se lee como vacío.
+func columnTicks[R any](bucket *db.Bucket, fields []string, opts QueryOptions, decode func(*R, string, []byte) error) iter.Seq2[keyedTick[R], error] {
+	return func(yield func(keyedTick[R], error) bool) {
+		cursors := make([]*db.Cursor, len(fields))
+		missing := ""
+		for i, field := range fields {
+			b := bucket.Bucket([]byte(field))
+			if b == nil {
+				missing = field
+				continue
+			}
+			cursors[i] = b.Cursor()
+		}
+		if cursors[0] == nil {
+			for i, c := range cursors {
+				if c != nil {
+					yield(keyedTick[R]{}, fmt.Errorf("%w: la columna '%s' no existe y la columna '%s' sí", ErrIncompleteTick, fields[0], fields[i]))
+					return
+				}
+			}
+			return // Sin columnas: no hay ticks de este tipo
+		}
+
+		keys := make([][]byte, len(fields))
+		values := make([][]byte, len(fields))
+		for i, c := range cursors {
+			if c != nil {
+				keys[i], values[i] = Seek(c, opts.FROM)
+			}
+		}
+		for keys[0] != nil {
+			var kt keyedTick[R]
+			kt.key = keys[0]
+			t, err := KeyTime(kt.key)
+			if err != nil {
+				yield(kt, err)
+				return
+			}
+			if !opts.TO.IsZero() && !t.Before(opts.TO) {
+				return
+			}
+			kt.time = t
+			for i, field := range fields {
+				if i > 0 {
+					if cursors[i] == nil {
+						yield(kt, fmt.Errorf("%w: %s: la columna '%s' no existe", ErrIncompleteTick, t.Format(time.RFC3339Nano), missing))
+						return
+					}
+					// Las columnas comparten claves, así que normalmente basta con avanzar
+					// el cursor; si hay claves sobrantes se salta hasta la del tick.
+					if keys[i] != nil && bytes.Compare(keys[i], kt.key) < 0 {
+						if keys[i], values[i] = cursors[i].Next(); keys[i] != nil && bytes.Compare(keys[i], kt.key) < 0 {
+							keys[i], values[i] = cursors[i].Seek(kt.key)
+						}
+					}
+					if !bytes.Equal(keys[i], kt.key) {
+						yield(kt, fmt.Errorf("%w: %s #%d sin valor en la columna '%s'", ErrIncompleteTick, t.Format(time.RFC3339Nano), KeySeq(kt.key), field))
+						return
+					}
+				}
+				if err := decode(&kt.rec, field, values[i]); err != nil {
+					yield(kt, fmt.Errorf("%s #%d: %w", t.Format(time.RFC3339Nano), KeySeq(kt.key), err))
+					return
+				}
+			}
+			if !yield(kt, nil) {
+				return
+			}
+			keys[0], values[0] = cursors[0].Next()
+		}
+	}
+}
+
+// rowTicks recorre las filas binarias de 'rows' en el rango de 'opts', dejando solo
+// los campos 'fields' de cada quote.
+func rowTicks(rows *db.Bucket, fields []string, opts QueryOptions) iter.Seq2[keyedTick[QuoteRecord], error] {
+	return func(yield func(keyedTick[QuoteRecord], error) bool) {
+		stop := errors.New("stop")
+		err := ForEach(rows, opts.FROM, opts.TO, func(key, value []byte) error {
+			q, err := DecodeQuoteRow(key, value)
+			if err != nil {
+				return err
+			}
+			t, _ := KeyTime(key) // DecodeQuoteRow ya validó la clave
+			if !yield(keyedTick[QuoteRecord]{key: key, time: t, rec: selectQuoteFields(q, fields)}, nil) {
+				return stop
+			}
+			return nil
+		})
+		if err != nil && err != stop {
+			yield(keyedTick[QuoteRecord]{}, err)
+		}
+	}
+}
+
+// chunkTicks recorre las quotes de los chunks de 'chunks' en el rango de 'opts',
+// dejando solo los campos 'fields' de cada quote. Los chunks se decodifican enteros.
+func chunkTicks(chunks *db.Bucket, fields []string, opts QueryOptions) iter.Seq2[keyedTick[QuoteRecord], error] {
+	return func(yield func(keyedTick[QuoteRecord], error) bool) {
+		c := chunks.Cursor()
+		for k, v := seekChunk(c, opts.FROM); k != nil; k, v = c.Next() {
+			start, err := KeyTime(k)
+			if err != nil {
+				yield(keyedTick[QuoteRecord]{}, err)
+				return
+			}
+			if !opts.TO.IsZero() && !start.Before(opts.TO) {
+				return
+			}
+			quotes, err := DecodeQuoteChunk(v)
+			if err != nil {
+				yield(keyedTick[QuoteRecord]{}, fmt.Errorf("chunk %s: %w", start.Format(time.RFC3339Nano), err))
+				return
+			}
+			for _, q := range quotes {
+				if q.Time.Before(opts.FROM) {
+					continue
+				}
+				if !opts.TO.IsZero() && !q.Time.Before(opts.TO) {
+					return
+				}
+				kt := keyedTick[QuoteRecord]{key: Key(q.Time.UnixNano(), q.Seq), time: q.Time, rec: selectQuoteFields(q.QuoteRecord, fields)}
+				if !yield(kt, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// selectQuoteFields devuelve 'q' con solo los campos 'fields' (ver `QueryOptions.FIELDS`).
+func selectQuoteFields(q QuoteRecord, fields []string) QuoteRecord {
+	if len(fields) == len(QuoteFields) {
+		return q
+	}
+	var out QuoteRecord
+	for _, field := range fields {
+		switch field {
+		case "AP":
+			out.AP = q.AP
+		case "AS":
+			out.AS = q.AS
+		case "AX":
+			out.AX = q.AX
+		case "BP":
+			out.BP = q.BP
+		case "BS":
+			out.BS = q.BS
+		case "BX":
+			out.BX = q.BX
+		case "C":
+			out.C = q.C
+		case "Z":
+			out.Z = q.Z
+		}
+	}
+	return out
+}
+
+// sameReadQuote es `sameQuote` para quotes leídas de layouts distintos: las filas
+// devuelven las condiciones en el orden del diccionario y sin repetidas (ver
+// `DecodeQuoteRow`), así que se comparan como conjuntos.
+func sameReadQuote(a, b QuoteRecord) bool {
+	a.C = slices.Compact(slices.Sorted(slices.Values(a.C)))
+	b.C = slices.Compact(slices.Sorted(slices.Values(b.C)))
+	return sameQuote(a, b)
+}
+
+// mergeTicks une dos recorridos ordenados por clave en uno solo ordenado. La escritura
+// no repite claves entre layouts (ver `quoteKeys`), pero las bases de datos escritas
+// antes sí pueden tenerlas: una clave que está en los dos con el mismo tick (según
+// 'same') se devuelve una sola vez, y con ticks distintos es un `ErrDuplicateKey`.
+func mergeTicks[R any](a, b iter.Seq2[keyedTick[R], error], same func(a, b R) bool) iter.Seq2[keyedTick[R], error] {
+	return func(yield func(keyedTick[R], error) bool) {
+		nextA, stopA := iter.Pull2(a)
+		defer stopA()
+		nextB, stopB := iter.Pull2(b)
+		defer stopB()
+
+		ta, errA, okA := nextA()
+		tb, errB, okB := nextB()
+		for okA || okB {
+			if errA != nil {
+				yield(ta, errA)
+				return
+			}
+			if errB != nil {
+				yield(tb, errB)
+				return
+			}
+			if okA && okB && bytes.Equal(ta.key, tb.key) {
+				if !same(ta.rec, tb.rec) {
+					yield(ta, fmt.Errorf("%w: %s #%d guarda dos ticks distintos", ErrDuplicateKey, ta.time.Format(time.RFC3339Nano), KeySeq(ta.key)))
+					return
+				}
+				tb, errB, okB = nextB() // Repetida: se devuelve una vez
+				continue
+			}
+			if okA && (!okB || bytes.Compare(ta.key, tb.key) < 0) {
+				if !yield(ta, nil) {
+					return
+				}
+				ta, errA, okA = nextA()
+				continue
+			}
+			if !yield(tb, nil) {
+				return
+			}
+			tb, errB, okB = nextB()
+		}
+	}
+}
+
+// quoteSeq convierte los ticks reconstruidos en `Quote`.
+func quoteSeq(ticks iter.Seq2[keyedTick[QuoteRecord], error]) iter.Seq2[Quote, error] {
+	return func(yield func(Quote, error) bool) {
+		for kt, err := range ticks {
+			q := Quote{Time: kt.time, Seq: KeySeq(kt.key), QuoteRecord: kt.rec}
+			if err == nil {
+				q.T = kt.time.Format(time.RFC3339Nano)
+			}
+			if !yield(q, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// viewSeq recorre 'seq' dentro de una transacción de solo lectura de 'dbInstance'.
+func viewSeq[T any](dbInstance *db.DB, seq func(tx *db.Tx) iter.Seq2[T, error]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		stopped := false
+		err := dbInstance.View(func(tx *db.Tx) error {
+			for v, err := range seq(tx) {
+				if !yield(v, err) || err != nil {
+					stopped = true
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil && !stopped {
+			var zero T
+			yield(zero, err)
+		}
+	}
+}
+
+// collect junta un recorrido en un slice, parando en el primer error.
+func collect[T any](seq iter.Seq2[T, error]) ([]T, error) {
+	var out []T
+	for v, err := range seq {
+		if err != nil {
+			return out, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func failSeq[T any](err error) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		var zero T
+		yield(zero, err)
+	}
+}
+
+func emptySeq[T any]() iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {}
+}
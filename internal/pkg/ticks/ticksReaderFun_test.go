@@ -0,0 +1,243 @@
+package ticks
+
+import (
+	"errors"
+	"iter"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+// openTestDB abre una base de datos temporal que se cierra al terminar el test.
+func openTestDB(t *testing.T) *db.DB {
+	t.Helper()
+	dbInstance, err := OpenDB(filepath.Join(t.TempDir(), "ticks.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbInstance.Close() })
+	return dbInstance
+}
+
+// putQuotes guarda 'quotes' de SPY con 'layout' y comprueba que se escribieron todas.
+func putQuotes(t *testing.T, dbInstance *db.DB, quotes []QuoteRecord, layout string) {
+	t.Helper()
+	err := dbInstance.Update(func(tx *db.Tx) error {
+		res, err := PutQuotesTx(tx, "SPY", quotes, layout)
+		if err == nil && res.Written != len(quotes) {
+			t.Errorf("%s: %+v, se esperaban %d escritas", layout, res, len(quotes))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestColumnTicksMissingColumns comprueba que una columna que falta se detecta aunque
+// sea la primera, que es la que marca las claves.
+func TestColumnTicksMissingColumns(t *testing.T) {
+	quotes := []QuoteRecord{
+		{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, T: chunkBase.Format(time.RFC3339Nano), Z: "C"},
+		{AP: 110.88, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, T: chunkBase.Add(time.Second).Format(time.RFC3339Nano), Z: "C"},
+	}
+	for _, tc := range []struct {
+		name    string
+		deleted []string
+		fields  []string
+		wantErr error
+		want    int
+	}{
+		{name: "completas", want: 2},
+		{name: "falta la primera", deleted: []string{"AP"}, wantErr: ErrIncompleteTick},
+		{name: "falta otra", deleted: []string{"BP"}, wantErr: ErrIncompleteTick},
+		{name: "falta la primera pedida", deleted: []string{"BP"}, fields: []string{"BP", "AP"}, wantErr: ErrIncompleteTick},
+		{name: "falta una no pedida", deleted: []string{"BP"}, fields: []string{"AP", "AS"}, want: 2},
+		{name: "faltan todas", deleted: QuoteFields, want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dbInstance := openTestDB(t)
+			putQuotes(t, dbInstance, quotes, LayoutColumns)
+			err := dbInstance.Update(func(tx *db.Tx) error {
+				symbol := tx.Bucket([]byte("SPY"))
+				for _, field := range tc.deleted {
+					if err := symbol.DeleteBucket([]byte(field)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := ReadQuotes(dbInstance, QueryOptions{SYMBOL: "SPY", FIELDS: tc.fields})
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("se esperaba %v, error %v (%d quotes)", tc.wantErr, err, len(read))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(read) != tc.want {
+				t.Fatalf("se leyeron %d quotes, se esperaban %d", len(read), tc.want)
+			}
+		})
+	}
+}
+
+// keyedSeq recorre ticks del mismo nanosegundo cuyo registro es un texto que empieza
+// por su secuencia (ej. "1" y "1b" comparten clave y son ticks distintos); 'err' se
+// devuelve al final si no es nil.
+func keyedSeq(err error, recs ...string) iter.Seq2[keyedTick[string], error] {
+	return func(yield func(keyedTick[string], error) bool) {
+		for _, rec := range recs {
+			seq := uint16(rec[0] - '0')
+			if !yield(keyedTick[string]{key: Key(chunkBase.UnixNano(), seq), time: chunkBase, rec: rec}, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(keyedTick[string]{}, err)
+		}
+	}
+}
+
+func TestMergeTicks(t *testing.T) {
+	errBroken := errors.New("roto")
+	for _, tc := range []struct {
+		name    string
+		a, b    iter.Seq2[keyedTick[string], error]
+		want    []string
+		wantErr error
+	}{
+		{name: "vacíos", a: keyedSeq(nil), b: keyedSeq(nil)},
+		{name: "solo 'a'", a: keyedSeq(nil, "0", "1"), b: keyedSeq(nil), want: []string{"0", "1"}},
+		{name: "solo 'b'", a: keyedSeq(nil), b: keyedSeq(nil, "0", "1"), want: []string{"0", "1"}},
+		{name: "intercalados", a: keyedSeq(nil, "0", "2", "4"), b: keyedSeq(nil, "1", "3"), want: []string{"0", "1", "2", "3", "4"}},
+		{name: "repetidos", a: keyedSeq(nil, "0", "1", "3"), b: keyedSeq(nil, "1", "2", "3"), want: []string{"0", "1", "2", "3"}},
+		{name: "iguales", a: keyedSeq(nil, "0", "1"), b: keyedSeq(nil, "0", "1"), want: []string{"0", "1"}},
+		{name: "clave repetida con otro tick", a: keyedSeq(nil, "0", "1a"), b: keyedSeq(nil, "1b", "2"), want: []string{"0"}, wantErr: ErrDuplicateKey},
+		{name: "error en 'a'", a: keyedSeq(errBroken, "0"), b: keyedSeq(nil, "1"), want: []string{"0"}, wantErr: errBroken},
+		{name: "error en 'b'", a: keyedSeq(nil, "0", "2"), b: keyedSeq(errBroken, "1"), want: []string{"0", "1"}, wantErr: errBroken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			var err error
+			for kt, e := range mergeTicks(tc.a, tc.b, func(a, b string) bool { return a == b }) {
+				if e != nil {
+					err = e
+					break
+				}
+				got = append(got, kt.rec)
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("error %v, se esperaba %v", err, tc.wantErr)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("%v, se esperaba %v", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestQuotesLayoutChange guarda un lote con un layout y lo repite con otro junto con
+// quotes distintas del mismo nanosegundo: las repetidas se reconocen como ya guardadas
+// y las distintas reciben la siguiente secuencia, así que se leen todas una sola vez.
+func TestQuotesLayoutChange(t *testing.T) {
+	quotes := syntheticQuotes(20)
+	var changed []QuoteRecord
+	for _, q := range quotes {
+		q.AP += 0.01
+		changed = append(changed, q)
+	}
+	for _, from := range QuoteLayouts {
+		for _, to := range QuoteLayouts {
+			if from == to {
+				continue
+			}
+			t.Run(from+"-"+to, func(t *testing.T) {
+				dbInstance := openTestDB(t)
+				putQuotes(t, dbInstance, quotes, from)
+				err := dbInstance.Update(func(tx *db.Tx) error {
+					res, err := PutQuotesTx(tx, "SPY", append(slices.Clone(quotes), changed...), to)
+					if err == nil && (res.Written != len(changed) || res.Existing != len(quotes)) {
+						t.Errorf("%+v, se esperaban %d escritas y %d existentes", res, len(changed), len(quotes))
+					}
+					return err
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				read, err := ReadQuotes(dbInstance, QueryOptions{SYMBOL: "SPY"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(read) != 2*len(quotes) {
+					t.Fatalf("se leyeron %d quotes, se esperaban %d", len(read), 2*len(quotes))
+				}
+				for i, q := range read {
+					want := [...][]QuoteRecord{quotes, changed}[i%2][i/2]
+					if q.T != want.T || q.Seq != uint16(i%2) || q.AP != want.AP {
+						t.Errorf("quote %d: %+v, se esperaba %+v #%d", i, q, want, i%2)
+					}
+				}
+				store, err := NewBoltStore(dbInstance, to)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stats, err := store.Stats(); err != nil || stats.Quotes != len(read) {
+					t.Fatalf("Stats: %+v, %v; se esperaban %d quotes", stats, err, len(read))
+				}
+			})
+		}
+	}
+}
+
+// TestQuotesDuplicateKey lee una clave guardada en las columnas y en las filas, como
+// en las bases de datos escritas antes de asignar las claves entre layouts.
+func TestQuotesDuplicateKey(t *testing.T) {
+	stored := QuoteRecord{AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R", "I"}, T: chunkBase.Format(time.RFC3339Nano), Z: "C"}
+	other := stored
+	other.AP = 110.88
+	for _, tc := range []struct {
+		name    string
+		row     QuoteRecord
+		wantErr error
+	}{
+		{name: "mismo tick", row: stored},
+		{name: "otro tick", row: other, wantErr: ErrDuplicateKey},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dbInstance := openTestDB(t)
+			putQuotes(t, dbInstance, []QuoteRecord{stored}, LayoutColumns)
+			err := dbInstance.Update(func(tx *db.Tx) error {
+				row, err := EncodeQuoteRow(tc.row)
+				if err != nil {
+					return err
+				}
+				rows, err := tx.Bucket([]byte("SPY")).CreateBucket([]byte(QuoteRowsBucket))
+				if err != nil {
+					return err
+				}
+				return rows.Put(Key(chunkBase.UnixNano(), 0), row)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			read, err := ReadQuotes(dbInstance, QueryOptions{SYMBOL: "SPY"})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("error %v, se esperaba %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && len(read) != 1 {
+				t.Fatalf("se leyeron %d quotes, se esperaba 1", len(read))
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Package ticks define el formato con el que dataDownloader guarda quotes, trades y
+// barras en bbolt (registros, claves, buckets y codificación de valores), la API para
+// leerlos por rango de tiempo y `TickStore`, la interfaz de almacén con la que se
+// consumen los ticks sin depender de bbolt. Lo comparten el descargador y quien
+// consume los datos guardados.
+package ticks
+
+// QuoteRecord es una quote (NBBO) ya normalizada, independiente del proveedor que la
+// entregó. Es lo que se guarda y lo que devuelve la lectura (ver `Quote`).
+// Las etiquetas JSON son las claves cortas de docs/rawData.json, que también se usan
+// para leer archivos planos.
+type QuoteRecord struct {
+	AP float64  `json:"ap"` // Ask Price (Precio de Venta).
+	AS int      `json:"as"` // Ask Size (Tamaño de Venta).
+	AX string   `json:"ax"` // Ask Exchange (Bolsa de Venta), ver `ExchangeName`.
+	BP float64  `json:"bp"` // Bid Price (Precio de Compra).
+	BS int      `json:"bs"` // Bid Size (Tamaño de Compra).
+	BX string   `json:"bx"` // Bid Exchange (Bolsa de Compra), ver `ExchangeName`.
+	C  []string `json:"c"`  // Conditions (Condiciones de la quote), ver `QuoteCondition`.
+	T  string   `json:"t"`  // Timestamp RFC3339 con nanosegundos (Marca de Tiempo).
+	Z  string   `json:"z"`  // Tape (Cinta).
+}
+
+// TradeRecord es una operación ejecutada ya normalizada, independiente del proveedor.
+type TradeRecord struct {
+	P float64  `json:"p"` // Price (Precio de la operación).
+	S int      `json:"s"` // Size (Tamaño de la operación).
+	X string   `json:"x"` // Exchange (Bolsa donde se ejecutó).
+	I int64    `json:"i"` // Trade ID (Identificador de la operación).
+	C []string `json:"c"` // Conditions (Condiciones de la operación), ver `TradeCondition`.
+	T string   `json:"t"` // Timestamp RFC3339 con nanosegundos (Marca de Tiempo).
+	Z string   `json:"z"` // Tape (Cinta).
+}
+
+// BarRecord es una barra OHLCV ya normalizada, independiente del proveedor.
+type BarRecord struct {
+	O  float64 `json:"o"`  // Open (Precio de apertura).
+	H  float64 `json:"h"`  // High (Precio máximo).
+	L  float64 `json:"l"`  // Low (Precio mínimo).
+	C  float64 `json:"c"`  // Close (Precio de cierre).
+	V  int64   `json:"v"`  // Volume (Volumen).
+	N  int64   `json:"n"`  // Trade count (Número de operaciones).
+	VW float64 `json:"vw"` // VWAP (Precio medio ponderado por volumen).
+	T  string  `json:"t"`  // Timestamp de inicio de la barra, RFC3339.
+}
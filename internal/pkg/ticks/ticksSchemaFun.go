@@ -0,0 +1,211 @@
+package ticks
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE VERSIÓN DEL ESQUEMA
+// ===============================
+
+//
+//
+//
+*/
+
+// SchemaVersion es la versión del formato de los ticks que escribe este paquete. Cada
+// cambio que deje sin leer o sin escribir bien los archivos anteriores (claves,
+// codificación de un campo, buckets) sube la versión y añade su paso a `Migrations`.
+//
+//	1  claves de 8 bytes, solo el timestamp (antes de existir la versión)
+//	2  claves de 10 bytes con secuencia (ver `Key`)
+//	3  condiciones de quote como lista, en la columna C en texto compacto
+//	   (ver `EncodeConditions`) en lugar de una cadena JSON
+//	4  metadatos de cada símbolo en `SymbolsBucket` (ver `SymbolMeta`)
+const SchemaVersion = 4
+
+// unversionedSchema es la versión más alta que puede tener un archivo sin versión
+// guardada: la del formato de cuando se empezó a guardar.
+const unversionedSchema = 2
+
+// MetaBucket es el bucket raíz con los metadatos del archivo. Como todo bucket raíz
+// que empieza con '_', no es un símbolo.
+const MetaBucket = "_meta"
+
+// Claves de `MetaBucket`.
+const (
+	metaSchemaVersion = "schema_version" // Versión en decimal (ej. "2")
+	metaUpdatedAt     = "updated_at"     // Última vez que se fijó la versión, RFC3339
+)
+
+// Errores de versión del esquema. Se comprueban con errors.Is.
+var (
+	// ErrSchemaOutdated indica un archivo de una versión anterior: hay que migrarlo
+	// (ver `MigrateFile`) antes de escribir en él.
+	ErrSchemaOutdated = errors.New("el esquema de la base de datos es anterior al actual")
+	// ErrSchemaTooNew indica un archivo escrito por una versión posterior del paquete.
+	ErrSchemaTooNew = errors.New("el esquema de la base de datos es posterior al actual")
+)
+
+// SchemaVersionTx devuelve la versión del esquema del archivo de 'tx'. Si el archivo
+// no la tiene guardada ('stored' es false), la deduce de su contenido: 1 si queda
+// alguna clave sin secuencia, `SchemaVersion` si no tiene ticks y si no la del formato
+// de cuando se empezó a guardar. Deducirla recorre las claves de todos los símbolos.
+func SchemaVersionTx(tx *db.Tx) (version int, stored bool, err error) {
+	if meta := tx.Bucket([]byte(MetaBucket)); meta != nil {
+		if raw := meta.Get([]byte(metaSchemaVersion)); raw != nil {
+			version, err := strconv.Atoi(string(raw))
+			if err != nil || version < 1 {
+				return 0, true, fmt.Errorf("versión de esquema inválida %q en %s", raw, MetaBucket)
+			}
+			return version, true, nil
+		}
+	}
+	legacy, err := hasLegacyKeys(tx)
+	if err != nil {
+		return 0, false, err
+	}
+	if legacy {
+		return 1, false, nil
+	}
+	if !hasTicks(tx) {
+		return SchemaVersion, false, nil
+	}
+	return unversionedSchema, false, nil
+}
+
+// hasTicks indica si algún símbolo de 'tx' tiene quotes o trades, en cualquier layout.
+func hasTicks(tx *db.Tx) bool {
+	found := errors.New("found")
+	err := tx.ForEach(func(name []byte, symbol *db.Bucket) error {
+		if strings.HasPrefix(string(name), "_") {
+			return nil
+		}
+		indexes := []*db.Bucket{
+			symbol.Bucket([]byte(QuoteFields[0])),
+			symbol.Bucket([]byte(QuoteRowsBucket)),
+			symbol.Bucket([]byte(QuoteChunksBucket)),
+		}
+		if trades := symbol.Bucket([]byte(TradesBucket)); trades != nil {
+			indexes = append(indexes, trades.Bucket([]byte(TradeFields[0])))
+		}
+		for _, index := range indexes {
+			if index != nil {
+				if k, _ := index.Cursor().First(); k != nil {
+					return found
+				}
+			}
+		}
+		return nil
+	})
+	return err == found
+}
+
+// setSchemaVersionTx guarda 'version' en `MetaBucket`.
+func setSchemaVersionTx(tx *db.Tx, version int) error {
+	meta, err := tx.CreateBucketIfNotExists([]byte(MetaBucket))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s': %w", MetaBucket, err)
+	}
+	if err := meta.Put([]byte(metaSchemaVersion), []byte(strconv.Itoa(version))); err != nil {
+		return err
+	}
+	return meta.Put([]byte(metaUpdatedAt), []byte(time.Now().UTC().Format(time.RFC3339)))
+}
+
+// EnsureSchema comprueba que 'dbInstance' tenga el esquema que entiende este paquete.
+//
+//   - Lectura/escritura: un archivo sin versión guardada que ya está en
+//     `SchemaVersion` (incluido uno vacío) queda marcado con ella. Uno anterior
+//     devuelve `ErrSchemaOutdated`: escribir el formato nuevo encima lo mezclaría con
+//     el anterior.
+//   - Solo lectura: los archivos anteriores se pueden leer (ver `Quotes`), así que solo
+//     falla con uno posterior.
+//
+// En ambos modos un archivo posterior devuelve `ErrSchemaTooNew`.
+func EnsureSchema(dbInstance *db.DB) error {
+	check := func(tx *db.Tx) error {
+		version, stored, err := SchemaVersionTx(tx)
+		switch {
+		case err != nil:
+			return err
+		case version > SchemaVersion:
+			return fmt.Errorf("%w: '%s' es v%d y este programa escribe v%d", ErrSchemaTooNew, dbInstance.Path(), version, SchemaVersion)
+		case dbInstance.IsReadOnly():
+			return nil
+		case version < SchemaVersion:
+			return fmt.Errorf("%w: '%s' es v%d y este programa escribe v%d; hay que migrarla", ErrSchemaOutdated, dbInstance.Path(), version, SchemaVersion)
+		case !stored:
+			return setSchemaVersionTx(tx, version)
+		}
+		return nil
+	}
+	if dbInstance.IsReadOnly() {
+		return dbInstance.View(check)
+	}
+	return dbInstance.Update(check)
+}
+
+// tickIndex es un grupo de buckets que comparten claves: las columnas de un tipo de
+// tick, o las filas. El primero sirve de índice.
+type tickIndex struct {
+	path    []string   // Del bucket padre, desde la raíz (ej. {"QQQ", "TRADES"})
+	parent  *db.Bucket // El bucket padre en la transacción en curso
+	columns []string
+}
+
+// tickIndexes llama a 'fn' con cada grupo de buckets con claves de tick de todos los
+// símbolos de 'tx'. Las barras y los chunks no entran: las barras siempre usaron
+// claves de 8 bytes y los chunks nunca.
+func tickIndexes(tx *db.Tx, fn func(index tickIndex) error) error {
+	return tx.ForEach(func(name []byte, symbol *db.Bucket) error {
+		if strings.HasPrefix(string(name), "_") {
+			return nil
+		}
+		indexes := []tickIndex{
+			{[]string{string(name)}, symbol, QuoteFields},
+			{[]string{string(name)}, symbol, []string{QuoteRowsBucket}},
+		}
+		if trades := symbol.Bucket([]byte(TradesBucket)); trades != nil {
+			indexes = append(indexes, tickIndex{[]string{string(name), TradesBucket}, trades, TradeFields})
+		}
+		for _, index := range indexes {
+			if index.parent.Bucket([]byte(index.columns[0])) == nil {
+				continue
+			}
+			if err := fn(index); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// hasLegacyKeys indica si a algún índice de tick de 'tx' le queda una clave de
+// `LegacyKeySize` bytes.
+func hasLegacyKeys(tx *db.Tx) (bool, error) {
+	found := errors.New("found")
+	err := tickIndexes(tx, func(index tickIndex) error {
+		c := index.parent.Bucket([]byte(index.columns[0])).Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) == LegacyKeySize {
+				return found
+			}
+		}
+		return nil
+	})
+	if err == found {
+		return true, nil
+	}
+	return false, err
+}
@@ -0,0 +1,125 @@
+package ticks
+
+import (
+	"errors"
+	"iter"
+	"time"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE ALMACENES DE TICKS
+// ===============================
+
+//
+//
+//
+*/
+
+// TickStore es un almacén de quotes y trades por símbolo, independiente de cómo se
+// guardan. Implementaciones:
+//   - `BoltStore`: el layout de bbolt del descargador (ver `PutQuotesTx`).
+//   - `PartitionedStore`: el layout de `BoltStore` en un archivo por símbolo y periodo.
+//   - `MemoryStore`: en memoria, para tests y backtests.
+//
+// Todas siguen las mismas reglas: los ticks de un símbolo se ordenan por timestamp y
+// secuencia (ver `Key`), los ticks que comparten nanosegundo reciben secuencias
+// consecutivas y volver a escribir un tick idéntico ya guardado no lo duplica (ver
+// `KeyAllocator`).
+//
+// Las implementaciones son seguras para uso concurrente.
+type TickStore interface {
+	// WriteBatch guarda los ticks de 'batch'. Es atómico por almacén subyacente: lo
+	// que va a un mismo archivo (o a la memoria) se guarda entero o no se guarda. En
+	// `BoltStore` y `MemoryStore` es todo el lote; en `PartitionedStore`, cada
+	// partición por separado, así que un error puede dejar guardada una parte. Repetir
+	// el lote es seguro: los ticks ya guardados no se duplican.
+	WriteBatch(batch Batch) (WriteResult, error)
+	// Quotes recorre las quotes de 'opts' en orden (ver `Quotes`).
+	Quotes(opts QueryOptions) iter.Seq2[Quote, error]
+	// Trades recorre los trades de 'opts' en orden (ver `Trades`).
+	Trades(opts QueryOptions) iter.Seq2[Trade, error]
+	// LastTimestamp devuelve el timestamp del último tick de tipo 'kind' de 'symbol';
+	// cero si no hay ninguno.
+	LastTimestamp(symbol string, kind Kind) (time.Time, error)
+	// Stats devuelve el número de ticks guardados por símbolo.
+	Stats() (StoreStats, error)
+	// Close libera el almacén. Después cualquier operación devuelve `ErrStoreClosed`.
+	Close() error
+}
+
+// Kind es un tipo de tick.
+type Kind string
+
+const (
+	KindQuotes Kind = "quotes"
+	KindTrades Kind = "trades"
+)
+
+// ErrStoreClosed indica una operación sobre un `TickStore` ya cerrado.
+var ErrStoreClosed = errors.New("almacén de ticks cerrado")
+
+// Batch es un lote de ticks de un símbolo para `TickStore.WriteBatch`.
+type Batch struct {
+	Symbol string
+	Quotes []QuoteRecord
+	Trades []TradeRecord
+}
+
+// WriteResult resume lo que hizo `TickStore.WriteBatch` con un lote.
+type WriteResult struct {
+	Written  int       // Ticks nuevos guardados
+	Existing int       // Ticks que ya estaban guardados (ej. una página repetida)
+	Skipped  int       // Ticks descartados por tener un timestamp que no es RFC3339
+	First    time.Time // Timestamp más antiguo del lote; cero si no había ticks válidos
+	Last     time.Time // Timestamp más reciente del lote; cero si no había ticks válidos
+}
+
+// Add acumula 'other' en 'r', por ejemplo los resultados de las quotes y los trades de un
+// lote.
+func (r *WriteResult) Add(other WriteResult) {
+	r.Written += other.Written
+	r.Existing += other.Existing
+	r.Skipped += other.Skipped
+	if !other.First.IsZero() && (r.First.IsZero() || other.First.Before(r.First)) {
+		r.First = other.First
+	}
+	if other.Last.After(r.Last) {
+		r.Last = other.Last
+	}
+}
+
+// StoreStats es el contenido de un `TickStore`.
+type StoreStats struct {
+	Quotes  int                    // Quotes en total
+	Trades  int                    // Trades en total
+	Symbols map[string]SymbolStats // Por símbolo; solo los que tienen ticks
+}
+
+// SymbolStats es el contenido de un símbolo en un `TickStore`.
+type SymbolStats struct {
+	Quotes int
+	Trades int
+}
+
+// addSymbol añade a 's' los ticks de 'symbol' (si tiene alguno).
+func (s *StoreStats) addSymbol(symbol string, stats SymbolStats) {
+	if stats.Quotes == 0 && stats.Trades == 0 {
+		return
+	}
+	if s.Symbols == nil {
+		s.Symbols = make(map[string]SymbolStats)
+	}
+	s.Symbols[symbol] = stats
+	s.Quotes += stats.Quotes
+	s.Trades += stats.Trades
+}
+
+// parseTickTime interpreta el timestamp RFC3339 de un tick.
+func parseTickTime(ts string) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	return t, err == nil
+}
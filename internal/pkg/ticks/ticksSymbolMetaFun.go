@@ -0,0 +1,228 @@
+package ticks
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE METADATOS POR SÍMBOLO
+// ===============================
+
+//
+//
+//
+*/
+
+// Saber qué hay en un archivo (rango de fechas y número de ticks de cada símbolo)
+// obligaría a recorrer todos sus sub-buckets. En su lugar, cada escritura actualiza en
+// la misma transacción un resumen por símbolo y tipo de dato en `SymbolsBucket`:
+// `PutEncodedQuotesTx` y `PutEncodedTradesTx` (y con ellas `PutQuotesTx`,
+// `PutTradesTx` y los `TickStore` de bbolt) lo hacen solas; otros datos del símbolo,
+// como las barras del descargador, lo actualizan con `UpdateSymbolMetaTx`.
+
+// SymbolsBucket es el bucket raíz con los metadatos de cada símbolo: un sub-bucket por
+// símbolo con una clave por tipo de dato (ej. "quotes") y `SymbolMeta` en JSON como
+// valor. Como todo bucket raíz que empieza con '_', no es un símbolo.
+const SymbolsBucket = "_symbols"
+
+// SymbolMeta resume los datos de un tipo de un símbolo.
+type SymbolMeta struct {
+	Symbol string `json:"-"`
+	// Kind es el tipo de dato: `KindQuotes`, `KindTrades` u otro que elija quien lo
+	// escribe (ej. el sub-bucket de unas barras).
+	Kind  Kind      `json:"-"`
+	First time.Time `json:"first"` // Timestamp más antiguo guardado
+	Last  time.Time `json:"last"`  // Timestamp más reciente guardado
+	Count int       `json:"count"` // Registros guardados
+	// Feed y Source son el feed ("sip", "iex", ...) y el proveedor de la última
+	// descarga que los indicó; vacíos si ninguna lo hizo.
+	Feed   string `json:"feed,omitempty"`
+	Source string `json:"source,omitempty"`
+	// UpdatedAt es la última escritura que pasó por el símbolo, aunque no añadiera
+	// nada nuevo (ej. una descarga sin datos nuevos que avanza su checkpoint).
+	UpdatedAt time.Time `json:"updated_at"`
+	// SchemaVersion es la versión del esquema con la que se hizo esa escritura.
+	SchemaVersion int `json:"schema_version"`
+}
+
+// SymbolMetaUpdate es lo que una escritura suma a un `SymbolMeta`.
+type SymbolMetaUpdate struct {
+	First, Last time.Time // Rango de los registros escritos, nuevos o no; cero si no hubo
+	Written     int       // Registros nuevos
+	Feed        string    // Si no está vacío, reemplaza al guardado
+	Source      string    // Si no está vacío, reemplaza al guardado
+}
+
+// UpdateSymbolMetaTx suma 'update' a los metadatos de 'kind' de 'symbol' dentro de la
+// transacción de escritura 'tx', creándolos si no existen, y fija UpdatedAt y
+// SchemaVersion.
+func UpdateSymbolMetaTx(tx *db.Tx, symbol string, kind Kind, update SymbolMetaUpdate) error {
+	root, err := tx.CreateBucketIfNotExists([]byte(SymbolsBucket))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s': %w", SymbolsBucket, err)
+	}
+	bucket, err := root.CreateBucketIfNotExists([]byte(symbol))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s/%s': %w", SymbolsBucket, symbol, err)
+	}
+	var meta SymbolMeta
+	if raw := bucket.Get([]byte(kind)); raw != nil {
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return fmt.Errorf("metadatos %s de %s: %w", kind, symbol, err)
+		}
+	}
+	meta.merge(SymbolMeta{First: update.First, Last: update.Last, Count: update.Written, Feed: update.Feed, Source: update.Source})
+	meta.UpdatedAt = time.Now().UTC()
+	meta.SchemaVersion = SchemaVersion
+	return putSymbolMeta(bucket, kind, meta)
+}
+
+// putSymbolMeta guarda 'meta' en la clave 'kind' de 'bucket'.
+func putSymbolMeta(bucket *db.Bucket, kind Kind, meta SymbolMeta) error {
+	meta.First, meta.Last = meta.First.UTC(), meta.Last.UTC()
+	value, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(kind), value)
+}
+
+// merge suma 'other' a 'm': amplía el rango, acumula Count y toma Feed, Source,
+// UpdatedAt y SchemaVersion de 'other' si los tiene.
+func (m *SymbolMeta) merge(other SymbolMeta) {
+	if !other.First.IsZero() && (m.First.IsZero() || other.First.Before(m.First)) {
+		m.First = other.First
+	}
+	if other.Last.After(m.Last) {
+		m.Last = other.Last
+	}
+	m.Count += other.Count
+	if other.Feed != "" {
+		m.Feed = other.Feed
+	}
+	if other.Source != "" {
+		m.Source = other.Source
+	}
+	if other.UpdatedAt.After(m.UpdatedAt) {
+		m.UpdatedAt = other.UpdatedAt
+		m.SchemaVersion = other.SchemaVersion
+	}
+}
+
+// updateTickMetaTx actualiza los metadatos de 'kind' de 'symbol' con el resultado de
+// una escritura de ticks.
+func updateTickMetaTx(tx *db.Tx, symbol string, kind Kind, res WriteResult) error {
+	if res.First.IsZero() && res.Written == 0 {
+		return nil // Ningún tick válido: nada que resumir
+	}
+	return UpdateSymbolMetaTx(tx, symbol, kind, SymbolMetaUpdate{First: res.First, Last: res.Last, Written: res.Written})
+}
+
+// SymbolMetaTx devuelve los metadatos de todos los símbolos de 'tx', ordenados por
+// símbolo y tipo.
+func SymbolMetaTx(tx *db.Tx) ([]SymbolMeta, error) {
+	root := tx.Bucket([]byte(SymbolsBucket))
+	if root == nil {
+		return nil, nil
+	}
+	var metas []SymbolMeta
+	err := root.ForEachBucket(func(symbol []byte) error {
+		return root.Bucket(symbol).ForEach(func(kind, value []byte) error {
+			meta := SymbolMeta{Symbol: string(symbol), Kind: Kind(kind)}
+			if err := json.Unmarshal(value, &meta); err != nil {
+				return fmt.Errorf("metadatos %s de %s: %w", kind, symbol, err)
+			}
+			metas = append(metas, meta)
+			return nil
+		})
+	})
+	return metas, err
+}
+
+// ReadSymbolMeta es `SymbolMetaTx` en una transacción de lectura de 'dbInstance'.
+func ReadSymbolMeta(dbInstance *db.DB) ([]SymbolMeta, error) {
+	var metas []SymbolMeta
+	err := dbInstance.View(func(tx *db.Tx) error {
+		var err error
+		metas, err = SymbolMetaTx(tx)
+		return err
+	})
+	return metas, err
+}
+
+// MergeSymbolMeta junta los metadatos de varios archivos (ej. las particiones de un
+// símbolo, o las barras de la base de datos principal y los ticks de las particiones)
+// en uno por símbolo y tipo, ordenados (ver `SymbolMeta.merge`).
+func MergeSymbolMeta(lists ...[]SymbolMeta) []SymbolMeta {
+	type id struct {
+		symbol string
+		kind   Kind
+	}
+	merged := make(map[id]*SymbolMeta)
+	for _, list := range lists {
+		for _, meta := range list {
+			k := id{meta.Symbol, meta.Kind}
+			if m := merged[k]; m != nil {
+				m.merge(meta)
+			} else {
+				merged[k] = &meta
+			}
+		}
+	}
+	out := make([]SymbolMeta, 0, len(merged))
+	for _, m := range merged {
+		out = append(out, *m)
+	}
+	slices.SortFunc(out, func(a, b SymbolMeta) int {
+		if c := strings.Compare(a.Symbol, b.Symbol); c != 0 {
+			return c
+		}
+		return strings.Compare(string(a.Kind), string(b.Kind))
+	})
+	return out
+}
+
+// SymbolMeta devuelve los metadatos de los símbolos del almacén (ver `SymbolMetaTx`).
+func (s *BoltStore) SymbolMeta() ([]SymbolMeta, error) {
+	if s.closed.Load() {
+		return nil, ErrStoreClosed
+	}
+	return ReadSymbolMeta(s.db)
+}
+
+// SymbolMeta junta los metadatos de todas las particiones (ver `MergeSymbolMeta`).
+// Abre cada archivo, pero no recorre sus ticks.
+func (s *PartitionedStore) SymbolMeta() ([]SymbolMeta, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, err
+	}
+	symbols, err := s.Symbols()
+	if err != nil {
+		return nil, err
+	}
+	var lists [][]SymbolMeta
+	for _, symbol := range symbols {
+		files, err := s.Partitions(symbol, time.Time{}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			metas, err := withPartition(s, file.Path, (*BoltStore).SymbolMeta)
+			if err != nil {
+				return nil, err
+			}
+			lists = append(lists, metas)
+		}
+	}
+	return MergeSymbolMeta(lists...), nil
+}
@@ -0,0 +1,247 @@
+package ticks
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+/*
+//
+//
+//
+
+BLOQUE DE VALIDACIÓN Y CUARENTENA
+// ===============================
+
+//
+//
+//
+*/
+
+// Reglas de validación de quotes y trades (ver `Validator`). `RuleTimestamp` se
+// comprueba siempre; el resto son configurables (ver `ValidationRules`).
+const (
+	RuleTimestamp = "timestamp" // El timestamp no es RFC3339
+	RulePrice     = "price"     // Precio negativo, NaN o infinito; en un trade, además, cero
+	RuleSize      = "size"      // Tamaño negativo, o cero en un lado de la quote con precio (o en un trade)
+	RuleCrossed   = "crossed"   // Quote con el bid por encima del ask (libro cruzado)
+	RuleTape      = "tape"      // Tape (Z) que no es A, B ni C (ver `ConditionPlan`)
+)
+
+// ValidationRules son las reglas configurables, en el orden en que se comprueban
+// después de `RuleTimestamp`.
+var ValidationRules = []string{RulePrice, RuleSize, RuleCrossed, RuleTape}
+
+// QuarantineBucket es el bucket raíz con los registros rechazados por la validación,
+// con un sub-bucket por símbolo (ver `PutQuarantineTx`). Como todo bucket raíz que
+// empieza con '_', no es un símbolo.
+const QuarantineBucket = "_quarantine"
+
+// Rejection es el motivo por el que un registro no pasa la validación.
+type Rejection struct {
+	Rule   string // Regla que no cumple (una de las constantes Rule*)
+	Reason string // Descripción legible, con los valores del registro
+}
+
+// Quarantined es un registro rechazado tal como se guarda en `QuarantineBucket`.
+type Quarantined struct {
+	Kind   Kind            `json:"kind"`   // Quotes o trades
+	Rule   string          `json:"rule"`   // Primera regla que no cumple
+	Reason string          `json:"reason"` // Ver `Rejection`
+	Record json.RawMessage `json:"record"` // El `QuoteRecord` o `TradeRecord` recibido
+	At     time.Time       `json:"at"`     // Cuándo se puso en cuarentena
+	// Time es el timestamp del registro, si se puede interpretar; sirve para avanzar
+	// el checkpoint aunque se rechacen todos los registros de una página.
+	Time time.Time `json:"-"`
+}
+
+// Validator comprueba quotes y trades antes de guardarlos. El valor cero solo
+// comprueba `RuleTimestamp`. Es seguro para uso concurrente.
+type Validator struct {
+	rules map[string]bool
+}
+
+// NewValidator crea un validador con las reglas 'rules' (de `ValidationRules`), además
+// de `RuleTimestamp`. Devuelve error si alguna regla no existe.
+func NewValidator(rules []string) (*Validator, error) {
+	v := &Validator{rules: make(map[string]bool, len(rules))}
+	for _, rule := range rules {
+		if rule != RuleTimestamp && !slices.Contains(ValidationRules, rule) {
+			return nil, fmt.Errorf("regla de validación desconocida %q (válidas: %s)", rule, strings.Join(ValidationRules, ", "))
+		}
+		v.rules[rule] = true
+	}
+	return v, nil
+}
+
+// CheckQuote devuelve el motivo por el que 'q' no pasa la validación, o nil si es
+// válida. Las reglas se comprueban en orden y solo se informa de la primera que falla.
+func (v *Validator) CheckQuote(q QuoteRecord) *Rejection {
+	if _, ok := parseTickTime(q.T); !ok {
+		return &Rejection{RuleTimestamp, fmt.Sprintf("timestamp %q inválido", q.T)}
+	}
+	if v.rules[RulePrice] {
+		if badPrice(q.AP) || badPrice(q.BP) {
+			return &Rejection{RulePrice, fmt.Sprintf("precio inválido (bid %v, ask %v)", q.BP, q.AP)}
+		}
+	}
+	if v.rules[RuleSize] {
+		switch {
+		case q.AS < 0 || q.BS < 0:
+			return &Rejection{RuleSize, fmt.Sprintf("tamaño negativo (bid %d, ask %d)", q.BS, q.AS)}
+		case q.AP > 0 && q.AS == 0:
+			return &Rejection{RuleSize, fmt.Sprintf("ask %v sin tamaño", q.AP)}
+		case q.BP > 0 && q.BS == 0:
+			return &Rejection{RuleSize, fmt.Sprintf("bid %v sin tamaño", q.BP)}
+		}
+	}
+	if v.rules[RuleCrossed] && q.AP > 0 && q.BP > q.AP {
+		return &Rejection{RuleCrossed, fmt.Sprintf("libro cruzado: bid %v > ask %v", q.BP, q.AP)}
+	}
+	if v.rules[RuleTape] && ConditionPlan(q.Z) == "" {
+		return &Rejection{RuleTape, fmt.Sprintf("tape %q desconocida", q.Z)}
+	}
+	return nil
+}
+
+// CheckTrade es `CheckQuote` para un trade. `RuleCrossed` no se aplica.
+func (v *Validator) CheckTrade(t TradeRecord) *Rejection {
+	if _, ok := parseTickTime(t.T); !ok {
+		return &Rejection{RuleTimestamp, fmt.Sprintf("timestamp %q inválido", t.T)}
+	}
+	if v.rules[RulePrice] && (badPrice(t.P) || t.P == 0) {
+		return &Rejection{RulePrice, fmt.Sprintf("precio %v inválido", t.P)}
+	}
+	if v.rules[RuleSize] && t.S <= 0 {
+		return &Rejection{RuleSize, fmt.Sprintf("tamaño %d inválido", t.S)}
+	}
+	if v.rules[RuleTape] && ConditionPlan(t.Z) == "" {
+		return &Rejection{RuleTape, fmt.Sprintf("tape %q desconocida", t.Z)}
+	}
+	return nil
+}
+
+// badPrice indica un precio negativo, NaN o infinito. Cero es válido en una quote: el
+// lado no tiene precio.
+func badPrice(p float64) bool {
+	return p < 0 || math.IsNaN(p) || math.IsInf(p, 0)
+}
+
+// FilterQuotes separa 'quotes' en las válidas, en su orden, y las rechazadas. Si no se
+// rechaza ninguna devuelve el mismo slice.
+func (v *Validator) FilterQuotes(quotes []QuoteRecord) ([]QuoteRecord, []Quarantined) {
+	return filterRecords(quotes, KindQuotes, v.CheckQuote, func(q QuoteRecord) string { return q.T })
+}
+
+// FilterTrades es `FilterQuotes` para trades.
+func (v *Validator) FilterTrades(trades []TradeRecord) ([]TradeRecord, []Quarantined) {
+	return filterRecords(trades, KindTrades, v.CheckTrade, func(t TradeRecord) string { return t.T })
+}
+
+// filterRecords implementa `FilterQuotes` y `FilterTrades`.
+func filterRecords[R any](records []R, kind Kind, check func(R) *Rejection, ts func(R) string) ([]R, []Quarantined) {
+	var valid []R
+	var rejected []Quarantined
+	for i, r := range records {
+		rejection := check(r)
+		if rejection == nil {
+			if valid != nil {
+				valid = append(valid, r)
+			}
+			continue
+		}
+		if valid == nil {
+			valid = append(make([]R, 0, len(records)-1), records[:i]...)
+		}
+		t, _ := parseTickTime(ts(r))
+		rejected = append(rejected, Quarantined{
+			Kind:   kind,
+			Rule:   rejection.Rule,
+			Reason: rejection.Reason,
+			Record: quarantineRecord(r),
+			Time:   t,
+		})
+	}
+	if rejected == nil {
+		return records, nil
+	}
+	return valid, rejected
+}
+
+// quarantineRecord serializa 'record' para `Quarantined.Record`. JSON no admite NaN
+// ni infinitos: en ese caso se guarda el registro como texto.
+func quarantineRecord(record any) json.RawMessage {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		raw, _ = json.Marshal(fmt.Sprintf("%+v", record))
+	}
+	return raw
+}
+
+// PutQuarantineTx añade 'records' al sub-bucket de 'symbol' de `QuarantineBucket`,
+// con una secuencia de 8 bytes big endian como clave y `Quarantined` en JSON como
+// valor. Es un registro de lo que se rechazó, no un índice: si un lote se vuelve a
+// procesar (ej. al reanudar una descarga) sus registros rechazados aparecen otra vez.
+func PutQuarantineTx(tx *db.Tx, symbol string, records []Quarantined) error {
+	if len(records) == 0 {
+		return nil
+	}
+	root, err := tx.CreateBucketIfNotExists([]byte(QuarantineBucket))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s': %w", QuarantineBucket, err)
+	}
+	bucket, err := root.CreateBucketIfNotExists([]byte(symbol))
+	if err != nil {
+		return fmt.Errorf("failed to create bucket '%s/%s': %w", QuarantineBucket, symbol, err)
+	}
+	now := time.Now().UTC()
+	for _, record := range records {
+		if record.At.IsZero() {
+			record.At = now
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, seq)
+		if err := bucket.Put(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QuarantineTx devuelve los registros en cuarentena de 'symbol', en el orden en que
+// se rechazaron.
+func QuarantineTx(tx *db.Tx, symbol string) ([]Quarantined, error) {
+	root := tx.Bucket([]byte(QuarantineBucket))
+	if root == nil {
+		return nil, nil
+	}
+	bucket := root.Bucket([]byte(symbol))
+	if bucket == nil {
+		return nil, nil
+	}
+	var records []Quarantined
+	err := bucket.ForEach(func(k, v []byte) error {
+		var record Quarantined
+		if err := json.Unmarshal(v, &record); err != nil {
+			return fmt.Errorf("cuarentena de %s, clave %x: %w", symbol, k, err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
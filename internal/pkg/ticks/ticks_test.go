@@ -0,0 +1,415 @@
+package ticks
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	db "go.etcd.io/bbolt"
+)
+
+// chunkBase es el timestamp de la primera quote de los chunks de prueba.
+var chunkBase = time.Date(2016, 1, 4, 14, 30, 0, 0, time.UTC)
+
+// syntheticQuotes genera 'n' quotes parecidas a las de SIP: timestamps crecientes con
+// saltos de microsegundos, precios de dos decimales alrededor de 110 y tamaños chicos.
+func syntheticQuotes(n int) []QuoteRecord {
+	rng := rand.New(rand.NewSource(1))
+	exchanges := "ABCDHKLMNPQTVXYZ"
+	ts := chunkBase
+	bid := 11000
+	quotes := make([]QuoteRecord, n)
+	for i := range quotes {
+		ts = ts.Add(time.Duration(1+rng.Intn(5000)) * time.Microsecond)
+		bid += rng.Intn(3) - 1
+		quotes[i] = QuoteRecord{
+			AP: float64(bid+1+rng.Intn(2)) / 100,
+			AS: 1 + rng.Intn(50),
+			AX: string(exchanges[rng.Intn(len(exchanges))]),
+			BP: float64(bid) / 100,
+			BS: 1 + rng.Intn(50),
+			BX: string(exchanges[rng.Intn(len(exchanges))]),
+			C:  []string{"R"},
+			T:  ts.Format(time.RFC3339Nano),
+			Z:  "C",
+		}
+	}
+	return quotes
+}
+
+// chunkQuotes convierte 'records' en quotes de chunk, con la secuencia 0.
+func chunkQuotes(records []QuoteRecord) []Quote {
+	quotes := make([]Quote, len(records))
+	for i, r := range records {
+		t, _ := time.Parse(time.RFC3339Nano, r.T)
+		quotes[i] = Quote{Time: t, QuoteRecord: r}
+	}
+	return quotes
+}
+
+// quoteAt devuelve una quote de prueba 'offset' después de `chunkBase`.
+func quoteAt(offset time.Duration, seq uint16) Quote {
+	return Quote{Time: chunkBase.Add(offset), Seq: seq, QuoteRecord: QuoteRecord{
+		AP: 110.87, AS: 6, AX: "T", BP: 109.3, BS: 30, BX: "T", C: []string{"R"}, Z: "C"}}
+}
+
+// sameQuoteBits dice si 'a' y 'b' guardan lo mismo. Los precios se comparan por sus bits
+// (un NaN es igual a sí mismo y -0 distinto de 0) y 'T' no cuenta.
+func sameQuoteBits(a, b Quote) bool {
+	return a.Time.Equal(b.Time) && a.Seq == b.Seq &&
+		math.Float64bits(a.AP) == math.Float64bits(b.AP) && a.AS == b.AS && a.AX == b.AX &&
+		math.Float64bits(a.BP) == math.Float64bits(b.BP) && a.BS == b.BS && a.BX == b.BX &&
+		slices.Equal(a.C, b.C) && a.Z == b.Z
+}
+
+// checkSameQuotes falla si 'got' y 'want' no guardan las mismas quotes.
+func checkSameQuotes(t *testing.T, got, want []Quote) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%d quotes, se esperaban %d", len(got), len(want))
+	}
+	for i := range want {
+		if !sameQuoteBits(got[i], want[i]) {
+			t.Fatalf("quote %d:\n got  %+v\n want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+// chunkRoundTripCases son chunks válidos que cubren cada rama del formato.
+func chunkRoundTripCases() []struct {
+	name   string
+	quotes []Quote
+} {
+	// Un delta-of-delta en cada cubeta: igual, 12, 20, 32 y 64 bits, en ambos sentidos.
+	var deltas []Quote
+	offset, delta := time.Duration(0), time.Microsecond
+	for _, dod := range []time.Duration{0, 0, 1000, -1000, 500 * time.Microsecond, -400 * time.Microsecond,
+		2 * time.Second, -time.Second, 1000 * time.Hour, -999 * time.Hour} {
+		delta += dod
+		offset += delta
+		deltas = append(deltas, quoteAt(offset, 0))
+	}
+
+	prices := []Quote{quoteAt(0, 0), quoteAt(1, 0), quoteAt(2, 0), quoteAt(3, 0), quoteAt(4, 0), quoteAt(5, 0)}
+	prices[1].AP, prices[1].BP = 110.88, 109.29
+	prices[2].AP, prices[2].BP = math.Copysign(0, -1), 0
+	prices[3].AP, prices[3].BP = math.Inf(1), math.NaN()
+	prices[4].AP, prices[4].BP = math.SmallestNonzeroFloat64, -math.MaxFloat64
+	prices[4].AS, prices[4].BS = -5, math.MaxInt64
+	prices[5].AS, prices[5].BS = math.MinInt64, 0
+
+	texts := []Quote{quoteAt(0, 0), quoteAt(1, 0), quoteAt(2, 0), quoteAt(3, 0), quoteAt(4, 0)}
+	texts[1].C, texts[1].AX = nil, ""
+	texts[2].C = []string{"R", "I"}
+	texts[3].C, texts[3].BX = []string{"AB", "["}, strings.Repeat("x", math.MaxUint8)
+	texts[4].Z = "é"
+
+	return []struct {
+		name   string
+		quotes []Quote
+	}{
+		{"una quote", []Quote{quoteAt(0, 0)}},
+		{"una quote con secuencia", []Quote{quoteAt(0, math.MaxUint16)}},
+		{"mismo nanosegundo", []Quote{quoteAt(0, 0), quoteAt(0, 1), quoteAt(0, 2), quoteAt(time.Nanosecond, 0)}},
+		{"antes de 1970", []Quote{{Time: time.Unix(0, -1).UTC()}, {Time: time.Unix(0, 0).UTC()}}},
+		{"delta-of-delta", deltas},
+		{"precios y tamaños", prices},
+		{"textos", texts},
+		{"chunk lleno", chunkQuotes(syntheticQuotes(QuoteChunkSize))},
+	}
+}
+
+func TestQuoteChunkRoundTrip(t *testing.T) {
+	for _, tc := range chunkRoundTripCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			chunk, err := EncodeQuoteChunk(tc.quotes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := DecodeQuoteChunk(chunk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkSameQuotes(t, got, tc.quotes)
+			for i, q := range got {
+				if q.T != q.Time.Format(time.RFC3339Nano) || q.Time.Location() != time.UTC {
+					t.Fatalf("quote %d: T %q, Time %v; se esperaba RFC3339Nano UTC", i, q.T, q.Time)
+				}
+			}
+			if n, err := quoteChunkCount(chunk); err != nil || n != len(tc.quotes) {
+				t.Fatalf("quoteChunkCount = %d, %v; se esperaba %d", n, err, len(tc.quotes))
+			}
+		})
+	}
+}
+
+func TestEncodeQuoteChunkErrors(t *testing.T) {
+	long := quoteAt(time.Nanosecond, 0)
+	long.AX = strings.Repeat("x", math.MaxUint8+1)
+	longC := quoteAt(time.Nanosecond, 0)
+	longC.C = []string{strings.Repeat("x", math.MaxUint8)} // En JSON ocupa 259 bytes
+	for _, tc := range []struct {
+		name   string
+		quotes []Quote
+	}{
+		{"vacío", nil},
+		{"tiempo hacia atrás", []Quote{quoteAt(time.Second, 0), quoteAt(0, 0)}},
+		{"secuencia repetida", []Quote{quoteAt(0, 1), quoteAt(0, 1)}},
+		{"secuencia hacia atrás", []Quote{quoteAt(0, 2), quoteAt(0, 1)}},
+		{"texto largo", []Quote{quoteAt(0, 0), long}},
+		{"condiciones largas", []Quote{quoteAt(0, 0), longC}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := EncodeQuoteChunk(tc.quotes); !errors.Is(err, ErrQuoteChunkEncode) {
+				t.Fatalf("se esperaba ErrQuoteChunkEncode, error %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeQuoteChunkErrors(t *testing.T) {
+	chunk, err := EncodeQuoteChunk(chunkQuotes(syntheticQuotes(50)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cada prefijo del chunk se queda sin bits antes de la última quote: el flujo de
+	// bits termina en el último byte, así que ningún recorte puede decodificarse.
+	t.Run("truncado", func(t *testing.T) {
+		for n := range len(chunk) {
+			if _, err := DecodeQuoteChunk(chunk[:n]); !errors.Is(err, ErrQuoteChunkDecode) {
+				t.Fatalf("prefijo de %d bytes de %d: se esperaba ErrQuoteChunkDecode, error %v", n, len(chunk), err)
+			}
+		}
+	})
+
+	for _, tc := range []struct {
+		name  string
+		chunk []byte
+	}{
+		{"vacío", nil},
+		{"versión desconocida", append([]byte{quoteChunkVersion1 + 1}, chunk[1:]...)},
+		{"sin número de quotes", []byte{quoteChunkVersion1, 0x80}},
+		{"cero quotes", []byte{quoteChunkVersion1, 0}},
+		{"más quotes que bits", append([]byte{quoteChunkVersion1, 0xff, 0xff, 0x03}, chunk[2:]...)},
+		{"primer valor ausente", []byte{quoteChunkVersion1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := DecodeQuoteChunk(tc.chunk); !errors.Is(err, ErrQuoteChunkDecode) {
+				t.Fatalf("se esperaba ErrQuoteChunkDecode, error %v", err)
+			}
+		})
+	}
+}
+
+// FuzzDecodeQuoteChunk decodifica bytes arbitrarios: no debe entrar en pánico, y lo que
+// se decodifica, si se puede volver a codificar (puede venir fuera de orden), debe
+// decodificarse igual.
+func FuzzDecodeQuoteChunk(f *testing.F) {
+	for _, tc := range chunkRoundTripCases() {
+		chunk, err := EncodeQuoteChunk(tc.quotes)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(chunk)
+	}
+	f.Add([]byte{quoteChunkVersion1, 2, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, chunk []byte) {
+		quotes, err := DecodeQuoteChunk(chunk)
+		if err != nil {
+			if !errors.Is(err, ErrQuoteChunkDecode) {
+				t.Fatalf("error sin ErrQuoteChunkDecode: %v", err)
+			}
+			return
+		}
+		again, err := EncodeQuoteChunk(quotes)
+		if err != nil {
+			if !errors.Is(err, ErrQuoteChunkEncode) {
+				t.Fatalf("error sin ErrQuoteChunkEncode: %v", err)
+			}
+			return
+		}
+		decoded, err := DecodeQuoteChunk(again)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkSameQuotes(t, decoded, quotes)
+	})
+}
+
+/*
+//
+//
+//
+
+BLOQUE DE BENCHMARKS DE LOS LAYOUTS DE QUOTES
+// ===============================
+
+//
+//
+//
+*/
+
+// benchQuotes es el número de quotes que escriben y leen los benchmarks de layouts.
+const benchQuotes = 100000
+
+// BenchmarkQuoteCodecs compara lo que cuesta codificar y decodificar una quote en cada
+// layout, sin base de datos. En chunks se mide un chunk lleno y se informa por quote
+// (métrica "ns/quote"), además del tamaño codificado ("bytes/quote").
+func BenchmarkQuoteCodecs(b *testing.B) {
+	records := syntheticQuotes(QuoteChunkSize)
+	sample := records[len(records)/2]
+	key := Key(chunkQuotes(records[len(records)/2:])[0].Time.UnixNano(), 0)
+	columns := EncodeQuoteColumns(sample)
+	row, err := EncodeQuoteRow(sample)
+	if err != nil {
+		b.Fatal(err)
+	}
+	quotes := chunkQuotes(records)
+	chunk, err := EncodeQuoteChunk(quotes)
+	if err != nil {
+		b.Fatal(err)
+	}
+	columnsSize := 0
+	for _, v := range columns {
+		columnsSize += len(v)
+	}
+
+	b.Run("encode/"+LayoutColumns, func(b *testing.B) {
+		for b.Loop() {
+			EncodeQuoteColumns(sample)
+		}
+		b.ReportMetric(float64(columnsSize), "bytes/quote")
+	})
+	b.Run("encode/"+LayoutRows, func(b *testing.B) {
+		for b.Loop() {
+			EncodeQuoteRow(sample)
+		}
+		b.ReportMetric(float64(len(row)), "bytes/quote")
+	})
+	b.Run("encode/"+LayoutChunks, func(b *testing.B) {
+		for b.Loop() {
+			EncodeQuoteChunk(quotes)
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(quotes)), "ns/quote")
+		b.ReportMetric(float64(len(chunk))/float64(len(quotes)), "bytes/quote")
+	})
+	b.Run("decode/"+LayoutColumns, func(b *testing.B) {
+		for b.Loop() {
+			var q QuoteRecord
+			for i, field := range QuoteFields {
+				if err := DecodeQuoteField(&q, field, columns[i]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("decode/"+LayoutRows, func(b *testing.B) {
+		for b.Loop() {
+			if _, err := DecodeQuoteRow(key, row); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("decode/"+LayoutChunks, func(b *testing.B) {
+		for b.Loop() {
+			if _, err := DecodeQuoteChunk(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(quotes)), "ns/quote")
+	})
+}
+
+// BenchmarkQuoteLayouts escribe `benchQuotes` quotes con `PutQuotesTx` en lotes de
+// 10000, las lee todas en orden y lee quotes sueltas por su timestamp, con cada layout
+// en su propio archivo. "write" informa también del tamaño del archivo por quote.
+func BenchmarkQuoteLayouts(b *testing.B) {
+	records := syntheticQuotes(benchQuotes)
+	times := chunkQuotes(records)
+	const batch = 10000
+
+	// write guarda 'records' en un archivo nuevo de 'dir'.
+	write := func(b *testing.B, dir, layout string) *db.DB {
+		b.Helper()
+		dbInstance, err := db.Open(filepath.Join(dir, layout+".db"), 0600, &db.Options{Timeout: time.Second, NoSync: true})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { dbInstance.Close() })
+		for from := 0; from < len(records); from += batch {
+			err := dbInstance.Update(func(tx *db.Tx) error {
+				_, err := PutQuotesTx(tx, "BENCH", records[from:min(from+batch, len(records))], layout)
+				return err
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := dbInstance.Sync(); err != nil {
+			b.Fatal(err)
+		}
+		return dbInstance
+	}
+
+	for _, layout := range QuoteLayouts {
+		b.Run("write/"+layout, func(b *testing.B) {
+			var size int64
+			for b.Loop() {
+				dbInstance := write(b, b.TempDir(), layout)
+				if err := dbInstance.View(func(tx *db.Tx) error {
+					size = tx.Size()
+					return nil
+				}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(records)), "ns/quote")
+			b.ReportMetric(float64(size)/float64(len(records)), "bytes/quote")
+		})
+
+		dbInstance := write(b, b.TempDir(), layout)
+		b.Run("scan/"+layout, func(b *testing.B) {
+			for b.Loop() {
+				quotes, err := ReadQuotes(dbInstance, QueryOptions{SYMBOL: "BENCH"})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(quotes) != len(records) {
+					b.Fatalf("se leyeron %d quotes de %d", len(quotes), len(records))
+				}
+			}
+			b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(records)), "ns/quote")
+		})
+		b.Run("get/"+layout, func(b *testing.B) {
+			err := dbInstance.View(func(tx *db.Tx) error {
+				i := 0
+				for b.Loop() {
+					want := times[(i*7919)%len(times)].Time
+					i++
+					found := false
+					for q, err := range QuotesTx(tx, QueryOptions{SYMBOL: "BENCH", FROM: want}) {
+						if err != nil {
+							return err
+						}
+						found = q.Time.Equal(want)
+						break
+					}
+					if !found {
+						return fmt.Errorf("quote %s no encontrada", want.Format(time.RFC3339Nano))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}